@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+)
+
+// how long a broker gets to answer GET /status before it counts as unreachable
+const statusTimeout = 2 * time.Second
+
+// state of one broker as reported by its GET /status
+type NodeSummary struct {
+	ID          int    `json:"id"` // -1 when unreachable
+	State       string `json:"state"`
+	Term        int    `json:"term"`
+	CommitIndex int    `json:"commit_index"`
+	LogLength   int    `json:"log_length"`
+
+	// the address the summary was fetched from
+	ReachableAt string `json:"reachable_at"`
+}
+
+// fetch GET /status from every broker http address in addrs at once. brokers
+// that don't answer within statusTimeout have State "unreachable". sorted by
+// id, the unreachable ones first. the error is only set when ctx ended
+func ClusterSummary(ctx context.Context, addrs []string) ([]NodeSummary, error) {
+	summaries := make([]NodeSummary, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			summaries[i] = nodeSummary(ctx, addr)
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(summaries, func(a, b NodeSummary) int {
+		return cmp.Or(cmp.Compare(a.ID, b.ID), cmp.Compare(a.ReachableAt, b.ReachableAt))
+	})
+	return summaries, nil
+}
+
+func nodeSummary(ctx context.Context, addr string) NodeSummary {
+	status, err := fetchStatus(ctx, addr)
+	if err != nil {
+		return NodeSummary{ID: -1, State: "unreachable", ReachableAt: addr}
+	}
+	return NodeSummary{
+		ID:          status.BrokerId,
+		State:       status.State,
+		Term:        status.Term,
+		CommitIndex: status.CommitIndex,
+		LogLength:   status.LogLength,
+		ReachableAt: addr,
+	}
+}
+
+// addr is a host:port like the ones brokers are configured with, or a url
+func fetchStatus(ctx context.Context, addr string) (broker.BrokerStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+
+	base := addr
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/status", nil)
+	if err != nil {
+		return broker.BrokerStatus{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return broker.BrokerStatus{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return broker.BrokerStatus{}, fmt.Errorf("GET /status on %s: %s", addr, resp.Status)
+	}
+	var status broker.BrokerStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+)
+
+func TestClusterSummary(t *testing.T) {
+	h := broker.NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, term := h.CheckSingleLeader()
+	leader := h.Cluster()[leaderId]
+
+	_, _, err := leader.SubmitOperation(broker.CRDTMessage{
+		Type: broker.OpInsert, Index: 0, Value: "a", ReplicaID: "r1", OpIndex: 1, Source: "client",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, b := range h.Cluster() {
+		for b.Status().CommitIndex < 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("the operation wasn't committed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// each broker's status behind its own server, listed out of order
+	var addrs []string
+	for i := len(h.Cluster()) - 1; i >= 0; i-- {
+		b := h.Cluster()[i]
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(b.Status())
+		}))
+		defer server.Close()
+		addrs = append(addrs, strings.TrimPrefix(server.URL, "http://"))
+	}
+	// one broker hangs and one is gone
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	addrs = append(addrs, hung.URL, gone.URL)
+
+	start := time.Now()
+	summaries, err := ClusterSummary(context.Background(), addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > statusTimeout+time.Second {
+		t.Errorf("summary took %v, want about %v", elapsed, statusTimeout)
+	}
+	if len(summaries) != len(addrs) {
+		t.Fatalf("got %d summaries, want %d", len(summaries), len(addrs))
+	}
+
+	for i, summary := range summaries[:2] {
+		if summary.State != "unreachable" || summary.ID != -1 {
+			t.Errorf("summary %d is %+v, want an unreachable broker", i, summary)
+		}
+	}
+	for i, summary := range summaries[2:] {
+		wantState := "Follower"
+		if i == leaderId {
+			wantState = "Leader"
+		}
+		if summary.ID != i || summary.State != wantState || summary.Term != term || summary.CommitIndex != 0 || summary.LogLength != 1 {
+			t.Errorf("summary of broker %d is %+v, want %s in term %d with one committed entry", i, summary, wantState, term)
+		}
+		if summary.ReachableAt != addrs[len(h.Cluster())-1-i] {
+			t.Errorf("broker %d reachable at %q, want %q", i, summary.ReachableAt, addrs[len(h.Cluster())-1-i])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ClusterSummary(ctx, addrs); err == nil {
+		t.Error("summary with a cancelled context returned no error")
+	}
+}
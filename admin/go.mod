@@ -0,0 +1,31 @@
+module admin
+
+go 1.23.2
+
+require github.com/townsag/clarity/broker v0.0.0-00010101000000-000000000000
+
+require (
+	github.com/felixge/httpsnoop v1.0.4 // indirect
+	github.com/go-logr/logr v1.4.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/townsag/clarity/broker/raftpb v0.0.0-00010101000000-000000000000 // indirect
+	github.com/townsag/clarity/crdt v0.1.0 // indirect
+	go.etcd.io/bbolt v1.4.3 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.62.0 // indirect
+	go.opentelemetry.io/otel v1.37.0 // indirect
+	go.opentelemetry.io/otel/metric v1.37.0 // indirect
+	go.opentelemetry.io/otel/trace v1.37.0 // indirect
+	golang.org/x/net v0.41.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.26.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250707201910-8d1bb00bc6a7 // indirect
+	google.golang.org/grpc v1.75.1 // indirect
+	google.golang.org/protobuf v1.36.6 // indirect
+)
+
+replace github.com/townsag/clarity/crdt => ../crdt
+
+replace github.com/townsag/clarity/broker => ../broker
+
+replace github.com/townsag/clarity/broker/raftpb => ../broker/raftpb
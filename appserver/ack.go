@@ -0,0 +1,125 @@
+package appserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrEntryNotCommitted = errors.New("operation was not committed")
+
+// how often and how long the broker is polled after it accepted an operation
+const (
+	commitPollInterval = 20 * time.Millisecond
+	commitWaitTimeout  = 5 * time.Second
+)
+
+// sent to the client that made an edit once the brokers have committed it
+// clients match it to their edit with OpID, so they should set op_id on the messages they send
+type AckMessage struct {
+	Type     string `json:"type"` // always "ack"
+	OpID     string `json:"op_id"`
+	Document string `json:"document"`
+	Index    int    `json:"index"` // position of the operation in the brokers' log
+}
+
+// sent to the client that made an edit when it couldn't be delivered to the brokers
+type NackMessage struct {
+	Type  string `json:"type"` // always "nack"
+	OpID  string `json:"op_id"`
+	Error string `json:"error"`
+}
+
+// poll the broker that accepted an operation until its commit index reaches the
+// operation. gives up if the term changes, because a new leader may have dropped it
+// receipts of operations that committed before the broker replied need no polling
+func (s *AppServer) waitForCommit(brokerAddr string, receipt broker.CRDTReceipt) error {
+	if receipt.Committed {
+		return nil
+	}
+	deadline := time.Now().Add(commitWaitTimeout)
+	for time.Now().Before(deadline) {
+		status, err := s.brokerStatus(brokerAddr)
+		if err != nil {
+			return err
+		}
+		if status.Term != receipt.Term {
+			return fmt.Errorf("%w: broker %d moved from term %d to %d", ErrEntryNotCommitted, receipt.BrokerID, receipt.Term, status.Term)
+		}
+		if commitIndex(status, receipt.Shard) >= receipt.Index {
+			return nil
+		}
+		time.Sleep(commitPollInterval)
+	}
+	return fmt.Errorf("%w within %s", ErrEntryNotCommitted, commitWaitTimeout)
+}
+
+// commit index of replication group shard in status. brokers that don't list
+// their groups have only the first
+func commitIndex(status broker.BrokerStatus, shard int) int {
+	for _, group := range status.Shards {
+		if group.Shard == shard {
+			return group.CommitIndex
+		}
+	}
+	if shard == 0 {
+		return status.CommitIndex
+	}
+	return -1
+}
+
+func (s *AppServer) brokerStatus(brokerAddr string) (broker.BrokerStatus, error) {
+	var status broker.BrokerStatus
+	req, err := s.newBrokerRequest(http.MethodGet, brokerAddr, "/status", nil)
+	if err != nil {
+		return status, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("broker %s returned status %d for /status", brokerAddr, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// tell conn its operation was committed, unless it disconnected in the meantime
+func (s *AppServer) sendAck(conn *websocket.Conn, receipt broker.CRDTReceipt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[conn]
+	if !ok {
+		return
+	}
+	ack := AckMessage{Type: "ack", OpID: receipt.OpID, Document: receipt.Document, Index: receipt.Index}
+	msg, err := s.prepare(ack)
+	if err != nil {
+		s.logger.Error("error encoding ack", "op_id", receipt.OpID, "err", err)
+		return
+	}
+	s.queue(c, msg)
+}
+
+func (s *AppServer) sendNack(conn *websocket.Conn, opID string, sendErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[conn]
+	if !ok {
+		return
+	}
+	msg, err := s.prepare(NackMessage{Type: "nack", OpID: opID, Error: sendErr.Error()})
+	if err != nil {
+		s.logger.Error("error encoding nack", "op_id", opID, "err", err)
+		return
+	}
+	s.queue(c, msg)
+}
@@ -0,0 +1,122 @@
+package appserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+
+	"github.com/gorilla/websocket"
+)
+
+// read messages from conn until an ack arrives or the deadline passes
+func readAck(t *testing.T, conn *websocket.Conn, deadline time.Time) (AckMessage, bool) {
+	t.Helper()
+	conn.SetReadDeadline(deadline)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return AckMessage{}, false
+		}
+		var ack AckMessage
+		if json.Unmarshal(data, &ack) == nil && ack.Type == "ack" {
+			return ack, true
+		}
+	}
+}
+
+func TestSenderGetsAckAfterCommit(t *testing.T) {
+	h := broker.NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	brokerAddrs := make([]string, len(h.Cluster()))
+	for i, b := range h.Cluster() {
+		brokerAddrs[i] = b.GetHTTPAddr()
+	}
+	appServer := NewAppServer("testReplica", brokerAddrs)
+	if err := appServer.requestCRDTLogs(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	sender, other := dial(), dial()
+	defer sender.Close()
+	defer other.Close()
+
+	msg := MessageV2{Message: Message{
+		Type: broker.OpInsert, Index: 0, Value: "a", ReplicaID: "client1", OpIndex: 3, Source: "client", OpID: "edit-1",
+	}}
+	if err := sender.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	ack, ok := readAck(t, sender, time.Now().Add(5*time.Second))
+	if !ok {
+		t.Fatal("sender got no ack")
+	}
+	if ack.OpID != "edit-1" || ack.Document != "3" {
+		t.Errorf("got ack %+v, want op edit-1 on document 3", ack)
+	}
+
+	// the ack only comes once the entry is committed on the leader
+	_, commits, _, _ := h.GetLogsAndCommitIndexFromServer(leaderId)
+	if ack.Index >= len(commits) {
+		t.Errorf("ack for index %d but the leader only committed %d entries", ack.Index, len(commits))
+	}
+
+	if ack, ok := readAck(t, other, time.Now().Add(300*time.Millisecond)); ok {
+		t.Errorf("other client got ack %+v meant for the sender", ack)
+	}
+}
+
+func TestOutOfRangeEditIsNacked(t *testing.T) {
+	// no brokers, the edit must be turned down before it is sent
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", http.Header{"Sec-WebSocket-Protocol": {ProtocolV2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := MessageV2{Message: Message{
+		Type: broker.OpInsert, Index: 5, Value: "a", ReplicaID: "client1", OpIndex: 3, Source: "client", OpID: "edit-1",
+	}}
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no nack for the out of range edit: %v", err)
+		}
+		var nack NackMessage
+		if json.Unmarshal(data, &nack) == nil && nack.Type == "nack" {
+			if nack.OpID != "edit-1" {
+				t.Errorf("got nack for %q, want edit-1", nack.OpID)
+			}
+			break
+		}
+	}
+	if got := appServer.GetRepresentation("3"); len(got) != 0 {
+		t.Errorf("document is %v after a rejected edit, want it empty", got)
+	}
+}
@@ -2,14 +2,23 @@ package appserver
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/townsag/clarity/auth"
+	"github.com/townsag/clarity/broker"
 	"github.com/townsag/clarity/crdt"
 
 	"github.com/gorilla/websocket"
@@ -18,21 +27,155 @@ import (
 type AppServer struct {
 	mu       sync.Mutex
 	upgrader websocket.Upgrader
-	clients  map[*websocket.Conn]bool
+	clients  map[*websocket.Conn]*client
 	brokers  []string
-	textCRDT *crdt.TextCRDT
+
+	// who is behind each client that sent a join message, see presence.go
+	presences map[*websocket.Conn]ClientPresence
+
+	// the values of clients, replaced while holding mu whenever clients
+	// changes, so BroadcastRaw can be called with or without mu held
+	clientSnapshot atomic.Pointer[[]*client]
+
+	// one crdt per document, keyed by the document name the brokers use.
+	// their tombstones are never compacted: the brokers' matchIndex says which
+	// entries every broker has, not which edits other application servers saw,
+	// so nothing here knows when a tombstone can go
+	replicaID string
+	documents map[string]crdt.CRDT
+
+	// documents loaded from Options.Persistence with at least one operation,
+	// they aren't rebuilt from the brokers' committed log again
+	restored map[string]bool
+
+	// documents taken out with CloseDocument, their operations are dropped
+	closed map[string]bool
+
+	// http address of the leader, from GET /leader or the broker that last
+	// accepted a message. empty once it failed a request, see postToBrokers
+	leaderAddr string
+
+	// op ids of operations sent to the brokers whose push hasn't arrived yet,
+	// nil until RegisterForCommits. see push.go
+	ownOpIDs map[string]struct{}
+
+	// log index of the last operation pushed by a broker, by replication
+	// group. -1 for groups nothing was pushed from
+	lastPushedIndex map[int]int
+
+	// false until the documents were rebuilt from the brokers' committed log,
+	// websocket clients are turned away until then. see requestCRDTLogs
+	synced bool
+
+	options    Options
+	httpClient *http.Client
+	logger     broker.Logger
+
+	// operations waiting for the next batch, see Options.BatchSize
+	batchMu    sync.Mutex
+	batch      []pendingMessage
+	batchTimer *time.Timer
+}
+
+// how the application server talks to the brokers
+type Options struct {
+	// sent as a bearer token with every request, must match the brokers' AuthToken
+	BrokerAuthToken string
+
+	// reach the brokers over https with this config. nil means plain http
+	BrokerTLS *tls.Config
+
+	// above 1, client operations are sent to POST /crdt/batch in groups of up
+	// to BatchSize, or whatever is queued after BatchInterval (defaultBatchInterval when 0)
+	BatchSize     int
+	BatchInterval time.Duration
+
+	// makes the crdt for each document. nil means text documents, crdt.NewTextCRDT
+	NewDocument func(replicaID string) crdt.CRDT
+
+	// where the application server logs to. nil means slog.Default() with
+	// the replica id added to every record
+	Logger broker.Logger
+
+	// messages that can wait for each websocket client before it is dropped
+	// for being too slow. 0 means defaultClientSendBuffer
+	ClientSendBuffer int
+
+	// saves every operation applied to a document and loads them back when the
+	// document is first used. nil keeps documents in memory only, see persistence.go
+	Persistence PersistenceBackend
+
+	// how long the http server waits for a whole request, for a response to
+	// be written, and for the next request on an idle keep-alive connection.
+	// 0 means the defaults below, negative means no timeout. websocket
+	// connections aren't cut off by them
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout  time.Duration
+
+	// most http connections open at once, websockets included, more wait to be
+	// accepted. 0 means no limit
+	MaxHTTPConns int
+
+	// websocket clients have to send a jwt signed with this secret, whose sub is
+	// the user id in their presence, see auth.JWTAuthMiddleware. empty lets
+	// every client connect
+	JWTSecret []byte
+
+	// how messages to and from websocket clients are encoded, see codec.go. nil
+	// means json in text messages, any codec set is used in binary messages
+	Codec BinaryCodec
 }
 
+const (
+	defaultHTTPReadTimeout  = 10 * time.Second
+	defaultHTTPWriteTimeout = 30 * time.Second
+	defaultHTTPIdleTimeout  = 2 * time.Minute
+)
+
 type Message struct { // Type, Index, Value combine to create crdt operation
-	Type      string      `json:"type"`  // the crdt operation type {insert, delete}
-	Index     int64       `json:"index"` // index of the operation
-	Value     interface{} `json:"value"` // chars being inserted / deleted
-	ReplicaID string      `json:"replica_id"`
-	OpIndex   int64       `json:"operation_index"` // identifies the document the crdt operations edit
-	Source    string      `json:"source"`          // "client" or "broker"
+	Type      broker.OpType `json:"type"`  // the crdt operation type {insert, delete}
+	Index     int64         `json:"index"` // index of the operation
+	Value     interface{}   `json:"value"` // chars being inserted / deleted
+	ReplicaID string        `json:"replica_id"`
+	OpIndex   int64         `json:"operation_index"` // identifies the document the crdt operations edit
+	Source    string        `json:"source"`          // "client" or "broker"
+
+	// shape of the message, stamped with broker.CurrentSchemaVersion when sent to the brokers
+	SchemaVersion int `json:"schema_version,omitempty"`
+
+	// identifies the user action so brokers ignore retries of it, see newOpID
+	OpID string `json:"op_id,omitempty"`
+
+	// json of the crdt.Operation this server made for the edit, replayed with
+	// Apply by servers syncing from the log. set by the server, not by clients
+	Operation json.RawMessage `json:"crdt_operation,omitempty"`
+}
+
+// random version 4 uuid read from random, rand.Reader outside of tests
+func newOpID(random io.Reader) (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(random, b[:]); err != nil {
+		return "", fmt.Errorf("making an op id: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
 }
 
 func NewAppServer(replicaID string, brokerList []string) *AppServer {
+	return NewAppServerWithOptions(replicaID, brokerList, Options{})
+}
+
+func NewAppServerWithOptions(replicaID string, brokerList []string, opts Options) *AppServer {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = opts.BrokerTLS
+
+	var logger broker.Logger = slog.Default().With("replica", replicaID)
+	if opts.Logger != nil {
+		logger = opts.Logger
+	}
+
 	return &AppServer{
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
@@ -40,192 +183,697 @@ func NewAppServer(replicaID string, brokerList []string) *AppServer {
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
+			Subprotocols: supportedProtocols,
 		},
-		clients:  make(map[*websocket.Conn]bool),
-		brokers:  brokerList,
-		textCRDT: crdt.NewTextCRDT(replicaID),
+		clients:         make(map[*websocket.Conn]*client),
+		presences:       make(map[*websocket.Conn]ClientPresence),
+		lastPushedIndex: make(map[int]int),
+		brokers:         brokerList,
+		replicaID:       replicaID,
+		documents:       make(map[string]crdt.CRDT),
+		restored:        make(map[string]bool),
+		closed:          make(map[string]bool),
+		synced:          len(brokerList) == 0, // nothing to catch up with
+		options:         opts,
+		httpClient:      &http.Client{Transport: transport},
+		logger:          logger,
+	}
+}
+
+// request to path on a broker, with the bearer token when one is configured
+func (s *AppServer) newBrokerRequest(method, brokerAddr, path string, body io.Reader) (*http.Request, error) {
+	scheme := "http"
+	if s.options.BrokerTLS != nil {
+		scheme = "https"
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", scheme, brokerAddr, path), body)
+	if err != nil {
+		return nil, err
+	}
+	if s.options.BrokerAuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.options.BrokerAuthToken)
+	}
+	return req, nil
+}
+
+// name of the document a message edits, the same one the brokers use
+func documentID(msg Message) string {
+	return fmt.Sprintf("%d", msg.OpIndex)
+}
+
+// caller must hold s.mu
+func (s *AppServer) document(docID string) crdt.CRDT {
+	doc, ok := s.documents[docID]
+	if !ok {
+		doc = s.newDocument()
+		s.documents[docID] = doc
+		s.loadDocumentLocked(docID, doc)
+	}
+	return doc
+}
+
+// replay the operations saved for docID onto doc, false when there were none
+// caller must hold s.mu
+func (s *AppServer) loadDocumentLocked(docID string, doc crdt.CRDT) bool {
+	if s.options.Persistence == nil {
+		return false
+	}
+	ops, err := s.options.Persistence.LoadOperations(docID)
+	if err != nil {
+		s.logger.Error("error loading saved operations", "document", docID, "err", err)
+		return false
+	}
+	for _, op := range ops {
+		doc.Apply(op)
+	}
+	if len(ops) == 0 {
+		return false
+	}
+	s.restored[docID] = true
+	s.logger.Info("loaded saved operations", "document", docID, "operations", len(ops))
+	return true
+}
+
+// like document but doesn't create documents nobody edited yet. after a
+// restart, documents with saved operations exist before they are edited again
+// caller must hold s.mu
+func (s *AppServer) existingDocumentLocked(docID string) (crdt.CRDT, bool) {
+	if s.closed[docID] {
+		return nil, false
+	}
+	if doc, ok := s.documents[docID]; ok {
+		return doc, true
+	}
+	doc := s.newDocument()
+	if !s.loadDocumentLocked(docID, doc) {
+		return nil, false
+	}
+	s.documents[docID] = doc
+	return doc, true
+}
+
+// caller must hold s.mu
+func (s *AppServer) saveOperationLocked(docID string, op crdt.Operation) {
+	if s.options.Persistence == nil {
+		return
+	}
+	if err := s.options.Persistence.SaveOperation(docID, op); err != nil {
+		s.logger.Error("error saving operation", "document", docID, "err", err)
 	}
 }
 
+// an empty document of the type chosen with Options.NewDocument
+func (s *AppServer) newDocument() crdt.CRDT {
+	if s.options.NewDocument != nil {
+		return s.options.NewDocument(s.replicaID)
+	}
+	return crdt.NewTextCRDT(s.replicaID)
+}
+
 func (s *AppServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// the upgrader accepts clients that don't offer any of our sub-protocols,
+	// so reject them before upgrading instead of guessing their message format
+	offered := false
+	wire, _ := s.wireCodec()
+	for _, protocol := range websocket.Subprotocols(r) {
+		if _, ok := codecFor(protocol, wire); ok {
+			offered = true
+		}
+	}
+	if !offered {
+		s.logger.Info("WebSocket upgrade rejected: unsupported sub-protocols", "protocols", websocket.Subprotocols(r))
+		http.Error(w, fmt.Sprintf("Sec-WebSocket-Protocol must include one of %v", supportedProtocols), http.StatusBadRequest)
+		return
+	}
+
+	// a client connecting now would get a snapshot missing the committed operations
+	if !s.Synced() {
+		http.Error(w, "Application server is still syncing with the brokers", http.StatusServiceUnavailable)
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		s.logger.Warn("WebSocket upgrade failed", "err", err)
 		return
 	}
+	codec, _ := codecFor(conn.Subprotocol(), wire)
 
 	defer func(conn *websocket.Conn) {
 		err := conn.Close()
 		if err != nil {
-			log.Printf("Error closing connection: %v", err)
+			s.logger.Debug("error closing connection", "err", err)
 		}
 	}(conn)
 
+	// clients that connect mid session start from the current state of every document
+	// queued ahead of the operations while holding mu so no operation is missed
+	// or sent twice. the client's writeLoop sends them, not this goroutine
 	s.mu.Lock()
-	s.clients[conn] = true
+	var snapshots []*websocket.PreparedMessage
+	for docID, doc := range s.documents {
+		// only text documents have a snapshot format, clients of other
+		// document types start from the operations that follow
+		text, ok := doc.(*crdt.TextCRDT)
+		if !ok {
+			continue
+		}
+		snapshot, err := s.prepare(NewSnapshotMessage(docID, text))
+		if err != nil {
+			s.mu.Unlock()
+			s.logger.Warn("error encoding snapshot", "document", docID, "err", err)
+			return
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	s.addClientLocked(conn, codec, snapshots)
 	s.mu.Unlock()
 
+	// empty unless the client authenticated
+	userID, _ := auth.UserID(r.Context())
+
 	for {
+		_, data, err := conn.ReadMessage()
+		if err == nil && isJoinMessage(wire, data) {
+			s.handleJoin(conn, data, userID)
+			continue
+		}
+		// the clock sent by clarity-v2 clients isn't used for ordering yet
 		var msg Message
-		err := conn.ReadJSON(&msg)
+		if err == nil {
+			msg, _, err = codec.DecodeMessage(data)
+		}
+		if errors.Is(err, broker.ErrUnknownOpType) {
+			// a bad message shouldn't drop the connection
+			s.logger.Info("rejecting message", "err", err)
+			continue
+		}
 		if err != nil {
-			log.Printf("Error reading message: %v", err)
+			s.logger.Debug("error reading message, dropping client", "err", err)
 			s.mu.Lock()
-			delete(s.clients, conn)
+			s.removeClientLocked(conn)
 			s.mu.Unlock()
 			break
 		}
 
+		s.mu.Lock()
+		closed := s.closed[documentID(msg)]
+		s.mu.Unlock()
+		if closed {
+			s.logger.Info("rejecting operation on closed document", "document", documentID(msg), "op_id", msg.OpID)
+			s.sendNack(conn, msg.OpID, ErrDocumentClosed)
+			continue
+		}
+
 		switch msg.Source {
 		case "client":
-			// Forward the message directly to broker
-			s.sendHTTPMessage(msg)
-			// Update local CRDT and broadcast to other clients
-			s.handleOperation(msg)
+			// Update local CRDT and broadcast to other clients. an edit that
+			// doesn't fit the document is never sent to the brokers
+			operation, err := s.handleOperation(msg)
+			if err != nil {
+				s.logger.Info("rejecting operation", "document", documentID(msg), "op_id", msg.OpID, "err", err)
+				s.sendNack(conn, msg.OpID, err)
+				continue
+			}
+			msg.Operation = s.encodeOperation(operation)
+			// Forward the message directly to broker, and ack it to the client once committed
+			// not limited by the websocket's request, an edit still reaches the brokers
+			// after its client disconnected
+			ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+			errc := s.sendHTTPMessage(ctx, msg, func(receipt broker.CRDTReceipt) {
+				s.sendAck(conn, receipt)
+			})
+			go func(opID string) {
+				defer cancel()
+				if err := <-errc; err != nil {
+					s.sendNack(conn, opID, err)
+				}
+			}(msg.OpID)
 
 		case "broker":
 			// Update local CRDT state and broadcast to clients
-			s.handleOperation(msg)
+			if _, err := s.handleOperation(msg); err != nil {
+				s.logger.Warn("error applying operation", "document", documentID(msg), "op_id", msg.OpID, "err", err)
+			}
 		}
 	}
 }
 
-func (s *AppServer) handleOperation(msg Message) {
+// apply msg to its document and broadcast it, returning the operation it
+// made. an edit the document can't take, like an index past its end, is
+// returned as an error
+func (s *AppServer) handleOperation(msg Message) (crdt.Operation, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	var operation crdt.Operation
+	var err error
+	docID := documentID(msg)
+	if s.closed[docID] {
+		s.logger.Debug("dropping operation on closed document", "document", docID)
+		return crdt.NoOp, nil
+	}
+	doc := s.document(docID)
 
 	switch msg.Type {
-	case "insert":
-		operation = s.textCRDT.LocalInsert(msg.Index, msg.Value)
-	case "delete":
-		operation = s.textCRDT.LocalDelete(msg.Index)
+	case broker.OpInsert:
+		operation, err = doc.LocalInsert(msg.Index, msg.Value)
+	case broker.OpDelete:
+		operation, err = doc.LocalDelete(msg.Index)
+		// two clients deleted the same character, the first delete already
+		// did what this one would have, so there is nothing to broadcast
+		if errors.Is(err, crdt.ErrOutOfRange) && msg.Source == "broker" {
+			s.logger.Info("skipping delete of a deleted character", "document", docID, "index", msg.Index, "source", msg.Source)
+			return crdt.NoOp, nil
+		}
 	default:
-		log.Printf("Unknown operation type: %s", msg.Type)
-		return
+		s.logger.Warn("unknown operation type", "type", msg.Type)
+		return crdt.NoOp, nil
+	}
+
+	// the document didn't change. nothing to save or broadcast
+	if err != nil {
+		return crdt.NoOp, err
 	}
+	s.saveOperationLocked(docID, operation)
 
 	// Broadcast operation to all clients
-	s.broadcastOperation(operation)
+	s.broadcastOperation(operation, doc.VersionClock())
+	return operation, nil
 }
 
-func (s *AppServer) sendHTTPMessage(msg Message) {
-	for _, brokerAddr := range s.brokers {
-		url := fmt.Sprintf("http://%s/crdt", brokerAddr)
-		jsonData, err := json.Marshal(msg)
+// attempts at sending an operation to the brokers before giving up, the wait
+// before the first retry, doubled after every failed attempt, and how long
+// sending one operation can take with its retries
+const (
+	sendAttempts     = 4
+	sendRetryBackoff = 100 * time.Millisecond
+	sendTimeout      = 10 * time.Second
+)
+
+// the brokers answered in a way retrying won't change, like a bad token
+var ErrRejectedByBroker = errors.New("broker rejected the message")
+
+// send the message to the broker that last accepted one first. followers
+// forward to the leader, so other brokers are only tried when a broker is
+// down or doesn't know the leader either. when no broker takes it, it is sent
+// again up to sendAttempts times or until ctx is done
+// committed is called with the broker's receipt once the operation is committed, it can be nil
+// with Options.BatchSize above 1 the message waits for the next batch instead
+// the returned channel gets the error when the message couldn't be delivered,
+// and is closed once sending is over
+func (s *AppServer) sendHTTPMessage(ctx context.Context, msg Message, committed func(broker.CRDTReceipt)) <-chan error {
+	errc := make(chan error, 1)
+	msg.SchemaVersion = broker.CurrentSchemaVersion
+	// one id for every attempt below, so a broker that got it already doesn't submit it again
+	if msg.OpID == "" {
+		opID, err := newOpID(rand.Reader)
 		if err != nil {
-			log.Printf("Error marshaling message for broker %s: %v", brokerAddr, err)
-			continue
+			s.logger.Error("error making an op id", "err", err)
+			errc <- err
+			close(errc)
+			return errc
 		}
-
-		go func(addr string, data []byte) {
-			resp, err := http.Post(addr, "application/json", bytes.NewBuffer(data))
-			if err != nil {
-				log.Printf("Error sending message to broker %s: %v", addr, err)
-				return
-			}
-			defer func(Body io.ReadCloser) {
-				err := Body.Close()
-				if err != nil {
-					log.Printf("Error closing body: %v", err)
-				}
-			}(resp.Body)
-		}(url, jsonData)
+		msg.OpID = opID
+	}
+	s.mu.Lock()
+	s.rememberOwnOpLocked(msg.OpID)
+	s.mu.Unlock()
+	if s.options.BatchSize > 1 {
+		s.queueForBatch(msg, committed, errc)
+		return errc
+	}
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		s.logger.Error("error marshaling message for brokers", "err", err)
+		errc <- err
+		close(errc)
+		return errc
 	}
+
+	go func(data []byte) {
+		defer close(errc)
+		brokerAddr, body, err := s.sendToBrokers(ctx, "/crdt", data)
+		if err != nil {
+			errc <- err
+			return
+		}
+		// accepted messages come back with a receipt. a retry whose first
+		// attempt hasn't committed gets plain text, the first attempt is waited on
+		var receipt broker.CRDTReceipt
+		if err := json.Unmarshal(body, &receipt); err != nil {
+			return
+		}
+		s.logger.Debug("broker appended operation", "broker", receipt.BrokerID, "op_id", receipt.OpID,
+			"document", receipt.Document, "index", receipt.Index, "term", receipt.Term)
+		if committed == nil {
+			return
+		}
+		if err := s.waitForCommit(brokerAddr, receipt); err != nil {
+			s.logger.Warn("not acknowledging operation", "op_id", receipt.OpID, "err", err)
+			return
+		}
+		committed(receipt)
+	}(jsonData)
+	return errc
 }
 
-// for testing at this point
-func (s *AppServer) requestCRDTLogs() error {
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: time.Second * 10,
+// postToBrokers with retries, backing off between attempts
+func (s *AppServer) sendToBrokers(ctx context.Context, path string, data []byte) (brokerAddr string, body []byte, err error) {
+	backoff := sendRetryBackoff
+	for attempt := 1; ; attempt++ {
+		brokerAddr, body, err = s.postToBrokers(ctx, path, data)
+		if err == nil || errors.Is(err, ErrRejectedByBroker) {
+			return brokerAddr, body, err
+		}
+		if attempt == sendAttempts {
+			s.logger.Error("giving up sending message to the brokers", "path", path, "attempts", attempt, "err", err)
+			return "", nil, err
+		}
+		s.logger.Warn("retrying message to the brokers", "path", path, "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", nil, fmt.Errorf("%w after %d attempts: %v", ctx.Err(), attempt, err)
+		}
+		backoff *= 2
 	}
+}
 
-	for _, brokerAddr := range s.brokers {
-		url := fmt.Sprintf("http://%s/logrequest", brokerAddr)
+// post data to path on the brokers in brokerOrder until one accepts it
+// returns the broker that did and the body of its response. the error wraps
+// ErrRejectedByBroker when a broker refused the message itself
+func (s *AppServer) postToBrokers(ctx context.Context, path string, data []byte) (brokerAddr string, body []byte, err error) {
+	s.mu.Lock()
+	leaderAddr := s.leaderAddr
+	s.mu.Unlock()
+	if leaderAddr == "" {
+		s.findLeader(ctx)
+	}
 
-		req, err := http.NewRequest("GET", url, nil)
+	lastErr := errors.New("no brokers")
+	for _, brokerAddr := range s.brokerOrder() {
+		req, err := s.newBrokerRequest(http.MethodPost, brokerAddr, path, bytes.NewBuffer(data))
 		if err != nil {
-			log.Printf("Error creating request for broker %s: %v", brokerAddr, err)
+			s.logger.Error("error creating request for broker", "broker", brokerAddr, "err", err)
+			lastErr = err
 			continue
 		}
-
-		resp, err := client.Do(req)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.httpClient.Do(req)
 		if err != nil {
-			log.Printf("Error requesting logs from broker %s: %v", brokerAddr, err)
+			s.logger.Warn("error sending message to broker", "broker", brokerAddr, "err", err)
+			s.forgetLeader(brokerAddr)
+			lastErr = err
 			continue
 		}
-		defer func(Body io.ReadCloser) {
-			err := Body.Close()
-			if err != nil {
-				log.Printf("Error closing body: %v", err)
-			}
-		}(resp.Body)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			s.logger.Warn("error reading response from broker", "broker", brokerAddr, "err", err)
+		}
+		err = resp.Body.Close()
+		if err != nil {
+			s.logger.Debug("error closing body", "err", err)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusOK:
+			s.mu.Lock()
+			s.leaderAddr = resp.Request.URL.Host
+			s.mu.Unlock()
+			return brokerAddr, body, nil
+		case resp.StatusCode == http.StatusUnauthorized:
+			// every broker has the same token, no point trying the others
+			s.logger.Error("broker rejected the auth token", "broker", brokerAddr)
+			return "", nil, fmt.Errorf("%w: broker %s answered %s", ErrRejectedByBroker, brokerAddr, resp.Status)
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			// a follower that doesn't know or can't reach the leader, or a
+			// broker in trouble, try the next broker
+			lastErr = fmt.Errorf("broker %s answered %s", brokerAddr, resp.Status)
+			s.forgetLeader(brokerAddr)
+			continue
+		default:
+			s.logger.Warn("broker rejected message", "broker", brokerAddr, "status", resp.StatusCode)
+			return "", nil, fmt.Errorf("%w: broker %s answered %s", ErrRejectedByBroker, brokerAddr, resp.Status)
+		}
+	}
+	s.logger.Warn("failed to send message to any broker", "err", lastErr)
+	return "", nil, lastErr
+}
 
-		// If we get a redirect, the broker is not the leader   <-- didn't have time to implement
-		// if resp.StatusCode == http.StatusTemporaryRedirect {
-		// 	continue
-		// }
+// ask the brokers who the leader is and remember its address. the leader
+// answering for itself is taken over what a follower last heard. false when
+// no broker knows, every broker is tried then
+func (s *AppServer) findLeader(ctx context.Context) bool {
+	s.mu.Lock()
+	brokers := slices.Clone(s.brokers)
+	s.mu.Unlock()
 
-		// response from Follower
-		if resp.StatusCode == http.StatusForbidden {
+	leaderAddr := ""
+	for _, brokerAddr := range brokers {
+		reply, err := s.whoIsLeader(ctx, brokerAddr)
+		if err != nil {
+			s.logger.Debug("broker doesn't know the leader", "broker", brokerAddr, "err", err)
 			continue
 		}
+		if reply.Self {
+			// the address the leader reports for itself can be a bare port
+			leaderAddr = brokerAddr
+			break
+		}
+		if leaderAddr == "" {
+			leaderAddr = reply.HTTPAddr
+		}
+	}
+	if leaderAddr == "" {
+		return false
+	}
 
-		// If we successfully get logs from the leader
-		if resp.StatusCode == http.StatusOK {
+	s.mu.Lock()
+	s.leaderAddr = leaderAddr
+	s.mu.Unlock()
+	s.logger.Debug("found leader", "broker", leaderAddr)
+	return true
+}
+
+// GET /leader on one broker
+func (s *AppServer) whoIsLeader(ctx context.Context, brokerAddr string) (broker.WhoIsLeaderReply, error) {
+	var reply broker.WhoIsLeaderReply
+	req, err := s.newBrokerRequest(http.MethodGet, brokerAddr, "/leader", nil)
+	if err != nil {
+		return reply, err
+	}
+	resp, err := s.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return reply, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return reply, fmt.Errorf("broker %s answered %s", brokerAddr, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return reply, err
+	}
+	if reply.LeaderId < 0 || reply.HTTPAddr == "" {
+		return reply, errors.New("no leader known")
+	}
+	return reply, nil
+}
 
-			//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-			// what this would have done is taken the logs obtained from the brokers to apply crdt to the text. but we ran out of time
-			//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-			// var operations []crdt.Operation
-			// if err := json.NewDecoder(resp.Body).Decode(&operations); err != nil {
-			// 	return fmt.Errorf("error decoding log response: %v", err)
-			// }
+// drop the cached leader when brokerAddr is it, the next send asks the
+// brokers again instead of trying it first
+func (s *AppServer) forgetLeader(brokerAddr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leaderAddr == brokerAddr {
+		s.leaderAddr = ""
+	}
+}
 
-			// // Apply operations to local CRDT
-			// s.mu.Lock()
-			// for _, op := range operations {
-			// 	s.textCRDT.Apply(op)
-			// }
-			// s.mu.Unlock()
-			// return nil
+// brokers to try in order, known leader first
+func (s *AppServer) brokerOrder() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			bodyBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return fmt.Errorf("error reading response body: %v", err)
-			}
-			log.Printf("appserver receives {%s} from broker", string(bodyBytes))
-			return nil
+	order := make([]string, 0, len(s.brokers)+1)
+	if s.leaderAddr != "" {
+		order = append(order, s.leaderAddr)
+	}
+	for _, brokerAddr := range s.brokers {
+		if brokerAddr != s.leaderAddr {
+			order = append(order, brokerAddr)
 		}
 	}
-	return fmt.Errorf("failed to get logs from any broker")
+	return order
 }
 
-func (s *AppServer) broadcastOperation(op crdt.Operation) {
-	for client := range s.clients {
-		err := client.WriteJSON(op)
-		if err != nil {
-			log.Printf("Error broadcasting to client: %v", err)
-			err := client.Close()
+// queue op for every client. it is encoded once for each sub-protocol in use
+// caller must hold s.mu
+func (s *AppServer) broadcastOperation(op crdt.Operation, clock crdt.VectorClock) {
+	_, messageType := s.wireCodec()
+	encoded := make(map[codec]*websocket.PreparedMessage)
+	for _, c := range s.clients {
+		msg, ok := encoded[c.codec]
+		if !ok {
+			data, err := c.codec.EncodeOperation(op, clock)
 			if err != nil {
+				s.logger.Error("error encoding operation for clients", "err", err)
+				return
+			}
+			if msg, err = websocket.NewPreparedMessage(messageType, data); err != nil {
+				s.logger.Error("error preparing operation for clients", "err", err)
 				return
 			}
-			delete(s.clients, client)
+			encoded[c.codec] = msg
 		}
+		s.queue(c, msg)
 	}
 }
 
-func (s *AppServer) GetRepresentation() []interface{} {
+// the local copy of a document, which may not have every committed edit yet
+// see GetCommittedRepresentation
+func (s *AppServer) GetRepresentation(docID string) []interface{} {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.textCRDT.Representation()
+	doc, ok := s.existingDocumentLocked(docID)
+	if !ok {
+		return nil
+	}
+	return doc.Representation()
+}
+
+// routes of the application server. each AppServer gets its own mux so
+// several can run in one process
+func (s *AppServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	var ws http.Handler = http.HandlerFunc(s.handleWebSocket)
+	if len(s.options.JWTSecret) > 0 {
+		ws = auth.JWTAuthMiddleware(s.options.JWTSecret)(ws)
+	}
+	mux.Handle("/ws", ws)
+	mux.HandleFunc("GET /document/{id}", s.handleDocument)
+	mux.HandleFunc("GET /document/{id}/snapshot", s.handleDocumentSnapshot)
+	mux.HandleFunc("GET /document/{id}/stats", s.handleDocumentStats)
+	mux.HandleFunc("GET /document/{id}/presence", s.handleDocumentPresence)
+	mux.HandleFunc("POST /commits", s.handleCommitPush)
+	return mux
 }
 
 func (s *AppServer) Serve(addr string) error {
-	http.HandleFunc("/ws", s.handleWebSocket)
+	s.logger.Info("starting application server", "addr", addr)
+	listener, err := s.listen(addr, ":http")
+	if err != nil {
+		return err
+	}
+	go s.syncWithBrokers()
+	return s.httpServer(addr).Serve(listener)
+}
+
+// how long ServeContext waits for http requests in flight once ctx is done
+const shutdownTimeout = 10 * time.Second
+
+// like Serve until ctx is done, then the websocket clients are disconnected
+// and the http server shut down. nil after a clean shutdown
+func (s *AppServer) ServeContext(ctx context.Context, addr string) error {
+	s.logger.Info("starting application server", "addr", addr)
+	listener, err := s.listen(addr, ":http")
+	if err != nil {
+		return err
+	}
+	go s.syncWithBrokers()
+	server := s.httpServer(addr)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	s.logger.Info("shutting down application server")
+
+	// Shutdown leaves hijacked connections alone, closing them ends their read loops
+	s.mu.Lock()
+	for _, c := range s.clients {
+		c.close()
+	}
+	s.mu.Unlock()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// tcp listener on addr, or on defaultAddr like http.ListenAndServe when addr
+// is empty, holding at most MaxHTTPConns connections
+func (s *AppServer) listen(addr string, defaultAddr string) (net.Listener, error) {
+	if addr == "" {
+		addr = defaultAddr
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.options.MaxHTTPConns > 0 {
+		listener = broker.LimitListener(listener, s.options.MaxHTTPConns)
+	}
+	return listener, nil
+}
+
+// timeouts keep slow or idle clients from holding connections open. the
+// websocket upgrader clears them on the connections it takes over
+func (s *AppServer) httpServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      s.Handler(),
+		ReadTimeout:  httpTimeout(s.options.HTTPReadTimeout, defaultHTTPReadTimeout),
+		WriteTimeout: httpTimeout(s.options.HTTPWriteTimeout, defaultHTTPWriteTimeout),
+		IdleTimeout:  httpTimeout(s.options.HTTPIdleTimeout, defaultHTTPIdleTimeout),
+	}
+}
 
-	log.Printf("Starting application server on %s", addr)
-	return http.ListenAndServe(addr, nil)
+// timeout from the options, def when it is 0 and none when it is negative
+func httpTimeout(timeout, def time.Duration) time.Duration {
+	switch {
+	case timeout < 0:
+		return 0
+	case timeout == 0:
+		return def
+	default:
+		return timeout
+	}
+}
+
+// http.Server for serving over tls. http/2 is turned off because websocket
+// upgrades hijack the connection, which only works over http/1.1
+func (s *AppServer) tlsServer(addr string, cfg *tls.Config) *http.Server {
+	server := s.httpServer(addr)
+	server.TLSConfig = cfg
+	server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	return server
+}
+
+// serve over https, so clients on https pages can connect with wss://
+func (s *AppServer) ServeTLS(addr, certFile, keyFile string) error {
+	s.logger.Info("starting application server with TLS", "addr", addr)
+	listener, err := s.listen(addr, ":https")
+	if err != nil {
+		return err
+	}
+	go s.syncWithBrokers()
+	return s.tlsServer(addr, nil).ServeTLS(listener, certFile, keyFile)
+}
+
+// like ServeTLS with the certificates taken from cfg
+func (s *AppServer) ServeWithTLSConfig(addr string, cfg *tls.Config) error {
+	s.logger.Info("starting application server with TLS", "addr", addr)
+	listener, err := s.listen(addr, ":https")
+	if err != nil {
+		return err
+	}
+	go s.syncWithBrokers()
+	return s.tlsServer(addr, cfg).ServeTLS(listener, "", "")
 }
@@ -1,7 +1,11 @@
 package appserver
 
 import (
+	"context"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -40,7 +44,7 @@ func TestHandleSendAndGet3brokers(t *testing.T) {
 
 	// Connect a WebSocket client
 	addr := "ws://localhost:8080/ws"
-	client, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	client, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
 	if err != nil {
 		t.Fatalf("failed to connect to WebSocket server: %v", err)
 	}
@@ -131,7 +135,7 @@ func TestHandleSendAndGet4brokers(t *testing.T) {
 
 	// Connect a WebSocket client
 	addr := "ws://localhost:8080/ws"
-	client, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	client, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
 	if err != nil {
 		t.Fatalf("failed to connect to WebSocket server: %v", err)
 	}
@@ -222,7 +226,7 @@ func TestHandleSendAndGet7brokers(t *testing.T) {
 
 	// Connect a WebSocket client
 	addr := "ws://localhost:8080/ws"
-	client, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	client, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
 	if err != nil {
 		t.Fatalf("failed to connect to WebSocket server: %v", err)
 	}
@@ -313,7 +317,7 @@ func TestHandleSendAndGet20brokers(t *testing.T) {
 
 	// Connect a WebSocket client
 	addr := "ws://localhost:8080/ws"
-	client, _, err := websocket.DefaultDialer.Dial(addr, nil)
+	client, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
 	if err != nil {
 		t.Fatalf("failed to connect to WebSocket server: %v", err)
 	}
@@ -373,3 +377,109 @@ func TestHandleSendAndGet20brokers(t *testing.T) {
 	log.Printf("roundtrip: %s", roundtripDuration)
 
 }
+
+func TestWebSocketSubprotocolNegotiation(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(http.HandlerFunc(appServer.handleWebSocket))
+	defer server.Close()
+	addr := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// clients without a supported sub-protocol are turned away before the upgrade
+	for _, protocols := range [][]string{nil, {"clarity-v0"}, {"chat", "superchat"}} {
+		dialer := websocket.Dialer{Subprotocols: protocols}
+		client, resp, err := dialer.Dial(addr, nil)
+		if err == nil {
+			client.Close()
+			t.Errorf("upgrade with sub-protocols %v succeeded, want it rejected", protocols)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("upgrade with sub-protocols %v got response %v, want status %d", protocols, resp, http.StatusBadRequest)
+		}
+	}
+
+	// the newest version both sides support is picked
+	for _, tt := range []struct {
+		offered []string
+		want    string
+	}{
+		{[]string{ProtocolV1}, ProtocolV1},
+		{[]string{ProtocolV2}, ProtocolV2},
+		{[]string{"clarity-v0", ProtocolV1, ProtocolV2}, ProtocolV2},
+	} {
+		dialer := websocket.Dialer{Subprotocols: tt.offered}
+		client, _, err := dialer.Dial(addr, nil)
+		if err != nil {
+			t.Errorf("upgrade with sub-protocols %v failed: %v", tt.offered, err)
+			continue
+		}
+		if client.Subprotocol() != tt.want {
+			t.Errorf("offered %v and got %q, want %q", tt.offered, client.Subprotocol(), tt.want)
+		}
+		client.Close()
+	}
+
+	// clarity-v2 clients get the vector clock with every operation
+	dialer := websocket.Dialer{Subprotocols: []string{ProtocolV2}}
+	client, _, err := dialer.Dial(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	msg := MessageV2{
+		Message:     Message{Type: "insert", Index: 0, Value: "a", ReplicaID: "other", Source: "broker"},
+		VectorClock: map[string]int64{"other": 1},
+	}
+	if err := client.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	var op struct {
+		VectorClock map[string]int64 `json:"vector_clock"`
+	}
+	if err := client.ReadJSON(&op); err != nil {
+		t.Fatal(err)
+	}
+	if op.VectorClock["testReplica"] != 1 {
+		t.Errorf("got vector clock %v, want testReplica at 1", op.VectorClock)
+	}
+}
+
+func TestSendHTTPMessageWithBrokerToken(t *testing.T) {
+	const token = "s3cret"
+	opts := make([]broker.BrokerOptions, 3)
+	for i := range opts {
+		opts[i].AuthToken = token
+	}
+	h := broker.NewHarnessWithOptions(t, 3, opts)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	// let a heartbeat tell the followers who the leader is
+	time.Sleep(100 * time.Millisecond)
+
+	// start at a follower so the token has to be forwarded to the leader
+	followerId := (leaderId + 1) % 3
+	brokerList := []string{h.Cluster()[followerId].GetHTTPAddr()}
+
+	leaderLogLength := func() int {
+		leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(leaderId)
+		return len(leaderLog)
+	}
+	msg := Message{Type: broker.OpInsert, Index: 0, Value: "a", ReplicaID: "testReplica", OpIndex: 1, Source: "client"}
+
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"", 0},
+		{"not-" + token, 0},
+		{token, 1},
+	} {
+		appServer := NewAppServerWithOptions("testReplica", brokerList, Options{BrokerAuthToken: tt.token})
+		appServer.sendHTTPMessage(context.Background(), msg, nil)
+		time.Sleep(200 * time.Millisecond)
+		if got := leaderLogLength(); got != tt.want {
+			t.Errorf("with token %q the leader log has %d entries, want %d", tt.token, got, tt.want)
+		}
+	}
+}
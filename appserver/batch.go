@@ -0,0 +1,114 @@
+package appserver
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+)
+
+// how long a partial batch waits for more operations when Options.BatchInterval isn't set
+const defaultBatchInterval = 50 * time.Millisecond
+
+type pendingMessage struct {
+	msg       Message
+	committed func(broker.CRDTReceipt)
+	// gets the error when the batch couldn't be delivered, closed once it is sent
+	errc chan error
+}
+
+func (s *AppServer) queueForBatch(msg Message, committed func(broker.CRDTReceipt), errc chan error) {
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+
+	s.batch = append(s.batch, pendingMessage{msg: msg, committed: committed, errc: errc})
+	if len(s.batch) >= s.options.BatchSize {
+		s.flushBatchLocked()
+		return
+	}
+	if s.batchTimer == nil {
+		interval := s.options.BatchInterval
+		if interval <= 0 {
+			interval = defaultBatchInterval
+		}
+		s.batchTimer = time.AfterFunc(interval, s.FlushBatch)
+	}
+}
+
+// send the queued operations now instead of waiting for the batch to fill up
+func (s *AppServer) FlushBatch() {
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+	s.flushBatchLocked()
+}
+
+// caller must hold s.batchMu
+func (s *AppServer) flushBatchLocked() {
+	if s.batchTimer != nil {
+		s.batchTimer.Stop()
+		s.batchTimer = nil
+	}
+	if len(s.batch) == 0 {
+		return
+	}
+	pending := s.batch
+	s.batch = nil
+	go s.sendBatch(pending)
+}
+
+func (s *AppServer) sendBatch(pending []pendingMessage) {
+	defer func() {
+		for _, p := range pending {
+			close(p.errc)
+		}
+	}()
+	msgs := make([]Message, len(pending))
+	committed := make(map[string]func(broker.CRDTReceipt))
+	for i, p := range pending {
+		msgs[i] = p.msg
+		if p.committed != nil {
+			committed[p.msg.OpID] = p.committed
+		}
+	}
+	data, err := json.Marshal(msgs)
+	if err != nil {
+		s.logger.Error("error marshaling batch for brokers", "err", err)
+		for _, p := range pending {
+			p.errc <- err
+		}
+		return
+	}
+
+	// the messages come from different clients, so the batch gets its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	brokerAddr, body, err := s.sendToBrokers(ctx, "/crdt/batch", data)
+	if err != nil {
+		for _, p := range pending {
+			p.errc <- err
+		}
+		return
+	}
+	var receipt broker.CRDTBatchReceipt
+	if err := json.Unmarshal(body, &receipt); err != nil {
+		s.logger.Warn("error decoding batch receipt", "err", err)
+		return
+	}
+	s.logger.Debug("broker appended batch", "broker", receipt.BrokerID, "operations", len(receipt.Receipts),
+		"first_index", receipt.FirstIndex, "last_index", receipt.LastIndex, "term", receipt.Term)
+	if len(committed) == 0 || len(receipt.Receipts) == 0 {
+		return
+	}
+
+	// the whole batch is in one term, so it is committed once its last entry is
+	if err := s.waitForCommit(brokerAddr, receipt.Receipts[len(receipt.Receipts)-1]); err != nil {
+		s.logger.Warn("not acknowledging batch", "first_index", receipt.FirstIndex, "last_index", receipt.LastIndex, "err", err)
+		return
+	}
+	for _, r := range receipt.Receipts {
+		if callback, ok := committed[r.OpID]; ok {
+			callback(r)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package appserver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+)
+
+func TestSendHTTPMessageBatches(t *testing.T) {
+	h := broker.NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	brokerAddrs := make([]string, len(h.Cluster()))
+	for i, b := range h.Cluster() {
+		brokerAddrs[i] = b.GetHTTPAddr()
+	}
+	appServer := NewAppServerWithOptions("testReplica", brokerAddrs, Options{BatchSize: 3, BatchInterval: 200 * time.Millisecond})
+
+	leaderLogLength := func() int {
+		leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(leaderId)
+		return len(leaderLog)
+	}
+
+	var mu sync.Mutex
+	acked := make(map[string]int)
+	send := func(i int, opID string) {
+		msg := Message{Type: broker.OpInsert, Index: int64(i), Value: "a", ReplicaID: "testReplica", OpIndex: 1, Source: "client", OpID: opID}
+		appServer.sendHTTPMessage(context.Background(), msg, func(receipt broker.CRDTReceipt) {
+			mu.Lock()
+			acked[receipt.OpID] = receipt.Index
+			mu.Unlock()
+		})
+	}
+
+	// a full batch goes out right away
+	for i, opID := range []string{"op-0", "op-1", "op-2"} {
+		send(i, opID)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := leaderLogLength(); got != 3 {
+		t.Fatalf("leader log has %d entries after a full batch, want 3", got)
+	}
+
+	// a partial one waits for the interval
+	send(3, "op-3")
+	time.Sleep(100 * time.Millisecond)
+	if got := leaderLogLength(); got != 3 {
+		t.Errorf("leader log has %d entries before the interval passed, want 3", got)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if got := leaderLogLength(); got != 4 {
+		t.Errorf("leader log has %d entries after the interval, want 4", got)
+	}
+
+	// every operation is acknowledged with its own index once committed
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(acked)
+		mu.Unlock()
+		if n == 4 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, opID := range []string{"op-0", "op-1", "op-2", "op-3"} {
+		if index, ok := acked[opID]; !ok || index != i {
+			t.Errorf("%s acked at index %d (acked %t), want %d", opID, index, ok, i)
+		}
+	}
+}
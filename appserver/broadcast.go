@@ -0,0 +1,156 @@
+package appserver
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const defaultClientSendBuffer = 256
+
+// how long a single write to a client can take before the client is dropped
+const clientWriteTimeout = 10 * time.Second
+
+// sent by BroadcastRaw. payload is base64 in the json
+type RawMessage struct {
+	Type    string `json:"type"`
+	Payload []byte `json:"payload"`
+}
+
+// a connected websocket client. once registered, everything written to conn
+// goes through send and is written by writeLoop, websocket connections allow
+// one writer at a time and a slow client only holds up its own goroutine
+type client struct {
+	conn  *websocket.Conn
+	codec codec // of the sub-protocol the client connected with
+	send  chan *websocket.PreparedMessage
+
+	// closed when the client is dropped, stops writeLoop
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// the connection is closed once this is written, see dropClientAfterLocked
+	last atomic.Pointer[websocket.PreparedMessage]
+}
+
+// close the connection, which also ends the client's read loop in handleWebSocket
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// first is queued before anything else, on top of the send buffer
+// caller must hold s.mu
+func (s *AppServer) addClientLocked(conn *websocket.Conn, codec codec, first []*websocket.PreparedMessage) {
+	size := s.options.ClientSendBuffer
+	if size <= 0 {
+		size = defaultClientSendBuffer
+	}
+	c := &client{conn: conn, codec: codec, send: make(chan *websocket.PreparedMessage, size+len(first)), done: make(chan struct{})}
+	for _, msg := range first {
+		c.send <- msg
+	}
+	s.clients[conn] = c
+	s.refreshClientSnapshotLocked()
+	go s.writeLoop(c)
+}
+
+// caller must hold s.mu
+func (s *AppServer) removeClientLocked(conn *websocket.Conn) {
+	if c, ok := s.clients[conn]; ok {
+		c.close()
+	}
+	delete(s.clients, conn)
+	s.refreshClientSnapshotLocked()
+	s.removePresenceLocked(conn)
+}
+
+// like removeClientLocked, but the connection is only closed once msg, the
+// last thing conn gets, was written
+// caller must hold s.mu
+func (s *AppServer) dropClientAfterLocked(conn *websocket.Conn, msg *websocket.PreparedMessage) {
+	c, ok := s.clients[conn]
+	if !ok {
+		return
+	}
+	c.last.Store(msg)
+	s.queue(c, msg)
+	delete(s.clients, conn)
+	s.refreshClientSnapshotLocked()
+	s.removePresenceLocked(conn)
+}
+
+// caller must hold s.mu
+func (s *AppServer) refreshClientSnapshotLocked() {
+	clients := slices.Collect(maps.Values(s.clients))
+	s.clientSnapshot.Store(&clients)
+}
+
+// write what is queued for c until it is dropped
+func (s *AppServer) writeLoop(c *client) {
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			if err := c.conn.WritePreparedMessage(msg); err != nil {
+				s.logger.Debug("error writing to client, dropping it", "err", err)
+				c.close()
+				return
+			}
+			if msg == c.last.Load() {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// hand msg to c's writeLoop without waiting. a client whose buffer is full
+// has fallen too far behind and is dropped. false if msg wasn't queued
+// doesn't need s.mu
+func (s *AppServer) queue(c *client, msg *websocket.PreparedMessage) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		s.logger.Warn("client too slow, dropping it", "buffered", len(c.send))
+		c.close()
+		return false
+	}
+}
+
+// push a message that isn't a crdt operation to every connected client, e.g.
+// "document locked" or "server shutting down in 30s". returns how many clients
+// it was queued for. doesn't need s.mu, so it can be called from code that holds it
+func (s *AppServer) BroadcastRaw(msgType string, payload []byte) int {
+	clients := s.clientSnapshot.Load()
+	if clients == nil {
+		return 0
+	}
+	msg, err := s.prepare(RawMessage{Type: msgType, Payload: payload})
+	if err != nil {
+		s.logger.Error("error encoding broadcast", "type", msgType, "err", err)
+		return 0
+	}
+
+	sent := 0
+	for _, c := range *clients {
+		if s.queue(c, msg) {
+			sent++
+		}
+	}
+	return sent
+}
@@ -0,0 +1,336 @@
+package appserver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+	"github.com/townsag/clarity/crdt"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBroadcastRaw(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	var clients []*websocket.Conn
+	for _, protocol := range []string{ProtocolV1, ProtocolV2} {
+		client, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {protocol}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	for deadline := time.Now().Add(time.Second); appServer.BroadcastRaw("ping", nil) < len(clients); {
+		if time.Now().After(deadline) {
+			t.Fatal("clients never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// every client is already blocked reading when the broadcasts go out
+	received := make(chan RawMessage, 10)
+	for _, client := range clients {
+		go func(client *websocket.Conn) {
+			for {
+				var msg RawMessage
+				if err := client.ReadJSON(&msg); err != nil {
+					return
+				}
+				if msg.Type != "ping" {
+					received <- msg
+				}
+			}
+		}(client)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	payload := []byte("server shutting down in 30s")
+	if sent := appServer.BroadcastRaw("shutdown", payload); sent != len(clients) {
+		t.Errorf("sent to %d clients, want %d", sent, len(clients))
+	}
+
+	// holding s.mu, like a handler would, doesn't block it
+	done := make(chan int)
+	appServer.mu.Lock()
+	go func() { done <- appServer.BroadcastRaw("locked", []byte("document locked")) }()
+	select {
+	case sent := <-done:
+		if sent != len(clients) {
+			t.Errorf("sent to %d clients while holding mu, want %d", sent, len(clients))
+		}
+	case <-time.After(time.Second):
+		t.Error("BroadcastRaw blocked on mu")
+	}
+	appServer.mu.Unlock()
+
+	want := map[string][]byte{"shutdown": payload, "locked": []byte("document locked")}
+	for i := 0; i < len(want)*len(clients); i++ {
+		select {
+		case msg := <-received:
+			if !bytes.Equal(msg.Payload, want[msg.Type]) {
+				t.Errorf("got %s payload %q, want %q", msg.Type, msg.Payload, want[msg.Type])
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d of %d messages", i, len(want)*len(clients))
+		}
+	}
+}
+
+// every write to the first accepted connection takes delay
+type slowFirstListener struct {
+	net.Listener
+	delay    time.Duration
+	accepted atomic.Int32
+}
+
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (l *slowFirstListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil && l.accepted.Add(1) == 1 {
+		return slowConn{Conn: conn, delay: l.delay}, nil
+	}
+	return conn, err
+}
+
+func (c slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+func TestSlowClientDoesNotHoldUpBroadcast(t *testing.T) {
+	const fastClients = 10
+	const operations = 100
+
+	appServer := NewAppServerWithOptions("testReplica", nil, Options{ClientSendBuffer: 16})
+	server := httptest.NewUnstartedServer(appServer.Handler())
+	server.Listener = &slowFirstListener{Listener: server.Listener, delay: 200 * time.Millisecond}
+	server.Start()
+	defer server.Close()
+
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	header := http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}}
+	// dialed first so it gets the slow connection, it never reads either
+	slow, _, err := websocket.DefaultDialer.Dial(addr, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	received := make(chan int, fastClients*operations)
+	for i := 0; i < fastClients; i++ {
+		client, _, err := websocket.DefaultDialer.Dial(addr, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		go func(i int) {
+			for {
+				if _, _, err := client.ReadMessage(); err != nil {
+					return
+				}
+				received <- i
+			}
+		}(i)
+	}
+	clientCount := func() int {
+		appServer.mu.Lock()
+		defer appServer.mu.Unlock()
+		return len(appServer.clients)
+	}
+	for deadline := time.Now().Add(time.Second); clientCount() < fastClients+1; {
+		if time.Now().After(deadline) {
+			t.Fatal("clients never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// rapid edits, but not so rapid that a fast client's buffer fills up
+	var slowest time.Duration
+	for i := 0; i < operations; i++ {
+		start := time.Now()
+		appServer.handleOperation(Message{Type: broker.OpInsert, Index: int64(i), Value: "a", ReplicaID: "r1", OpIndex: 1, Source: "client"})
+		slowest = max(slowest, time.Since(start))
+		time.Sleep(2 * time.Millisecond)
+	}
+	// a single write to the slow client takes 200ms
+	if slowest > 100*time.Millisecond {
+		t.Errorf("broadcasting an operation took up to %s, the slow client held it up", slowest)
+	}
+
+	counts := make([]int, fastClients)
+	timeout := time.After(time.Second)
+	for got := 0; got < fastClients*operations; got++ {
+		select {
+		case i := <-received:
+			counts[i]++
+		case <-timeout:
+			t.Fatalf("fast clients got %v operations each, want %d", counts, operations)
+		}
+	}
+
+	// the slow client overflowed its buffer and was dropped
+	for deadline := time.Now().Add(2 * time.Second); clientCount() != fastClients; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients connected, want the slow one dropped leaving %d", clientCount(), fastClients)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a set of values, inserting one that is already there changes nothing
+type setCRDT struct {
+	values map[string]bool
+}
+
+type setOperation struct {
+	Value string `json:"value"`
+}
+
+func (op *setOperation) Type() crdt.OperationType {
+	return crdt.Insert
+}
+
+func (s *setCRDT) LocalInsert(index int64, value interface{}) (crdt.Operation, error) {
+	v := fmt.Sprint(value)
+	if s.values[v] {
+		return crdt.NoOp, fmt.Errorf("%s is in the set already", v)
+	}
+	s.values[v] = true
+	return &setOperation{Value: v}, nil
+}
+
+func (s *setCRDT) LocalDelete(index int64) (crdt.Operation, error) {
+	return crdt.NoOp, fmt.Errorf("a set has no index %d to delete", index)
+}
+
+func (s *setCRDT) Apply(operation crdt.Operation) (bool, error) {
+	op, ok := operation.(*setOperation)
+	if !ok || s.values[op.Value] {
+		return false, nil
+	}
+	s.values[op.Value] = true
+	return true, nil
+}
+
+func (s *setCRDT) Representation() []interface{} {
+	return []interface{}{len(s.values)}
+}
+
+func (s *setCRDT) VersionClock() crdt.VectorClock {
+	return crdt.VectorClock{}
+}
+
+func TestUnchangedDocumentIsNotBroadcast(t *testing.T) {
+	appServer := NewAppServerWithOptions("testReplica", nil, Options{
+		NewDocument: func(string) crdt.CRDT { return &setCRDT{values: make(map[string]bool)} },
+	})
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for deadline := time.Now().Add(time.Second); appServer.BroadcastRaw("ping", nil) < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("client never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	received := make(chan struct{}, 10)
+	go func() {
+		for {
+			var msg RawMessage
+			if err := client.ReadJSON(&msg); err != nil {
+				return
+			}
+			if msg.Type != "ping" {
+				received <- struct{}{}
+			}
+		}
+	}()
+	broadcasts := func(msg Message) int {
+		appServer.handleOperation(msg)
+		n := 0
+		for {
+			select {
+			case <-received:
+				n++
+			case <-time.After(100 * time.Millisecond):
+				return n
+			}
+		}
+	}
+
+	insert := Message{Type: broker.OpInsert, Index: 0, Value: "a", OpIndex: 1, Source: "broker"}
+	if n := broadcasts(insert); n != 1 {
+		t.Errorf("a new value was broadcast %d times, want once", n)
+	}
+	if n := broadcasts(insert); n != 0 {
+		t.Errorf("a value already in the document was broadcast %d times, want none", n)
+	}
+}
+
+func TestOutOfRangeDeleteIsNotBroadcast(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for deadline := time.Now().Add(time.Second); appServer.BroadcastRaw("ping", nil) < 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("client never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	appServer.handleOperation(Message{Type: broker.OpInsert, Index: 0, Value: "a", OpIndex: 1, Source: "broker"})
+	// two clients delete the "a" before either sees the other's delete,
+	// the second finds it deleted already
+	appServer.handleOperation(Message{Type: broker.OpDelete, Index: 0, OpIndex: 1, Source: "broker"})
+	appServer.handleOperation(Message{Type: broker.OpDelete, Index: 0, OpIndex: 1, Source: "broker"})
+	appServer.handleOperation(Message{Type: broker.OpDelete, Index: 3, OpIndex: 1, Source: "broker"})
+	// a marker after them, anything past the insert and the first delete was broadcast in error
+	appServer.BroadcastRaw("done", nil)
+
+	var types []string
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var msg map[string]interface{}
+		if err := client.ReadJSON(&msg); err != nil {
+			t.Fatalf("reading broadcasts: %v, got %v so far", err, types)
+		}
+		msgType := fmt.Sprint(msg["type"])
+		if msgType == "ping" {
+			continue
+		}
+		if msgType == "done" {
+			break
+		}
+		types = append(types, msgType)
+	}
+	if len(types) != 2 {
+		t.Errorf("got broadcasts %v, want only the insert and the first delete", types)
+	}
+}
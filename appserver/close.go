@@ -0,0 +1,79 @@
+package appserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var ErrDocumentClosed = errors.New("document is closed")
+
+// sent to the clients that have a document open when it is closed, right
+// before they are disconnected
+type DocumentClosedMessage struct {
+	Type     string `json:"type"` // always "document_closed"
+	Document string `json:"document"`
+}
+
+// persistence backends that can write out what they buffer for a document
+type persistenceFlusher interface {
+	Flush(docID string) error
+}
+
+var _ persistenceFlusher = (*LevelDBBackend)(nil)
+
+// drop docID from memory. clients that joined it are sent a DocumentClosedMessage
+// and disconnected, and operations on it are rejected from then on, from
+// clients and brokers alike. ErrUnknownDocument when there is no such
+// document or it was closed already
+func (s *AppServer) CloseDocument(docID string) error {
+	msg, err := s.prepare(DocumentClosedMessage{Type: "document_closed", Document: docID})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.existingDocumentLocked(docID); !ok {
+		return fmt.Errorf("%w %s", ErrUnknownDocument, docID)
+	}
+	delete(s.documents, docID)
+	delete(s.restored, docID)
+	s.closed[docID] = true
+
+	disconnected := 0
+	for conn, presence := range s.presences {
+		if presence.Document == docID {
+			s.dropClientAfterLocked(conn, msg)
+			disconnected++
+		}
+	}
+
+	if flusher, ok := s.options.Persistence.(persistenceFlusher); ok {
+		if err := flusher.Flush(docID); err != nil {
+			return fmt.Errorf("flushing %s: %w", docID, err)
+		}
+	}
+	s.logger.Info("closed document", "document", docID, "disconnected", disconnected)
+	return nil
+}
+
+// the local copy of a document as json, 404 once it is closed
+func (s *AppServer) handleDocument(w http.ResponseWriter, r *http.Request) {
+	docID := r.PathValue("id")
+	s.mu.Lock()
+	doc, ok := s.existingDocumentLocked(docID)
+	var representation []interface{}
+	if ok {
+		representation = doc.Representation()
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("%v %s", ErrUnknownDocument, docID), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// the client went away, nothing to tell it
+	json.NewEncoder(w).Encode(representation)
+}
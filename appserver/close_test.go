@@ -0,0 +1,122 @@
+package appserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+
+	"github.com/gorilla/websocket"
+)
+
+// read messages from conn until one of type msgType arrives, decoded into v
+func readMessageOfType(t *testing.T, conn *websocket.Conn, msgType string, v any) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for a %s message: %v", msgType, err)
+		}
+		var envelope struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(data, &envelope) == nil && envelope.Type == msgType {
+			if err := json.Unmarshal(data, v); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+}
+
+func TestCloseDocument(t *testing.T) {
+	backend, err := OpenLevelDBBackend(filepath.Join(t.TempDir(), "ops"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	appServer := NewAppServerWithOptions("testReplica", nil, Options{Persistence: backend})
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	for _, opIndex := range []int64{1, 2} {
+		appServer.handleOperation(Message{Type: broker.OpInsert, Index: 0, Value: "a", ReplicaID: "r1", OpIndex: opIndex, Source: "broker"})
+	}
+
+	// alice has the document that is closed open, bob another one
+	var conns []*websocket.Conn
+	for _, presence := range []ClientPresence{{UserID: "alice", Document: "1"}, {UserID: "bob", Document: "2"}} {
+		conn, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.WriteJSON(JoinMessage{Type: "join", ClientPresence: presence}); err != nil {
+			t.Fatal(err)
+		}
+		readPresence(t, conn)
+		conns = append(conns, conn)
+	}
+	alice, bob := conns[0], conns[1]
+
+	if err := appServer.CloseDocument("1"); err != nil {
+		t.Fatalf("CloseDocument: %v", err)
+	}
+
+	var closed DocumentClosedMessage
+	readMessageOfType(t, alice, "document_closed", &closed)
+	if closed.Document != "1" {
+		t.Errorf("alice was told %q was closed, want %q", closed.Document, "1")
+	}
+	alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var netErr net.Error
+	if _, _, err := alice.ReadMessage(); err == nil || errors.As(err, &netErr) && netErr.Timeout() {
+		t.Errorf("alice is still connected after her document was closed: %v", err)
+	}
+
+	// bob stays, but his edits of the closed document are refused
+	if err := bob.WriteJSON(Message{Type: broker.OpInsert, Index: 0, Value: "b", ReplicaID: "r2", OpIndex: 1, Source: "client", OpID: "op1"}); err != nil {
+		t.Fatal(err)
+	}
+	var nack NackMessage
+	readMessageOfType(t, bob, "nack", &nack)
+	if nack.OpID != "op1" || nack.Error != ErrDocumentClosed.Error() {
+		t.Errorf("bob got %+v, want a nack for op1 saying the document is closed", nack)
+	}
+	// the brokers' copy of it is dropped too
+	appServer.handleOperation(Message{Type: broker.OpInsert, Index: 0, Value: "c", ReplicaID: "r1", OpIndex: 1, Source: "broker"})
+	if got := appServer.GetRepresentation("1"); got != nil {
+		t.Errorf("closed document came back as %v", got)
+	}
+
+	for docID, want := range map[string]int{"1": http.StatusNotFound, "2": http.StatusOK} {
+		resp, err := http.Get(server.URL + "/document/" + docID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET /document/%s got status %d, want %d", docID, resp.StatusCode, want)
+		}
+	}
+
+	// the operations saved before the close are kept
+	if ops, err := backend.LoadOperations("1"); err != nil || len(ops) != 1 {
+		t.Errorf("backend has %d operations of the closed document (err %v), want 1", len(ops), err)
+	}
+
+	for _, docID := range []string{"1", "3"} {
+		if err := appServer.CloseDocument(docID); !errors.Is(err, ErrUnknownDocument) {
+			t.Errorf("CloseDocument(%q) returned %v, want %v", docID, err, ErrUnknownDocument)
+		}
+	}
+}
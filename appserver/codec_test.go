@@ -0,0 +1,108 @@
+package appserver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/townsag/clarity/broker"
+)
+
+func TestMsgpackWebSocket(t *testing.T) {
+	appServer := NewAppServerWithOptions("testReplica", nil, Options{Codec: MsgpackCodec{}})
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{ProtocolV2}}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	codec := MsgpackCodec{}
+	send := func(msg MessageV2) {
+		t.Helper()
+		data, err := codec.Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an unknown type is rejected like json rejects it, the connection stays up
+	send(MessageV2{Message: Message{Type: "upsert", Index: 0, Value: "x", ReplicaID: "other", Source: "broker"}})
+	send(MessageV2{
+		Message:     Message{Type: broker.OpInsert, Index: 0, Value: "a", ReplicaID: "other", Source: "broker"},
+		VectorClock: map[string]int64{"other": 1},
+	})
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	messageType, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType != websocket.BinaryMessage {
+		t.Errorf("operation sent as message type %d, want binary", messageType)
+	}
+	var op struct {
+		Operation struct {
+			Type  string      `json:"type"`
+			Value interface{} `json:"value"`
+		} `json:"operation"`
+		VectorClock map[string]int64 `json:"vector_clock"`
+	}
+	if err := codec.Decode(data, &op); err != nil {
+		t.Fatal(err)
+	}
+	if op.Operation.Type != "insert" || op.Operation.Value != "a" {
+		t.Errorf("got operation %+v, want the insert of a", op.Operation)
+	}
+	if op.VectorClock["testReplica"] != 1 {
+		t.Errorf("got vector clock %v, want testReplica at 1", op.VectorClock)
+	}
+	if got := appServer.GetRepresentation("0"); len(got) != 1 || got[0] != "a" {
+		t.Errorf("document is %v, want [a]", got)
+	}
+}
+
+// decoding and encoding 10 000 small client messages, run with -benchmem
+func BenchmarkCodecs(b *testing.B) {
+	const messages = 10000
+	msg := MessageV2{
+		Message:     Message{Type: broker.OpInsert, Index: 42, Value: "a", ReplicaID: "client-1", OpIndex: 7, Source: "client", OpID: "op-123"},
+		VectorClock: map[string]int64{"client-1": 42},
+	}
+	for _, bench := range []struct {
+		name  string
+		codec BinaryCodec
+	}{
+		{"JSON", JSONCodec{}},
+		{"Msgpack", MsgpackCodec{}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			c := v2Codec{bench.codec}
+			data, err := bench.codec.Encode(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				for range messages {
+					if _, _, err := c.DecodeMessage(data); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := bench.codec.Encode(msg); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.ReportMetric(float64(len(data)), "bytes/msg")
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package appserver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+	"github.com/townsag/clarity/crdt"
+)
+
+// a counter document: inserts add their value, deletes take one away
+type counterCRDT struct {
+	replicaID string
+	value     int
+	ops       int64
+}
+
+type counterOperation struct {
+	Delta int `json:"delta"`
+}
+
+func (op *counterOperation) Type() crdt.OperationType {
+	return crdt.Insert
+}
+
+func newCounterCRDT(replicaID string) crdt.CRDT {
+	return &counterCRDT{replicaID: replicaID}
+}
+
+func (c *counterCRDT) add(delta int) crdt.Operation {
+	c.value += delta
+	c.ops++
+	return &counterOperation{Delta: delta}
+}
+
+// values come back from the brokers' log as strings
+func (c *counterCRDT) LocalInsert(index int64, value interface{}) (crdt.Operation, error) {
+	delta, err := strconv.Atoi(fmt.Sprint(value))
+	if err != nil {
+		return crdt.NoOp, err
+	}
+	return c.add(delta), nil
+}
+
+func (c *counterCRDT) LocalDelete(index int64) (crdt.Operation, error) {
+	return c.add(-1), nil
+}
+
+func (c *counterCRDT) Apply(operation crdt.Operation) (bool, error) {
+	op, ok := operation.(*counterOperation)
+	if !ok {
+		return false, nil
+	}
+	c.value += op.Delta
+	return true, nil
+}
+
+func (c *counterCRDT) Representation() []interface{} {
+	return []interface{}{c.value}
+}
+
+func (c *counterCRDT) VersionClock() crdt.VectorClock {
+	return crdt.VectorClock{c.replicaID: c.ops}
+}
+
+func TestCounterDocumentsConverge(t *testing.T) {
+	h := broker.NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	brokerAddrs := make([]string, len(h.Cluster()))
+	for i, b := range h.Cluster() {
+		brokerAddrs[i] = b.GetHTTPAddr()
+	}
+	options := Options{NewDocument: newCounterCRDT}
+
+	first := NewAppServerWithOptions("first", brokerAddrs, options)
+	if err := first.requestCRDTLogs(); err != nil {
+		t.Fatal(err)
+	}
+	edits := []Message{
+		{Type: broker.OpInsert, Value: "3"},
+		{Type: broker.OpInsert, Value: "4"},
+		{Type: broker.OpDelete},
+	}
+	for _, msg := range edits {
+		msg.ReplicaID, msg.OpIndex, msg.Source = "client1", 7, "client"
+		first.handleOperation(msg)
+		first.sendHTTPMessage(context.Background(), msg, nil)
+		// one commit at a time, like the edits in TestRestartedAppServerSyncsFromCommittedLog
+		time.Sleep(50 * time.Millisecond)
+	}
+	want := []interface{}{6}
+	if got := first.GetRepresentation("7"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("counter is %v after the edits, want %v", got, want)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_, commits, _, _ := h.GetLogsAndCommitIndexFromServer(leaderId)
+		if len(commits) == len(edits) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leader committed %d entries, want %d", len(commits), len(edits))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// a second application server only learns about the edits through the brokers
+	second := NewAppServerWithOptions("second", brokerAddrs, options)
+	if err := second.requestCRDTLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := second.GetRepresentation("7"); !reflect.DeepEqual(got, want) {
+		t.Errorf("second application server's counter is %v, want %v", got, want)
+	}
+	got, err := first.GetCommittedRepresentation("7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("committed counter is %v, want %v", got, want)
+	}
+
+	// counters have no snapshot format
+	if _, err := first.GetDocumentSnapshot("7"); err == nil {
+		t.Error("got a snapshot of a counter document")
+	}
+}
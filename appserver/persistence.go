@@ -0,0 +1,121 @@
+package appserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/townsag/clarity/crdt"
+)
+
+// keeps the operations applied to each document so an application server
+// that restarts gets its documents back without the brokers
+type PersistenceBackend interface {
+	// called after every operation applied to docID
+	SaveOperation(docID string, op crdt.Operation) error
+	// every operation saved for docID, in the order they were saved
+	LoadOperations(docID string) ([]crdt.Operation, error)
+}
+
+// a PersistenceBackend keeping operations in a leveldb database on disk.
+// only operations of the crdt package's text documents can be saved
+type LevelDBBackend struct {
+	db *leveldb.DB
+
+	// sequence number of the next operation of each document, looked up
+	// from the database the first time a document is saved to
+	mu   sync.Mutex
+	next map[string]uint64
+}
+
+var _ PersistenceBackend = (*LevelDBBackend)(nil)
+
+// open the database at path, creating it when it doesn't exist
+func OpenLevelDBBackend(path string) (*LevelDBBackend, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening leveldb at %s: %w", path, err)
+	}
+	return &LevelDBBackend{db: db, next: make(map[string]uint64)}, nil
+}
+
+func (b *LevelDBBackend) Close() error {
+	return b.db.Close()
+}
+
+// keys are the document id, a zero byte, then the big endian sequence number,
+// so the operations of a document are next to each other and in order
+func documentPrefix(docID string) []byte {
+	return append([]byte(docID), 0)
+}
+
+func operationKey(docID string, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(documentPrefix(docID), seq)
+}
+
+func (b *LevelDBBackend) SaveOperation(docID string, op crdt.Operation) error {
+	snapshot := crdt.SnapshotOperation(op)
+	if snapshot.Type == crdt.Noop {
+		return fmt.Errorf("can't save %T operations", op)
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seq, ok := b.next[docID]
+	if !ok {
+		if seq, err = b.nextSequence(docID); err != nil {
+			return err
+		}
+	}
+	if err := b.db.Put(operationKey(docID, seq), data, nil); err != nil {
+		return err
+	}
+	b.next[docID] = seq + 1
+	return nil
+}
+
+// one past the last sequence number saved for docID
+func (b *LevelDBBackend) nextSequence(docID string) (uint64, error) {
+	iter := b.db.NewIterator(util.BytesPrefix(documentPrefix(docID)), nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return 0, iter.Error()
+	}
+	return binary.BigEndian.Uint64(iter.Key()[len(docID)+1:]) + 1, nil
+}
+
+// write the operations of docID out of the memtable and forget its sequence
+// number, it's looked up again if the document is saved to later
+func (b *LevelDBBackend) Flush(docID string) error {
+	b.mu.Lock()
+	delete(b.next, docID)
+	b.mu.Unlock()
+	return b.db.CompactRange(*util.BytesPrefix(documentPrefix(docID)))
+}
+
+func (b *LevelDBBackend) LoadOperations(docID string) ([]crdt.Operation, error) {
+	iter := b.db.NewIterator(util.BytesPrefix(documentPrefix(docID)), nil)
+	defer iter.Release()
+
+	var ops []crdt.Operation
+	for iter.Next() {
+		var snapshot crdt.OperationSnapshot
+		if err := json.Unmarshal(iter.Value(), &snapshot); err != nil {
+			return nil, fmt.Errorf("decoding operation of %s: %w", docID, err)
+		}
+		op, err := crdt.NewOperationFromSnapshot(snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("decoding operation of %s: %w", docID, err)
+		}
+		ops = append(ops, op)
+	}
+	return ops, iter.Error()
+}
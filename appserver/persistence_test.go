@@ -0,0 +1,68 @@
+package appserver
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/townsag/clarity/broker"
+)
+
+func TestDocumentsRecoveredFromLevelDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "documents")
+	backend, err := OpenLevelDBBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appServer := NewAppServerWithOptions("testReplica", nil, Options{Persistence: backend})
+
+	// 100 operations: 80 inserts, every fifth operation deletes instead
+	for i := 0; i < 100; i++ {
+		msg := Message{Type: broker.OpInsert, Index: int64(i / 2), Value: string(rune('a' + i%26)), OpIndex: 1, Source: "client"}
+		if i%5 == 4 {
+			msg = Message{Type: broker.OpDelete, Index: int64(i / 3), OpIndex: 1, Source: "client"}
+		}
+		appServer.handleOperation(msg)
+	}
+	want := appServer.GetRepresentation("1")
+	wantSnapshot, err := appServer.GetDocumentSnapshot("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 60 {
+		t.Fatalf("document has %d characters, want 60", len(want))
+	}
+	if err := backend.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err = OpenLevelDBBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	restarted := NewAppServerWithOptions("testReplica", nil, Options{Persistence: backend})
+	if got := restarted.GetRepresentation("1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered document is %v, want %v", got, want)
+	}
+	gotSnapshot, err := restarted.GetDocumentSnapshot("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotSnapshot) != string(wantSnapshot) {
+		t.Errorf("recovered snapshot is %s, want %s", gotSnapshot, wantSnapshot)
+	}
+	if got := restarted.GetRepresentation("2"); got != nil {
+		t.Errorf("document nobody edited is %v, want nil", got)
+	}
+
+	// edits after the restart are saved after the recovered ones
+	restarted.handleOperation(Message{Type: broker.OpInsert, Index: 0, Value: "!", OpIndex: 1, Source: "client"})
+	ops, err := backend.LoadOperations("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 101 {
+		t.Errorf("%d operations saved, want 101", len(ops))
+	}
+}
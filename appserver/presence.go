@@ -0,0 +1,116 @@
+package appserver
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/websocket"
+)
+
+// who is behind a websocket client, shown as an avatar in other clients' editors
+type ClientPresence struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name"`
+	Color       string `json:"color"`
+
+	// the document the client has open, empty when it didn't say
+	Document string `json:"document,omitempty"`
+}
+
+// sent by a client to announce itself, and again whenever its presence changes
+type JoinMessage struct {
+	Type string `json:"type"` // always "join"
+	ClientPresence
+}
+
+// sent to every client whenever a client joins or leaves
+type PresenceMessage struct {
+	Type      string           `json:"type"` // always "presence"
+	Presences []ClientPresence `json:"presences"`
+}
+
+// join messages are told apart from operations by their type
+func isJoinMessage(wire BinaryCodec, data []byte) bool {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	return wire.Decode(data, &envelope) == nil && envelope.Type == "join"
+}
+
+// userID is the user the client authenticated as and replaces the one in the
+// join message, empty when the client didn't authenticate
+func (s *AppServer) handleJoin(conn *websocket.Conn, data []byte, userID string) {
+	var join JoinMessage
+	wire, _ := s.wireCodec()
+	err := wire.Decode(data, &join)
+	if userID != "" {
+		join.UserID = userID
+	}
+	if err != nil || join.UserID == "" {
+		// a bad join shouldn't drop the connection
+		s.logger.Info("rejecting join message", "err", err, "user_id", join.UserID)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// dropped for being too slow while the join was being read
+	if _, ok := s.clients[conn]; !ok {
+		return
+	}
+	s.presences[conn] = join.ClientPresence
+	s.logger.Debug("client joined", "user_id", join.UserID, "document", join.Document)
+	s.broadcastPresenceLocked()
+}
+
+// caller must hold s.mu
+func (s *AppServer) removePresenceLocked(conn *websocket.Conn) {
+	if _, ok := s.presences[conn]; !ok {
+		return
+	}
+	delete(s.presences, conn)
+	s.broadcastPresenceLocked()
+}
+
+// every presence, ordered by user so clients can show a stable list
+// caller must hold s.mu
+func (s *AppServer) presenceListLocked() []ClientPresence {
+	presences := make([]ClientPresence, 0, len(s.presences))
+	for _, presence := range s.presences {
+		presences = append(presences, presence)
+	}
+	slices.SortFunc(presences, func(a, b ClientPresence) int {
+		return cmp.Or(cmp.Compare(a.UserID, b.UserID), cmp.Compare(a.DisplayName, b.DisplayName), cmp.Compare(a.Document, b.Document))
+	})
+	return presences
+}
+
+// queued while holding s.mu, so clients see the lists in the order they changed
+// caller must hold s.mu
+func (s *AppServer) broadcastPresenceLocked() {
+	msg, err := s.prepare(PresenceMessage{Type: "presence", Presences: s.presenceListLocked()})
+	if err != nil {
+		s.logger.Error("error encoding presence", "err", err)
+		return
+	}
+	for _, c := range s.clients {
+		s.queue(c, msg)
+	}
+}
+
+// presences of the clients that have docID open
+func (s *AppServer) Presences(docID string) []ClientPresence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.DeleteFunc(s.presenceListLocked(), func(p ClientPresence) bool {
+		return p.Document != docID
+	})
+}
+
+func (s *AppServer) handleDocumentPresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// the client went away, nothing to tell it
+	json.NewEncoder(w).Encode(s.Presences(r.PathValue("id")))
+}
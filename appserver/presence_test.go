@@ -0,0 +1,126 @@
+package appserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// read messages from conn until a presence list arrives
+func readPresence(t *testing.T, conn *websocket.Conn) []ClientPresence {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for presence: %v", err)
+		}
+		var msg PresenceMessage
+		if json.Unmarshal(data, &msg) == nil && msg.Type == "presence" {
+			return msg.Presences
+		}
+	}
+}
+
+func TestPresenceBroadcasts(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	alice := ClientPresence{UserID: "alice", DisplayName: "Alice", Color: "#f00", Document: "1"}
+	bob := ClientPresence{UserID: "bob", DisplayName: "Bob", Color: "#0f0", Document: "1"}
+	carol := ClientPresence{UserID: "carol", DisplayName: "Carol", Color: "#00f", Document: "2"}
+
+	var conns []*websocket.Conn
+	var joined []ClientPresence
+	for _, presence := range []ClientPresence{alice, bob, carol} {
+		conn, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.WriteJSON(JoinMessage{Type: "join", ClientPresence: presence}); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		joined = append(joined, presence)
+
+		// everyone connected, the new client included, gets the whole list
+		for i, conn := range conns {
+			if got := readPresence(t, conn); !reflect.DeepEqual(got, joined) {
+				t.Errorf("client %d got %+v after %s joined, want %+v", i, got, presence.UserID, joined)
+			}
+		}
+	}
+
+	if got := appServer.Presences("1"); !reflect.DeepEqual(got, []ClientPresence{alice, bob}) {
+		t.Errorf("document 1 has %+v, want alice and bob", got)
+	}
+
+	// bob leaves
+	conns[1].Close()
+	for _, i := range []int{0, 2} {
+		if got := readPresence(t, conns[i]); !reflect.DeepEqual(got, []ClientPresence{alice, carol}) {
+			t.Errorf("client %d got %+v after bob left, want alice and carol", i, got)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/document/1/presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got []ClientPresence
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []ClientPresence{alice}) {
+		t.Errorf("GET presence of document 1 got %+v, want only alice", got)
+	}
+}
+
+func TestPresenceUsesTokenUser(t *testing.T) {
+	secret := []byte("test-secret")
+	appServer := NewAppServerWithOptions("testReplica", nil, Options{JWTSecret: secret})
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	header := http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}}
+	if _, resp, err := websocket.DefaultDialer.Dial(addr, header); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("upgrade without a token got %v, want status %d", err, http.StatusUnauthorized)
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "alice",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Set("Authorization", "Bearer "+token)
+	conn, _, err := websocket.DefaultDialer.Dial(addr, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the client claims to be someone else, the token wins
+	join := ClientPresence{UserID: "mallory", DisplayName: "Alice", Document: "1"}
+	if err := conn.WriteJSON(JoinMessage{Type: "join", ClientPresence: join}); err != nil {
+		t.Fatal(err)
+	}
+	want := join
+	want.UserID = "alice"
+	if got := readPresence(t, conn); !reflect.DeepEqual(got, []ClientPresence{want}) {
+		t.Errorf("got presences %+v, want %+v", got, []ClientPresence{want})
+	}
+}
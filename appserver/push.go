@@ -0,0 +1,131 @@
+package appserver
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/townsag/clarity/broker"
+	"github.com/townsag/clarity/crdt"
+)
+
+var ErrNotRegistered = errors.New("no broker registered the application server")
+
+// an operation pushed by the leader broker once it is committed, see broker.CommittedOperation
+type pushedOperation struct {
+	Shard    int `json:"shard,omitempty"`
+	LogIndex int `json:"log_index"`
+	Message
+}
+
+// ask every broker to push committed operations to callbackURL, which must
+// reach this application server's POST /commits. registering with every
+// broker keeps the pushes coming when the leader changes, only the leader pushes
+func (s *AppServer) RegisterForCommits(callbackURL string) error {
+	data, err := json.Marshal(broker.AppServerRegistration{CallbackURL: callbackURL})
+	if err != nil {
+		return err
+	}
+	// remember our own operations from now on, so their pushes aren't applied twice
+	s.mu.Lock()
+	s.ownOpIDs = make(map[string]struct{})
+	s.mu.Unlock()
+
+	registered := 0
+	for _, brokerAddr := range s.brokers {
+		req, err := s.newBrokerRequest(http.MethodPost, brokerAddr, "/appservers", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.httpClient.Do(req)
+		if err != nil {
+			s.logger.Warn("error registering with broker", "broker", brokerAddr, "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			s.logger.Warn("broker refused registration", "broker", brokerAddr, "status", resp.StatusCode)
+			continue
+		}
+		registered++
+	}
+	if registered == 0 {
+		return fmt.Errorf("%w of %d", ErrNotRegistered, len(s.brokers))
+	}
+	s.logger.Info("registered for committed operations", "brokers", registered, "callback_url", callbackURL)
+	return nil
+}
+
+// caller must hold s.mu
+func (s *AppServer) rememberOwnOpLocked(opID string) {
+	if s.ownOpIDs != nil {
+		s.ownOpIDs[opID] = struct{}{}
+	}
+}
+
+// committed operations pushed by the leader broker. operations this application
+// server sent were applied when its client made them, the rest are applied now
+func (s *AppServer) handleCommitPush(w http.ResponseWriter, r *http.Request) {
+	if token := s.options.BrokerAuthToken; token != "" {
+		scheme, got, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "Missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+	}
+	var ops []pushedOperation
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid committed operations: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	for _, op := range ops {
+		s.mu.Lock()
+		err := s.applyPushedLocked(op)
+		s.mu.Unlock()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid committed operation %d: %v", op.LogIndex, err), http.StatusBadRequest)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apply a pushed operation with the crdt operation it carries, like entries
+// replayed from the log. lastPushedIndex of its group only moves past
+// operations that were applied, so one that failed is applied when the broker
+// pushes it again
+// caller must hold s.mu
+func (s *AppServer) applyPushedLocked(op pushedOperation) error {
+	_, own := s.ownOpIDs[op.OpID]
+	delete(s.ownOpIDs, op.OpID)
+	// pushed again by a new leader
+	if last, ok := s.lastPushedIndex[op.Shard]; ok && op.LogIndex <= last {
+		return nil
+	}
+
+	docID := documentID(op.Message)
+	if !own && !s.closed[docID] {
+		doc := s.document(docID)
+		operation, err := applyCommitted(doc, op.Message)
+		// deleted already by an operation without a crdt operation to merge with
+		if errors.Is(err, crdt.ErrOutOfRange) && op.Type == broker.OpDelete {
+			s.logger.Info("skipping pushed delete of a deleted character", "document", docID, "index", op.Index)
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if !crdt.IsNoOp(operation) {
+			s.saveOperationLocked(docID, operation)
+			s.broadcastOperation(operation, doc.VersionClock())
+		}
+	}
+	s.lastPushedIndex[op.Shard] = op.LogIndex
+	return nil
+}
@@ -0,0 +1,227 @@
+package appserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/townsag/clarity/broker"
+	"github.com/townsag/clarity/crdt"
+)
+
+func TestCommittedOperationsArePushed(t *testing.T) {
+	h := broker.NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	brokerAddrs := make([]string, len(h.Cluster()))
+	for i, b := range h.Cluster() {
+		brokerAddrs[i] = b.GetHTTPAddr()
+	}
+	appServer := NewAppServer("testReplica", brokerAddrs)
+	if err := appServer.requestCRDTLogs(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+	if err := appServer.RegisterForCommits(server.URL + "/commits"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor := func(want []interface{}) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got := appServer.GetRepresentation("3")
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("document is %v, want %v", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// an operation another application server submitted reaches this one through the push
+	_, _, err := h.Cluster()[leaderId].SubmitOperation(broker.CRDTMessage{
+		Type: broker.OpInsert, Index: 0, Value: "a", ReplicaID: "other", OpIndex: 3, Source: "client",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor([]interface{}{"a"})
+
+	// an operation from this application server's own client is applied once
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	client, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	msg := Message{Type: broker.OpInsert, Index: 1, Value: "b", ReplicaID: "client", OpIndex: 3, Source: "client"}
+	if err := client.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	waitFor([]interface{}{"a", "b"})
+
+	// then another from elsewhere, after the push of our own was skipped
+	_, _, err = h.Cluster()[leaderId].SubmitOperation(broker.CRDTMessage{
+		Type: broker.OpInsert, Index: 2, Value: "c", ReplicaID: "other", OpIndex: 3, Source: "client",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor([]interface{}{"a", "b", "c"})
+	time.Sleep(100 * time.Millisecond)
+	if got := appServer.GetRepresentation("3"); !reflect.DeepEqual(got, []interface{}{"a", "b", "c"}) {
+		t.Errorf("document is %v after the pushes settled, want [a b c]", got)
+	}
+}
+
+// client op on one application server, committed by the leader and pushed to another
+func TestPushReachesOtherAppServer(t *testing.T) {
+	h := broker.NewHarness(t, 3)
+	defer h.Shutdown()
+	h.CheckSingleLeader()
+
+	brokerAddrs := make([]string, len(h.Cluster()))
+	for i, b := range h.Cluster() {
+		brokerAddrs[i] = b.GetHTTPAddr()
+	}
+	var appServers []*AppServer
+	var servers []*httptest.Server
+	for _, replicaID := range []string{"replicaA", "replicaB"} {
+		appServer := NewAppServer(replicaID, brokerAddrs)
+		if err := appServer.requestCRDTLogs(); err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewServer(appServer.Handler())
+		defer server.Close()
+		if err := appServer.RegisterForCommits(server.URL + "/commits"); err != nil {
+			t.Fatal(err)
+		}
+		appServers = append(appServers, appServer)
+		servers = append(servers, server)
+	}
+
+	addr := "ws" + strings.TrimPrefix(servers[0].URL, "http") + "/ws"
+	client, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// one at a time, the brokers may commit operations sent together in any order
+	var want []interface{}
+	for i, value := range []string{"h", "i"} {
+		msg := Message{Type: broker.OpInsert, Index: int64(i), Value: value, ReplicaID: "client", OpIndex: 4, Source: "client"}
+		if err := client.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, value)
+		deadline := time.Now().Add(5 * time.Second)
+		for !reflect.DeepEqual(appServers[1].GetRepresentation("4"), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("second application server has %v, want %v", appServers[1].GetRepresentation("4"), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if got := appServers[0].GetRepresentation("4"); !reflect.DeepEqual(got, want) {
+		t.Errorf("first application server has %v, want %v", got, want)
+	}
+}
+
+func TestOutOfRangePushIsRejected(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	body := `[{"log_index": 0, "type": "insert", "index": 4, "value": "a", "operation_index": 3}]`
+	resp, err := http.Post(server.URL+"/commits", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestRejectedPushIsAppliedWhenPushedAgain(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	push := func(body string) int {
+		resp, err := http.Post(server.URL+"/commits", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := push(`[{"log_index": 0, "type": "insert", "index": 4, "value": "a", "operation_index": 3}]`); status != http.StatusBadRequest {
+		t.Fatalf("got status %d for an insert out of range, want %d", status, http.StatusBadRequest)
+	}
+	// the same log index, corrected
+	if status := push(`[{"log_index": 0, "type": "insert", "index": 0, "value": "a", "operation_index": 3}]`); status != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", status, http.StatusNoContent)
+	}
+	if got, want := appServer.GetRepresentation("3"), []interface{}{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("document is %v, want %v", got, want)
+	}
+}
+
+func TestPushedOperationIsMergedWithLocalEdits(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	// another replica inserts after the "a" both have, while this one inserts
+	// before it. by index the pushed "b" would land in front of the "a"
+	remote := crdt.NewTextCRDT("other")
+	shared, err := remote.LocalInsert(0, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appServer.mu.Lock()
+	_, err = appServer.document("3").Apply(shared)
+	appServer.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := appServer.handleOperation(Message{Type: broker.OpInsert, Index: 0, Value: "x", OpIndex: 3, Source: "client"}); err != nil {
+		t.Fatal(err)
+	}
+	op, err := remote.LocalInsert(1, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pushed, err := json.Marshal([]pushedOperation{{LogIndex: 1, Message: Message{Type: broker.OpInsert, Index: 1, Value: "b", OpIndex: 3, Operation: data}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(server.URL+"/commits", "application/json", bytes.NewReader(pushed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	if got, want := appServer.GetRepresentation("3"), []interface{}{"x", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("document is %v, want %v", got, want)
+	}
+}
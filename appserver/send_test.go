@@ -0,0 +1,209 @@
+package appserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+)
+
+// a broker's POST /crdt answering status to the first failures attempts
+// and accepting the messages after that
+type flakyBroker struct {
+	mu       sync.Mutex
+	failures int
+	status   int
+	attempts int
+	opIDs    []string // of every attempt
+	accepted []string
+}
+
+func (b *flakyBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msg Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts++
+	b.opIDs = append(b.opIDs, msg.OpID)
+	if b.failures > 0 {
+		b.failures--
+		http.Error(w, "not now", b.status)
+		return
+	}
+	b.accepted = append(b.accepted, msg.OpID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(broker.CRDTReceipt{OpID: msg.OpID, Index: len(b.accepted) - 1})
+}
+
+func sendThrough(ctx context.Context, t *testing.T, b *flakyBroker) error {
+	t.Helper()
+	server := httptest.NewServer(b)
+	defer server.Close()
+	appServer := NewAppServer("testReplica", []string{strings.TrimPrefix(server.URL, "http://")})
+	msg := Message{Type: broker.OpInsert, Index: 0, Value: "a", ReplicaID: "testReplica", OpIndex: 1, Source: "client"}
+	select {
+	case err := <-appServer.sendHTTPMessage(ctx, msg, nil):
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending didn't finish")
+		return nil
+	}
+}
+
+func TestSendRetriesUntilDelivered(t *testing.T) {
+	b := &flakyBroker{failures: sendAttempts - 1, status: http.StatusServiceUnavailable}
+	if err := sendThrough(context.Background(), t, b); err != nil {
+		t.Fatalf("message wasn't delivered: %v", err)
+	}
+	if b.attempts != sendAttempts || len(b.accepted) != 1 {
+		t.Errorf("got %d attempts and %d accepted, want %d attempts and one accepted", b.attempts, len(b.accepted), sendAttempts)
+	}
+	// every attempt carries the same op id, so brokers don't submit it twice
+	for _, opID := range b.opIDs {
+		if opID == "" || opID != b.opIDs[0] {
+			t.Errorf("attempts were sent with op ids %v, want one op id", b.opIDs)
+			break
+		}
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	b := &flakyBroker{failures: sendAttempts, status: http.StatusServiceUnavailable}
+	if err := sendThrough(context.Background(), t, b); err == nil {
+		t.Error("sending to a broker that always fails returned no error")
+	}
+	if b.attempts != sendAttempts || len(b.accepted) != 0 {
+		t.Errorf("got %d attempts and %d accepted, want %d attempts", b.attempts, len(b.accepted), sendAttempts)
+	}
+
+	// a message the broker refuses isn't sent again
+	b = &flakyBroker{failures: 1, status: http.StatusBadRequest}
+	if err := sendThrough(context.Background(), t, b); !errors.Is(err, ErrRejectedByBroker) {
+		t.Errorf("got %v, want %v", err, ErrRejectedByBroker)
+	}
+	if b.attempts != 1 {
+		t.Errorf("rejected message was sent %d times", b.attempts)
+	}
+
+	// retries stop at the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), sendRetryBackoff/2)
+	defer cancel()
+	b = &flakyBroker{failures: sendAttempts, status: http.StatusServiceUnavailable}
+	if err := sendThrough(ctx, t, b); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if b.attempts != 1 {
+		t.Errorf("got %d attempts before the deadline, want 1", b.attempts)
+	}
+}
+
+func TestNewOpID(t *testing.T) {
+	opID, err := newOpID(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(opID) {
+		t.Errorf("op id %q isn't a version 4 uuid", opID)
+	}
+
+	// without randomness there is no op id, rather than a predictable one
+	failure := errors.New("no entropy")
+	if opID, err := newOpID(iotest.ErrReader(failure)); !errors.Is(err, failure) || opID != "" {
+		t.Errorf("got op id %q and %v, want %v", opID, err, failure)
+	}
+}
+
+// a broker answering GET /leader with whatever leader is set to, and taking
+// POST /crdt only while it is the leader itself
+type leaderBroker struct {
+	mu     sync.Mutex
+	addr   string
+	leader *leaderBroker // nil while no leader is known
+	posts  int
+}
+
+func (b *leaderBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.Method == http.MethodGet && r.URL.Path == "/leader" {
+		if b.leader == nil {
+			http.Error(w, "no leader known", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(broker.WhoIsLeaderReply{HTTPAddr: b.leader.addr, Self: b.leader == b})
+		return
+	}
+	b.posts++
+	if b.leader != b {
+		http.Error(w, "This server is not the leader", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(broker.CRDTReceipt{Index: b.posts - 1})
+}
+
+func (b *leaderBroker) follow(leader *leaderBroker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.leader = leader
+	b.posts = 0
+}
+
+func (b *leaderBroker) postCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.posts
+}
+
+func TestSendGoesToTheLeaderFromGetLeader(t *testing.T) {
+	follower, leader := new(leaderBroker), new(leaderBroker)
+	followerServer, leaderServer := httptest.NewServer(follower), httptest.NewServer(leader)
+	defer followerServer.Close()
+	follower.addr = strings.TrimPrefix(followerServer.URL, "http://")
+	leader.addr = strings.TrimPrefix(leaderServer.URL, "http://")
+	follower.follow(leader)
+	leader.follow(leader)
+
+	// the follower is listed first but never sees the message
+	appServer := NewAppServer("testReplica", []string{follower.addr, leader.addr})
+	send := func() {
+		t.Helper()
+		msg := Message{Type: broker.OpInsert, Index: 0, Value: "a", ReplicaID: "testReplica", OpIndex: 1, Source: "client"}
+		if err := <-appServer.sendHTTPMessage(context.Background(), msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send()
+	if follower.postCount() != 0 || leader.postCount() != 1 {
+		t.Errorf("follower got %d messages and the leader %d, want all on the leader", follower.postCount(), leader.postCount())
+	}
+
+	// the cached leader dies, the send falls back to the other brokers and
+	// the one that takes the message is cached instead
+	leaderServer.Close()
+	follower.follow(follower)
+	send()
+	send()
+	if follower.postCount() != 2 {
+		t.Errorf("new leader got %d messages, want 2", follower.postCount())
+	}
+	appServer.mu.Lock()
+	cached := appServer.leaderAddr
+	appServer.mu.Unlock()
+	if cached != follower.addr {
+		t.Errorf("cached leader is %q, want the new leader %q", cached, follower.addr)
+	}
+}
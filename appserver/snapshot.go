@@ -0,0 +1,63 @@
+package appserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/townsag/clarity/crdt"
+)
+
+var ErrUnknownDocument = errors.New("unknown document")
+var ErrNoSnapshot = errors.New("document type has no snapshot format")
+
+// first messages a websocket client gets, one per document, before any live operations
+type SnapshotMessage struct {
+	Type     string                `json:"type"` // always "snapshot"
+	Document string                `json:"document"`
+	Snapshot crdt.TextCRDTSnapshot `json:"snapshot"`
+}
+
+func NewSnapshotMessage(docID string, doc *crdt.TextCRDT) SnapshotMessage {
+	return SnapshotMessage{Type: "snapshot", Document: docID, Snapshot: doc.Snapshot()}
+}
+
+// full state of a document as json: every node including tombstones,
+// the version vector and the format spans
+func (s *AppServer) GetDocumentSnapshot(docID string) ([]byte, error) {
+	s.mu.Lock()
+	doc, ok := s.existingDocumentLocked(docID)
+	if !ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w %s", ErrUnknownDocument, docID)
+	}
+	text, ok := doc.(*crdt.TextCRDT)
+	if !ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrNoSnapshot, docID)
+	}
+	snapshot := text.Snapshot()
+	s.mu.Unlock()
+
+	return json.Marshal(snapshot)
+}
+
+func (s *AppServer) handleDocumentSnapshot(w http.ResponseWriter, r *http.Request) {
+	data, err := s.GetDocumentSnapshot(r.PathValue("id"))
+	if errors.Is(err, ErrUnknownDocument) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrNoSnapshot) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		s.logger.Error("error building snapshot", "err", err)
+		http.Error(w, "Error building snapshot", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
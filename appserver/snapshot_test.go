@@ -0,0 +1,118 @@
+package appserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/townsag/clarity/broker"
+	"github.com/townsag/clarity/crdt"
+)
+
+func TestLateClientGetsSnapshot(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	// 10 operations committed before the client shows up
+	for i, value := range "helloworld" {
+		appServer.handleOperation(Message{
+			Type: broker.OpInsert, Index: int64(i), Value: string(value),
+			ReplicaID: "other", OpIndex: 1, Source: "broker",
+		})
+	}
+	want := appServer.GetRepresentation("1")
+	if len(want) != 10 {
+		t.Fatalf("want 10 characters applied, got %v", want)
+	}
+
+	resp, err := http.Get(server.URL + "/document/1/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", got)
+	}
+	var snapshot crdt.TextCRDTSnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got := crdt.NewTextCRDTFromSnapshot(snapshot).Representation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot over http has %v, want %v", got, want)
+	}
+
+	if resp, err := http.Get(server.URL + "/document/2/snapshot"); err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("snapshot of unknown document got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	client, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var msg SnapshotMessage
+	if err := client.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "snapshot" || msg.Document != "1" {
+		t.Fatalf("first message is %q for document %q, want a snapshot of document 1", msg.Type, msg.Document)
+	}
+	if got := crdt.NewTextCRDTFromSnapshot(msg.Snapshot).Representation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot over websocket has %v, want %v", got, want)
+	}
+}
+
+func TestLateClientGetsEverySnapshotPastItsSendBuffer(t *testing.T) {
+	appServer := NewAppServerWithOptions("testReplica", nil, Options{ClientSendBuffer: 2})
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	const documents = 5
+	for i := range documents {
+		appServer.handleOperation(Message{Type: broker.OpInsert, Index: 0, Value: "a", OpIndex: int64(i), Source: "broker"})
+	}
+
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	client, _, err := websocket.DefaultDialer.Dial(addr, http.Header{"Sec-WebSocket-Protocol": {ProtocolV1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	got := make(map[string]bool)
+	for range documents {
+		var msg SnapshotMessage
+		if err := client.ReadJSON(&msg); err != nil {
+			t.Fatalf("after snapshots of %v: %v", got, err)
+		}
+		if msg.Type != "snapshot" {
+			t.Fatalf("got a %q message before every snapshot", msg.Type)
+		}
+		got[msg.Document] = true
+	}
+	if len(got) != documents {
+		t.Errorf("got snapshots of %v, want %d documents", got, documents)
+	}
+
+	// operations come after the snapshots
+	appServer.handleOperation(Message{Type: broker.OpInsert, Index: 1, Value: "b", OpIndex: 0, Source: "broker"})
+	var msg map[string]any
+	if err := client.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["type"] == "snapshot" {
+		t.Errorf("got another snapshot, want the operation")
+	}
+}
@@ -0,0 +1,47 @@
+package appserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/townsag/clarity/crdt"
+)
+
+var ErrNoStats = errors.New("document type has no text statistics")
+
+// what an editor's status bar shows about a document
+type DocumentStats struct {
+	Chars int `json:"chars"`
+	Words int `json:"words"`
+}
+
+func (s *AppServer) GetDocumentStats(docID string) (DocumentStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.existingDocumentLocked(docID)
+	if !ok {
+		return DocumentStats{}, fmt.Errorf("%w %s", ErrUnknownDocument, docID)
+	}
+	text, ok := doc.(*crdt.TextCRDT)
+	if !ok {
+		return DocumentStats{}, fmt.Errorf("%w: %s", ErrNoStats, docID)
+	}
+	return DocumentStats{Chars: text.CharacterCount(), Words: text.WordCount()}, nil
+}
+
+func (s *AppServer) handleDocumentStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.GetDocumentStats(r.PathValue("id"))
+	if errors.Is(err, ErrUnknownDocument) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrNoStats) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// the client went away, nothing to tell it
+	json.NewEncoder(w).Encode(stats)
+}
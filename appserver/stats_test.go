@@ -0,0 +1,45 @@
+package appserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/townsag/clarity/broker"
+)
+
+func TestDocumentStats(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewServer(appServer.Handler())
+	defer server.Close()
+
+	for i, value := range []rune("héllo, wörld 日本") {
+		appServer.handleOperation(Message{
+			Type: broker.OpInsert, Index: int64(i), Value: string(value),
+			ReplicaID: "other", OpIndex: 1, Source: "broker",
+		})
+	}
+
+	resp, err := http.Get(server.URL + "/document/1/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var stats DocumentStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if want := (DocumentStats{Chars: 15, Words: 3}); stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+
+	if resp, err := http.Get(server.URL + "/document/2/stats"); err != nil {
+		t.Fatal(err)
+	} else if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("stats of unknown document got status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
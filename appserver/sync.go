@@ -0,0 +1,293 @@
+package appserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+	"github.com/townsag/clarity/crdt"
+)
+
+// how long to wait before asking the brokers again when syncing failed
+const syncRetryInterval = 500 * time.Millisecond
+
+// rebuild the message a log entry was made from
+func messageFromLogEntry(entry broker.LogEntry) (Message, error) {
+	op, err := entry.Operation()
+	if err != nil {
+		return Message{}, err
+	}
+	if !op.Type.Valid() {
+		return Message{}, fmt.Errorf("%w %q", broker.ErrUnknownOpType, op.Type)
+	}
+	opIndex, err := strconv.ParseInt(entry.Document, 10, 64)
+	if err != nil {
+		return Message{}, fmt.Errorf("document of %+v: %w", op, err)
+	}
+	return Message{
+		Type:      op.Type,
+		Index:     op.Index,
+		Value:     op.Value,
+		ReplicaID: op.ReplicaID,
+		OpIndex:   opIndex,
+		Source:    "broker",
+		Operation: op.Operation,
+	}, nil
+}
+
+// json of an operation to send along with its message, nil for NoOp or when
+// the document's operations don't encode
+func (s *AppServer) encodeOperation(op crdt.Operation) json.RawMessage {
+	if crdt.IsNoOp(op) {
+		return nil
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		s.logger.Warn("error encoding operation", "err", err)
+		return nil
+	}
+	return data
+}
+
+// fetch the committed log from the brokers, known leader first, and apply it
+// to the documents the first time. after that the documents are kept up to
+// date by live operations and the log is only reported
+func (s *AppServer) requestCRDTLogs() error {
+	logs, err := s.fetchCommittedLogs()
+	if err != nil {
+		return err
+	}
+	return s.applyCommittedLogs(logs)
+}
+
+// the brokers trimmed their log and the documents are made with
+// Options.NewDocument, which can't be built from the brokers' text snapshot
+var ErrSnapshotUnsupported = errors.New("the committed log was trimmed and the document type has no snapshot")
+
+// the committed log of every replication group, all from the same broker, with
+// the brokers' documents when they trimmed entries off them
+func (s *AppServer) fetchCommittedLogs() ([]broker.CommittedLog, error) {
+	client := *s.httpClient
+	client.Timeout = time.Second * 10
+
+	for _, brokerAddr := range s.brokerOrder() {
+		log, ok, err := s.fetchCommittedLog(&client, brokerAddr, 0)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		// the first group's log says how many there are
+		logs := []broker.CommittedLog{log}
+		for shard := 1; ok && shard < log.Shards; shard++ {
+			var shardLog broker.CommittedLog
+			shardLog, ok, err = s.fetchCommittedLog(&client, brokerAddr, shard)
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, shardLog)
+		}
+		if ok {
+			return logs, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to get logs from any broker")
+}
+
+// the committed log of replication group shard on brokerAddr. false when the
+// broker didn't answer it and the next one should be asked
+func (s *AppServer) fetchCommittedLog(client *http.Client, brokerAddr string, shard int) (broker.CommittedLog, bool, error) {
+	path := "/committedlog?snapshot=true"
+	if shard > 0 {
+		path += "&shard=" + strconv.Itoa(shard)
+	}
+	req, err := s.newBrokerRequest(http.MethodGet, brokerAddr, path, nil)
+	if err != nil {
+		s.logger.Error("error creating request for broker", "broker", brokerAddr, "err", err)
+		return broker.CommittedLog{}, false, nil
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		s.logger.Warn("error requesting logs from broker", "broker", brokerAddr, "shard", shard, "err", err)
+		return broker.CommittedLog{}, false, nil
+	}
+
+	var log broker.CommittedLog
+	err = json.NewDecoder(resp.Body).Decode(&log)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.logger.Warn("broker refused its committed log", "broker", brokerAddr, "shard", shard, "status", resp.StatusCode)
+		return broker.CommittedLog{}, false, nil
+	}
+	if err != nil {
+		return broker.CommittedLog{}, false, fmt.Errorf("error decoding committed log from %s: %v", brokerAddr, err)
+	}
+	return log, true, nil
+}
+
+// a document built from the brokers' snapshot of it, with this server's replica id
+func (s *AppServer) documentFromSnapshot(snapshot crdt.TextCRDTSnapshot) (crdt.CRDT, error) {
+	if _, ok := s.newDocument().(*crdt.TextCRDT); !ok {
+		return nil, ErrSnapshotUnsupported
+	}
+	snapshot.ReplicaID = s.replicaID
+	return crdt.NewTextCRDTFromSnapshot(snapshot), nil
+}
+
+// install the brokers' documents, then apply the entries after them, for every
+// replication group. documents restored from Persistence already have the log
+// and are left alone. Persistence only keeps operations, so what a snapshot
+// installed isn't saved
+func (s *AppServer) applyCommittedLogs(logs []broker.CommittedLog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.synced {
+		s.logger.Debug("received committed entries, already synced", "shards", len(logs))
+		return nil
+	}
+	entries, documents := 0, 0
+	for _, log := range logs {
+		if err := s.applyCommittedLogLocked(log); err != nil {
+			return err
+		}
+		entries += len(log.Entries)
+		documents += len(log.Documents)
+	}
+	s.synced = true
+	s.logger.Info("synced committed entries from the brokers", "shards", len(logs), "entries", entries, "snapshot_documents", documents)
+	return nil
+}
+
+// a document is in one replication group only, so groups are applied one
+// after the other. caller must hold s.mu
+func (s *AppServer) applyCommittedLogLocked(log broker.CommittedLog) error {
+	// what the brokers trimmed off the log goes in first
+	for docID, snapshot := range log.Documents {
+		if s.closed[docID] {
+			continue
+		}
+		// loads what Persistence saved for it
+		s.document(docID)
+		if s.restored[docID] {
+			continue
+		}
+		doc, err := s.documentFromSnapshot(snapshot)
+		if err != nil {
+			return err
+		}
+		s.documents[docID] = doc
+	}
+	for j, entry := range log.Entries {
+		i := log.FirstIndex + j
+		msg, err := messageFromLogEntry(entry)
+		if err != nil {
+			s.logger.Warn("skipping log entry", "shard", log.Shard, "index", i, "err", err)
+			continue
+		}
+		docID := documentID(msg)
+		if s.closed[docID] {
+			continue
+		}
+		doc := s.document(docID)
+		// already has these operations, from before the restart
+		if s.restored[docID] {
+			continue
+		}
+		if op := s.replayLogEntry(doc, msg, i); !crdt.IsNoOp(op) {
+			s.saveOperationLocked(docID, op)
+		}
+	}
+	return nil
+}
+
+// apply the operation of log entry i to doc. entries with the crdt operation
+// their server made are applied with Apply, so replaying one twice or after
+// local edits changes nothing or merges. older entries, and operations
+// crdt.UnmarshalOperation can't read, fall back to their index
+// returns NoOp when the entry was skipped
+func (s *AppServer) replayLogEntry(doc crdt.CRDT, msg Message, i int) crdt.Operation {
+	op, err := applyCommitted(doc, msg)
+	if err != nil {
+		s.logger.Warn("skipping log entry", "index", i, "err", err)
+	}
+	return op
+}
+
+// the part of replayLogEntry shared with pushed operations, which need the error
+func applyCommitted(doc crdt.CRDT, msg Message) (crdt.Operation, error) {
+	if len(msg.Operation) > 0 {
+		if op, err := crdt.UnmarshalOperation(msg.Operation); err == nil {
+			applied, err := doc.Apply(op)
+			if errors.Is(err, crdt.ErrAlreadyDeleted) {
+				err = nil
+			}
+			if !applied {
+				return crdt.NoOp, err
+			}
+			return op, err
+		}
+	}
+	switch msg.Type {
+	case broker.OpInsert:
+		return doc.LocalInsert(msg.Index, msg.Value)
+	case broker.OpDelete:
+		return doc.LocalDelete(msg.Index)
+	}
+	return crdt.NoOp, nil
+}
+
+// like GetRepresentation but built from the brokers' committed log instead of
+// the local document, so it includes every edit the brokers committed so far,
+// and none that are still in flight. slower, it fetches the whole log of
+// every replication group
+func (s *AppServer) GetCommittedRepresentation(docID string) ([]interface{}, error) {
+	logs, err := s.fetchCommittedLogs()
+	if err != nil {
+		return nil, err
+	}
+	doc := s.newDocument()
+	// the document is only in the log of its own group
+	for _, log := range logs {
+		if snapshot, ok := log.Documents[docID]; ok {
+			if doc, err = s.documentFromSnapshot(snapshot); err != nil {
+				return nil, err
+			}
+		}
+		for j, entry := range log.Entries {
+			i := log.FirstIndex + j
+			if entry.Document != docID {
+				continue
+			}
+			msg, err := messageFromLogEntry(entry)
+			if err != nil {
+				s.logger.Warn("skipping log entry", "shard", log.Shard, "index", i, "err", err)
+				continue
+			}
+			s.replayLogEntry(doc, msg, i)
+		}
+	}
+	return doc.Representation(), nil
+}
+
+// true once the documents include everything the brokers had committed at startup
+func (s *AppServer) Synced() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.synced
+}
+
+// keep asking the brokers for their committed log until one answers
+func (s *AppServer) syncWithBrokers() {
+	for !s.Synced() {
+		if err := s.requestCRDTLogs(); err != nil {
+			s.logger.Warn("error syncing with the brokers", "err", err)
+			time.Sleep(syncRetryInterval)
+		}
+	}
+}
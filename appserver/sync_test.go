@@ -0,0 +1,345 @@
+package appserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+	"github.com/townsag/clarity/crdt"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRestartedAppServerSyncsFromCommittedLog(t *testing.T) {
+	h := broker.NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	brokerAddrs := make([]string, len(h.Cluster()))
+	for i, b := range h.Cluster() {
+		brokerAddrs[i] = b.GetHTTPAddr()
+	}
+
+	// edits made through an application server that then goes away
+	before := NewAppServer("before", brokerAddrs)
+	before.synced = true
+	edits := []Message{
+		{Type: broker.OpInsert, Index: 0, Value: "h"},
+		{Type: broker.OpInsert, Index: 1, Value: "i"},
+		{Type: broker.OpDelete, Index: 0},
+		{Type: broker.OpInsert, Index: 1, Value: "!"},
+	}
+	for _, msg := range edits {
+		msg.ReplicaID, msg.OpIndex, msg.Source = "client1", 5, "client"
+		before.handleOperation(msg)
+		before.sendHTTPMessage(context.Background(), msg, nil)
+		// keep the edits in order
+		time.Sleep(50 * time.Millisecond)
+	}
+	want := before.GetRepresentation("5")
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_, commits, _, _ := h.GetLogsAndCommitIndexFromServer(leaderId)
+		if len(commits) == len(edits) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leader committed %d entries, want %d", len(commits), len(edits))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	after := NewAppServer("after", brokerAddrs)
+	server := httptest.NewServer(after.Handler())
+	defer server.Close()
+	addr := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	header := http.Header{"Sec-WebSocket-Protocol": {ProtocolV2}}
+
+	// clients are turned away until the documents are rebuilt
+	if _, resp, err := websocket.DefaultDialer.Dial(addr, header); err == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("dial before sync got %v, want status %d", err, http.StatusServiceUnavailable)
+	}
+
+	if err := after.requestCRDTLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := after.GetRepresentation("5"); !reflect.DeepEqual(got, want) {
+		t.Errorf("synced document is %v, want %v", got, want)
+	}
+
+	client, _, err := websocket.DefaultDialer.Dial(addr, header)
+	if err != nil {
+		t.Fatalf("dial after sync: %v", err)
+	}
+	defer client.Close()
+	var snapshot SnapshotMessage
+	if err := client.ReadJSON(&snapshot); err != nil || snapshot.Document != "5" {
+		t.Errorf("got snapshot of %q (%v), want document 5", snapshot.Document, err)
+	}
+
+	// a second sync doesn't apply the log again
+	if err := after.requestCRDTLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := after.GetRepresentation("5"); !reflect.DeepEqual(got, want) {
+		t.Errorf("document is %v after syncing twice, want %v", got, want)
+	}
+}
+
+func TestGetCommittedRepresentation(t *testing.T) {
+	h := broker.NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	brokerAddrs := make([]string, len(h.Cluster()))
+	for i, b := range h.Cluster() {
+		brokerAddrs[i] = b.GetHTTPAddr()
+	}
+	appServer := NewAppServer("testReplica", brokerAddrs)
+	if err := appServer.requestCRDTLogs(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an edit the application server never sees, made through the leader
+	body := `{"type":"insert","index":0,"value":"x","replica_id":"elsewhere","operation_index":9}`
+	resp, err := http.Post("http://"+h.Cluster()[leaderId].GetHTTPAddr()+"/crdt", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_, commits, _, _ := h.GetLogsAndCommitIndexFromServer(leaderId)
+		if len(commits) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the edit wasn't committed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if got := appServer.GetRepresentation("9"); got != nil {
+		t.Errorf("local representation is %v, want nothing", got)
+	}
+	got, err := appServer.GetCommittedRepresentation("9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{"x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("committed representation is %v, want %v", got, want)
+	}
+}
+
+// log entries for edits made on a document of replica "before", each carrying
+// the crdt operation it made
+func logEntriesFromEdits(t *testing.T, edits []Message) ([]broker.LogEntry, []interface{}) {
+	t.Helper()
+	doc := crdt.NewTextCRDT("before")
+	var entries []broker.LogEntry
+	for _, msg := range edits {
+		var op crdt.Operation
+		var err error
+		if msg.Type == broker.OpInsert {
+			op, err = doc.LocalInsert(msg.Index, msg.Value)
+		} else {
+			op, err = doc.LocalDelete(msg.Index)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, broker.LogEntry{
+			CRDTOperation: broker.CRDTMessage{Type: msg.Type, Index: msg.Index, Value: msg.Value, ReplicaID: "client1", OpIndex: 5, Operation: data},
+			Term:          1,
+			Document:      "5",
+		})
+	}
+	return entries, doc.Representation()
+}
+
+func replayLog(t *testing.T, s *AppServer, doc crdt.CRDT, entries []broker.LogEntry) {
+	t.Helper()
+	for i, entry := range entries {
+		msg, err := messageFromLogEntry(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.replayLogEntry(doc, msg, i)
+	}
+}
+
+func TestReplayingLogTwiceChangesNothing(t *testing.T) {
+	entries, want := logEntriesFromEdits(t, []Message{
+		{Type: broker.OpInsert, Index: 0, Value: "h"},
+		{Type: broker.OpInsert, Index: 1, Value: "i"},
+		{Type: broker.OpDelete, Index: 0},
+		{Type: broker.OpInsert, Index: 1, Value: "!"},
+	})
+	appServer := NewAppServer("after", nil)
+	doc := crdt.NewTextCRDT("after")
+	replayLog(t, appServer, doc, entries)
+	if got := doc.Representation(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed document is %v, want %v", got, want)
+	}
+
+	replayLog(t, appServer, doc, entries)
+	if got := doc.Representation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("document is %v after replaying the log twice, want %v", got, want)
+	}
+}
+
+func TestReplayAfterConcurrentLocalEdit(t *testing.T) {
+	entries, _ := logEntriesFromEdits(t, []Message{
+		{Type: broker.OpInsert, Index: 0, Value: "a"},
+		{Type: broker.OpInsert, Index: 1, Value: "b"},
+	})
+	appServer := NewAppServer("after", nil)
+
+	// an edit made here before the log arrived
+	doc := crdt.NewTextCRDT("after")
+	local, err := doc.LocalInsert(0, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayLog(t, appServer, doc, entries)
+
+	// the replica that wrote the log gets the local edit the other way around
+	other := crdt.NewTextCRDT("before")
+	replayLog(t, appServer, other, entries)
+	if _, err := other.Apply(local); err != nil {
+		t.Fatal(err)
+	}
+
+	got, want := doc.Representation(), other.Representation()
+	if len(got) != 3 || !reflect.DeepEqual(got, want) {
+		t.Errorf("replicas diverged: %v here, %v on the other replica", got, want)
+	}
+}
+
+func TestSyncAfterBrokersTrimmedLog(t *testing.T) {
+	options := make([]broker.BrokerOptions, 3)
+	for i := range options {
+		options[i].AdminToken = "admin"
+	}
+	h := broker.NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leaderAddr := h.Cluster()[leaderId].GetHTTPAddr()
+
+	before := NewAppServer("before", []string{leaderAddr})
+	before.synced = true
+	edit := func(msg Message) {
+		t.Helper()
+		msg.ReplicaID, msg.OpIndex, msg.Source = "client1", 5, "client"
+		op, err := before.handleOperation(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Operation = before.encodeOperation(op)
+		if err := <-before.sendHTTPMessage(context.Background(), msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edit(Message{Type: broker.OpInsert, Index: 0, Value: "h"})
+	edit(Message{Type: broker.OpInsert, Index: 1, Value: "i"})
+	h.WaitForCommit(1)
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+leaderAddr+"/admin/snapshot", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("snapshot request answered %d", resp.StatusCode)
+	}
+
+	// after the trim, so it is only in the log
+	edit(Message{Type: broker.OpInsert, Index: 2, Value: "!"})
+	h.WaitForCommit(2)
+	want := before.GetRepresentation("5")
+
+	after := NewAppServer("after", []string{leaderAddr})
+	if err := after.requestCRDTLogs(); err != nil {
+		t.Fatal(err)
+	}
+	if got := after.GetRepresentation("5"); !reflect.DeepEqual(got, want) {
+		t.Errorf("synced document is %v, want %v", got, want)
+	}
+	got, err := after.GetCommittedRepresentation("5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("committed representation is %v, want %v", got, want)
+	}
+}
+
+func TestSyncFromShardedBrokers(t *testing.T) {
+	options := make([]broker.BrokerOptions, 3)
+	for i := range options {
+		options[i].Shards = 2
+	}
+	h := broker.NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.Cluster()[leaderId]
+
+	// a document in each replication group
+	var opIndexes []int
+	for i := 0; len(opIndexes) < 2 && i < 100; i++ {
+		if leader.Router().Shard(fmt.Sprint(i)) == len(opIndexes) {
+			opIndexes = append(opIndexes, i)
+		}
+	}
+	if len(opIndexes) < 2 {
+		t.Fatal("no document hashed to the second shard")
+	}
+	for shard, opIndex := range opIndexes {
+		body := fmt.Sprintf(`{"type":"insert","index":0,"value":"%d","replica_id":"elsewhere","operation_index":%d}`, shard, opIndex)
+		resp, err := http.Post("http://"+leader.GetHTTPAddr()+"/crdt", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// each group counts from 0
+		if err := leader.WaitForCommit(shard, 0, 3*time.Second); err != nil {
+			t.Fatalf("shard %d: %v", shard, err)
+		}
+	}
+
+	appServer := NewAppServer("after", []string{leader.GetHTTPAddr()})
+	if err := appServer.requestCRDTLogs(); err != nil {
+		t.Fatal(err)
+	}
+	for shard, opIndex := range opIndexes {
+		want := []interface{}{fmt.Sprint(shard)}
+		if got := appServer.GetRepresentation(fmt.Sprint(opIndex)); !reflect.DeepEqual(got, want) {
+			t.Errorf("synced document of shard %d is %v, want %v", shard, got, want)
+		}
+		got, err := appServer.GetCommittedRepresentation(fmt.Sprint(opIndex))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("committed representation of shard %d is %v, want %v", shard, got, want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package appserver
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/townsag/clarity/broker"
+)
+
+// send an operation from the brokers and read it back from the broadcast
+func exchangeOverWebSocket(t *testing.T, dialer websocket.Dialer, url string) {
+	t.Helper()
+	dialer.Subprotocols = []string{ProtocolV2}
+	client, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, ok := client.UnderlyingConn().(*tls.Conn); !ok {
+		t.Errorf("websocket runs over %T, want *tls.Conn", client.UnderlyingConn())
+	}
+
+	msg := Message{Type: broker.OpInsert, Index: 0, Value: "a", ReplicaID: "other", OpIndex: 1, Source: "broker"}
+	if err := client.WriteJSON(msg); err != nil {
+		t.Fatal(err)
+	}
+	var op struct {
+		VectorClock map[string]int64 `json:"vector_clock"`
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := client.ReadJSON(&op); err != nil {
+		t.Fatal(err)
+	}
+	if op.VectorClock["testReplica"] != 1 {
+		t.Errorf("got vector clock %v, want testReplica at 1", op.VectorClock)
+	}
+}
+
+func TestWebSocketOverTLS(t *testing.T) {
+	appServer := NewAppServer("testReplica", nil)
+	server := httptest.NewTLSServer(appServer.Handler())
+	defer server.Close()
+
+	dialer := websocket.Dialer{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+	exchangeOverWebSocket(t, dialer, "wss"+strings.TrimPrefix(server.URL, "https")+"/ws")
+
+	// ServeWithTLSConfig serves the same, with the test server's certificate
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	go NewAppServer("testReplica", nil).ServeWithTLSConfig(addr, server.TLS)
+	for start := time.Now(); ; {
+		conn, err := tls.Dial("tcp", addr, dialer.TLSClientConfig)
+		if err == nil {
+			if proto := conn.ConnectionState().NegotiatedProtocol; proto == "h2" {
+				t.Errorf("negotiated %s, websocket upgrades need http/1.1", proto)
+			}
+			conn.Close()
+			break
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("ServeWithTLSConfig never started: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	exchangeOverWebSocket(t, dialer, "wss://"+addr+"/ws")
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type userIDKey struct{}
+
+// reject requests without "Authorization: Bearer <jwt>" signed with secret
+// using HS256 with 401, as well as expired tokens and tokens without a sub.
+// the sub claim is put in the request context, see UserID
+func JWTAuthMiddleware(secret []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			if !strings.EqualFold(scheme, "Bearer") || token == "" {
+				unauthorized(w, "Missing bearer token")
+				return
+			}
+			userID, err := validate(token, secret)
+			if err != nil {
+				unauthorized(w, "Invalid token: "+err.Error())
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithUserID(r.Context(), userID)))
+		})
+	}
+}
+
+// the sub claim of a valid token
+func validate(token string, secret []byte) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", jwt.ErrTokenInvalidSubject
+	}
+	return claims.Subject, nil
+}
+
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="clarity"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// the user the request was authenticated as, false when it went through no
+// JWTAuthMiddleware
+func UserID(ctx context.Context) (string, bool) {
+	userID, ok := ctx.Value(userIDKey{}).(string)
+	return userID, ok
+}
+
+// ctx carrying userID, like JWTAuthMiddleware sets it
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
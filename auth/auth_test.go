@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var secret = []byte("test-secret")
+
+func sign(t *testing.T, claims jwt.RegisteredClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTAuthMiddleware(t *testing.T) {
+	var gotUserID string
+	handler := JWTAuthMiddleware(secret)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUserID, _ = UserID(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	valid := sign(t, jwt.RegisteredClaims{Subject: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	expired := sign(t, jwt.RegisteredClaims{Subject: "alice", ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))})
+	// the payload swapped for another user's, keeping alice's signature
+	other := sign(t, jwt.RegisteredClaims{Subject: "mallory", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	tampered := swapPayload(valid, other)
+	noSubject := sign(t, jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	otherSecret, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "alice"}).SignedString([]byte("other"))
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+	}{
+		{"valid", "Bearer " + valid, http.StatusNoContent},
+		{"expired", "Bearer " + expired, http.StatusUnauthorized},
+		{"tampered", "Bearer " + tampered, http.StatusUnauthorized},
+		{"no subject", "Bearer " + noSubject, http.StatusUnauthorized},
+		{"other secret", "Bearer " + otherSecret, http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+		{"not bearer", "Basic " + valid, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotUserID = ""
+			req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusNoContent && gotUserID != "alice" {
+				t.Errorf("handler got user %q, want alice", gotUserID)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
+
+// token with the header and signature of signed and the payload of from
+func swapPayload(signed, from string) string {
+	s := strings.Split(signed, ".")
+	f := strings.Split(from, ".")
+	return strings.Join([]string{s[0], f[1], s[2]}, ".")
+}
@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+)
+
+// gob encode the entries and gzip them if the encoding is larger than threshold
+// the follower undoes this with decompress before touching args.Entries
+func (args *AppendEntriesArgs) compress(threshold int) error {
+	if len(args.Entries) == 0 {
+		return nil
+	}
+
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(args.Entries); err != nil {
+		return err
+	}
+	if encoded.Len() <= threshold {
+		return nil
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(encoded.Bytes()); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	args.Compressed = true
+	args.CompressedEntries = compressed.Bytes()
+	args.Entries = nil
+	return nil
+}
+
+func (args *AppendEntriesArgs) decompress() error {
+	zr, err := gzip.NewReader(bytes.NewReader(args.CompressedEntries))
+	if err != nil {
+		return fmt.Errorf("decompress AE entries: %w", err)
+	}
+	defer zr.Close()
+
+	var entries []LogEntry
+	if err := gob.NewDecoder(zr).Decode(&entries); err != nil {
+		return fmt.Errorf("decode AE entries: %w", err)
+	}
+
+	args.Entries = entries
+	args.Compressed = false
+	args.CompressedEntries = nil
+	return nil
+}
@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCompressedAEMatchesUncompressed(t *testing.T) {
+
+	values := []string{"a", "b", "c", "d", "e"}
+
+	// operations of the replicated log for each threshold
+	var replicated [][]LogEntry
+
+	// 0 never compresses, 1 compresses every AE that carries entries
+	for _, threshold := range []int{0, 1} {
+		options := make([]BrokerOptions, 3)
+		for i := range options {
+			options[i].AECompressionThreshold = threshold
+		}
+		h := NewHarnessWithOptions(t, 3, options)
+
+		origLeaderId, _ := h.CheckSingleLeader()
+		for i, v := range values {
+			op := fmt.Sprintf("Type[insert] Index[%d] Value[%s]", i, v)
+			if h.SubmitToServer(origLeaderId, "doc1", op) < 0 {
+				t.Fatalf("want id=%d leader, but it's not", origLeaderId)
+			}
+			h.WaitForCommit(i)
+		}
+
+		leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+		for serverId := 0; serverId < h.n; serverId++ {
+			followerLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(serverId)
+			if !reflect.DeepEqual(followerLog, leaderLog) {
+				t.Errorf("threshold %d: server %d log %+v, want %+v", threshold, serverId, followerLog, leaderLog)
+			}
+		}
+
+		entries := make([]LogEntry, len(leaderLog))
+		for i, entry := range leaderLog {
+			// terms depend on how the election went, only compare the operations
+			entries[i] = LogEntry{CRDTOperation: entry.CRDTOperation, Document: entry.Document}
+		}
+		replicated = append(replicated, entries)
+
+		h.Shutdown()
+	}
+
+	if !reflect.DeepEqual(replicated[0], replicated[1]) {
+		t.Errorf("compressed log %+v differs from uncompressed log %+v", replicated[1], replicated[0])
+	}
+}
+
+// go test -bench AEPayload -run ^$
+func BenchmarkAEPayloadSize(b *testing.B) {
+	entries := make([]LogEntry, 10000)
+	for i := range entries {
+		op := fmt.Sprintf("Type[insert] Index[%d] Value[%c]", i, 'a'+i%26)
+		entries[i] = LogEntry{CRDTOperation: op, Term: 1, Document: "doc1"}
+	}
+
+	for _, compressed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compressed=%t", compressed), func(b *testing.B) {
+			var wireBytes int
+			for i := 0; i < b.N; i++ {
+				args := AppendEntriesArgs{Term: 1, PrevLogIndex: -1, PrevLogTerm: -1, Entries: entries}
+				if compressed {
+					if err := args.compress(0); err != nil {
+						b.Fatal(err)
+					}
+				}
+				// what net/rpc would put on the wire
+				var wire bytes.Buffer
+				if err := gob.NewEncoder(&wire).Encode(args); err != nil {
+					b.Fatal(err)
+				}
+				wireBytes = wire.Len()
+			}
+			b.ReportMetric(float64(wireBytes), "wire-bytes")
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// header TokenAuthorizer reads document tokens from, forwarded to the leader
+const documentTokenHeader = "X-Document-Token"
+
+// decides which CRDT messages may be written on /crdt and /crdt/batch.
+// document is the one the message edits, its OpIndex, and r the request it
+// came in, for credentials in headers
+type Authorizer interface {
+	Authorize(r *http.Request, replicaID string, document string) bool
+}
+
+// lets every message through, what brokers do without BrokerOptions.Authorizer
+type AllowAllAuthorizer struct{}
+
+func (AllowAllAuthorizer) Authorize(*http.Request, string, string) bool {
+	return true
+}
+
+// lets a message through when its request has one of the document's tokens
+// in the X-Document-Token header. documents without tokens can't be written
+type TokenAuthorizer struct {
+	// tokens of each document
+	Tokens map[string][]string
+}
+
+func (a TokenAuthorizer) Authorize(r *http.Request, replicaID string, document string) bool {
+	got := []byte(r.Header.Get(documentTokenHeader))
+	if len(got) == 0 {
+		return false
+	}
+	for _, token := range a.Tokens[document] {
+		if subtle.ConstantTimeCompare(got, []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (broker *BrokerServer) authorizer() Authorizer {
+	if broker.options.Authorizer != nil {
+		return broker.options.Authorizer
+	}
+	return AllowAllAuthorizer{}
+}
+
+// answer 403 to a message the authorizer denies, false when it may be written
+func (broker *BrokerServer) refuseUnauthorizedWrite(w http.ResponseWriter, r *http.Request, msg CRDTMessage) bool {
+	document := msg.logEntry().Document
+	if broker.authorizer().Authorize(r, msg.ReplicaID, document) {
+		return false
+	}
+	broker.logger.Info("refuses unauthorized CRDT message", "replica_id", msg.ReplicaID, "document", document)
+	http.Error(w, "Not allowed to edit document "+document, http.StatusForbidden)
+	return true
+}
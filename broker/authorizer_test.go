@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestTokenAuthorizer(t *testing.T) {
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].Authorizer = TokenAuthorizer{Tokens: map[string][]string{"7": {"s3cret"}}}
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	post := func(id int, path string, body any, token string) int {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", h.cluster[id].GetHTTPAddr(), path), bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set(documentTokenHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	msg := func(document int64) CRDTMessage {
+		return CRDTMessage{Type: OpInsert, Index: 0, Value: "a", ReplicaID: "r1", OpIndex: document, Source: "client"}
+	}
+
+	tests := []struct {
+		name       string
+		id         int
+		path       string
+		body       any
+		token      string
+		wantStatus int
+	}{
+		{"authorized", leaderId, "/crdt", msg(7), "s3cret", http.StatusAccepted},
+		{"authorized through a follower", (leaderId + 1) % 3, "/crdt", msg(7), "s3cret", http.StatusAccepted},
+		{"wrong token", leaderId, "/crdt", msg(7), "guess", http.StatusForbidden},
+		{"no token", leaderId, "/crdt", msg(7), "", http.StatusForbidden},
+		{"document without tokens", leaderId, "/crdt", msg(8), "s3cret", http.StatusForbidden},
+		{"authorized batch", leaderId, "/crdt/batch", []CRDTMessage{msg(7), msg(7)}, "s3cret", http.StatusAccepted},
+		{"batch with another document", leaderId, "/crdt/batch", []CRDTMessage{msg(7), msg(8)}, "s3cret", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status := post(tt.id, tt.path, tt.body, tt.token); status != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, tt.wantStatus)
+		}
+	}
+}
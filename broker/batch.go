@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// most messages accepted in one POST /crdt/batch
+const maxBatchSize = 1000
+
+// what the leader replies to POST /crdt/batch. the submitted messages got the
+// indexes FirstIndex to LastIndex, in the order they were sent, in the log of
+// the shard all of their documents are in
+// messages whose op id was already accepted are left out of the range and of Receipts
+type CRDTBatchReceipt struct {
+	FirstIndex int `json:"first_index"`
+	LastIndex  int `json:"last_index"`
+	Term       int `json:"term"`
+	BrokerID   int `json:"broker_id"`
+
+	Receipts   []CRDTReceipt `json:"receipts"`
+	Duplicates []string      `json:"duplicates,omitempty"` // op ids that were already accepted
+}
+
+// http func to receive a json array of crdt messages
+// every message is validated before any is submitted, so a bad batch changes nothing
+func (broker *BrokerServer) handleCRDTBatch(w http.ResponseWriter, r *http.Request) {
+	if broker.currentView().state != Leader {
+		broker.forwardCRDTToLeader(w, r)
+		return
+	}
+	if broker.refuseWriteIfReadOnly(w) {
+		return
+	}
+
+	msgs, err := decodeCRDTBatch(r.Body)
+	if bodyTooLarge(w, err) {
+		return
+	}
+	var decodeErr *batchDecodeError
+	if errors.As(err, &decodeErr) {
+		if verr := validationErrorFromDecode(decodeErr.err); verr != nil {
+			verr.Position = &decodeErr.position
+			writeValidationError(w, verr)
+			return
+		}
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid CRDT batch payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(msgs) == 0 {
+		http.Error(w, "Empty CRDT batch", http.StatusBadRequest)
+		return
+	}
+	if len(msgs) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("CRDT batch has %d messages, at most %d are allowed", len(msgs), maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	for i, msg := range msgs {
+		if verr := validateCRDTMessage(msg); verr != nil {
+			verr.Position = &i
+			broker.logger.Info("rejects CRDT batch", "err", verr)
+			writeValidationError(w, verr)
+			return
+		}
+	}
+	// the indexes of a batch are one range in one log
+	shard := broker.router.Shard(msgs[0].logEntry().Document)
+	for i, msg := range msgs {
+		if other := msg.logEntry().Document; broker.router.Shard(other) != shard {
+			http.Error(w, fmt.Sprintf("CRDT batch spans shards, document %q of message %d is in shard %d, not %d", other, i, broker.router.Shard(other), shard), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// one message the authorizer denies refuses the whole batch
+	for _, msg := range msgs {
+		if broker.refuseUnauthorizedWrite(w, r, msg) {
+			return
+		}
+	}
+
+	// a batch costs one token, like a single message
+	if source := rateLimitSource(msgs[0], r); !broker.limiter.allow(source) {
+		broker.logger.Warn("rate limits CRDT batch", "source", source)
+		http.Error(w, "Too many CRDT operations", http.StatusTooManyRequests)
+		return
+	}
+
+	var duplicates, reserved []string
+	var submitted []CRDTMessage
+	var entries []LogEntry
+	for _, msg := range msgs {
+		if msg.OpID != "" && !broker.seenOpIDs.AddIfAbsent(msg.OpID, nil) {
+			duplicates = append(duplicates, msg.OpID)
+			continue
+		}
+		if msg.OpID != "" {
+			reserved = append(reserved, msg.OpID)
+		}
+		submitted = append(submitted, msg)
+		entries = append(entries, msg.logEntry())
+	}
+
+	receipt := CRDTBatchReceipt{FirstIndex: -1, LastIndex: -1, BrokerID: broker.brokerid, Duplicates: duplicates}
+	if len(entries) == 0 {
+		broker.logger.Info("ignores CRDT batch of duplicates", "duplicates", len(duplicates))
+		// like a single retry, done only once every first attempt committed
+		status := http.StatusOK
+		for _, opID := range duplicates {
+			if broker.committedReceipt(opID) == nil {
+				status = http.StatusAccepted
+			}
+		}
+		writeBatchReceipt(w, status, receipt)
+		return
+	}
+
+	firstIndex, term, err := broker.router.Shards()[shard].submitBatchContext(r.Context(), entries)
+	if err != nil {
+		for _, opID := range reserved {
+			broker.seenOpIDs.Remove(opID)
+		}
+		broker.logger.Error("refuses CRDT batch", "err", err)
+		http.Error(w, fmt.Sprintf("Invalid CRDT operation: %v", err), http.StatusBadRequest)
+		return
+	}
+	if firstIndex < 0 {
+		// lost leadership since the check above, the retry must not look like a duplicate
+		for _, opID := range reserved {
+			broker.seenOpIDs.Remove(opID)
+		}
+		http.Error(w, "This server is no longer the leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	broker.logger.Debug("submits batch", "entries", len(entries), "first_index", firstIndex, "last_index", firstIndex+len(entries)-1)
+
+	receipt.FirstIndex = firstIndex
+	receipt.LastIndex = firstIndex + len(entries) - 1
+	receipt.Term = term
+	receipt.Receipts = make([]CRDTReceipt, len(submitted))
+	// the last entry committing commits the ones before it
+	committed := broker.committedInTime(r.Context(), broker.router.Shards()[shard], receipt.LastIndex, term)
+	for i, msg := range submitted {
+		receipt.Receipts[i] = CRDTReceipt{
+			Index:     firstIndex + i,
+			Term:      term,
+			Shard:     shard,
+			Document:  entries[i].Document,
+			BrokerID:  broker.brokerid,
+			ReplicaID: msg.ReplicaID,
+			OpIndex:   msg.OpIndex,
+			OpID:      msg.OpID,
+			Committed: committed,
+		}
+		if msg.OpID != "" {
+			broker.seenOpIDs.Update(msg.OpID, &receipt.Receipts[i])
+		}
+	}
+	writeBatchReceipt(w, http.StatusAccepted, receipt)
+}
+
+func writeBatchReceipt(w http.ResponseWriter, status int, receipt CRDTBatchReceipt) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// the client went away, nothing to tell it
+	json.NewEncoder(w).Encode(receipt)
+}
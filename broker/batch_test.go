@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postBatch(t testing.TB, url string, body []byte) (int, CRDTBatchReceipt) {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var receipt CRDTBatchReceipt
+	json.NewDecoder(resp.Body).Decode(&receipt)
+	return resp.StatusCode, receipt
+}
+
+func TestCRDTBatch(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, term := h.CheckSingleLeader()
+	followerId := (origLeaderId + 1) % h.n
+	// let a heartbeat tell the follower who the leader is
+	sleepMs(100)
+
+	leaderLogLength := func() int {
+		leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+		return len(leaderLog)
+	}
+
+	var batch []CRDTMessage
+	for i, value := range "abc" {
+		batch = append(batch, CRDTMessage{Type: "insert", Index: int64(i), Value: string(value), ReplicaID: "r1", OpIndex: 2, OpID: fmt.Sprintf("op-%d", i)})
+	}
+	body, _ := json.Marshal(batch)
+
+	// through a follower, which forwards the whole batch
+	status, receipt := postBatch(t, fmt.Sprintf("http://%s/crdt/batch", h.cluster[followerId].GetHTTPAddr()), body)
+	if status != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", status, http.StatusAccepted)
+	}
+	if receipt.FirstIndex != 0 || receipt.LastIndex != 2 || receipt.Term != term || receipt.BrokerID != origLeaderId {
+		t.Errorf("got receipt %+v, want indexes 0 to 2 in term %d from %d", receipt, term, origLeaderId)
+	}
+	leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+	if len(leaderLog) != 3 {
+		t.Fatalf("leader log has %d entries, want 3", len(leaderLog))
+	}
+	for i, r := range receipt.Receipts {
+		if r.Index != i || r.OpID != batch[i].OpID {
+			t.Errorf("receipt %d is %+v, want index %d for %s", i, r, i, batch[i].OpID)
+		}
+		if got := leaderLog[i].CRDTOperation.(CRDTMessage).Value; got != batch[i].Value {
+			t.Errorf("log entry %d is %+v, want value %v", i, leaderLog[i], batch[i].Value)
+		}
+	}
+
+	url := fmt.Sprintf("http://%s/crdt/batch", h.cluster[origLeaderId].GetHTTPAddr())
+
+	// one bad message rejects the whole batch
+	for _, body := range []string{
+		`[{"type":"insert","value":"d","replica_id":"r1"},{"type":"upsert","value":"e","replica_id":"r1"}]`,
+		`[{"type":"insert","value":"d","replica_id":"r1"},{"type":"insert","index":-1,"value":"e","replica_id":"r1"}]`,
+	} {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var verr ValidationError
+		json.NewDecoder(resp.Body).Decode(&verr)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnprocessableEntity || verr.Position == nil || *verr.Position != 1 {
+			t.Errorf("%s got status %d %+v, want %d for message 1", body, resp.StatusCode, verr, http.StatusUnprocessableEntity)
+		}
+	}
+	status, _ = postBatch(t, url, []byte(`[]`))
+	if status != http.StatusBadRequest {
+		t.Errorf("empty batch got status %d, want %d", status, http.StatusBadRequest)
+	}
+	if got := leaderLogLength(); got != 3 {
+		t.Errorf("rejected batches changed the leader log to %d entries", got)
+	}
+
+	// a retried batch only submits the messages that weren't accepted before
+	batch = append(batch, CRDTMessage{Type: "insert", Index: 3, Value: "d", ReplicaID: "r1", OpIndex: 2, OpID: "op-3"})
+	body, _ = json.Marshal(batch)
+	status, receipt = postBatch(t, url, body)
+	if status != http.StatusAccepted || receipt.FirstIndex != 3 || receipt.LastIndex != 3 || len(receipt.Duplicates) != 3 {
+		t.Errorf("retried batch got status %d receipt %+v, want index 3 and 3 duplicates", status, receipt)
+	}
+	if got := leaderLogLength(); got != 4 {
+		t.Errorf("leader log has %d entries, want 4", got)
+	}
+}
+
+// a broker that is the only member of its cluster, made leader by hand
+// because nobody replies to its RequestVotes
+func newSingleLeader(tb testing.TB) *BrokerServer {
+	tb.Helper()
+	broker, err := NewBrokerServer(0, nil, map[int]string{}, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), BrokerOptions{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := broker.Serve(); err != nil {
+		tb.Fatal(err)
+	}
+
+	broker.mu2.Lock()
+	broker.em.term++
+	broker.em.votedFor = broker.brokerid
+	// ready is never closed so there is no election timer yet for becomeLeader to stop
+	broker.em.electionTimer = time.NewTimer(time.Hour)
+	broker.em.becomeLeader()
+	broker.mu2.Unlock()
+	return broker
+}
+
+// ops per second through POST /crdt, one request per op, against POST /crdt/batch
+func BenchmarkCRDTSingleVsBatch(b *testing.B) {
+	broker := newSingleLeader(b)
+	defer shutdownNow(broker)
+	base := fmt.Sprintf("http://%s", broker.GetHTTPAddr())
+
+	op := func(i int) CRDTMessage {
+		return CRDTMessage{Type: "insert", Index: int64(i), Value: "a", ReplicaID: "bench", OpIndex: 1}
+	}
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			body, _ := json.Marshal(op(i))
+			resp, err := http.Post(base+"/crdt", "application/json", bytes.NewReader(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+	})
+
+	for _, size := range []int{10, 100} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i += size {
+				batch := make([]CRDTMessage, 0, size)
+				for j := i; j < i+size && j < b.N; j++ {
+					batch = append(batch, op(j))
+				}
+				body, _ := json.Marshal(batch)
+				if status, _ := postBatch(b, base+"/crdt/batch", body); status != http.StatusAccepted {
+					b.Fatalf("got status %d", status)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "ops/s")
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// log entries keyed by their index, big endian so keys sort like indexes
+	logBucket = []byte("log")
+	// hard state, snapshot and where the log starts
+	stateBucket = []byte("state")
+
+	hardStateKey  = []byte("hardState")
+	snapshotKey   = []byte("snapshot")
+	firstIndexKey = []byte("firstIndex")
+)
+
+// Storage in a bbolt database file. every call is one transaction that is
+// synced to disk before it returns
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// opens the database at path, creating it if it doesn't exist
+// fails if another process has it open
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(logBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(stateBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
+
+// bytes the database file takes
+func (bs *BoltStorage) Size() (int64, error) {
+	var size int64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size, err
+}
+
+func (bs *BoltStorage) AppendEntries(entries []LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		index := lastStoredIndex(tx) + 1
+		log := tx.Bucket(logBucket)
+		for _, entry := range entries {
+			data, err := encodeGob(entry)
+			if err != nil {
+				return err
+			}
+			if err := log.Put(indexKey(index), data); err != nil {
+				return err
+			}
+			index++
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStorage) Entries(lo, hi int) ([]LogEntry, error) {
+	var entries []LogEntry
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(logBucket).Cursor()
+		for k, v := c.Seek(indexKey(max(lo, 0))); k != nil && keyIndex(k) < hi; k, v = c.Next() {
+			var entry LogEntry
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (bs *BoltStorage) TruncateSuffix(from int) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(logBucket).Cursor()
+		for k, _ := c.Seek(indexKey(max(from, 0))); k != nil; k, _ = c.Seek(indexKey(max(from, 0))) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStorage) TruncatePrefix(to int) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if to <= firstStoredIndex(tx) {
+			return nil
+		}
+		c := tx.Bucket(logBucket).Cursor()
+		for k, _ := c.First(); k != nil && keyIndex(k) < to; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(stateBucket).Put(firstIndexKey, indexKey(to))
+	})
+}
+
+func (bs *BoltStorage) SetHardState(state HardState) error {
+	return bs.put(hardStateKey, state)
+}
+
+func (bs *BoltStorage) GetHardState() (HardState, bool, error) {
+	var state HardState
+	found, err := bs.get(hardStateKey, &state)
+	return state, found, err
+}
+
+func (bs *BoltStorage) SaveSnapshot(snapshot StorageSnapshot) error {
+	return bs.put(snapshotKey, snapshot)
+}
+
+func (bs *BoltStorage) LoadSnapshot() (StorageSnapshot, bool, error) {
+	var snapshot StorageSnapshot
+	found, err := bs.get(snapshotKey, &snapshot)
+	return snapshot, found, err
+}
+
+// gob encode value into the state bucket under key
+func (bs *BoltStorage) put(key []byte, value any) error {
+	data, err := encodeGob(value)
+	if err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put(key, data)
+	})
+}
+
+// decode what put saved under key into value, false if nothing was
+func (bs *BoltStorage) get(key []byte, value any) (bool, error) {
+	found := false
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(stateBucket).Get(key)
+		if data == nil {
+			return nil
+		}
+		found = true
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+	})
+	return found, err
+}
+
+// index of the first entry the log has or would have, after TruncatePrefix
+func firstStoredIndex(tx *bolt.Tx) int {
+	if k := tx.Bucket(stateBucket).Get(firstIndexKey); k != nil {
+		return keyIndex(k)
+	}
+	return 0
+}
+
+// index of the last stored entry, or the one before the log starts when it is empty
+func lastStoredIndex(tx *bolt.Tx) int {
+	if k, _ := tx.Bucket(logBucket).Cursor().Last(); k != nil {
+		return keyIndex(k)
+	}
+	return firstStoredIndex(tx) - 1
+}
+
+func indexKey(index int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(index))
+}
+
+func keyIndex(key []byte) int {
+	return int(binary.BigEndian.Uint64(key))
+}
+
+func encodeGob(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return nil, fmt.Errorf("encoding for storage: %w", err)
+	}
+	return buf.Bytes(), nil
+}
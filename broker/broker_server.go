@@ -4,13 +4,22 @@ package broker
 // use rm.Submit(document, crdt) to add entry
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/townsag/clarity/crdt"
 )
 
 type ServerState int
@@ -38,29 +47,69 @@ func (s ServerState) String() string {
 }
 
 type BrokerServer struct {
+	// lock for connections and peer clients, taken after mu2, see locking.go
 	mu sync.Mutex
 
 	// lock for election and replication modules
 	mu2 sync.Mutex
 
+	// signalled on mu2 when rm's commit index moves or the broker shuts down, see WaitForCommit
+	commitCond *sync.Cond
+
 	brokerid int
 
 	// initialize election and replication modules
 	em *ElectionModule
 	rm *ReplicationModule
 
+	// rm and the other replication groups when documents are sharded, see shard.go
+	router *DocumentRouter
+
+	// peerClients is guarded by mu, see peer_connections.go
 	peerIds     []int
-	peerClients map[int]*rpc.Client
+	peerClients map[int]TransportClient
+
+	// redial state for each peer, and the peers that were disconnected on purpose
+	// and must not be redialed. see peer_connections.go
+	dialers      map[int]*peerDialer
+	disconnected map[int]bool
+
+	// clients a call timed out on, redialed before the next call to their peer
+	suspect map[int]TransportClient
+
+	// connections peers opened to this broker's rpc server
+	rpcConns map[net.Conn]struct{}
 
 	listener net.Listener
 
 	// states unique to each server
 	state ServerState
 
+	// set by Shutdown, the leader stops taking new entries. guarded by mu2
+	draining bool
+
+	// set by Pause, rpcs from peers are refused. guarded by mu2
+	paused bool
+
+	// copy of state the logger can read without mu2, see setState
+	loggedState atomic.Int32
+
+	// state, term and leader for readers that don't take mu2, see locking.go
+	view atomic.Pointer[brokerView]
+
+	// adds the broker id and state to every record, see logger.go
+	logger Logger
+
+	// starts the spans of rpcs and CRDT messages, see tracing.go
+	tracer trace.Tracer
+
 	commitChan chan<- CommitEntry
 
-	// rpc server for handling actual requests
-	rpcServer *rpc.Server
+	// rpc server for handling actual requests, see transport.go
+	rpcServer TransportServer
+
+	// what rpcServer answers with when options.RPCFaults is set, see rpc_proxy.go
+	rpcProxy *RPCProxy
 
 	// channel to ensure servers start together
 	ready <-chan any
@@ -72,31 +121,206 @@ type BrokerServer struct {
 	httpServer *http.Server
 	httpAddr   string
 	peerAddrs  map[int]string
+
+	// materialized per document state built from committed entries
+	documents *documentStore
+
+	options BrokerOptions
+
+	// limits CRDT messages per source on the http endpoint, nil when turned off
+	limiter *rateLimiter
+
+	// limits http requests per remote host on every endpoint, nil when turned off
+	requestLimiter *rateLimiter
+
+	// nil unless options.RPCTLS is set
+	rpcServerTLS *tls.Config
+	rpcClientTLS *tls.Config
+
+	// nil unless options.HTTPTLS is set
+	httpServerTLS *tls.Config
+	httpClientTLS *tls.Config
+
+	// for CRDT messages a follower forwards to the leader
+	forwardClient *http.Client
+
+	// op ids of CRDT messages this broker submitted as leader
+	seenOpIDs *lruCache[string, *CRDTReceipt]
+
+	// application servers committed operations are pushed to, see push.go
+	pusher *commitPusher
+
+	// wakes up GET /commits/stream requests and pushes, see stream.go
+	streams *commitNotifier
+
+	// SubscribeCommits consumers, guarded by mu2
+	subscribers map[*CommitSubscription]struct{}
+
+	// the error that stopped the rpc accept loop, see ServeErrors
+	serveErrors chan error
+
+	// lets tests wrap the rpc listener before the accept loop starts
+	wrapListener func(net.Listener) net.Listener
+
+	// lets tests slow down AppendEntries or change what it was sent, called before it takes mu2
+	beforeAppendEntries atomic.Pointer[func(*AppendEntriesArgs)]
+}
+
+var ErrInvalidHTTPAddr = errors.New("invalid http address")
+
+// httpAddr has to be a host:port, this is checked here so a typo fails at
+// construction instead of when Serve starts listening
+func checkHTTPAddr(httpAddr string) error {
+	if _, err := net.ResolveTCPAddr("tcp", httpAddr); err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidHTTPAddr, httpAddr, err)
+	}
+	return nil
 }
 
 // ready <-chan any is for make sure everything starts are the same time when close(ready) when starting the servers
-func NewBrokerServer(brokerid int, peerIds []int, peerAddrs map[int]string, httpAddr string, state ServerState, ready <-chan any, commitChan chan<- CommitEntry) *BrokerServer {
+func NewBrokerServer(brokerid int, peerIds []int, peerAddrs map[int]string, httpAddr string, state ServerState, ready <-chan any, commitChan chan<- CommitEntry, opts BrokerOptions) (*BrokerServer, error) {
+	if err := checkHTTPAddr(httpAddr); err != nil {
+		return nil, err
+	}
+	if err := opts.checkElectionTimeouts(); err != nil {
+		return nil, err
+	}
+
 	broker := new(BrokerServer)
 	broker.brokerid = brokerid
 	broker.peerIds = peerIds
-	broker.peerClients = make(map[int]*rpc.Client)
-	broker.state = state
+	broker.peerClients = make(map[int]TransportClient)
+	broker.commitCond = sync.NewCond(&broker.mu2)
+	broker.dialers = make(map[int]*peerDialer)
+	broker.disconnected = make(map[int]bool)
+	broker.suspect = make(map[int]TransportClient)
+	broker.rpcConns = make(map[net.Conn]struct{})
+	broker.setState(state)
 	broker.ready = ready
 	broker.commitChan = commitChan
 	broker.quit = make(chan any)
+	broker.serveErrors = make(chan error, 1)
 	broker.peerAddrs = peerAddrs
 	broker.httpAddr = httpAddr
+	broker.options = opts
+	broker.logger = newBrokerLogger(opts.Logger, brokerid, &broker.loggedState)
+	broker.tracer = opts.tracerProvider().Tracer(tracerName)
+	broker.limiter = newRateLimiter(opts.RateLimit, opts.RateLimitBurst)
+	broker.requestLimiter = newRateLimiter(opts.RequestRateLimit, opts.RequestRateLimitBurst)
+
+	if opts.RPCTLS != nil {
+		var err error
+		broker.rpcServerTLS, broker.rpcClientTLS, err = opts.RPCTLS.load(true)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.HTTPTLS != nil {
+		var err error
+		broker.httpServerTLS, broker.httpClientTLS, err = opts.HTTPTLS.load(false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	broker.forwardClient = newForwardClient(broker)
+	broker.seenOpIDs = newLRUCache[string, *CRDTReceipt](opIDCacheCapacity, opts.opIDTTL())
+	broker.pusher = newCommitPusher()
+	broker.streams = newCommitNotifier()
+	broker.subscribers = make(map[*CommitSubscription]struct{})
+
+	// load the last checkpoint so only the log suffix has to be replayed
+	broker.documents = newDocumentStore(brokerid, opts, broker.logger)
 
-	return broker
+	return broker, nil
 }
 
 type CRDTMessage struct { // Type, Index, Value combine to create crdt operation
-	Type      string      `json:"type"`  // the crdt operation type {insert, delete}
+	Type      OpType      `json:"type"`  // the crdt operation type {insert, delete}
 	Index     int64       `json:"index"` // index of the operation
 	Value     interface{} `json:"value"` // chars being inserted / deleted
 	ReplicaID string      `json:"replica_id"`
 	OpIndex   int64       `json:"operation_index"` // identifies the document the crdt operations edit
 	Source    string      `json:"source"`          // "client" or "broker"
+
+	// shape of the message, see CurrentSchemaVersion
+	SchemaVersion int `json:"schema_version"`
+
+	// unique id the application server gives each user action, so a message it
+	// retries isn't submitted twice. empty means no deduplication
+	OpID string `json:"op_id,omitempty"`
+
+	// json of the crdt.Operation the application server made for this edit, so
+	// replicas can apply it instead of the index. empty for edits sent without one
+	Operation json.RawMessage `json:"crdt_operation,omitempty"`
+}
+
+// what the leader replies when it appends a CRDT message to its log
+// ReplicaID, OpIndex and OpID are copied from the message so the sender can match them up
+type CRDTReceipt struct {
+	Index    int    `json:"index"`
+	Term     int    `json:"term"`
+	Shard    int    `json:"shard,omitempty"` // Index counts within the shard, see shard.go
+	Document string `json:"document"`
+	BrokerID int    `json:"broker_id"`
+
+	ReplicaID string `json:"replica_id"`
+	OpIndex   int64  `json:"operation_index"`
+	OpID      string `json:"op_id,omitempty"`
+
+	// the entry committed before the leader replied, see
+	// BrokerOptions.ReceiptCommitTimeout. false doesn't mean it never will
+	Committed bool `json:"committed"`
+}
+
+// the log entry the leader submits for a message. the message itself is the
+// operation, so followers and readers of the log get it back as it was sent
+func (msg CRDTMessage) logEntry() LogEntry {
+	// entries are gob encoded for rpcs and storage, which needs concrete types
+	// it knows. values are strings after validation, except on some deletes
+	if msg.Value != nil {
+		if _, ok := msg.Value.(string); !ok {
+			msg.Value = fmt.Sprintf("%+v", msg.Value)
+		}
+	}
+	return LogEntry{
+		CRDTOperation: msg,
+		Document:      fmt.Sprintf("%d", msg.OpIndex),
+	}
+}
+
+// validate msg and append it to the log, without the http handler's rate
+// limiting and deduplication. index is -1 if this broker isn't the leader
+func (broker *BrokerServer) SubmitOperation(msg CRDTMessage) (index int, term int, err error) {
+	if verr := validateCRDTMessage(msg); verr != nil {
+		return -1, 0, verr
+	}
+	entry := msg.logEntry()
+	return broker.router.For(entry.Document).submitBatchContext(context.Background(), []LogEntry{entry})
+}
+
+func writeReceipt(w http.ResponseWriter, status int, receipt *CRDTReceipt) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// the client went away, nothing to tell it
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// how many op ids the leader remembers, and for how long by default
+const (
+	opIDCacheCapacity = 10000
+	opIDCacheTTL      = 60 * time.Second
+)
+
+// op id of a message on POST /crdt whose body doesn't have one, for clients
+// using the usual http header instead
+const idempotencyKeyHeader = "Idempotency-Key"
+
+func (opts BrokerOptions) opIDTTL() time.Duration {
+	if opts.OpIDTTL <= 0 {
+		return opIDCacheTTL
+	}
+	return opts.OpIDTTL
 }
 
 // http func to recieve crdts
@@ -107,117 +331,503 @@ func (broker *BrokerServer) handleCRDTOperation(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	// the entry keeps this span through replication and commit, see tracing.go
+	ctx, span := broker.tracer.Start(r.Context(), "BrokerServer.handleCRDTOperation")
+	defer span.End()
+
 	// check first is this broker is leader
-	// since our implementation of the appserver multicasts to all nodes
-	// when follower recieves message, just ignore
-	if broker.state != Leader {
-		log.Printf("%s %d ignores CRDT message: Not the leader", broker.state, broker.brokerid)
-		http.Error(w, "This server is not the leader", http.StatusForbidden)
+	// followers pass the message on to the leader when they know who it is
+	if broker.currentView().state != Leader {
+		broker.forwardCRDTToLeader(w, r)
+		return
+	}
+	if broker.refuseWriteIfReadOnly(w) {
 		return
 	}
 
-	var crdtMessage CRDTMessage
-	err := json.NewDecoder(r.Body).Decode(&crdtMessage)
+	crdtMessage, err := decodeCRDTMessage(r.Body)
+	if bodyTooLarge(w, err) {
+		return
+	}
+	if verr := validationErrorFromDecode(err); verr != nil {
+		writeValidationError(w, verr)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Invalid CRDT operation payload", http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Invalid CRDT operation payload: %v", err), http.StatusBadRequest)
+		return
+	}
+	if crdtMessage.OpID == "" {
+		crdtMessage.OpID = r.Header.Get(idempotencyKeyHeader)
+	}
+	if verr := validateCRDTMessage(crdtMessage); verr != nil {
+		broker.logger.Info("rejects CRDT message", "err", verr)
+		writeValidationError(w, verr)
+		return
+	}
+	if broker.refuseUnauthorizedWrite(w, r, crdtMessage) {
 		return
 	}
 
-	log.Printf("%s %d Received CRDT Message: %+v", broker.state, broker.brokerid, crdtMessage)
+	if source := rateLimitSource(crdtMessage, r); !broker.limiter.allow(source) {
+		broker.logger.Warn("rate limits CRDT message", "source", source)
+		http.Error(w, "Too many CRDT operations", http.StatusTooManyRequests)
+		return
+	}
+
+	broker.logger.Debug("received CRDT message", "message", crdtMessage)
+
+	// a retry of a message that was already submitted gets the receipt of the
+	// first attempt once that committed. until then it is only told the first
+	// attempt was accepted
+	if crdtMessage.OpID != "" && !broker.seenOpIDs.AddIfAbsent(crdtMessage.OpID, nil) {
+		broker.logger.Info("ignores duplicate CRDT message", "op_id", crdtMessage.OpID)
+		if receipt := broker.committedReceipt(crdtMessage.OpID); receipt != nil {
+			writeReceipt(w, http.StatusOK, receipt)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("CRDT operation already accepted, not committed yet"))
+		return
+	}
 
 	// leader builds crdt operation log and submits to ReplicationModule for log replication and committing
-	crdtOp := fmt.Sprintf("Type[%s] Index[%d] Value[%+v]", crdtMessage.Type, crdtMessage.Index, crdtMessage.Value)
-	documentName := fmt.Sprintf("%d", crdtMessage.OpIndex)
+	entry := crdtMessage.logEntry()
+	crdtOp, documentName := entry.CRDTOperation, entry.Document
 
 	// submit CRDT Operation to RM
-	broker.rm.Submit(documentName, crdtOp)
-
-	log.Printf("%s %d Submits entry %s for document %s", broker.state, broker.brokerid, crdtOp, documentName)
+	index, term, err := broker.router.For(documentName).submit(ctx, documentName, crdtOp)
+	if err != nil {
+		if crdtMessage.OpID != "" {
+			broker.seenOpIDs.Remove(crdtMessage.OpID)
+		}
+		broker.logger.Error("refuses CRDT message", "err", err)
+		http.Error(w, fmt.Sprintf("Invalid CRDT operation: %v", err), http.StatusBadRequest)
+		return
+	}
+	if index < 0 {
+		// lost leadership since the check above, the retry must not look like a duplicate
+		if crdtMessage.OpID != "" {
+			broker.seenOpIDs.Remove(crdtMessage.OpID)
+		}
+		http.Error(w, "This server is no longer the leader", http.StatusServiceUnavailable)
+		return
+	}
 
-	w.WriteHeader(http.StatusAccepted)
-	w.Write([]byte("CRDT operation accepted"))
+	broker.logger.Debug("submits entry", "index", index, "entry", crdtOp, "document", documentName)
+
+	receipt := &CRDTReceipt{
+		Index:     index,
+		Term:      term,
+		Shard:     broker.router.Shard(documentName),
+		Document:  documentName,
+		BrokerID:  broker.brokerid,
+		ReplicaID: crdtMessage.ReplicaID,
+		OpIndex:   crdtMessage.OpIndex,
+		OpID:      crdtMessage.OpID,
+		Committed: broker.committedInTime(ctx, broker.router.For(documentName), index, term),
+	}
+	if crdtMessage.OpID != "" {
+		broker.seenOpIDs.Update(crdtMessage.OpID, receipt)
+	}
+	writeReceipt(w, http.StatusAccepted, receipt)
 }
 
 // http func to send logs back to app server
+// ?since=N asks for the committed entries from index N instead, see replay.go
 func (broker *BrokerServer) handleLogGetRequest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if r.URL.Query().Has("since") {
+		broker.handleEntriesSince(w, r)
+		return
+	}
+	rm, err := broker.shardOf(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	broker.mu.Lock()
-	defer broker.mu.Unlock()
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
 
 	// if broker is not leader, ignore GET request
 	if broker.state != Leader {
-		log.Printf("%s %d ignores GET log requset: Not the leader", broker.state, broker.brokerid)
+		broker.logger.Info("ignores GET log request: not the leader")
 		http.Error(w, "This server is not the leader", http.StatusForbidden)
 		return
 	}
 
-	// get and send logs
-	sendlogs := broker.rm.log
-	var sendlogslist []string
-
-	for _, entry := range sendlogs {
-		logString := fmt.Sprintf("Operation: %+v  Document: %s  Term: %d", entry.CRDTOperation, entry.Document, entry.Term)
-		sendlogslist = append(sendlogslist, logString)
+	// the whole log, committed or not, with operations as structured messages
+	sendlogslist := make([]HistoryEntry, 0, len(rm.log))
+	for i, entry := range decompressEntries(rm.log) {
+		sendlogslist = append(sendlogslist, HistoryEntry{Index: rm.logBaseIndex + i, LogEntry: entry})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(sendlogslist); err != nil {
 		http.Error(w, fmt.Sprintf("Error encoding logs: %v", err), http.StatusInternalServerError)
 	}
-	log.Printf("%s %d sends logs %s to appserver", broker.state, broker.brokerid, sendlogslist)
+	broker.logger.Debug("sends logs to appserver", "entries", len(sendlogslist))
 
 }
 
-func (broker *BrokerServer) Serve() {
+// poll until this broker knows who the leader is, itself included, and return its id
+func (broker *BrokerServer) WaitForLeader(timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		view := broker.currentView()
+		if view.state == Dead {
+			return -1, ErrBrokerDead
+		}
+		if view.leaderId >= 0 {
+			return view.leaderId, nil
+		}
+		if time.Now().After(deadline) {
+			return -1, fmt.Errorf("%w after %s", ErrNoLeader, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
 
-	broker.mu.Lock()
+// what GET /committedlog?snapshot=true answers. once the log is trimmed the
+// entries before FirstIndex are only in Documents, which have to be installed
+// before Entries are applied
+type CommittedLog struct {
+	// replication group the log is of, see ?shard=
+	Shard int `json:"shard,omitempty"`
+	// number of groups the broker has, each has its own committed log
+	Shards int `json:"shards"`
+	// log index of Entries[0]
+	FirstIndex int `json:"first_index"`
+	// every document as of FirstIndex-1, empty while nothing was trimmed
+	Documents map[string]crdt.TextCRDTSnapshot `json:"documents,omitempty"`
+	Entries   []LogEntry                       `json:"entries"`
+}
 
-	// initialize election and replication modules for broker server
-	broker.em = NewEM(broker.brokerid, broker.peerIds, broker.peerAddrs, broker, broker.ready)
-	broker.rm = NewRM(broker.brokerid, broker.peerIds, broker, broker.commitChan)
+// the documents can move past the log while the snapshot is taken, this many
+// tries at a snapshot that lines up with the log before giving up
+const committedLogAttempts = 3
+
+// the committed log, with the documents when entries were trimmed off it
+// ErrEntriesCompacted when the log is trimmed and withSnapshot is false
+func (rm *ReplicationModule) readCommittedLog(withSnapshot bool) (CommittedLog, error) {
+	for range committedLogAttempts {
+		var documents documentCheckpoint
+		if withSnapshot {
+			documents = rm.documents.snapshot()
+		}
 
-	// create new rpcServer and register with EM and RM
-	broker.rpcServer = rpc.NewServer()
-	broker.rpcServer.RegisterName("ElectionModule", broker.em)
-	broker.rpcServer.RegisterName("ReplicationModule", broker.rm)
+		rm.broker.mu2.Lock()
+		if rm.logBaseIndex == 0 {
+			entries := decompressEntries(rm.logSlice(0, rm.commitIndex+1))
+			rm.broker.mu2.Unlock()
+			return CommittedLog{Shard: rm.shard, Shards: rm.broker.options.shards(), Entries: entries}, nil
+		}
+		if !withSnapshot {
+			err := fmt.Errorf("%w: entries before %d are only in the snapshot", ErrEntriesCompacted, rm.logBaseIndex)
+			rm.broker.mu2.Unlock()
+			return CommittedLog{}, err
+		}
+		// documents restored from a checkpoint can be ahead of the log, and
+		// the log can be trimmed past them since they were copied
+		first := documents.LastApplied + 1
+		if first < rm.logBaseIndex || first > rm.commitIndex+1 {
+			rm.broker.mu2.Unlock()
+			continue
+		}
+		entries := decompressEntries(rm.logSlice(first, rm.commitIndex+1))
+		rm.broker.mu2.Unlock()
+		return CommittedLog{Shard: rm.shard, Shards: rm.broker.options.shards(), FirstIndex: first, Documents: documents.Documents, Entries: entries}, nil
+	}
+	return CommittedLog{}, errors.New("documents don't line up with the log")
+}
+
+// http func for application servers catching up after a restart
+// every committed entry in log order. followers answer too, they may just be a little behind
+// once entries are trimmed after a snapshot, see BrokerOptions.SnapshotInterval,
+// the log alone is 410 Gone and ?snapshot=true answers a CommittedLog instead.
+// the first replication group's log, or the one of ?shard=
+func (broker *BrokerServer) handleCommittedLogRequest(w http.ResponseWriter, r *http.Request) {
+	rm, err := broker.shardOf(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	withSnapshot := r.URL.Query().Get("snapshot") == "true"
+	log, err := rm.readCommittedLog(withSnapshot)
+	if errors.Is(err, ErrEntriesCompacted) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	var body any = log.Entries
+	if withSnapshot {
+		body = log
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		broker.logger.Warn("error encoding committed log", "err", err)
+	}
+}
+
+// what GET /status reports about a broker
+type BrokerStatus struct {
+	BrokerId    int          `json:"brokerid"`
+	State       string       `json:"state"`
+	Term        int          `json:"term"`
+	CommitIndex int          `json:"commit_index"`
+	LastApplied int          `json:"last_applied"`
+	LogLength   int          `json:"log_length"`
+	LeaderId    int          `json:"leader_id"` // -1 when no leader is known
+	ReadOnly    bool         `json:"read_only"` // a leader that lost its majority, see quorum_loss.go
+	Peers       []PeerStatus `json:"peers"`
+
+	// every replication group, the first is the one CommitIndex, LastApplied
+	// and LogLength are of. see shard.go
+	Shards []ShardStatus `json:"shards"`
+}
+
+// where a replication group's log is on a broker
+type ShardStatus struct {
+	Shard       int `json:"shard"`
+	CommitIndex int `json:"commit_index"`
+	LastApplied int `json:"last_applied"`
+	LogLength   int `json:"log_length"`
+}
+
+type PeerStatus struct {
+	Id        int  `json:"id"`
+	Connected bool `json:"connected"`
+	Lag       *int `json:"lag,omitempty"` // entries behind the leader's log, only reported by the leader
+}
+
+// copy of this broker's state for debugging
+func (broker *BrokerServer) Status() BrokerStatus {
+	broker.mu2.Lock()
+	status := BrokerStatus{
+		BrokerId:    broker.brokerid,
+		State:       broker.state.String(),
+		Term:        broker.em.term,
+		CommitIndex: broker.rm.commitIndex,
+		LastApplied: broker.rm.lastApplied,
+		LogLength:   len(broker.rm.log),
+		LeaderId:    broker.em.leaderId,
+		ReadOnly:    broker.state == Leader && broker.rm.readOnly,
+	}
+	for _, rm := range broker.router.Shards() {
+		status.Shards = append(status.Shards, ShardStatus{
+			Shard:       rm.shard,
+			CommitIndex: rm.commitIndex,
+			LastApplied: rm.lastApplied,
+			LogLength:   len(rm.log),
+		})
+	}
+	peerIds := broker.rm.membership.peers(broker.brokerid)
+	lag := broker.rm.replicationLag()
+	broker.mu2.Unlock()
+
+	connected := broker.connectedPeers()
+	for _, peerId := range peerIds {
+		peer := PeerStatus{Id: peerId, Connected: connected[peerId]}
+		if peerLag, ok := lag[peerId]; ok {
+			peer.Lag = &peerLag
+		}
+		status.Peers = append(status.Peers, peer)
+	}
+	return status
+}
+
+// http func to report broker state
+func (broker *BrokerServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(broker.Status()); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding status: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// restore the broker's state and start serving its peers and application
+// servers. the listeners are opened first, an address in use or a failure
+// to start returns an error with nothing left running. errors after Serve
+// returned come on ServeErrors
+func (broker *BrokerServer) Serve() error {
+
+	broker.mu.Lock()
 
 	// for internal broker rpc server
-	var err error
-	broker.listener, err = net.Listen("tcp", ":0") // listen on any open port
+	rpcAddr := broker.options.RPCAddr
+	if rpcAddr == "" {
+		rpcAddr = ":0" // listen on any open port
+	}
+	rpcListener, err := net.Listen("tcp", rpcAddr)
 	if err != nil {
-		log.Fatal(err)
+		broker.mu.Unlock()
+		return fmt.Errorf("rpc listen: %w", err)
 	}
-	log.Printf("[%v] listening at %s", broker.brokerid, broker.listener.Addr())
+	// listen before returning so peers can connect as soon as Serve does
+	httpListener, err := net.Listen("tcp", broker.httpAddr)
+	if err != nil {
+		rpcListener.Close()
+		broker.mu.Unlock()
+		return fmt.Errorf("http listen: %w", err)
+	}
+	broker.httpAddr = httpListener.Addr().String()
+
+	// initialize election and replication modules for broker server
+	broker.em = NewEM(broker.brokerid, broker.peerAddrs, broker, broker.ready, broker.options.Storage)
+	broker.rm, err = NewRM(broker.brokerid, broker.peerIds, broker, broker.commitChan, broker.options.Storage)
+	if err != nil {
+		// the election timer finds the broker dead
+		broker.mu2.Lock()
+		broker.setState(Dead)
+		broker.mu2.Unlock()
+		rpcListener.Close()
+		httpListener.Close()
+		broker.mu.Unlock()
+		return err
+	}
+	broker.router, err = newDocumentRouter(broker)
+	if err != nil {
+		broker.mu.Unlock()
+		broker.abandonServe(rpcListener, httpListener)
+		return err
+	}
+
+	// create new rpcServer and register with EM and RM, or a proxy in front of them
+	var election ElectionService = broker.em
+	var replication ReplicationService = routedReplication{broker.router}
+	if broker.options.RPCFaults != nil {
+		broker.rpcProxy = newRPCProxy(election, replication, broker.quit, *broker.options.RPCFaults)
+		election, replication = rpcProxyElection{broker.rpcProxy}, rpcProxyReplication{broker.rpcProxy}
+	}
+	broker.rpcServer, err = broker.transport().NewServer(election, replication)
+	if err != nil {
+		broker.mu.Unlock()
+		broker.abandonServe(rpcListener, httpListener)
+		return fmt.Errorf("rpc server: %w", err)
+	}
+
+	broker.listener = rpcListener
+	if broker.wrapListener != nil {
+		broker.listener = broker.wrapListener(broker.listener)
+	}
+	if broker.rpcServerTLS != nil {
+		broker.listener = tls.NewListener(broker.listener, broker.rpcServerTLS)
+	}
+	broker.logger.Info("rpc server listening", "addr", broker.listener.Addr())
 
 	broker.mu.Unlock()
 
+	// the term left in storage and no leader yet
+	broker.mu2.Lock()
+	broker.publishView()
+	broker.mu2.Unlock()
+
 	// initialize and start http server for comms with application server
 	mux := http.NewServeMux()
 
+	// endpoints for the application server need the bearer token when one is configured
+	token := broker.options.AuthToken
+
 	// func for handling incoming crdt Messages from application server
-	mux.HandleFunc("/crdt", broker.handleCRDTOperation)
+	mux.Handle("/crdt", authMiddleware(token, decompressionMiddleware(http.HandlerFunc(broker.handleCRDTOperation))))
+
+	// several crdt Messages in one request, submitted together
+	mux.Handle("POST /crdt/batch", authMiddleware(token, decompressionMiddleware(http.HandlerFunc(broker.handleCRDTBatch))))
 
 	// func for handling incoming log request from application server
-	mux.HandleFunc("/logrequest", broker.handleLogGetRequest)
+	// read endpoints are gzipped for clients that accept it
+	mux.Handle("/logrequest", authMiddleware(token, compressionMiddleware(http.HandlerFunc(broker.handleLogGetRequest))))
 
+	// committed entries for application servers rebuilding their documents
+	mux.Handle("GET /committedlog", authMiddleware(token, compressionMiddleware(http.HandlerFunc(broker.handleCommittedLogRequest))))
+
+	// application servers that want committed operations pushed to them
+	mux.Handle("POST /appservers", authMiddleware(token, http.HandlerFunc(broker.handleRegisterAppServer)))
+	mux.Handle("POST /subscribe", authMiddleware(token, http.HandlerFunc(broker.handleSubscribe)))
+
+	// committed entries as they are applied, as server-sent events. not gzipped,
+	// the compressor would hold events back
+	mux.Handle("GET /commits/stream", authMiddleware(token, http.HandlerFunc(broker.handleCommitStream)))
+
+	// committed entries of one document, for application servers replaying it
+	mux.Handle("GET /document/{id}/history", authMiddleware(token, compressionMiddleware(http.HandlerFunc(broker.handleDocumentHistory))))
+
+	// how many entries of one document are committed, for read-your-writes
+	mux.Handle("GET /document/{id}/watermark", authMiddleware(token, http.HandlerFunc(broker.handleDocumentWatermark)))
+
+	// the leader this broker knows of, so clients don't have to guess
+	mux.Handle("GET /leader", authMiddleware(token, http.HandlerFunc(broker.handleLeader)))
+
+	// election counters for monitoring
+	mux.Handle("GET /metrics/election", authMiddleware(token, http.HandlerFunc(broker.handleElectionMetrics)))
+
+	// operator endpoints, only there when an admin token is set
+	if adminToken := broker.options.AdminToken; adminToken != "" {
+		mux.Handle("GET /admin/log", authMiddleware(adminToken, http.HandlerFunc(broker.handleAdminLog)))
+		mux.Handle("POST /admin/snapshot", authMiddleware(adminToken, http.HandlerFunc(broker.handleAdminSnapshot)))
+		mux.Handle("POST /admin/stepdown", authMiddleware(adminToken, http.HandlerFunc(broker.handleAdminStepDown)))
+	}
+
+	// func for debugging the state of the broker
+	mux.Handle("/status", authMiddleware(token, compressionMiddleware(http.HandlerFunc(broker.handleStatus))))
+
+	// liveness and readiness probes. left open, probes don't carry the token
+	mux.HandleFunc("GET /healthz", broker.handleHealthz)
+	mux.HandleFunc("GET /readyz", broker.handleReadyz)
+
+	// peers can also reach the rpc server through the http address, see ConnectToPeerByID
+	mux.HandleFunc(rpc.DefaultRPCPath, broker.handleRPC)
+
+	// wraps the whole mux so every endpoint is limited, see http_limits.go
+	// and every request gets a span, a child of the one the caller sent
+	handler := limitMiddleware(broker.requestLimiter, broker.options.maxRequestBytes(), mux)
+	handler = otelhttp.NewHandler(handler, "broker",
+		otelhttp.WithTracerProvider(broker.options.tracerProvider()),
+		otelhttp.WithPropagators(tracePropagator),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		}),
+	)
 	broker.httpServer = &http.Server{
 		Addr:    broker.httpAddr,
-		Handler: mux,
+		Handler: handler,
+		// so slow or idle clients can't hold connections open
+		ReadTimeout:  httpTimeout(broker.options.HTTPReadTimeout, defaultHTTPReadTimeout),
+		WriteTimeout: httpTimeout(broker.options.HTTPWriteTimeout, defaultHTTPWriteTimeout),
+		IdleTimeout:  httpTimeout(broker.options.HTTPIdleTimeout, defaultHTTPIdleTimeout),
+	}
+	// streams never end on their own, Shutdown would wait out its grace period for them
+	broker.httpServer.RegisterOnShutdown(broker.streams.stop)
+
+	if n := broker.options.MaxHTTPConns; n > 0 {
+		httpListener = LimitListener(httpListener, n)
+	}
+	if broker.httpServerTLS != nil {
+		httpListener = tls.NewListener(httpListener, broker.httpServerTLS)
 	}
 
-	log.Printf("[%d] HTTP server listening on %s", broker.brokerid, broker.httpAddr)
+	broker.logger.Info("HTTP server listening", "addr", broker.httpAddr)
 
 	broker.wg.Add(1)
 
 	// start listening for requests from application server
 	go func() {
 		defer broker.wg.Done()
-		if err := broker.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("[%d] HTTP server error: %v", broker.brokerid, err)
+		if err := broker.httpServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
+			broker.logger.Error("HTTP server error", "err", err)
+			broker.reportServeError(fmt.Errorf("http server: %w", err))
 		}
 	}()
 
@@ -225,6 +835,7 @@ func (broker *BrokerServer) Serve() {
 	broker.wg.Add(1)
 	go func() {
 		defer broker.wg.Done()
+		var backoff time.Duration
 		for {
 			conn, err := broker.listener.Accept()
 			if err != nil {
@@ -233,35 +844,154 @@ func (broker *BrokerServer) Serve() {
 				case <-broker.quit:
 					return
 				default:
-					log.Fatal("accept error:", err)
 				}
 
+				// temporary errors like running out of file descriptors go away on their own,
+				// so back off and keep serving instead of taking the http server down with us
+				if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+					backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+					broker.logger.Warn("accept error, retrying", "err", err, "backoff", backoff)
+					time.Sleep(backoff)
+					continue
+				}
+
+				broker.logger.Error("accept error, no longer accepting rpcs", "err", err)
+				broker.reportServeError(err)
+				return
 			}
-			broker.wg.Add(1)
+			backoff = 0
 			// go routine so that rpc is non blocking
-			go func() {
-				broker.rpcServer.ServeConn(conn)
-				//log.Printf("serve conn")
-				broker.wg.Done()
-			}()
+			go broker.serveRPCConn(conn)
 
 		}
 	}()
 
+	// dial the configured peers, so no one has to call ConnectToPeer
+	broker.wg.Add(1)
+	go func() {
+		defer broker.wg.Done()
+		broker.connectPeers()
+	}()
+	return nil
 }
 
-func (broker *BrokerServer) Call(id int, serviceMethod string, args any, reply any) error {
-	broker.mu.Lock()
-	peer := broker.peerClients[id]
-	broker.mu.Unlock()
+// stop what Serve started before it failed. the election timer finds the
+// broker dead, commitChanSender returns. caller must not hold mu or mu2
+func (broker *BrokerServer) abandonServe(listeners ...net.Listener) {
+	broker.mu2.Lock()
+	broker.setState(Dead)
+	broker.mu2.Unlock()
+	for _, rm := range broker.router.Shards() {
+		close(rm.newCommitReadyChan)
+	}
+	broker.wg.Wait()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
+
+// receives the error that stopped the broker accepting rpcs from its peers or
+// http requests. nothing is sent when the broker is shut down normally
+func (broker *BrokerServer) ServeErrors() <-chan error {
+	return broker.serveErrors
+}
+
+// the first error is enough to stop the broker, later ones are only logged
+func (broker *BrokerServer) reportServeError(err error) {
+	select {
+	case broker.serveErrors <- err:
+	default:
+	}
+}
 
+// call serviceMethod on a peer, giving up when ctx is done
+// calls without a deadline in ctx get the configured rpc timeout
+// reply must not be read if an error is returned, the call may still be writing it
+func (broker *BrokerServer) Call(ctx context.Context, id int, serviceMethod string, args any, reply any) error {
+	peer := broker.peerClient(id)
 	if peer == nil {
-		return fmt.Errorf("call client %d after it's closed", id)
-	} else {
-		//log.Printf("%d makes call to %d", broker.brokerid, id)
-		return peer.Call(serviceMethod, args, reply)
+		var err error
+		if peer, err = broker.reconnect(id); err != nil {
+			return err
+		}
+	} else if broker.isSuspect(id, peer) {
+		peer = broker.refreshSuspect(id, peer)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, broker.rpcTimeout())
+		defer cancel()
+	}
+
+	err := peer.Call(ctx, serviceMethod, args, reply)
+	if err != nil && ctx.Err() != nil {
+		// a half open connection looks like a peer that never answers
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			broker.markSuspect(id, peer)
+		}
+		return fmt.Errorf("call %s on %d: %w", serviceMethod, id, ctx.Err())
+	}
+	if err != nil {
+		broker.dropBrokenClient(id, peer, err)
+	}
+	return err
+}
+
+func (broker *BrokerServer) receiptCommitTimeout() time.Duration {
+	if broker.options.ReceiptCommitTimeout == 0 {
+		return defaultReceiptCommitTimeout
+	}
+	return max(broker.options.ReceiptCommitTimeout, 0)
+}
+
+// wait up to ReceiptCommitTimeout for the entry submitted at index in term to
+// commit. false when it didn't in time, or another leader replaced it. the
+// wait ends early when ctx does or Shutdown stops the http server
+func (broker *BrokerServer) committedInTime(ctx context.Context, rm *ReplicationModule, index int, term int) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-broker.streams.stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if broker.waitForCommit(ctx, rm, index, broker.receiptCommitTimeout()) != nil {
+		return false
 	}
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
+	return rm.committedInTerm(index, term)
+}
+
+// the receipt of the first attempt of the message with this op id, nil while
+// it is being submitted or its entry hasn't committed. a receipt that didn't
+// commit within ReceiptCommitTimeout is checked again
+func (broker *BrokerServer) committedReceipt(opID string) *CRDTReceipt {
+	receipt, _ := broker.seenOpIDs.Get(opID)
+	if receipt == nil || receipt.Committed {
+		return receipt
+	}
+	rm := broker.router.For(receipt.Document)
+	broker.mu2.Lock()
+	committed := rm.commitIndex >= receipt.Index && rm.committedInTerm(receipt.Index, receipt.Term)
+	broker.mu2.Unlock()
+	if !committed {
+		return nil
+	}
+	update := *receipt
+	update.Committed = true
+	broker.seenOpIDs.Update(opID, &update)
+	return &update
+}
 
+func (broker *BrokerServer) rpcTimeout() time.Duration {
+	if broker.options.RPCTimeout > 0 {
+		return broker.options.RPCTimeout
+	}
+	return defaultRPCTimeout
 }
 
 ////////////////////////////////////////////////////////////////////
@@ -270,60 +1000,231 @@ func (broker *BrokerServer) Call(id int, serviceMethod string, args any, reply a
 
 // func to connect broker server to a peer when initializing network
 func (broker *BrokerServer) ConnectToPeer(peerId int, addr net.Addr) error {
-	broker.mu.Lock()
-	defer broker.mu.Unlock()
-	if broker.peerClients[peerId] == nil {
-		client, err := rpc.Dial(addr.Network(), addr.String())
-		if err != nil {
-			return err
+	if broker.allowPeer(peerId) {
+		return nil
+	}
+	client, err := broker.dialRPC(addr.String())
+	if err != nil {
+		return err
+	}
+	_, err = broker.installPeerClient(peerId, client)
+	return err
+}
+
+// like ConnectToPeer, but a client the peer already has is closed and
+// replaced, for connections that went stale without breaking
+func (broker *BrokerServer) Reconnect(peerId int, addr net.Addr) error {
+	broker.allowPeer(peerId)
+	stale := broker.peerClient(peerId)
+	client, err := broker.dialRPC(addr.String())
+	if err != nil {
+		return err
+	}
+	_, err = broker.replacePeerClient(peerId, stale, client)
+	return err
+}
+
+// connect to a peer through the http address it was configured with
+func (broker *BrokerServer) ConnectToPeerByID(peerId int) error {
+	addr, ok := broker.peerAddrs[peerId]
+	if !ok {
+		return fmt.Errorf("no address configured for peer %d", peerId)
+	}
+
+	if broker.allowPeer(peerId) {
+		return nil
+	}
+	client, err := broker.dialRPCOverHTTP(addr)
+	if err != nil {
+		return fmt.Errorf("connecting to peer %d at %s: %w", peerId, addr, err)
+	}
+	_, err = broker.installPeerClient(peerId, client)
+	return err
+}
+
+// connect to every configured peer, returning the errors of any that failed
+func (broker *BrokerServer) ConnectAllPeers() error {
+	var errs []error
+	for _, peerId := range broker.peerIds {
+		if err := broker.ConnectToPeerByID(peerId); err != nil {
+			errs = append(errs, err)
 		}
-		broker.peerClients[peerId] = client
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 // disconnect a server from network
+// the peer won't be redialed until it is connected again
 func (broker *BrokerServer) DisconnectPeer(peerId int) error {
-	broker.mu.Lock()
-	defer broker.mu.Unlock()
-	if broker.peerClients[peerId] != nil {
-		err := broker.peerClients[peerId].Close()
-		broker.peerClients[peerId] = nil
+	return broker.disconnectPeer(peerId)
+}
+
+func (broker *BrokerServer) DisconnectAll() {
+	for _, id := range broker.peerIds {
+		broker.disconnectPeer(id)
+	}
+	// peers that joined later through a config entry
+	for id := range broker.connectedPeers() {
+		broker.disconnectPeer(id)
+	}
+}
+
+var ErrBrokerDead = errors.New("broker is shut down")
+
+// block until the commit index of replication group shard reaches index,
+// without polling. ErrBrokerDead once it shuts down
+// only call it after Serve
+func (broker *BrokerServer) WaitForCommit(shard int, index int, timeout time.Duration) error {
+	rm, err := broker.router.shard(shard)
+	if err != nil {
 		return err
 	}
-	return nil
+	return broker.waitForCommit(context.Background(), rm, index, timeout)
 }
 
-func (broker *BrokerServer) DisconnectAll() {
-	broker.mu.Lock()
-	defer broker.mu.Unlock()
-	for id := range broker.peerClients {
-		if broker.peerClients[id] != nil {
-			broker.peerClients[id].Close()
-			broker.peerClients[id] = nil
+// WaitForCommit in the replication group of document, where the index of a
+// CRDTReceipt for it counts, see shard.go
+func (broker *BrokerServer) WaitForDocumentCommit(document string, index int, timeout time.Duration) error {
+	return broker.waitForCommit(context.Background(), broker.router.For(document), index, timeout)
+}
+
+// every group's setCommitIndex wakes up commitCond. ctx ending stops the wait too
+func (broker *BrokerServer) waitForCommit(ctx context.Context, rm *ReplicationModule, index int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// wakes up the wait below once the timeout passes or ctx ends
+	stop := context.AfterFunc(ctx, func() {
+		broker.mu2.Lock()
+		defer broker.mu2.Unlock()
+		broker.commitCond.Broadcast()
+	})
+	defer stop()
+
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
+	for rm.commitIndex < index {
+		if broker.state == Dead {
+			return ErrBrokerDead
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("commit index is %d after %s, want %d: %w", rm.commitIndex, timeout, index, context.DeadlineExceeded)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+		broker.commitCond.Wait()
 	}
+	return nil
 }
 
 // shuts down server
-func (broker *BrokerServer) Shutdown() {
+// entries already in the log are still delivered on commitChan until ctx is done,
+// the returned error says when some weren't. an expired ctx shuts down right away
+func (broker *BrokerServer) Shutdown(ctx context.Context) error {
+
+	// stop http server first so requests from the application server that
+	// are already in flight still get their entries submitted and acknowledged
+	broker.shutdownHTTP()
+
+	// nothing new is submitted, what is already in the log keeps replicating
+	broker.mu2.Lock()
+	broker.draining = true
+	broker.mu2.Unlock()
+	drainErr := broker.waitForDelivery(ctx)
 
 	// stop em and rm
 	broker.mu2.Lock()
-	defer broker.mu2.Unlock()
-	broker.state = Dead
-	close(broker.rm.newCommitReadyChan)
-	close(broker.quit)
+	broker.setState(Dead)
+	broker.commitCond.Broadcast()
+	broker.stopReplicating()
+	for _, rm := range broker.router.Shards() {
+		close(rm.newCommitReadyChan)
+	}
 	broker.listener.Close()
+	// in flight rpc handlers need mu2 to return, so don't hold it while waiting on wg
+	broker.mu2.Unlock()
 
-	// stop http server
-	if broker.httpServer != nil {
-		if err := broker.httpServer.Close(); err != nil {
-			log.Printf("[%d] Error shutting down HTTP server: %v", broker.brokerid, err)
+	// commitChanSender returns once the entries it picked up are delivered
+	for _, rm := range broker.router.Shards() {
+		if drainErr != nil {
+			break
+		}
+		select {
+		case <-rm.senderDone:
+		case <-ctx.Done():
+			drainErr = fmt.Errorf("committed entries not delivered before shutdown: %w", ctx.Err())
 		}
 	}
+	close(broker.quit)
+
+	// peers keep their connections open, close them so ServeConn returns
+	broker.closeRPCConns()
+	broker.rpcServer.Close()
+	broker.DisconnectAll()
 
 	broker.wg.Wait()
+
+	if err := broker.documents.checkpoint(); err != nil {
+		broker.logger.Error("error checkpointing documents", "err", err)
+	}
+	if drainErr != nil {
+		broker.logger.Warn("shut down without delivering every entry", "err", drainErr)
+	}
+	return drainErr
+}
+
+// poll until every entry this broker could still deliver on commitChan was picked up
+// for delivery. the leader waits for its whole log to commit, followers for the
+// entries they know are committed, they can't commit anything on their own
+func (broker *BrokerServer) waitForDelivery(ctx context.Context) error {
+	for {
+		broker.mu2.Lock()
+		pending := 0
+		for _, rm := range broker.router.Shards() {
+			target := rm.commitIndex
+			if broker.state == Leader {
+				target = rm.lastLogIndex()
+			}
+			pending += max(target-rm.lastApplied, 0)
+		}
+		broker.mu2.Unlock()
+
+		if pending <= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d entries not delivered before shutdown: %w", pending, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// stop accepting http requests and wait for the in flight ones to finish
+// requests still running after the grace period have their connections closed
+func (broker *BrokerServer) shutdownHTTP() {
+	if broker.httpServer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), broker.shutdownGracePeriod())
+	defer cancel()
+
+	err := broker.httpServer.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		broker.logger.Warn("HTTP requests still running, closing their connections", "grace_period", broker.shutdownGracePeriod())
+		err = broker.httpServer.Close()
+	}
+	if err != nil {
+		broker.logger.Error("error shutting down HTTP server", "err", err)
+	}
+}
+
+func (broker *BrokerServer) shutdownGracePeriod() time.Duration {
+	if broker.options.ShutdownGracePeriod > 0 {
+		return broker.options.ShutdownGracePeriod
+	}
+	return defaultShutdownGracePeriod
 }
 
 //////////////////////////////////////////////////
@@ -336,6 +1237,11 @@ func (broker *BrokerServer) GetListenAddr() net.Addr {
 	return broker.listener.Addr()
 }
 
+// current materialized representation of a document, for the http layer
+func (broker *BrokerServer) DocumentState(doc string) ([]interface{}, bool) {
+	return broker.router.For(doc).documents.representation(doc)
+}
+
 func (broker *BrokerServer) GetHTTPAddr() string {
 	broker.mu.Lock()
 	defer broker.mu.Unlock()
@@ -0,0 +1,911 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/crdt"
+)
+
+func TestFollowerForwardsCRDTToLeader(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	followerId := (origLeaderId + 1) % h.n
+
+	// let a heartbeat tell the follower who the leader is
+	sleepMs(100)
+
+	url := fmt.Sprintf("http://%s/crdt", h.cluster[followerId].GetHTTPAddr())
+	post := func(body string, header http.Header) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	// the follower passes the message on and relays the leader's answer
+	body, _ := json.Marshal(CRDTMessage{Type: "insert", Index: 0, Value: "a", ReplicaID: "r1", OpIndex: 1, Source: "client"})
+	resp, _ := post(string(body), nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("follower returned status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+	if len(leaderLog) != 1 {
+		t.Errorf("leader log has %d entries, want 1", len(leaderLog))
+	}
+
+	// errors from the leader come back unchanged
+	resp, text := post(`{"type":"insert","schema_version":99}`, nil)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(text, ErrUnsupportedSchemaVersion.Error()) {
+		t.Errorf("invalid message got status %d %q, want the leader's 400", resp.StatusCode, text)
+	}
+
+	// a message that was already forwarded once isn't forwarded again
+	resp, _ = post(string(body), http.Header{forwardedByHeader: {"7"}})
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("message forwarded twice got status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	leaderLog, _, _, _ = h.GetLogsAndCommitIndexFromServer(origLeaderId)
+	if len(leaderLog) != 1 {
+		t.Errorf("leader log has %d entries, want 1", len(leaderLog))
+	}
+}
+
+func TestFollowerWithoutLeaderRejectsCRDT(t *testing.T) {
+	broker := newSingleBroker(t, nil)
+	defer shutdownNow(broker)
+
+	body, _ := json.Marshal(CRDTMessage{Type: "insert", Index: 0, Value: "a", ReplicaID: "r1", OpIndex: 1, Source: "client"})
+	resp, err := http.Post(fmt.Sprintf("http://%s/crdt", broker.GetHTTPAddr()), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("follower without a leader returned status %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestCRDTReceipt(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, term := h.CheckSingleLeader()
+	url := fmt.Sprintf("http://%s/crdt", h.cluster[origLeaderId].GetHTTPAddr())
+
+	post := func(msg CRDTMessage) (int, CRDTReceipt) {
+		body, _ := json.Marshal(msg)
+		resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var receipt CRDTReceipt
+		if err := json.NewDecoder(resp.Body).Decode(&receipt); err != nil {
+			t.Fatalf("decoding receipt: %v", err)
+		}
+		return resp.StatusCode, receipt
+	}
+
+	for i, value := range []string{"a", "b", "c"} {
+		msg := CRDTMessage{Type: "insert", Index: int64(i), Value: value, ReplicaID: "r1", OpIndex: 4, OpID: "op-" + value}
+		status, receipt := post(msg)
+		if status != http.StatusAccepted {
+			t.Fatalf("got status %d, want %d", status, http.StatusAccepted)
+		}
+		want := CRDTReceipt{Index: i, Term: term, Document: "4", BrokerID: origLeaderId, ReplicaID: "r1", OpIndex: 4, OpID: "op-" + value, Committed: true}
+		if receipt != want {
+			t.Errorf("got receipt %+v, want %+v", receipt, want)
+		}
+
+		leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+		if receipt.Index >= len(leaderLog) {
+			t.Fatalf("receipt index %d is past the end of the leader's log", receipt.Index)
+		}
+		if entry := leaderLog[receipt.Index]; entry.Term != receipt.Term || entry.Document != receipt.Document ||
+			entry.CRDTOperation.(CRDTMessage).Value != value {
+			t.Errorf("log entry %d is %+v, doesn't match receipt %+v", receipt.Index, entry, receipt)
+		}
+	}
+
+	// a retry gets the receipt of the first attempt
+	status, receipt := post(CRDTMessage{Type: "insert", Index: 1, Value: "b", ReplicaID: "r1", OpIndex: 4, OpID: "op-b"})
+	if status != http.StatusOK || receipt.Index != 1 {
+		t.Errorf("retry got status %d receipt %+v, want %d with index 1", status, receipt, http.StatusOK)
+	}
+}
+
+func TestReceiptOfUncommittedEntry(t *testing.T) {
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].ReceiptCommitTimeout = 100 * time.Millisecond
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	// commits need every member
+	h.DisconnectPeer((leaderId + 1) % 3)
+
+	post := func() (int, []byte) {
+		body := `{"type":"insert","index":0,"value":"a","replica_id":"r1","operation_index":4,"op_id":"op-1"}`
+		resp, err := http.Post(fmt.Sprintf("http://%s/crdt", h.cluster[leaderId].GetHTTPAddr()), "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		reply, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, reply
+	}
+
+	start := time.Now()
+	status, reply := post()
+	var receipt CRDTReceipt
+	if err := json.Unmarshal(reply, &receipt); err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusAccepted || receipt.Index != 0 {
+		t.Fatalf("got status %d receipt %+v, want %d with index 0", status, receipt, http.StatusAccepted)
+	}
+	if receipt.Committed {
+		t.Error("receipt says an entry that can't commit is committed")
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("leader took %s to reply, want about the 100ms timeout", waited)
+	}
+
+	// a retry doesn't get the receipt until the first attempt commits
+	if status, reply := post(); status != http.StatusAccepted || json.Unmarshal(reply, &CRDTReceipt{}) == nil {
+		t.Errorf("retry of an uncommitted entry got status %d and %q, want %d without a receipt", status, reply, http.StatusAccepted)
+	}
+	h.ReconnectPeer((leaderId + 1) % 3)
+	waitForApplied(t, h, []int{leaderId}, 0)
+	status, reply = post()
+	receipt = CRDTReceipt{}
+	if err := json.Unmarshal(reply, &receipt); err != nil || status != http.StatusOK || receipt.Index != 0 || !receipt.Committed {
+		t.Errorf("retry after the commit got status %d and %q, want %d with the committed receipt", status, reply, http.StatusOK)
+	}
+}
+
+func TestCommittedOperationsAreStructured(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+
+	msgs := []CRDTMessage{
+		{Type: OpInsert, Index: 0, Value: "h", ReplicaID: "r1", OpIndex: 7, Source: "client", SchemaVersion: CurrentSchemaVersion},
+		{Type: OpInsert, Index: 1, Value: "é", ReplicaID: "r1", OpIndex: 7, Source: "client", SchemaVersion: CurrentSchemaVersion},
+		{Type: OpDelete, Index: 0, ReplicaID: "r1", OpIndex: 7, Source: "client", SchemaVersion: CurrentSchemaVersion},
+	}
+	var last int
+	for _, msg := range msgs {
+		index, _, err := leader.SubmitOperation(msg)
+		if err != nil || index < 0 {
+			t.Fatalf("SubmitOperation(%+v) = %d, %v", msg, index, err)
+		}
+		last = index
+	}
+	if _, _, err := leader.SubmitOperation(CRDTMessage{Type: OpInsert, ReplicaID: "r1"}); err == nil {
+		t.Error("SubmitOperation accepted an insert without a value")
+	}
+	waitForApplied(t, h, []int{0, 1, 2}, last)
+
+	// read the entries back the way an application server does
+	resp, err := http.Get(fmt.Sprintf("http://%s/committedlog", leader.GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var entries []LogEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(msgs) {
+		t.Fatalf("committed log has %d entries, want %d", len(entries), len(msgs))
+	}
+
+	want, got := crdt.NewTextCRDT("r1"), crdt.NewTextCRDT("r1")
+	for i, entry := range entries {
+		op, err := entry.Operation()
+		if err != nil {
+			t.Fatalf("entry %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(op, msgs[i]) || entry.Document != "7" {
+			t.Errorf("entry %d holds %+v in %q, want %+v in \"7\"", i, op, entry.Document, msgs[i])
+		}
+
+		// the same edits on identical documents give identical crdt operations
+		var wantOp, gotOp crdt.Operation
+		switch op.Type {
+		case OpInsert:
+			wantOp, _ = want.LocalInsert(msgs[i].Index, msgs[i].Value)
+			gotOp, _ = got.LocalInsert(op.Index, op.Value)
+		case OpDelete:
+			wantOp, _ = want.LocalDelete(msgs[i].Index)
+			gotOp, _ = got.LocalDelete(op.Index)
+		}
+		if !reflect.DeepEqual(gotOp, wantOp) {
+			t.Errorf("entry %d rebuilds %+v, want %+v", i, gotOp, wantOp)
+		}
+	}
+	if rebuilt := got.Representation(); !reflect.DeepEqual(rebuilt, []interface{}{"é"}) {
+		t.Errorf("rebuilt document is %v, want [é]", rebuilt)
+	}
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	// let a heartbeat reach every follower
+	sleepMs(100)
+
+	leaders := 0
+	for i, broker := range h.Cluster() {
+		resp, err := http.Get(fmt.Sprintf("http://%s/status", broker.GetHTTPAddr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status BrokerStatus
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("decoding status of broker %d: %v", i, err)
+		}
+
+		if status.BrokerId != i {
+			t.Errorf("broker %d reports brokerid %d", i, status.BrokerId)
+		}
+		if status.State == Leader.String() {
+			leaders++
+		}
+		if status.Term != origTerm {
+			t.Errorf("broker %d reports term %d, want %d", i, status.Term, origTerm)
+		}
+		if status.LeaderId != origLeaderId {
+			t.Errorf("broker %d reports leader %d, want %d", i, status.LeaderId, origLeaderId)
+		}
+		if len(status.Peers) != 2 {
+			t.Errorf("broker %d reports %d peers, want 2", i, len(status.Peers))
+		}
+		for _, peer := range status.Peers {
+			if !peer.Connected {
+				t.Errorf("broker %d reports peer %d disconnected", i, peer.Id)
+			}
+		}
+	}
+	if leaders != 1 {
+		t.Errorf("%d brokers report being leader, want 1", leaders)
+	}
+}
+
+func TestReplicationLag(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[origLeaderId]
+	pausedId := (origLeaderId + 1) % h.n
+	runningId := (origLeaderId + 2) % h.n
+
+	if lag := h.cluster[pausedId].rm.ReplicationLag(); lag != nil {
+		t.Errorf("follower reports lag %v, want nil", lag)
+	}
+
+	h.DisconnectPeer(pausedId)
+	for i := 0; i < 3; i++ {
+		h.SubmitToServer(origLeaderId, "doc1", 100+i)
+		sleepMs(100)
+
+		lag := leader.rm.ReplicationLag()
+		if lag[pausedId] != i+1 {
+			t.Errorf("paused follower lags %d entries after %d submits, want %d", lag[pausedId], i+1, i+1)
+		}
+		if lag[runningId] != 0 {
+			t.Errorf("running follower lags %d entries, want 0", lag[runningId])
+		}
+	}
+
+	// the leader reports the same through /status
+	resp, err := http.Get(fmt.Sprintf("http://%s/status", leader.GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status BrokerStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range status.Peers {
+		want := 0
+		if peer.Id == pausedId {
+			want = 3
+		}
+		if peer.Lag == nil || *peer.Lag != want {
+			t.Errorf("status reports lag %v for peer %d, want %d", peer.Lag, peer.Id, want)
+		}
+	}
+
+	// the follower catches up once it is back. it may have started elections
+	// while it was away, so ask whichever broker leads now
+	h.ReconnectPeer(pausedId)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		leaderId, _ := h.CheckSingleLeader()
+		lag := h.cluster[leaderId].rm.ReplicationLag()
+		if lag[pausedId] == 0 && lag[runningId] == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reconnected follower still lags: %v", lag)
+		}
+		sleepMs(50)
+	}
+}
+
+func TestCRDTRejectsUnknownOpType(t *testing.T) {
+	var msg CRDTMessage
+	if err := json.Unmarshal([]byte(`{"type":"upsert","index":0}`), &msg); !errors.Is(err, ErrUnknownOpType) {
+		t.Errorf("decoding an unknown type returned %v, want %v", err, ErrUnknownOpType)
+	}
+}
+
+// listener that fails the first failures calls to Accept with err
+type faultyListener struct {
+	net.Listener
+	mu       sync.Mutex
+	failures int
+	err      error
+}
+
+func (l *faultyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.failures > 0 {
+		l.failures--
+		l.mu.Unlock()
+		return nil, l.err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func newSingleBroker(t *testing.T, wrap func(net.Listener) net.Listener) *BrokerServer {
+	t.Helper()
+	broker, err := NewBrokerServer(0, nil, map[int]string{}, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), BrokerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.wrapListener = wrap
+	if err := broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	return broker
+}
+
+func TestAcceptLoopSurvivesTemporaryErrors(t *testing.T) {
+	broker := newSingleBroker(t, func(l net.Listener) net.Listener {
+		return &faultyListener{Listener: l, failures: 3, err: temporaryError{}}
+	})
+	defer shutdownNow(broker)
+
+	client, err := rpc.Dial("tcp", broker.GetListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var reply RequestVoteReply
+	if err := client.Call("ElectionModule.RequestVote", RequestVoteArgs{Term: 0, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}, &reply); err != nil {
+		t.Fatalf("rpc after temporary accept errors: %v", err)
+	}
+	if reply.Id != 0 {
+		t.Errorf("reply from broker %d, want 0", reply.Id)
+	}
+
+	select {
+	case err := <-broker.ServeErrors():
+		t.Errorf("temporary errors stopped the accept loop: %v", err)
+	default:
+	}
+}
+
+func TestAcceptLoopReportsPermanentErrors(t *testing.T) {
+	permanent := errors.New("listener broke")
+	broker := newSingleBroker(t, func(l net.Listener) net.Listener {
+		return &faultyListener{Listener: l, failures: 1, err: permanent}
+	})
+	defer shutdownNow(broker)
+
+	select {
+	case err := <-broker.ServeErrors():
+		if err != permanent {
+			t.Errorf("got serve error %v, want %v", err, permanent)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("permanent accept error was not reported")
+	}
+}
+
+// an address in use is the caller's to handle, and Serve leaves nothing open
+func TestServeReturnsListenErrors(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpcAddr := free.Addr().String()
+	free.Close()
+
+	broker, err := NewBrokerServer(0, nil, map[int]string{}, taken.Addr().String(), Follower, make(chan any), make(chan CommitEntry), BrokerOptions{RPCAddr: rpcAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err == nil {
+		t.Fatalf("Serve on an http address in use returned no error")
+	}
+	// the rpc listener it opened first was closed again
+	listener, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		t.Fatalf("rpc address still in use after Serve failed: %v", err)
+	}
+	listener.Close()
+}
+
+// a log whose snapshot can't be read back
+type unreadableSnapshotStorage struct {
+	*MemoryStorage
+}
+
+func (unreadableSnapshotStorage) LoadSnapshot() (StorageSnapshot, bool, error) {
+	return StorageSnapshot{}, false, errors.New("snapshot unreadable")
+}
+
+func TestServeReturnsRestoreErrors(t *testing.T) {
+	storage := unreadableSnapshotStorage{NewMemoryStorage()}
+	if err := storage.SetHardState(HardState{CommitIndex: -1, LastApplied: -1, VotedFor: -1}); err != nil {
+		t.Fatal(err)
+	}
+
+	broker, err := NewBrokerServer(0, nil, map[int]string{}, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), BrokerOptions{RPCAddr: "127.0.0.1:0", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err == nil {
+		t.Fatalf("Serve with unreadable storage returned no error")
+	}
+}
+
+func TestConnectAllPeers(t *testing.T) {
+	const n = 3
+	peerAddrs := make(map[int]string)
+	for i := 0; i < n; i++ {
+		peerAddrs[i] = fmt.Sprintf("127.0.0.1:%d", 8100+i)
+	}
+
+	ready := make(chan any)
+	brokers := make([]*BrokerServer, n)
+	for i := range brokers {
+		var peerIds []int
+		for p := 0; p < n; p++ {
+			if p != i {
+				peerIds = append(peerIds, p)
+			}
+		}
+		broker, err := NewBrokerServerFromConfig(ClusterConfig{
+			BrokerId:     i,
+			PeerIds:      peerIds,
+			PeerAddrs:    peerAddrs,
+			HTTPAddr:     peerAddrs[i],
+			InitialState: Follower,
+			Ready:        ready,
+			CommitChan:   make(chan CommitEntry, 16),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := broker.Serve(); err != nil {
+			t.Fatal(err)
+		}
+		brokers[i] = broker
+	}
+	defer func() {
+		for _, broker := range brokers {
+			broker.DisconnectAll()
+		}
+		for _, broker := range brokers {
+			shutdownNow(broker)
+		}
+	}()
+
+	for i, broker := range brokers {
+		if err := broker.ConnectAllPeers(); err != nil {
+			t.Fatalf("broker %d: %v", i, err)
+		}
+	}
+	for i, broker := range brokers {
+		for _, peer := range broker.Status().Peers {
+			if !peer.Connected {
+				t.Errorf("broker %d has no client for peer %d", i, peer.Id)
+			}
+		}
+	}
+
+	// the connections carry rpcs, so the cluster can elect a leader
+	close(ready)
+	const timeout = 2 * time.Second
+	start := time.Now()
+	for {
+		leaders := 0
+		for _, broker := range brokers {
+			if _, _, isLeader := broker.em.Report(); isLeader {
+				leaders++
+			}
+		}
+		if leaders == 1 {
+			break
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("no single leader elected over the http rpc connections within %s", timeout)
+		}
+		sleepMs(10)
+	}
+
+	// a peer without an address can't be connected
+	if err := brokers[0].ConnectToPeerByID(7); err == nil {
+		t.Errorf("connecting to unconfigured peer 7 succeeded")
+	}
+}
+
+// crash hungId and point the leader's client for it at a listener that
+// accepts connections but never answers
+func hangPeer(t *testing.T, h *Harness, leaderId, hungId int) {
+	t.Helper()
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hung.Close() })
+	go func() {
+		for {
+			conn, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	h.CrashPeer(hungId)
+	conn, err := net.Dial("tcp", hung.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader := h.cluster[leaderId]
+	leader.mu.Lock()
+	leader.peerClients[hungId] = netRPCClient{rpc.NewClient(conn)}
+	leader.mu.Unlock()
+}
+
+func TestCallTimesOutOnHungPeer(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	leader := h.cluster[origLeaderId]
+	hungId := (origLeaderId + 1) % h.n
+	otherId := (origLeaderId + 2) % h.n
+
+	hangPeer(t, h, origLeaderId, hungId)
+
+	// calls to the hung peer give up after the rpc timeout
+	start := time.Now()
+	var reply AppendEntriesReply
+	err := leader.Call(context.Background(), hungId, "ReplicationModule.AppendEntries", AppendEntriesArgs{Term: origTerm, LeaderId: origLeaderId, PrevLogIndex: -1}, &reply)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("call to hung peer returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*defaultRPCTimeout {
+		t.Errorf("call to hung peer took %s", elapsed)
+	}
+
+	// meanwhile the other follower keeps getting heartbeats and never campaigns
+	sleepMs(500)
+	_, term, isLeader := leader.em.Report()
+	if !isLeader || term != origTerm {
+		t.Errorf("leader %d is leader=%t in term %d, want leader in term %d", origLeaderId, isLeader, term, origTerm)
+	}
+	if _, term, _ := h.cluster[otherId].em.Report(); term != origTerm {
+		t.Errorf("follower %d moved to term %d, want %d", otherId, term, origTerm)
+	}
+}
+
+const slowCRDTBody = `{"type":"insert","index":0,"value":"a","replica_id":"r1","operation_index":1,"source":"client"}`
+
+// post a CRDT message to addr but only send the first few bytes of the body
+// the caller writes the rest to the returned connection. the result is nil
+// once the broker accepts the message
+func startSlowCRDTRequest(t *testing.T, addr string) (net.Conn, <-chan error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := fmt.Sprintf("POST /crdt HTTP/1.1\r\nHost: %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n", addr, len(slowCRDTBody))
+	if _, err := conn.Write([]byte(header + slowCRDTBody[:10])); err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			result <- err
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			result <- fmt.Errorf("status %d", resp.StatusCode)
+			return
+		}
+		result <- nil
+	}()
+	return conn, result
+}
+
+func TestShutdownWaitsForInFlightCRDTRequest(t *testing.T) {
+	const grace = 300 * time.Millisecond
+	opts := make([]BrokerOptions, 3)
+	for i := range opts {
+		opts[i].ShutdownGracePeriod = grace
+	}
+	h := NewHarnessWithOptions(t, 3, opts)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+	conn, result := startSlowCRDTRequest(t, leader.GetHTTPAddr())
+	defer conn.Close()
+	sleepMs(50)
+
+	crashed := make(chan struct{})
+	go func() {
+		h.CrashPeer(leaderId)
+		close(crashed)
+	}()
+
+	// shutdown holds off while the request is still being read
+	sleepMs(100)
+	select {
+	case <-crashed:
+		t.Fatal("shutdown returned with a request in flight")
+	default:
+	}
+
+	conn.Write([]byte(slowCRDTBody[10:]))
+	if err := <-result; err != nil {
+		t.Errorf("in flight request failed during shutdown: %v", err)
+	}
+	<-crashed
+
+	leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(leaderId)
+	if len(leaderLog) != 1 {
+		t.Errorf("leader log has %d entries, want the in flight request's 1", len(leaderLog))
+	}
+}
+
+func TestShutdownCancelsStuckCRDTRequest(t *testing.T) {
+	const grace = 300 * time.Millisecond
+	opts := make([]BrokerOptions, 3)
+	for i := range opts {
+		opts[i].ShutdownGracePeriod = grace
+	}
+	h := NewHarnessWithOptions(t, 3, opts)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	conn, result := startSlowCRDTRequest(t, h.cluster[leaderId].GetHTTPAddr())
+	defer conn.Close()
+	sleepMs(50)
+
+	// the rest of the body never comes, the connection is closed after the grace period
+	start := time.Now()
+	h.CrashPeer(leaderId)
+	elapsed := time.Since(start)
+	if elapsed < grace || elapsed > grace+2*time.Second {
+		t.Errorf("shutdown took %s, want a little over the %s grace period", elapsed, grace)
+	}
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("stuck request succeeded, want it cancelled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stuck request still hanging after shutdown")
+	}
+}
+
+func TestNewBrokerServerRejectsInvalidHTTPAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "127.0.0.1:80800", "127.0.0.1:http-ish", "localhost;8000"} {
+		broker, err := NewBrokerServer(0, nil, map[int]string{}, addr, Follower, make(chan any), make(chan CommitEntry), BrokerOptions{})
+		if !errors.Is(err, ErrInvalidHTTPAddr) {
+			t.Errorf("NewBrokerServer with http address %q returned error %v, want %v", addr, err, ErrInvalidHTTPAddr)
+		}
+		if broker != nil {
+			t.Errorf("NewBrokerServer with http address %q returned a broker", addr)
+		}
+	}
+
+	// valid addresses still work, including ones that pick a free port
+	for _, addr := range []string{"127.0.0.1:8080", "127.0.0.1:0", ":8080"} {
+		if _, err := NewBrokerServer(0, nil, map[int]string{}, addr, Follower, make(chan any), make(chan CommitEntry), BrokerOptions{}); err != nil {
+			t.Errorf("NewBrokerServer with http address %q failed: %v", addr, err)
+		}
+	}
+}
+
+func TestHungPeerDoesNotStallReplication(t *testing.T) {
+	loggers := make([]*captureLogger, 3)
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		loggers[i] = new(captureLogger)
+		options[i].Logger = loggers[i]
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	hungId := (leaderId + 1) % h.n
+	healthyId := (leaderId + 2) % h.n
+	hangPeer(t, h, leaderId, hungId)
+
+	// submitting needs mu2, which no AE to the hung peer holds while waiting
+	start := time.Now()
+	for cmd := 0; cmd < 3; cmd++ {
+		if h.SubmitToServer(leaderId, "doc1", cmd) < 0 {
+			t.Fatalf("broker %d stopped leading", leaderId)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > defaultRPCTimeout {
+		t.Errorf("submitting took %s with a hung peer", elapsed)
+	}
+
+	// the healthy follower gets every entry while AEs to the hung peer time out
+	// nothing commits, commits are atomic so they wait for the hung peer too
+	deadline := time.Now().Add(time.Second)
+	for {
+		log, _, _, _ := h.GetLogsAndCommitIndexFromServer(healthyId)
+		if len(log) == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("healthy follower %d has %d entries, want 3", healthyId, len(log))
+		}
+		sleepMs(10)
+	}
+
+	timedOut := func() bool {
+		for _, r := range loggers[leaderId].find("AE timed out, peer unreachable this round") {
+			if r.level == "warn" && r.attr("peer") == hungId {
+				return true
+			}
+		}
+		return false
+	}
+	for !timedOut() {
+		if time.Now().After(deadline) {
+			t.Fatalf("leader %d never warned about AEs to hung peer %d timing out", leaderId, hungId)
+		}
+		sleepMs(10)
+	}
+}
+
+func TestShutdownDeliversOrRejectsSubmit(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+
+	index := leader.rm.Submit("doc1", 42)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := leader.Shutdown(ctx)
+	h.alive[leaderId] = false
+
+	if index < 0 {
+		// rejected before it was appended, that's fine too
+		return
+	}
+	if err != nil {
+		t.Fatalf("shutdown after submitting entry %d: %v", index, err)
+	}
+	// the entry was delivered on commitChan before Shutdown returned
+	deadline := time.Now().Add(time.Second)
+	for {
+		h.mu.Lock()
+		commits := slices.Clone(h.commits[leaderId])
+		h.mu.Unlock()
+		if slices.ContainsFunc(commits, func(c CommitEntry) bool { return c.CRDTOperation == 42 && c.Index == index }) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry %d accepted before shutdown never delivered, got %+v", index, commits)
+		}
+		sleepMs(10)
+	}
+
+	if index := leader.rm.Submit("doc1", 43); index >= 0 {
+		t.Errorf("submit after shutdown appended entry %d", index)
+	}
+}
+
+func TestShutdownReportsUndeliveredEntries(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+	for j := 0; j < h.n; j++ {
+		if j != leaderId {
+			h.DisconnectPeer(j)
+		}
+	}
+
+	// can't commit without the followers
+	if index := leader.rm.Submit("doc1", 42); index < 0 {
+		t.Fatalf("want id=%d leader, but it's not", leaderId)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := leader.Shutdown(ctx)
+	h.alive[leaderId] = false
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("shutdown with an uncommitted entry returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("shutdown took %s, want it to give up when ctx is done", elapsed)
+	}
+}
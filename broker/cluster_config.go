@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// everything needed to construct a broker server
+// use NewBrokerServerFromConfig to have it checked before anything starts
+type ClusterConfig struct {
+	BrokerId int
+
+	// ids of every other broker in the cluster
+	PeerIds []int
+
+	// http addresses of the brokers, by id. must have every peer and may have this broker
+	PeerAddrs map[int]string
+
+	// http address this broker serves the application server on
+	HTTPAddr string
+
+	InitialState ServerState
+
+	// closed to start the election timer, so brokers in a cluster start together
+	Ready <-chan any
+
+	CommitChan chan<- CommitEntry
+
+	Options BrokerOptions
+}
+
+var ErrInvalidClusterConfig = errors.New("invalid cluster config")
+
+func invalidConfig(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidClusterConfig, fmt.Sprintf(format, a...))
+}
+
+// check the invariants NewBrokerServer relies on but doesn't check itself
+func (cfg ClusterConfig) Validate() error {
+	if cfg.BrokerId < 0 {
+		return invalidConfig("broker id %d is negative", cfg.BrokerId)
+	}
+	if cfg.HTTPAddr == "" {
+		return invalidConfig("broker %d has no http address", cfg.BrokerId)
+	}
+	if err := checkHTTPAddr(cfg.HTTPAddr); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidClusterConfig, err)
+	}
+	if cfg.InitialState == Dead {
+		return invalidConfig("broker %d can't start %s", cfg.BrokerId, cfg.InitialState)
+	}
+	if cfg.Ready == nil {
+		return invalidConfig("broker %d has no ready channel", cfg.BrokerId)
+	}
+	if cfg.CommitChan == nil {
+		return invalidConfig("broker %d has no commit channel", cfg.BrokerId)
+	}
+
+	for i, peerId := range cfg.PeerIds {
+		if peerId == cfg.BrokerId {
+			return invalidConfig("broker %d lists itself as a peer", cfg.BrokerId)
+		}
+		if peerId < 0 {
+			return invalidConfig("peer id %d is negative", peerId)
+		}
+		if slices.Contains(cfg.PeerIds[:i], peerId) {
+			return invalidConfig("peer %d is listed more than once", peerId)
+		}
+		if addr, ok := cfg.PeerAddrs[peerId]; !ok || addr == "" {
+			return invalidConfig("peer %d has no address", peerId)
+		}
+	}
+
+	for id, addr := range cfg.PeerAddrs {
+		if id == cfg.BrokerId {
+			if addr != cfg.HTTPAddr {
+				return invalidConfig("broker %d has address %s in PeerAddrs but serves on %s", id, addr, cfg.HTTPAddr)
+			}
+			continue
+		}
+		if !slices.Contains(cfg.PeerIds, id) {
+			return invalidConfig("PeerAddrs has an address for %d which is not a peer of broker %d", id, cfg.BrokerId)
+		}
+	}
+	return nil
+}
+
+func NewBrokerServerFromConfig(cfg ClusterConfig) (*BrokerServer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return NewBrokerServer(cfg.BrokerId, cfg.PeerIds, cfg.PeerAddrs, cfg.HTTPAddr, cfg.InitialState, cfg.Ready, cfg.CommitChan, cfg.Options)
+}
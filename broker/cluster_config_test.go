@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+)
+
+func validClusterConfig() ClusterConfig {
+	return ClusterConfig{
+		BrokerId: 0,
+		PeerIds:  []int{1, 2},
+		PeerAddrs: map[int]string{
+			0: "127.0.0.1:8000",
+			1: "127.0.0.1:8001",
+			2: "127.0.0.1:8002",
+		},
+		HTTPAddr:     "127.0.0.1:8000",
+		InitialState: Follower,
+		Ready:        make(chan any),
+		CommitChan:   make(chan CommitEntry),
+	}
+}
+
+func TestNewBrokerServerFromConfig(t *testing.T) {
+	broker, err := NewBrokerServerFromConfig(validClusterConfig())
+	if err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+	if broker.brokerid != 0 || len(broker.peerIds) != 2 || broker.httpAddr != "127.0.0.1:8000" {
+		t.Errorf("broker built with id %d, peers %v, http addr %s", broker.brokerid, broker.peerIds, broker.httpAddr)
+	}
+
+	// PeerAddrs doesn't need an entry for the broker itself
+	cfg := validClusterConfig()
+	delete(cfg.PeerAddrs, 0)
+	if _, err := NewBrokerServerFromConfig(cfg); err != nil {
+		t.Errorf("config without own address rejected: %v", err)
+	}
+}
+
+func TestClusterConfigValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *ClusterConfig)
+	}{
+		{"negative broker id", func(cfg *ClusterConfig) { cfg.BrokerId = -1 }},
+		{"missing http address", func(cfg *ClusterConfig) { cfg.HTTPAddr = "" }},
+		{"http address without port", func(cfg *ClusterConfig) { cfg.HTTPAddr, cfg.PeerAddrs[0] = "127.0.0.1", "127.0.0.1" }},
+		{"starts dead", func(cfg *ClusterConfig) { cfg.InitialState = Dead }},
+		{"missing ready channel", func(cfg *ClusterConfig) { cfg.Ready = nil }},
+		{"missing commit channel", func(cfg *ClusterConfig) { cfg.CommitChan = nil }},
+		{"self in peer list", func(cfg *ClusterConfig) { cfg.PeerIds = []int{0, 1, 2} }},
+		{"negative peer id", func(cfg *ClusterConfig) { cfg.PeerIds = []int{1, 2, -1} }},
+		{"duplicate peer", func(cfg *ClusterConfig) { cfg.PeerIds = []int{1, 2, 1} }},
+		{"peer without address", func(cfg *ClusterConfig) { delete(cfg.PeerAddrs, 2) }},
+		{"peer with empty address", func(cfg *ClusterConfig) { cfg.PeerAddrs[2] = "" }},
+		{"address for unknown broker", func(cfg *ClusterConfig) { cfg.PeerAddrs[3] = "127.0.0.1:8003" }},
+		{"own address mismatch", func(cfg *ClusterConfig) { cfg.PeerAddrs[0] = "127.0.0.1:9000" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validClusterConfig()
+			tt.modify(&cfg)
+			broker, err := NewBrokerServerFromConfig(cfg)
+			if !errors.Is(err, ErrInvalidClusterConfig) {
+				t.Errorf("got error %v, want %v", err, ErrInvalidClusterConfig)
+			}
+			if broker != nil {
+				t.Errorf("got a broker for an invalid config")
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// elections, replication and the http handlers all at once, for go test -race.
+// the brokers have to agree on their logs afterwards
+func TestConcurrentElectionReplicationAndHTTP(t *testing.T) {
+	const duration = 2 * time.Second
+
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	h.CheckSingleLeader()
+
+	client := &http.Client{Timeout: time.Second}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	run := func(seed int64, step func(r *rand.Rand)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				step(r)
+			}
+		}()
+	}
+	url := func(r *rand.Rand, path string) string {
+		return fmt.Sprintf("http://%s%s", h.cluster[r.Intn(3)].GetHTTPAddr(), path)
+	}
+	drain := func(resp *http.Response, err error) {
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	// writes to any broker, followers forward them to the leader
+	for writer := range 3 {
+		run(int64(writer), func(r *rand.Rand) {
+			body, _ := json.Marshal(CRDTMessage{Type: OpInsert, Index: 0, Value: "a", ReplicaID: fmt.Sprintf("r%d", writer), OpIndex: 1, Source: "client"})
+			drain(client.Post(url(r, "/crdt"), "application/json", bytes.NewReader(body)))
+		})
+	}
+	paths := []string{"/status", "/leader", "/readyz", "/committedlog", "/document/1/watermark", "/metrics/election"}
+	for reader := range 2 {
+		run(int64(10+reader), func(r *rand.Rand) {
+			drain(client.Get(url(r, paths[r.Intn(len(paths))])))
+		})
+	}
+	run(20, func(r *rand.Rand) {
+		broker := h.cluster[r.Intn(3)]
+		broker.em.Report()
+		broker.Status()
+		broker.Readiness()
+		broker.rm.ReplicationLag()
+		sleepMs(1)
+	})
+
+	// elections, step downs and links going down and up again
+	run(30, func(r *rand.Rand) {
+		i, j := r.Intn(3), r.Intn(3)
+		switch r.Intn(3) {
+		case 0:
+			h.cluster[i].em.ForceElection()
+		case 1:
+			h.cluster[i].em.StepDown()
+		case 2:
+			if i == j {
+				break
+			}
+			h.cluster[i].DisconnectPeer(j)
+			sleepMs(r.Intn(50))
+			if err := h.cluster[i].ConnectToPeer(j, h.cluster[j].GetListenAddr()); err != nil {
+				t.Errorf("reconnecting %d to %d: %v", i, j, err)
+			}
+		}
+		sleepMs(50 + r.Intn(100))
+	})
+
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+
+	// every link is back, so the cluster settles and commits again
+	sleepMs(500)
+	leaderId, _ := h.CheckSingleLeader()
+	first, _ := h.cluster[leaderId].rm.submitBatch([]LogEntry{{CRDTOperation: insertOp("z"), Document: "1"}})
+	if first < 0 {
+		t.Fatalf("leader %d refused the entry", leaderId)
+	}
+	waitForApplied(t, h, []int{0, 1, 2}, first)
+	h.CompareCommittedLogs()
+}
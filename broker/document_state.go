@@ -0,0 +1,373 @@
+package broker
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/townsag/clarity/crdt"
+)
+
+// materialized state of every document, built by applying committed log entries
+// periodically checkpointed so a restarted broker only has to replay the log suffix
+type documentStore struct {
+	mu sync.Mutex
+
+	brokerid int
+	logger   Logger
+
+	docs map[string]*crdt.TextCRDT
+
+	// log index of the last entry applied to docs
+	lastApplied int
+
+	// number of committed entries of each document applied, see watermark.go
+	committed map[string]int
+
+	checkpointPath     string
+	checkpointInterval int
+	sinceCheckpoint    int
+
+	// number of entries applied since this store was created
+	replayed int
+
+	compactionInterval int
+	// entries applied that no compaction covered yet
+	sinceCompaction int
+	// the clock of each document after every entry applied to it since the
+	// last compaction that covered the entry, oldest first
+	clocks map[string][]indexedClock
+}
+
+// the clock a document had once the entry at index was applied
+type indexedClock struct {
+	index int
+	clock crdt.VectorClock
+}
+
+// clocks kept per document while a member lags behind
+const maxClocksPerDocument = 256
+
+// drop every other clock but the last once there are too many. compacting
+// with an older clock than the member has seen removes less, never too much
+func thinClocks(clocks []indexedClock) []indexedClock {
+	if len(clocks) <= maxClocksPerDocument {
+		return clocks
+	}
+	kept := clocks[:0]
+	for i := (len(clocks) - 1) % 2; i < len(clocks); i += 2 {
+		kept = append(kept, clocks[i])
+	}
+	return kept
+}
+
+// what is written to disk at every checkpoint
+type documentCheckpoint struct {
+	LastApplied int
+	Documents   map[string]crdt.TextCRDTSnapshot
+
+	// entries of each document up to LastApplied. empty in checkpoints from
+	// before watermarks, their counts start over from the checkpoint
+	Committed map[string]int
+}
+
+func newDocumentStore(brokerid int, opts BrokerOptions, logger Logger) *documentStore {
+	ds := new(documentStore)
+	ds.brokerid = brokerid
+	ds.logger = logger
+	ds.docs = make(map[string]*crdt.TextCRDT)
+	ds.committed = make(map[string]int)
+	ds.clocks = make(map[string][]indexedClock)
+	ds.lastApplied = -1
+	ds.checkpointPath = opts.CheckpointPath
+	ds.checkpointInterval = opts.CheckpointInterval
+	ds.compactionInterval = opts.CompactionInterval
+	if ds.checkpointInterval <= 0 {
+		ds.checkpointInterval = defaultCheckpointInterval
+	}
+
+	if ds.checkpointPath != "" {
+		if err := ds.loadCheckpoint(); err != nil && !os.IsNotExist(err) {
+			ds.logger.Warn("could not load document checkpoint", "path", ds.checkpointPath, "err", err)
+		}
+	}
+	return ds
+}
+
+// apply the committed entry at log index to its document
+// entries at or before lastApplied are already part of the state and are skipped
+func (ds *documentStore) apply(index int, entry LogEntry) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if index <= ds.lastApplied {
+		return
+	}
+	ds.lastApplied = index
+	ds.committed[entry.Document]++
+
+	// membership changes and rollbacks don't belong to any document
+	if isConfigEntry(entry) || isRollbackNotice(entry) {
+		return
+	}
+
+	doc, ok := ds.docs[entry.Document]
+	if !ok {
+		doc = crdt.NewTextCRDT(fmt.Sprintf("broker%d", ds.brokerid))
+		ds.docs[entry.Document] = doc
+	}
+	if err := applyToDocument(doc, entry.operation()); err != nil {
+		ds.logger.Warn("could not apply entry to document", "index", index, "document", entry.Document, "err", err)
+	}
+	ds.replayed++
+	if ds.compactionInterval > 0 {
+		ds.sinceCompaction++
+		ds.clocks[entry.Document] = thinClocks(append(ds.clocks[entry.Document], indexedClock{index, doc.VersionClock()}))
+	}
+
+	ds.sinceCheckpoint++
+	if ds.checkpointPath != "" && ds.sinceCheckpoint >= ds.checkpointInterval {
+		if err := ds.writeCheckpoint(); err != nil {
+			ds.logger.Error("could not write document checkpoint", "err", err)
+		}
+	}
+}
+
+// drop tombstones every member has seen once enough entries have been applied
+// safeIndex is the highest log index known to be on every member, the minimum
+// matchIndex on the leader. each document is compacted with the clock it had
+// at safeIndex, so the deletes a lagging member doesn't have yet keep their
+// tombstones
+func (ds *documentStore) maybeCompact(safeIndex int) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if ds.compactionInterval <= 0 || ds.sinceCompaction < ds.compactionInterval {
+		return
+	}
+
+	removed := 0
+	for name, clocks := range ds.clocks {
+		// the last clock at or before safeIndex is the one every member has
+		covered := 0
+		for covered < len(clocks) && clocks[covered].index <= safeIndex {
+			covered++
+		}
+		if covered == 0 {
+			continue
+		}
+		removed += ds.docs[name].Compact(clocks[covered-1].clock)
+		if covered == len(clocks) {
+			delete(ds.clocks, name)
+		} else {
+			ds.clocks[name] = clocks[covered:]
+		}
+	}
+	ds.sinceCompaction = max(ds.lastApplied-safeIndex, 0)
+	if removed > 0 {
+		ds.logger.Info("compacted tombstones", "removed", removed, "index", safeIndex)
+	}
+}
+
+// an entry at an index the document doesn't have returns crdt.ErrOutOfRange
+// and changes nothing. entries carrying the application server's crdt
+// operation are applied with it instead, so the documents have the same nodes
+// as the application servers' and can be sent to them as a snapshot
+func applyToDocument(doc *crdt.TextCRDT, operation any) error {
+	msg, err := parseCRDTOperation(operation)
+	if err != nil {
+		return err
+	}
+
+	if len(msg.Operation) > 0 {
+		if op, err := crdt.UnmarshalOperation(msg.Operation); err == nil {
+			if _, err := doc.Apply(op); err != nil && !errors.Is(err, crdt.ErrAlreadyDeleted) {
+				return err
+			}
+			return nil
+		}
+	}
+	switch msg.Type {
+	case OpInsert:
+		_, err = doc.LocalInsert(msg.Index, msg.Value)
+	case OpDelete:
+		_, err = doc.LocalDelete(msg.Index)
+	default:
+		return fmt.Errorf("unknown operation type %s", msg.Type)
+	}
+	return err
+}
+
+// brokers before structured log entries submitted operations formatted as
+// Type[%s] Index[%d] Value[%+v], and those can still be in stored logs
+var crdtOperationPattern = regexp.MustCompile(`(?s)^Type\[(\w*)\] Index\[(-?\d+)\] Value\[(.*)\]$`)
+
+func init() {
+	gob.Register(CRDTMessage{})
+}
+
+// the crdt operation an entry carries. entries read from the http endpoints
+// hold it as decoded json, and older logs as a formatted string
+func (entry LogEntry) Operation() (CRDTMessage, error) {
+	return parseCRDTOperation(entry.operation())
+}
+
+func parseCRDTOperation(operation any) (CRDTMessage, error) {
+	switch op := operation.(type) {
+	case CRDTMessage:
+		return op, nil
+	case map[string]any:
+		data, err := json.Marshal(op)
+		if err != nil {
+			return CRDTMessage{}, err
+		}
+		var msg CRDTMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return CRDTMessage{}, err
+		}
+		// config entries decode to maps too
+		if !msg.Type.Valid() {
+			return CRDTMessage{}, fmt.Errorf("%w %q", ErrUnknownOpType, msg.Type)
+		}
+		return msg, nil
+	case string:
+		match := crdtOperationPattern.FindStringSubmatch(op)
+		if match == nil {
+			return CRDTMessage{}, fmt.Errorf("malformed crdt operation %q", op)
+		}
+		index, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return CRDTMessage{}, err
+		}
+		return CRDTMessage{Type: OpType(match[1]), Index: index, Value: match[3]}, nil
+	default:
+		return CRDTMessage{}, fmt.Errorf("unsupported crdt operation %T", operation)
+	}
+}
+
+// write to a temp file first so a crash mid write can't corrupt the last good checkpoint
+// caller must hold ds.mu
+func (ds *documentStore) writeCheckpoint() error {
+	checkpoint := ds.currentCheckpoint()
+
+	tmpPath := ds.checkpointPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(checkpoint); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, ds.checkpointPath); err != nil {
+		return err
+	}
+
+	ds.sinceCheckpoint = 0
+	ds.logger.Info("checkpointed documents", "documents", len(ds.docs), "index", ds.lastApplied)
+	return nil
+}
+
+func (ds *documentStore) loadCheckpoint() error {
+	file, err := os.Open(ds.checkpointPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var checkpoint documentCheckpoint
+	if err := gob.NewDecoder(file).Decode(&checkpoint); err != nil {
+		return err
+	}
+
+	ds.restoreCheckpoint(checkpoint)
+	ds.logger.Info("restored documents from checkpoint", "documents", len(ds.docs), "index", ds.lastApplied)
+	return nil
+}
+
+// copy of every document and the log index they're up to. caller must hold ds.mu
+func (ds *documentStore) currentCheckpoint() documentCheckpoint {
+	checkpoint := documentCheckpoint{
+		LastApplied: ds.lastApplied,
+		Documents:   make(map[string]crdt.TextCRDTSnapshot, len(ds.docs)),
+		Committed:   maps.Clone(ds.committed),
+	}
+	for name, doc := range ds.docs {
+		checkpoint.Documents[name] = doc.Snapshot()
+	}
+	return checkpoint
+}
+
+// replace every document with the ones in checkpoint. caller must hold ds.mu
+func (ds *documentStore) restoreCheckpoint(checkpoint documentCheckpoint) {
+	ds.docs = make(map[string]*crdt.TextCRDT, len(checkpoint.Documents))
+	// the clocks of the replaced documents don't apply any more
+	ds.clocks = make(map[string][]indexedClock)
+	ds.sinceCompaction = 0
+	for name, snapshot := range checkpoint.Documents {
+		ds.docs[name] = crdt.NewTextCRDTFromSnapshot(snapshot)
+	}
+	ds.lastApplied = checkpoint.LastApplied
+	ds.committed = make(map[string]int, len(checkpoint.Committed))
+	maps.Copy(ds.committed, checkpoint.Committed)
+}
+
+// the documents as a log snapshot, see snapshot.go
+func (ds *documentStore) snapshot() documentCheckpoint {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.currentCheckpoint()
+}
+
+// replace the documents with a snapshot unless they already include every entry in it
+func (ds *documentStore) installSnapshot(snapshot documentCheckpoint) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if snapshot.LastApplied <= ds.lastApplied {
+		return
+	}
+	ds.restoreCheckpoint(snapshot)
+	ds.logger.Info("installed document snapshot", "documents", len(ds.docs), "index", ds.lastApplied)
+}
+
+// number of committed entries of document applied
+func (ds *documentStore) watermark(document string) int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.committed[document]
+}
+
+// log index of the last entry applied to the documents
+func (ds *documentStore) appliedIndex() int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.lastApplied
+}
+
+func (ds *documentStore) checkpoint() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.checkpointPath == "" {
+		return nil
+	}
+	return ds.writeCheckpoint()
+}
+
+func (ds *documentStore) representation(document string) ([]interface{}, bool) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	doc, ok := ds.docs[document]
+	if !ok {
+		return nil, false
+	}
+	return doc.Representation(), true
+}
@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDocumentStateCheckpointRestore(t *testing.T) {
+	opts := BrokerOptions{
+		CheckpointPath:     filepath.Join(t.TempDir(), "documents.checkpoint"),
+		CheckpointInterval: 1500,
+	}
+
+	// 5000 committed inserts, the last checkpoint lands after entry 4499
+	entries := make([]LogEntry, 5000)
+	for i := range entries {
+		op := fmt.Sprintf("Type[insert] Index[%d] Value[%c]", i, 'a'+i%26)
+		entries[i] = LogEntry{CRDTOperation: op, Term: 1, Document: "doc1"}
+	}
+
+	ds := newDocumentStore(0, opts, slog.Default())
+	for i, entry := range entries {
+		ds.apply(i, entry)
+	}
+	want, ok := ds.representation("doc1")
+	if !ok || len(want) != len(entries) {
+		t.Fatalf("want %d characters before restart, got %d", len(entries), len(want))
+	}
+
+	// after a restart the leader sends the whole committed log again
+	start := time.Now()
+	restarted := newDocumentStore(0, opts, slog.Default())
+	for i, entry := range entries {
+		restarted.apply(i, entry)
+	}
+	tlog("restored and replayed in %s", time.Since(start))
+
+	got, _ := restarted.representation("doc1")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered representation differs from the one before restart")
+	}
+	if restarted.replayed != 500 {
+		t.Errorf("want only the 500 entry suffix replayed, got %d", restarted.replayed)
+	}
+}
+
+func TestDocumentStateFollowsCommits(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+
+	for i, value := range []string{"a", "b", "c"} {
+		op := fmt.Sprintf("Type[insert] Index[%d] Value[%s]", i, value)
+		if h.SubmitToServer(origLeaderId, "doc1", op) < 0 {
+			t.Fatalf("want id=%d leader, but it's not", origLeaderId)
+		}
+		h.WaitForCommit(i)
+	}
+
+	want := []interface{}{"a", "b", "c"}
+	const timeout = 5 * time.Second
+	start := time.Now()
+	for serverId := 0; serverId < h.n; serverId++ {
+		for {
+			got, _ := h.cluster[serverId].DocumentState("doc1")
+			if reflect.DeepEqual(got, want) {
+				break
+			}
+			if time.Since(start) > timeout {
+				t.Fatalf("server %d document state %v, want %v", serverId, got, want)
+			}
+			sleepMs(10)
+		}
+	}
+}
+
+func TestDocumentStateCompaction(t *testing.T) {
+	ds := newDocumentStore(0, BrokerOptions{CompactionInterval: 1}, slog.Default())
+
+	// type "abcdef" then delete "def" from the end
+	var entries []LogEntry
+	for i, value := range "abcdef" {
+		op := fmt.Sprintf("Type[insert] Index[%d] Value[%c]", i, value)
+		entries = append(entries, LogEntry{CRDTOperation: op, Term: 1, Document: "doc1"})
+	}
+	for i := 5; i >= 3; i-- {
+		op := fmt.Sprintf("Type[delete] Index[%d] Value[]", i)
+		entries = append(entries, LogEntry{CRDTOperation: op, Term: 1, Document: "doc1"})
+	}
+	for i, entry := range entries {
+		ds.apply(i, entry)
+	}
+
+	want, _ := ds.representation("doc1")
+	nodesBefore := ds.docs["doc1"].NodeCount()
+
+	// a member that hasn't caught up with the last delete keeps that
+	// tombstone around, the ones it has are dropped but for the "e" right
+	// after the "d" it still has, inserts after the "d" go under it
+	ds.maybeCompact(len(entries) - 2)
+	if got := ds.docs["doc1"].NodeCount(); got != nodesBefore-1 {
+		t.Errorf("compacted to %d nodes while a member was behind, want %d", got, nodesBefore-1)
+	}
+
+	// the "d" right after the "c" stays for the same reason
+	ds.maybeCompact(len(entries) - 1)
+	if got := ds.docs["doc1"].NodeCount(); got != nodesBefore-2 {
+		t.Errorf("got %d nodes after compaction, want %d", got, nodesBefore-2)
+	}
+	got, _ := ds.representation("doc1")
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(got, []interface{}{"a", "b", "c"}) {
+		t.Errorf("document state changed by compaction: %v, want %v", got, want)
+	}
+}
+
+func TestThinClocksKeepsLatest(t *testing.T) {
+	var clocks []indexedClock
+	for i := range 1000 {
+		clocks = thinClocks(append(clocks, indexedClock{index: i}))
+	}
+	if len(clocks) > maxClocksPerDocument {
+		t.Errorf("kept %d clocks, want at most %d", len(clocks), maxClocksPerDocument)
+	}
+	if clocks[0].index != 0 || clocks[len(clocks)-1].index != 999 {
+		t.Errorf("kept clocks of entries %d to %d, want 0 to 999", clocks[0].index, clocks[len(clocks)-1].index)
+	}
+}
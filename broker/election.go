@@ -1,56 +1,127 @@
 package broker
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// how often the leader sends AppendEntries when there is nothing new to send
+const defaultHeartbeatInterval = 25 * time.Millisecond
+
+// followers start an election after a random timeout in this range without
+// hearing from a leader
+const (
+	defaultMinElectionTimeout = 150 * time.Millisecond
+	defaultMaxElectionTimeout = 300 * time.Millisecond
 )
 
+func (opts BrokerOptions) heartbeatInterval() time.Duration {
+	if opts.HeartbeatInterval <= 0 {
+		return defaultHeartbeatInterval
+	}
+	return opts.HeartbeatInterval
+}
+
+// range followers pick their election timeout from
+func (opts BrokerOptions) electionTimeouts() (time.Duration, time.Duration) {
+	minTimeout, maxTimeout := opts.MinElectionTimeout, opts.MaxElectionTimeout
+	if minTimeout <= 0 {
+		minTimeout = defaultMinElectionTimeout
+	}
+	if maxTimeout <= 0 {
+		maxTimeout = max(defaultMaxElectionTimeout, 2*minTimeout)
+	}
+	return minTimeout, maxTimeout
+}
+
+// a follower has to hear at least two heartbeats before its election timeout
+// can run out, or one late heartbeat starts an election
+func (opts BrokerOptions) checkElectionTimeouts() error {
+	minTimeout, maxTimeout := opts.electionTimeouts()
+	if maxTimeout < minTimeout {
+		return fmt.Errorf("%w: %s < %s", ErrElectionTimeoutRange, maxTimeout, minTimeout)
+	}
+	if heartbeat := opts.heartbeatInterval(); heartbeat >= minTimeout/2 {
+		return fmt.Errorf("%w: %s >= %s / 2", ErrHeartbeatTooSlow, heartbeat, minTimeout)
+	}
+	return nil
+}
+
+// first step of the backoff after a failed election, it doubles with every
+// further failure up to BrokerOptions.ElectionBackoffCeiling
+const electionBackoffStep = 150 * time.Millisecond
+
+var ErrHeartbeatTooSlow = errors.New("heartbeat interval has to be under half the minimum election timeout")
+var ErrElectionTimeoutRange = errors.New("maximum election timeout is under the minimum")
+
+var ErrNoLeader = errors.New("no leader known")
+
 type ElectionModule struct {
 	broker *BrokerServer
 
 	// id of connected server
 	id int
 
-	// peers of connected server
-	peerIds []int
-
 	// persistent state on all servers
 	// should be replicated across all brokers
 	term     int // what is the current term
 	votedFor int // who this server voted for
 
+	// starts an election when it fires. resetElectionTimer runs both with and
+	// without mu2, so the timer has a lock of its own
+	timerMu       sync.Mutex
 	electionTimer *time.Timer
 
-	// map is like a python dict
-	nextIndex  map[int]int
-	matchIndex map[int]int
+	// elections in a row this broker started without winning or hearing from a leader
+	// atomic since resetElectionTimer runs both with and without mu2
+	failedElections atomic.Int32
+
+	// unix nanoseconds before which this broker doesn't start an election, set
+	// by StepDown so the others get a head start. atomic like failedElections
+	holdElectionsUntil atomic.Int64
+
+	// see election_metrics.go
+	metrics ElectionMetrics
 
-	//////////////////////////////////////////////////
-	// below didn't end up being implemented in time
-	//////////////////////////////////////////////////
 	// in the case a follower receives an http request
-	// each broker keeps track of who the leader is and a list of peer addresses
-	// so the follower can send an http reply back with the leader's address
+	// each broker keeps track of who the leader is and a list of peer http addresses
+	// so the follower can redirect the request to the leader
 	leaderId  int
 	peerAddrs map[int]string
+
+	// where term and votedFor are persisted, nil to keep them in memory only
+	storage Storage
 }
 
-func NewEM(id int, peerIds []int, peerAddrs map[int]string, broker *BrokerServer, ready <-chan any) *ElectionModule {
+// storage keeps term and votedFor so a restarted broker can't vote twice in the
+// same term, they're picked up from whatever a previous run left there. nil
+// storage keeps them in memory only
+func NewEM(id int, peerAddrs map[int]string, broker *BrokerServer, ready <-chan any, storage Storage) *ElectionModule {
 
 	em := new(ElectionModule)
 
 	em.broker = broker
 	em.id = id
-	em.peerIds = peerIds
 	em.votedFor = -1
 
-	em.nextIndex = make(map[int]int)
-	em.matchIndex = make(map[int]int)
-
 	em.leaderId = -1
 	em.peerAddrs = peerAddrs
 
+	em.storage = storage
+	if storage != nil {
+		if err := em.restoreFromStorage(); err != nil {
+			broker.logger.Error("could not restore election state from storage", "err", err)
+		}
+	}
+
 	// start election timeouts together
 	go func() {
 		<-ready
@@ -62,47 +133,94 @@ func NewEM(id int, peerIds []int, peerAddrs map[int]string, broker *BrokerServer
 
 func (em *ElectionModule) resetElectionTimer() {
 
-	log.Printf("%d resets election timer", em.id)
+	em.broker.logger.Debug("resets election timer")
 
+	// set and start new timer
+	//timeout := time.Duration(500+rand.Intn(150)) * time.Millisecond
+	minTimeout, maxTimeout := em.broker.options.electionTimeouts()
+	timeout := minTimeout + em.electionBackoff()
+	if maxTimeout > minTimeout {
+		timeout += time.Duration(rand.Int63n(int64(maxTimeout - minTimeout)))
+	}
+	if held := time.Until(time.Unix(0, em.holdElectionsUntil.Load())); held > timeout {
+		timeout = held
+	}
+
+	em.timerMu.Lock()
+	defer em.timerMu.Unlock()
 	// stop timer if there is still time left
 	if em.electionTimer != nil {
 		em.electionTimer.Stop()
 	}
-
-	// set and start new timer
-	//timeout := time.Duration(500+rand.Intn(150)) * time.Millisecond
-	timeout := time.Duration(150+rand.Intn(150)) * time.Millisecond
-	em.electionTimer = time.NewTimer(timeout)
-
 	// start election when timer runs out
-	go func() {
-
-		<-em.electionTimer.C
-		log.Printf("%d detected no heartbeat from leader, starting election", em.id)
+	em.electionTimer = time.AfterFunc(timeout, func() {
+		em.broker.logger.Info("detected no heartbeat from leader, starting election")
 		em.startElection()
+	})
+}
 
-	}()
+func (em *ElectionModule) stopElectionTimer() {
+	em.timerMu.Lock()
+	defer em.timerMu.Unlock()
+	if em.electionTimer != nil {
+		em.electionTimer.Stop()
+	}
 }
 
 func (em *ElectionModule) startElection() {
-	log.Printf("%d starts election", em.id)
+	em.broker.mu2.Lock()
+	config := em.broker.rm.membership
+	dead := em.broker.state == Dead
+	// a timer that fired just before Pause. Resume starts a new one
+	paused := em.broker.paused
+	if !paused {
+		// a leader campaigning again, e.g. from ForceElection, stops replicating first
+		em.broker.stopReplicating()
+	}
+	em.broker.mu2.Unlock()
+
+	// a shut down broker stays down instead of campaigning with its old state
+	if dead || paused {
+		return
+	}
 
-	em.broker.state = Candidate
+	// brokers that were removed, or haven't been added yet, don't campaign
+	if !config.contains(em.id) {
+		em.broker.logger.Info("not a member of the cluster, skips election")
+		go em.resetElectionTimer()
+		return
+	}
+
+	em.broker.mu2.Lock()
+	// still a candidate means the last election went nowhere
+	if em.broker.state == Candidate {
+		em.failedElections.Add(1)
+	}
+	em.broker.setState(Candidate)
 	em.term++
+	atomic.AddUint64(&em.metrics.ElectionsStarted, 1)
+	atomic.AddUint64(&em.metrics.TermChanges, 1)
 
 	em.votedFor = em.id
 
-	em.leaderId = -1
+	em.setLeader(-1)
 
 	currentTerm := em.term
 
-	log.Printf("%d voted for %d for term %d", em.id, em.votedFor, em.term)
+	// the vote for itself has to survive a restart like any other
+	em.persistToStorage()
+	em.broker.mu2.Unlock()
+
+	em.broker.logger.Info("starts election", "term", currentTerm)
+	electionCtx, span := em.broker.tracer.Start(context.Background(), "ElectionModule.startElection",
+		trace.WithAttributes(attribute.Int("term", currentTerm)))
+	defer span.End()
 
 	// server votes for itself
-	votes := 1
+	granted := map[int]bool{em.id: true}
 
 	// send vote request rpc to all peers
-	for _, peerId := range em.peerIds {
+	for _, peerId := range config.peers(em.id) {
 		go func(peerId int) {
 
 			em.broker.mu2.Lock()
@@ -116,122 +234,156 @@ func (em *ElectionModule) startElection() {
 				LastLogIndex: lastLogIndex,
 				LastLogTerm:  lastLogTerm,
 			}
+			injectTrace(electionCtx, &args.TraceParent, &args.TraceState)
 
-			log.Printf("%d sending RequestVote Call to %d: %+v", em.id, peerId, args)
+			em.broker.logger.Debug("sending RequestVote", "peer", peerId, "args", args)
+			atomic.AddUint64(&em.metrics.VotesRequested, 1)
+
+			ctx, cancel := context.WithTimeout(context.Background(), em.broker.rpcTimeout())
+			defer cancel()
 
 			var reply RequestVoteReply
-			if err := em.broker.Call(peerId, "ElectionModule.RequestVote", args, &reply); err == nil {
+			if err := em.broker.Call(ctx, peerId, "ElectionModule.RequestVote", args, &reply); err == nil {
 				em.broker.mu2.Lock()
 				defer em.broker.mu2.Unlock()
-				log.Printf("%d received RequestVoteReply %+v", em.id, reply)
+				em.broker.logger.Debug("received RequestVote reply", "reply", reply)
 
 				// state no longer candidate during election
 				if em.broker.state != Candidate {
-					log.Printf("while waiting for reply, state = %v", em.broker.state)
 					return
 				}
 
 				// if reply has greater term, become follower and update own term
 				if reply.Term > currentTerm {
-					log.Printf("%d term out of date", em.id)
+					em.broker.logger.Info("term out of date", "term", currentTerm, "peer_term", reply.Term)
 					em.becomeFollower(reply.Term)
 					return
 				} else if reply.Term == currentTerm { // if terms are equal
 					// if vote is granted by replier, increment votes and check for majority
 					if reply.VoteGranted {
-						log.Printf("%s %d is granted vote from %d", em.broker.state, em.id, reply.Id)
-						votes += 1
-						if votes*2 > len(em.peerIds)+1 {
-							//log.Printf("%d becomes leader", em.id)
+						em.broker.logger.Debug("granted vote", "peer", reply.Id)
+						granted[reply.Id] = true
+						if config.hasQuorum(func(id int) bool { return granted[id] }) {
 							em.becomeLeader()
 							return
 						}
 					}
 				}
 
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				em.broker.logger.Warn("RequestVote timed out", "peer", peerId, "timeout", em.broker.rpcTimeout())
 			} else {
-				log.Printf("error with requestvote call %s", err)
+				em.broker.logger.Debug("RequestVote call failed", "peer", peerId, "err", err)
 			}
 
 		}(peerId)
 	}
-	log.Printf("%d's election fails", em.id)
 	go em.resetElectionTimer()
 
 }
 
-// set em to follower
-func (em *ElectionModule) becomeFollower(term int) {
-	log.Printf("%d becomes Follower with term:%d", em.id, term)
+// extra wait before the next election after failed ones so a candidate that
+// can't win, e.g. on the wrong side of a partition, doesn't keep flooding its peers
+func (em *ElectionModule) electionBackoff() time.Duration {
+	ceiling := em.broker.options.ElectionBackoffCeiling
+	if ceiling <= 0 {
+		ceiling = defaultElectionBackoffCeiling
+	}
+	var backoff time.Duration
+	step := electionBackoffStep
+	for i := int32(0); i < em.failedElections.Load() && backoff < ceiling; i++ {
+		backoff += step
+		step *= 2
+	}
+	return min(backoff, ceiling)
+}
+
+// start an election right away instead of waiting for the election timer
+// lets tests change leadership without sleeping through a timeout
+func (em *ElectionModule) ForceElection() error {
+	em.broker.mu2.Lock()
+	if em.broker.state == Dead {
+		em.broker.mu2.Unlock()
+		return ErrBrokerDead
+	}
+	em.stopElectionTimer()
+	em.broker.mu2.Unlock()
 
-	em.broker.state = Follower
+	em.broker.logger.Info("forces an election")
+	em.startElection()
+	return nil
+}
 
+// hand off leadership without picking a successor. the leader becomes a
+// follower in the same term and waits the longest election timeout before it
+// campaigns again, so another broker most likely wins the next election
+// returns the term it stepped down in
+func (em *ElectionModule) StepDown() (int, error) {
+	em.broker.mu2.Lock()
+	defer em.broker.mu2.Unlock()
+	if em.broker.state == Dead {
+		return 0, ErrBrokerDead
+	}
+	if em.broker.state != Leader {
+		return 0, ErrNotLeader
+	}
+
+	em.broker.logger.Info("steps down", "term", em.term)
+	_, maxTimeout := em.broker.options.electionTimeouts()
+	em.holdElectionsUntil.Store(time.Now().Add(maxTimeout).UnixNano())
+	em.becomeFollower(em.term)
+	return em.term, nil
+}
+
+// set em to follower
+func (em *ElectionModule) becomeFollower(term int) {
+	em.broker.setState(Follower)
+	em.broker.logger.Info("becomes follower", "term", term)
+	em.broker.stopReplicating()
+
+	// the vote only resets with the term, stepping down within a term keeps it
+	if term != em.term {
+		atomic.AddUint64(&em.metrics.TermChanges, 1)
+		em.votedFor = -1
+	}
 	em.term = term
-	em.votedFor = -1
-	em.leaderId = -1
+	em.setLeader(-1)
+	em.persistToStorage()
 
 	go em.resetElectionTimer()
 
 }
 
+// a candidate or leader heard from leaderId, the leader of its own term
+// two leaders in one term mean votes were counted wrong somewhere, which is
+// worth a loud warning for whoever reads the logs afterwards
+// caller must hold mu2
+func (em *ElectionModule) stepDownFor(leaderId int, term int) {
+	if em.broker.state == Leader && leaderId != em.id {
+		atomic.AddUint64(&em.metrics.SplitLeaderships, 1)
+		em.broker.logger.Warn("split leadership detected", "term", term, "other_leader", leaderId)
+	}
+	em.becomeFollower(term)
+}
+
 // set em to leader and start its responsibilities
 func (em *ElectionModule) becomeLeader() {
 
-	em.broker.state = Leader
-	em.leaderId = em.id
+	em.broker.setState(Leader)
+	em.setLeader(em.id)
+	em.failedElections.Store(0)
 
 	// stop timer for leader election
-	em.electionTimer.Stop()
+	em.stopElectionTimer()
 
-	log.Printf("%d becomes leader", em.id)
+	em.broker.logger.Info("becomes leader", "term", em.term)
 
-	// structure to keep track of follower log indexes
-	for _, peerId := range em.peerIds {
-		em.nextIndex[peerId] = len(em.broker.rm.log)
-		em.matchIndex[peerId] = -1
+	// reset follower log indexes so nothing from a previous leadership stint is
+	// reused, and send heartbeats in every replication group
+	for _, rm := range em.broker.router.Shards() {
+		rm.initializeLeaderState()
+		go rm.sendHeartbeats(em.broker.options.heartbeatInterval())
 	}
-
-	// send heartbeats by using leaderSendAEs in replication.go
-	// heartbeats are just blank AppendEntries
-	go func(heartbeatTimeout time.Duration) {
-		log.Printf("%d sends heartbeats", em.id)
-		em.broker.rm.leaderSendAEs()
-
-		heartbeat := time.NewTimer(heartbeatTimeout)
-		defer heartbeat.Stop()
-		for {
-			doSend := false
-			select {
-			case <-heartbeat.C:
-				doSend = true
-
-				heartbeat.Stop()
-				heartbeat.Reset(heartbeatTimeout)
-			case _, ok := <-em.broker.rm.triggerAEChan:
-				if ok {
-					doSend = true
-				} else {
-					return
-				}
-
-				if !heartbeat.Stop() {
-					<-heartbeat.C
-				}
-				heartbeat.Reset(heartbeatTimeout)
-			}
-
-			// send another heartbeat
-			if doSend {
-				em.broker.mu2.Lock()
-				if em.broker.state != Leader {
-					em.broker.mu2.Unlock()
-					return
-				}
-				em.broker.mu2.Unlock()
-				em.broker.rm.leaderSendAEs()
-			}
-		}
-	}(25 * time.Millisecond)
 }
 
 // //////////////////////////////////////////////////
@@ -245,6 +397,10 @@ type RequestVoteArgs struct {
 
 	LastLogIndex int
 	LastLogTerm  int
+
+	// trace context of the candidate's span, see tracing.go
+	TraceParent string
+	TraceState  string
 }
 
 type RequestVoteReply struct {
@@ -255,7 +411,9 @@ type RequestVoteReply struct {
 
 // rpc func that handles incoming vote requests sent from startElection()
 func (em *ElectionModule) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
-	log.Printf("%d recieves RequestVote from %d", em.id, args.CandidateId)
+	_, span := em.broker.tracer.Start(extractTrace(args.TraceParent, args.TraceState), "ElectionModule.RequestVote",
+		trace.WithAttributes(attribute.Int("candidate", args.CandidateId), attribute.Int("term", args.Term)))
+	defer span.End()
 
 	em.broker.mu2.Lock()
 	defer em.broker.mu2.Unlock()
@@ -263,13 +421,15 @@ func (em *ElectionModule) RequestVote(args RequestVoteArgs, reply *RequestVoteRe
 	if em.broker.state == Dead {
 		return nil
 	}
+	if em.broker.paused {
+		return ErrBrokerPaused
+	}
 
 	lastLogIndex, lastLogTerm := em.lastLogIndexAndTerm()
 
 	// check vote request term with own term
 	// if own term is lesser, become follower
 	if args.Term > em.term {
-		log.Printf("%d term out of data in RequestVote", em.id)
 		em.becomeFollower(args.Term)
 	}
 
@@ -278,32 +438,40 @@ func (em *ElectionModule) RequestVote(args RequestVoteArgs, reply *RequestVoteRe
 	if em.term == args.Term && (em.votedFor == -1 || em.votedFor == args.CandidateId) &&
 		(args.LastLogTerm > lastLogTerm || (args.LastLogTerm == lastLogTerm && args.LastLogIndex >= lastLogIndex)) {
 
-		log.Printf("%d voteGranted = true for %d", em.id, args.CandidateId)
+		em.broker.logger.Info("grants vote", "candidate", args.CandidateId, "term", args.Term)
 		reply.VoteGranted = true
 		em.votedFor = args.CandidateId
-		em.leaderId = args.CandidateId
+		em.failedElections.Store(0)
+		atomic.AddUint64(&em.metrics.VotesGranted, 1)
+
+		// saved before the reply goes out, a restart must not forget this vote
+		em.persistToStorage()
 
 		em.resetElectionTimer()
 	} else {
-		log.Printf("%d voteGranted = false for %d", em.id, args.CandidateId)
+		em.broker.logger.Debug("refuses vote", "candidate", args.CandidateId, "term", args.Term)
 		reply.VoteGranted = false
 	}
 
 	reply.Term = em.term
 	reply.Id = em.id
 
-	log.Printf("%d replies RequestVote from %d. %+v", em.id, args.CandidateId, reply)
-
 	return nil
 }
 
 func (em *ElectionModule) lastLogIndexAndTerm() (int, int) {
-	if len(em.broker.rm.log) > 0 {
-		lastIndex := len(em.broker.rm.log) - 1
-		return lastIndex, em.broker.rm.log[lastIndex].Term
-	} else {
-		return -1, -1
-	}
+	lastIndex := em.broker.rm.lastLogIndex()
+	return lastIndex, em.broker.rm.termAt(lastIndex)
+}
+
+// id and http address of the leader this broker last heard from
+// ok is false when it doesn't know of a leader or its address
+func (em *ElectionModule) knownLeader() (leaderId int, leaderAddr string, ok bool) {
+	em.broker.mu2.Lock()
+	defer em.broker.mu2.Unlock()
+
+	leaderAddr, ok = em.peerAddrs[em.leaderId]
+	return em.leaderId, leaderAddr, ok
 }
 
 func (em *ElectionModule) GetLeaderAddr() string {
@@ -321,7 +489,6 @@ func (em *ElectionModule) GetLeaderAddr() string {
 ////////////////////////////////////////////////////////////////////
 
 func (em *ElectionModule) Report() (id int, term int, idLeader bool) {
-	em.broker.mu2.Lock()
-	defer em.broker.mu2.Unlock()
-	return em.id, em.term, em.broker.state == Leader
+	view := em.broker.currentView()
+	return em.id, view.term, view.state == Leader
 }
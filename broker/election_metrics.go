@@ -0,0 +1,42 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// counters of one broker's election module since it started. the fields are
+// only touched through sync/atomic, Metrics returns a copy
+type ElectionMetrics struct {
+	// elections this broker started as a candidate
+	ElectionsStarted uint64 `json:"elections_started"`
+	// RequestVote rpcs this broker sent to its peers as a candidate
+	VotesRequested uint64 `json:"votes_requested"`
+	// votes this broker granted to candidates, its own not included
+	VotesGranted uint64 `json:"votes_granted"`
+	// times this broker's term moved, by starting an election or hearing of a newer term
+	TermChanges uint64 `json:"term_changes"`
+	// times this broker was leader and heard from another leader of the same term
+	SplitLeaderships uint64 `json:"split_leaderships"`
+}
+
+// snapshot of the counters, safe to call at any time
+func (em *ElectionModule) Metrics() ElectionMetrics {
+	return ElectionMetrics{
+		ElectionsStarted: atomic.LoadUint64(&em.metrics.ElectionsStarted),
+		VotesRequested:   atomic.LoadUint64(&em.metrics.VotesRequested),
+		VotesGranted:     atomic.LoadUint64(&em.metrics.VotesGranted),
+		TermChanges:      atomic.LoadUint64(&em.metrics.TermChanges),
+		SplitLeaderships: atomic.LoadUint64(&em.metrics.SplitLeaderships),
+	}
+}
+
+// http func for monitoring elections
+func (broker *BrokerServer) handleElectionMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(broker.em.Metrics()); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding election metrics: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestElectionMetrics(t *testing.T) {
+	const elections = 3
+
+	h := NewHarness(t, 5)
+	defer h.Shutdown()
+	h.CheckSingleLeader()
+
+	before := make([]ElectionMetrics, h.n)
+	for i := range before {
+		before[i] = h.cluster[i].em.Metrics()
+	}
+
+	for round := 0; round < elections; round++ {
+		id := round % h.n
+		if err := h.cluster[id].em.ForceElection(); err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		if _, err := h.cluster[id].WaitForLeader(2 * time.Second); err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		sleepMs(50)
+		h.CheckSingleLeader()
+	}
+
+	// counted across the cluster, the voters count the votes they grant
+	var total ElectionMetrics
+	for i := range h.cluster {
+		m := h.cluster[i].em.Metrics()
+		total.ElectionsStarted += m.ElectionsStarted - before[i].ElectionsStarted
+		total.VotesRequested += m.VotesRequested - before[i].VotesRequested
+		total.VotesGranted += m.VotesGranted - before[i].VotesGranted
+		total.TermChanges += m.TermChanges - before[i].TermChanges
+	}
+	if total.ElectionsStarted < elections {
+		t.Errorf("%d elections started, want at least %d", total.ElectionsStarted, elections)
+	}
+	// a quorum of 3 out of 5 in every election
+	if total.VotesGranted < 2*elections {
+		t.Errorf("%d votes granted, want at least %d", total.VotesGranted, 2*elections)
+	}
+	if total.VotesRequested < 4*elections {
+		t.Errorf("%d votes requested, want at least %d", total.VotesRequested, 4*elections)
+	}
+	// every broker moved to each new term
+	if total.TermChanges < uint64(h.n*elections) {
+		t.Errorf("%d term changes, want at least %d", total.TermChanges, h.n*elections)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics/election", h.cluster[0].GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics/election got status %d", resp.StatusCode)
+	}
+	var got ElectionMetrics
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ElectionsStarted <= before[0].ElectionsStarted {
+		t.Errorf("GET /metrics/election reported %+v, broker 0 forced an election since %+v", got, before[0])
+	}
+}
+
+func TestSplitLeadershipIsDetected(t *testing.T) {
+	loggers := make([]*captureLogger, 3)
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		loggers[i] = new(captureLogger)
+		options[i].Logger = loggers[i]
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, term := h.CheckSingleLeader()
+	otherId := (leaderId + 1) % 3
+
+	// as if otherId had also won term, its heartbeat reaches the leader
+	args := AppendEntriesArgs{Term: term, LeaderId: otherId, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: -1}
+	var reply AppendEntriesReply
+	if err := h.cluster[leaderId].rm.AppendEntries(args, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := h.cluster[leaderId].em.Metrics().SplitLeaderships; got != 1 {
+		t.Errorf("%d split leaderships counted, want 1", got)
+	}
+	warnings := loggers[leaderId].find("split leadership detected")
+	if len(warnings) != 1 || warnings[0].attr("other_leader") != otherId || warnings[0].attr("term") != term {
+		t.Errorf("got warnings %+v, want one naming leader %d in term %d", warnings, otherId, term)
+	}
+	if _, reportedTerm, isLeader := h.cluster[leaderId].em.Report(); isLeader || reportedTerm != term {
+		t.Errorf("leader is at term %d leading %v after the split, want a follower at term %d", reportedTerm, isLeader, term)
+	}
+
+	// followers hearing from their leader aren't counted
+	for id := range 3 {
+		if id != leaderId && h.cluster[id].em.Metrics().SplitLeaderships != 0 {
+			t.Errorf("follower %d counted a split leadership", id)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIsolatedCandidateBacksOff(t *testing.T) {
+	const ceiling = 500 * time.Millisecond
+	const attempts = 5
+
+	loggers := make([]*captureLogger, 3)
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		loggers[i] = new(captureLogger)
+		options[i].Logger = loggers[i]
+		options[i].ElectionBackoffCeiling = ceiling
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	isolated := (leaderId + 1) % 3
+	h.DisconnectPeer(isolated)
+	since := time.Now()
+
+	// the isolated broker can never get a vote, so every election it starts fails
+	var elections []time.Time
+	deadline := time.Now().Add(5 * time.Second)
+	for len(elections) < attempts {
+		if time.Now().After(deadline) {
+			t.Fatalf("isolated broker started %d elections, want %d", len(elections), attempts)
+		}
+		sleepMs(50)
+		elections = elections[:0]
+		for _, r := range loggers[isolated].find("starts election") {
+			if r.at.After(since) {
+				elections = append(elections, r.at)
+			}
+		}
+	}
+
+	intervals := make([]time.Duration, attempts-1)
+	for i := range intervals {
+		intervals[i] = elections[i+1].Sub(elections[i])
+	}
+	t.Logf("intervals between elections: %v", intervals)
+
+	// after one failure the wait is the election timeout plus a single step
+	if intervals[0] >= ceiling {
+		t.Errorf("first retry after %s, want it under the %s ceiling", intervals[0], ceiling)
+	}
+	// later retries wait for the timeout plus the whole ceiling, but no longer
+	const slack = 100 * time.Millisecond
+	for _, interval := range intervals[len(intervals)-2:] {
+		if interval < ceiling || interval > ceiling+300*time.Millisecond+slack {
+			t.Errorf("retry after %s, want the ceiling of %s plus an election timeout", interval, ceiling)
+		}
+	}
+
+	// hearing from a leader again resets the backoff
+	h.ReconnectPeer(isolated)
+	deadline = time.Now().Add(3 * time.Second)
+	for h.cluster[isolated].em.failedElections.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("isolated broker still counts %d failed elections after rejoining", h.cluster[isolated].em.failedElections.Load())
+		}
+		sleepMs(20)
+	}
+}
+
+func TestFastHeartbeatPreventsSpuriousElections(t *testing.T) {
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].HeartbeatInterval = 10 * time.Millisecond
+		options[i].MinElectionTimeout = time.Second
+		options[i].MaxElectionTimeout = 1200 * time.Millisecond
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+
+	// nobody times out before the first second
+	sleepMs(1000)
+	leaderId, term := h.CheckSingleLeader()
+	var started uint64
+	for i := range 3 {
+		started += h.cluster[i].em.Metrics().ElectionsStarted
+	}
+
+	sleepMs(5000)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId != leaderId || newTerm != term {
+		t.Errorf("leader moved from %d in term %d to %d in term %d", leaderId, term, newLeaderId, newTerm)
+	}
+	var after uint64
+	for i := range 3 {
+		after += h.cluster[i].em.Metrics().ElectionsStarted
+	}
+	if after != started {
+		t.Errorf("%d elections started while the leader was sending heartbeats", after-started)
+	}
+}
+
+func TestNewBrokerServerRejectsSlowHeartbeat(t *testing.T) {
+	for _, opts := range []BrokerOptions{
+		{HeartbeatInterval: 75 * time.Millisecond},
+		{HeartbeatInterval: 100 * time.Millisecond, MinElectionTimeout: 150 * time.Millisecond},
+		{HeartbeatInterval: time.Second, MinElectionTimeout: time.Second, MaxElectionTimeout: 2 * time.Second},
+	} {
+		if _, err := NewBrokerServer(0, nil, map[int]string{}, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), opts); !errors.Is(err, ErrHeartbeatTooSlow) {
+			t.Errorf("NewBrokerServer with %s heartbeat and %s minimum election timeout returned error %v, want %v", opts.HeartbeatInterval, opts.MinElectionTimeout, err, ErrHeartbeatTooSlow)
+		}
+	}
+
+	opts := BrokerOptions{MinElectionTimeout: time.Second, MaxElectionTimeout: 500 * time.Millisecond}
+	if _, err := NewBrokerServer(0, nil, map[int]string{}, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), opts); !errors.Is(err, ErrElectionTimeoutRange) {
+		t.Errorf("NewBrokerServer with a maximum election timeout under the minimum returned error %v, want %v", err, ErrElectionTimeoutRange)
+	}
+	opts = BrokerOptions{HeartbeatInterval: 10 * time.Millisecond, MinElectionTimeout: time.Second}
+	if _, err := NewBrokerServer(0, nil, map[int]string{}, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), opts); err != nil {
+		t.Errorf("NewBrokerServer with a 10ms heartbeat and 1s election timeout failed: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package broker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+)
+
+// the crdt operation of a log entry, gob encoded and gzipped. the leader wraps
+// operations larger than BrokerOptions.CompressionThreshold in it before they
+// go in rm.log, so a large paste is held once, compressed, instead of once
+// per AppendEntries in flight. it's decompressed again whenever the operation
+// is read, see LogEntry.operation
+type CompressedLogEntry struct {
+	Data []byte
+}
+
+func init() {
+	gob.Register(CompressedLogEntry{})
+}
+
+// operation as it goes in the log, compressed when its encoding is larger than
+// threshold. config entries are left alone, membership looks at their type
+func compressOperation(operation any, threshold int) (any, error) {
+	switch operation.(type) {
+	case JointConfig, NewConfig, CompressedLogEntry:
+		return operation, nil
+	}
+
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(&operation); err != nil {
+		return nil, err
+	}
+	if encoded.Len() <= threshold {
+		return operation, nil
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(encoded.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return CompressedLogEntry{Data: compressed.Bytes()}, nil
+}
+
+func (c CompressedLogEntry) decompress() (any, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(c.Data))
+	if err != nil {
+		return nil, fmt.Errorf("decompress log entry: %w", err)
+	}
+	defer zr.Close()
+
+	var operation any
+	if err := gob.NewDecoder(zr).Decode(&operation); err != nil {
+		return nil, fmt.Errorf("decode log entry: %w", err)
+	}
+	return operation, nil
+}
+
+// the entry's crdt operation, decompressed if it was compressed. an entry
+// that doesn't decompress is returned as is, parsing it fails later on
+func (entry LogEntry) operation() any {
+	c, ok := entry.CRDTOperation.(CompressedLogEntry)
+	if !ok {
+		return entry.CRDTOperation
+	}
+	operation, err := c.decompress()
+	if err != nil {
+		return entry.CRDTOperation
+	}
+	return operation
+}
+
+// copy of entries with their operations decompressed, for handing them out
+// of the broker. the checksums stay those of the compressed entries
+func decompressEntries(entries []LogEntry) []LogEntry {
+	decompressed := make([]LogEntry, len(entries))
+	for i, entry := range entries {
+		entry.CRDTOperation = entry.operation()
+		decompressed[i] = entry
+	}
+	return decompressed
+}
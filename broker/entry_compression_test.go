@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// a paste of n bytes of text that doesn't compress too well
+func pasteMessage(n int) CRDTMessage {
+	var text strings.Builder
+	for i := 0; text.Len() < n; i++ {
+		fmt.Fprintf(&text, "line %d of the pasted text, %x\n", i, i*2654435761)
+	}
+	return CRDTMessage{Type: OpInsert, Index: 0, Value: text.String()[:n], ReplicaID: "r1", OpIndex: 1, Source: "client"}
+}
+
+func TestLargeEntriesAreCompressedInTheLog(t *testing.T) {
+	const threshold = 1024
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].CompressionThreshold = threshold
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	paste := pasteMessage(10 * 1024)
+	small := CRDTMessage{Type: OpInsert, Index: 0, Value: "a", ReplicaID: "r1", OpIndex: 1, Source: "client"}
+	first, _ := h.cluster[leaderId].rm.submitBatch([]LogEntry{paste.logEntry(), small.logEntry()})
+	if first < 0 {
+		t.Fatalf("leader %d refused the entries", leaderId)
+	}
+	waitForApplied(t, h, []int{0, 1, 2}, first+1)
+
+	for id := range 3 {
+		broker := h.cluster[id]
+		broker.mu2.Lock()
+		large, _ := broker.rm.entry(first).CRDTOperation.(CompressedLogEntry)
+		_, smallCompressed := broker.rm.entry(first + 1).CRDTOperation.(CompressedLogEntry)
+		broker.mu2.Unlock()
+		if len(large.Data) == 0 || len(large.Data) >= 10*1024 {
+			t.Errorf("broker %d holds the paste as %d compressed bytes, want fewer than the original", id, len(large.Data))
+		}
+		if smallCompressed {
+			t.Errorf("broker %d compressed an entry under the threshold", id)
+		}
+	}
+
+	// everything reading the log gets the operation back as it was sent
+	want, _ := h.cluster[leaderId].DocumentState("1")
+	if len(want) == 0 {
+		t.Error("leader's document is empty after the paste")
+	}
+	for id := range 3 {
+		if got, _ := h.cluster[id].DocumentState("1"); !reflect.DeepEqual(got, want) {
+			t.Errorf("broker %d's document differs from the leader's", id)
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id := range 3 {
+		for _, commit := range h.commits[id] {
+			if commit.Index == first && !reflect.DeepEqual(commit.CRDTOperation, paste) {
+				t.Errorf("broker %d sent the paste on commitChan as %T", id, commit.CRDTOperation)
+			}
+		}
+	}
+}
+
+func TestCompressedLogEntryRoundTripsThroughGob(t *testing.T) {
+	paste := pasteMessage(4096)
+	compressed, err := compressOperation(paste, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []LogEntry{{CRDTOperation: compressed, Term: 1, Document: "1"}, {CRDTOperation: "small", Term: 1, Document: "1"}}
+	for i := range entries {
+		entries[i].Checksum = checksumOf(t, entries[i])
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entries); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []LogEntry
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, entry := range decoded {
+		if !entry.intact() {
+			t.Errorf("entry %d fails its checksum after gob", i)
+		}
+	}
+	if got := decoded[0].operation(); !reflect.DeepEqual(got, paste) {
+		t.Errorf("compressed entry decodes to %T, want the paste", got)
+	}
+	if got := decoded[1].operation(); got != "small" {
+		t.Errorf("uncompressed entry decodes to %v, want %q", got, "small")
+	}
+}
+
+// bytes held while a 1 MB paste is in AppendEntries to every follower at once
+// go test -bench LargePaste -run ^$ -benchmem
+func BenchmarkLargePasteInFlight(b *testing.B) {
+	const followers = 4
+	paste := pasteMessage(1 << 20)
+
+	for _, threshold := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("threshold=%d", threshold), func(b *testing.B) {
+			b.ReportAllocs()
+			var inFlight int
+			for i := 0; i < b.N; i++ {
+				operation := any(paste)
+				if threshold > 0 {
+					var err error
+					if operation, err = compressOperation(paste, threshold); err != nil {
+						b.Fatal(err)
+					}
+				}
+				entry := LogEntry{CRDTOperation: operation, Term: 1, Document: "1"}
+
+				// what net/rpc encodes for each follower
+				inFlight = 0
+				for range followers {
+					var wire bytes.Buffer
+					args := AppendEntriesArgs{Term: 1, PrevLogIndex: -1, PrevLogTerm: -1, Entries: []LogEntry{entry}}
+					if err := gob.NewEncoder(&wire).Encode(args); err != nil {
+						b.Fatal(err)
+					}
+					inFlight += wire.Len()
+				}
+			}
+			b.ReportMetric(float64(inFlight), "in-flight-bytes")
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// set on CRDT messages a follower forwards to the leader, to the id of the follower
+const forwardedByHeader = "X-Forwarded-By-Broker"
+
+// how long a follower waits on the leader before giving up on a forwarded message
+const forwardTimeout = 5 * time.Second
+
+// headers of the application server's request that the leader needs too
+var forwardedHeaders = []string{"Content-Type", "Authorization", idempotencyKeyHeader, documentTokenHeader}
+
+// client followers forward CRDT messages to the leader with
+func newForwardClient(broker *BrokerServer) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = broker.httpClientTLS
+	return &http.Client{
+		Transport: transport,
+		Timeout:   forwardTimeout,
+		// the leader doesn't redirect, and a forwarded message shouldn't go any further
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// proxy a CRDT message that reached a follower to the leader and relay the
+// leader's response, so the application server can send to any broker
+// forwarding is one hop only. a forwarded message that lands on a follower,
+// e.g. because leadership changed in between, gets a 503 like when the leader is unknown
+func (broker *BrokerServer) forwardCRDTToLeader(w http.ResponseWriter, r *http.Request) {
+	if from := r.Header.Get(forwardedByHeader); from != "" {
+		broker.logger.Info("rejects forwarded CRDT message: not the leader", "forwarded_by", from)
+		http.Error(w, "Forwarded to a broker that is not the leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	leaderId, leaderAddr, ok := broker.em.knownLeader()
+	if !ok || leaderId == broker.brokerid {
+		broker.logger.Info("ignores CRDT message: not the leader and no leader known")
+		http.Error(w, "This server is not the leader and doesn't know who is", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if bodyTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading CRDT message: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	url := fmt.Sprintf("%s://%s%s", broker.httpScheme(), leaderAddr, r.URL.Path)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error forwarding CRDT message: %v", err), http.StatusInternalServerError)
+		return
+	}
+	for _, header := range forwardedHeaders {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	req.Header.Set(forwardedByHeader, strconv.Itoa(broker.brokerid))
+
+	broker.logger.Debug("forwards CRDT message to leader", "leader", leaderId, "addr", leaderAddr)
+	resp, err := broker.forwardClient.Do(req)
+	if err != nil {
+		broker.logger.Warn("could not forward CRDT message to leader", "leader", leaderId, "err", err)
+		http.Error(w, fmt.Sprintf("Leader %d is unreachable", leaderId), http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range []string{"Content-Type", "Retry-After", "WWW-Authenticate"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
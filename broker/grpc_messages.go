@@ -0,0 +1,469 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/townsag/clarity/broker/raftpb"
+)
+
+// protobuf encoding of the rpc arguments and replies, by copying them to and
+// from the messages generated from raftpb/raft.proto. zero values are left
+// out like proto3 does, except in the oneof of LogEntry where the field that
+// is set says what the operation is
+
+// a log entry whose operation is of a type raft.proto has no field for. it
+// couldn't be checksummed or sent to followers, so leaders don't append it
+var ErrUnencodableEntry = errors.New("log entry has no protobuf encoding")
+
+// a message GRPCTransport can send
+type wireMessage interface {
+	appendWire(b []byte) ([]byte, error)
+}
+
+// a message GRPCTransport can receive, implemented on pointers
+type wireReader interface {
+	readWire(b []byte) error
+}
+
+// deterministic so map entries are in key order and the same entry always
+// encodes, and checksums, the same
+func appendProto(b []byte, m proto.Message) ([]byte, error) {
+	return proto.MarshalOptions{Deterministic: true}.MarshalAppend(b, m)
+}
+
+func toInt64s(vs []int) []int64 {
+	if len(vs) == 0 {
+		return nil
+	}
+	out := make([]int64, len(vs))
+	for i, v := range vs {
+		out[i] = int64(v)
+	}
+	return out
+}
+
+func fromInt64s(vs []int64) []int {
+	if len(vs) == 0 {
+		return nil
+	}
+	out := make([]int, len(vs))
+	for i, v := range vs {
+		out[i] = int(v)
+	}
+	return out
+}
+
+func toAddrs(addrs map[int]string) map[int64]string {
+	if len(addrs) == 0 {
+		return nil
+	}
+	out := make(map[int64]string, len(addrs))
+	for id, addr := range addrs {
+		out[int64(id)] = addr
+	}
+	return out
+}
+
+func fromAddrs(addrs map[int64]string) map[int]string {
+	if len(addrs) == 0 {
+		return nil
+	}
+	out := make(map[int]string, len(addrs))
+	for id, addr := range addrs {
+		out[int(id)] = addr
+	}
+	return out
+}
+
+func (args RequestVoteArgs) appendWire(b []byte) ([]byte, error) {
+	return appendProto(b, &raftpb.RequestVoteArgs{
+		Term:         int64(args.Term),
+		CandidateId:  int64(args.CandidateId),
+		LastLogIndex: int64(args.LastLogIndex),
+		LastLogTerm:  int64(args.LastLogTerm),
+		TraceParent:  args.TraceParent,
+		TraceState:   args.TraceState,
+	})
+}
+
+func (args *RequestVoteArgs) readWire(b []byte) error {
+	var m raftpb.RequestVoteArgs
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*args = RequestVoteArgs{
+		Term:         int(m.Term),
+		CandidateId:  int(m.CandidateId),
+		LastLogIndex: int(m.LastLogIndex),
+		LastLogTerm:  int(m.LastLogTerm),
+		TraceParent:  m.TraceParent,
+		TraceState:   m.TraceState,
+	}
+	return nil
+}
+
+func (reply RequestVoteReply) appendWire(b []byte) ([]byte, error) {
+	return appendProto(b, &raftpb.RequestVoteReply{
+		Term:        int64(reply.Term),
+		VoteGranted: reply.VoteGranted,
+		Id:          int64(reply.Id),
+	})
+}
+
+func (reply *RequestVoteReply) readWire(b []byte) error {
+	var m raftpb.RequestVoteReply
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*reply = RequestVoteReply{Term: int(m.Term), VoteGranted: m.VoteGranted, Id: int(m.Id)}
+	return nil
+}
+
+func (args WhoIsLeaderArgs) appendWire(b []byte) ([]byte, error) {
+	return appendProto(b, &raftpb.WhoIsLeaderArgs{})
+}
+
+func (args *WhoIsLeaderArgs) readWire(b []byte) error {
+	return proto.Unmarshal(b, &raftpb.WhoIsLeaderArgs{})
+}
+
+func (reply WhoIsLeaderReply) appendWire(b []byte) ([]byte, error) {
+	return appendProto(b, &raftpb.WhoIsLeaderReply{
+		LeaderId: int64(reply.LeaderId),
+		HttpAddr: reply.HTTPAddr,
+		Term:     int64(reply.Term),
+		Self:     reply.Self,
+	})
+}
+
+func (reply *WhoIsLeaderReply) readWire(b []byte) error {
+	var m raftpb.WhoIsLeaderReply
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*reply = WhoIsLeaderReply{LeaderId: int(m.LeaderId), HTTPAddr: m.HttpAddr, Term: int(m.Term), Self: m.Self}
+	return nil
+}
+
+func (args AppendEntriesArgs) appendWire(b []byte) ([]byte, error) {
+	m := &raftpb.AppendEntriesArgs{
+		Term:              int64(args.Term),
+		LeaderId:          int64(args.LeaderId),
+		PrevLogIndex:      int64(args.PrevLogIndex),
+		PrevLogTerm:       int64(args.PrevLogTerm),
+		Compressed:        args.Compressed,
+		CompressedEntries: args.CompressedEntries,
+		LeaderCommit:      int64(args.LeaderCommit),
+		TraceParent:       args.TraceParent,
+		TraceState:        args.TraceState,
+		Shard:             int64(args.Shard),
+	}
+	for _, entry := range args.Entries {
+		pb, err := entry.toProto()
+		if err != nil {
+			return nil, err
+		}
+		m.Entries = append(m.Entries, pb)
+	}
+	return appendProto(b, m)
+}
+
+func (args *AppendEntriesArgs) readWire(b []byte) error {
+	var m raftpb.AppendEntriesArgs
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*args = AppendEntriesArgs{
+		Term:              int(m.Term),
+		LeaderId:          int(m.LeaderId),
+		PrevLogIndex:      int(m.PrevLogIndex),
+		PrevLogTerm:       int(m.PrevLogTerm),
+		Compressed:        m.Compressed,
+		CompressedEntries: m.CompressedEntries,
+		LeaderCommit:      int(m.LeaderCommit),
+		TraceParent:       m.TraceParent,
+		TraceState:        m.TraceState,
+		Shard:             int(m.Shard),
+	}
+	for _, pb := range m.Entries {
+		entry, err := logEntryFromProto(pb)
+		if err != nil {
+			return err
+		}
+		args.Entries = append(args.Entries, entry)
+	}
+	return nil
+}
+
+func (reply AppendEntriesReply) appendWire(b []byte) ([]byte, error) {
+	return appendProto(b, &raftpb.AppendEntriesReply{
+		Term:          int64(reply.Term),
+		Success:       reply.Success,
+		Id:            int64(reply.Id),
+		ConflictIndex: int64(reply.ConflictIndex),
+		ConflictTerm:  int64(reply.ConflictTerm),
+	})
+}
+
+func (reply *AppendEntriesReply) readWire(b []byte) error {
+	var m raftpb.AppendEntriesReply
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*reply = AppendEntriesReply{
+		Term:          int(m.Term),
+		Success:       m.Success,
+		Id:            int(m.Id),
+		ConflictIndex: int(m.ConflictIndex),
+		ConflictTerm:  int(m.ConflictTerm),
+	}
+	return nil
+}
+
+func (args InstallSnapshotArgs) appendWire(b []byte) ([]byte, error) {
+	documents, err := json.Marshal(args.Documents)
+	if err != nil {
+		return nil, err
+	}
+	return appendProto(b, &raftpb.InstallSnapshotArgs{
+		Term:              int64(args.Term),
+		LeaderId:          int64(args.LeaderId),
+		LastIncludedIndex: int64(args.LastIncludedIndex),
+		LastIncludedTerm:  int64(args.LastIncludedTerm),
+		Members:           toInt64s(args.Members),
+		OldMembers:        toInt64s(args.OldMembers),
+		Documents:         documents,
+		Shard:             int64(args.Shard),
+	})
+}
+
+func (args *InstallSnapshotArgs) readWire(b []byte) error {
+	var m raftpb.InstallSnapshotArgs
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*args = InstallSnapshotArgs{
+		Term:              int(m.Term),
+		LeaderId:          int(m.LeaderId),
+		LastIncludedIndex: int(m.LastIncludedIndex),
+		LastIncludedTerm:  int(m.LastIncludedTerm),
+		Members:           fromInt64s(m.Members),
+		OldMembers:        fromInt64s(m.OldMembers),
+		Shard:             int(m.Shard),
+	}
+	if len(m.Documents) == 0 {
+		return nil
+	}
+	return json.Unmarshal(m.Documents, &args.Documents)
+}
+
+func (reply InstallSnapshotReply) appendWire(b []byte) ([]byte, error) {
+	return appendProto(b, &raftpb.InstallSnapshotReply{Term: int64(reply.Term), Id: int64(reply.Id)})
+}
+
+func (reply *InstallSnapshotReply) readWire(b []byte) error {
+	var m raftpb.InstallSnapshotReply
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*reply = InstallSnapshotReply{Term: int(m.Term), Id: int(m.Id)}
+	return nil
+}
+
+func (entry LogEntry) appendWire(b []byte) ([]byte, error) {
+	m, err := entry.toProto()
+	if err != nil {
+		return nil, err
+	}
+	return appendProto(b, m)
+}
+
+func (entry *LogEntry) readWire(b []byte) error {
+	var m raftpb.LogEntry
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	read, err := logEntryFromProto(&m)
+	if err != nil {
+		return err
+	}
+	*entry = read
+	return nil
+}
+
+func (entry LogEntry) toProto() (*raftpb.LogEntry, error) {
+	m := &raftpb.LogEntry{Term: int64(entry.Term), Document: entry.Document, Checksum: entry.Checksum}
+	switch op := entry.CRDTOperation.(type) {
+	case nil:
+	case CRDTMessage:
+		msg, err := op.toProto()
+		if err != nil {
+			return nil, err
+		}
+		m.Operation = &raftpb.LogEntry_CrdtMessage{CrdtMessage: msg}
+	case string:
+		m.Operation = &raftpb.LogEntry_Text{Text: op}
+	case int:
+		m.Operation = &raftpb.LogEntry_Number{Number: int64(op)}
+	case JointConfig:
+		m.Operation = &raftpb.LogEntry_JointConfig{JointConfig: &raftpb.JointConfig{
+			Old:   toInt64s(op.Old),
+			New:   toInt64s(op.New),
+			Addrs: toAddrs(op.Addrs),
+		}}
+	case NewConfig:
+		m.Operation = &raftpb.LogEntry_NewConfig{NewConfig: &raftpb.NewConfig{
+			Members: toInt64s(op.Members),
+			Addrs:   toAddrs(op.Addrs),
+		}}
+	case CompressedLogEntry:
+		m.Operation = &raftpb.LogEntry_Compressed{Compressed: op.Data}
+	case RollbackNotice:
+		m.Operation = &raftpb.LogEntry_RollbackNotice{RollbackNotice: &raftpb.RollbackNotice{Index: int64(op.Index)}}
+	default:
+		return nil, fmt.Errorf("%w: operation of type %T", ErrUnencodableEntry, op)
+	}
+	return m, nil
+}
+
+func logEntryFromProto(m *raftpb.LogEntry) (LogEntry, error) {
+	entry := LogEntry{Term: int(m.Term), Document: m.Document, Checksum: m.Checksum}
+	switch op := m.Operation.(type) {
+	case *raftpb.LogEntry_CrdtMessage:
+		msg, err := crdtMessageFromProto(op.CrdtMessage)
+		if err != nil {
+			return LogEntry{}, err
+		}
+		entry.CRDTOperation = msg
+	case *raftpb.LogEntry_Text:
+		entry.CRDTOperation = op.Text
+	case *raftpb.LogEntry_Number:
+		entry.CRDTOperation = int(op.Number)
+	case *raftpb.LogEntry_JointConfig:
+		entry.CRDTOperation = JointConfig{
+			Old:   fromInt64s(op.JointConfig.GetOld()),
+			New:   fromInt64s(op.JointConfig.GetNew()),
+			Addrs: fromAddrs(op.JointConfig.GetAddrs()),
+		}
+	case *raftpb.LogEntry_NewConfig:
+		entry.CRDTOperation = NewConfig{
+			Members: fromInt64s(op.NewConfig.GetMembers()),
+			Addrs:   fromAddrs(op.NewConfig.GetAddrs()),
+		}
+	case *raftpb.LogEntry_Compressed:
+		entry.CRDTOperation = CompressedLogEntry{Data: op.Compressed}
+	case *raftpb.LogEntry_RollbackNotice:
+		entry.CRDTOperation = RollbackNotice{Index: int(op.RollbackNotice.GetIndex())}
+	}
+	return entry, nil
+}
+
+func (msg CRDTMessage) appendWire(b []byte) ([]byte, error) {
+	m, err := msg.toProto()
+	if err != nil {
+		return nil, err
+	}
+	return appendProto(b, m)
+}
+
+func (msg *CRDTMessage) readWire(b []byte) error {
+	var m raftpb.CRDTMessage
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	read, err := crdtMessageFromProto(&m)
+	if err != nil {
+		return err
+	}
+	*msg = read
+	return nil
+}
+
+func (msg CRDTMessage) toProto() (*raftpb.CRDTMessage, error) {
+	m := &raftpb.CRDTMessage{
+		Type:           string(msg.Type),
+		Index:          msg.Index,
+		ReplicaId:      msg.ReplicaID,
+		OperationIndex: msg.OpIndex,
+		Source:         msg.Source,
+		SchemaVersion:  int64(msg.SchemaVersion),
+		OpId:           msg.OpID,
+		OperationJson:  string(msg.Operation),
+	}
+	if msg.Value != nil {
+		value, err := json.Marshal(msg.Value)
+		if err != nil {
+			return nil, err
+		}
+		m.ValueJson = string(value)
+	}
+	return m, nil
+}
+
+func crdtMessageFromProto(m *raftpb.CRDTMessage) (CRDTMessage, error) {
+	msg := CRDTMessage{
+		Type:          OpType(m.GetType()),
+		Index:         m.GetIndex(),
+		ReplicaID:     m.GetReplicaId(),
+		OpIndex:       m.GetOperationIndex(),
+		Source:        m.GetSource(),
+		SchemaVersion: int(m.GetSchemaVersion()),
+		OpID:          m.GetOpId(),
+	}
+	if operation := m.GetOperationJson(); operation != "" {
+		msg.Operation = json.RawMessage(operation)
+	}
+	if value := m.GetValueJson(); value != "" {
+		if err := json.Unmarshal([]byte(value), &msg.Value); err != nil {
+			return CRDTMessage{}, err
+		}
+	}
+	return msg, nil
+}
+
+func (config JointConfig) appendWire(b []byte) ([]byte, error) {
+	return appendProto(b, &raftpb.JointConfig{
+		Old:   toInt64s(config.Old),
+		New:   toInt64s(config.New),
+		Addrs: toAddrs(config.Addrs),
+	})
+}
+
+func (config *JointConfig) readWire(b []byte) error {
+	var m raftpb.JointConfig
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*config = JointConfig{Old: fromInt64s(m.Old), New: fromInt64s(m.New), Addrs: fromAddrs(m.Addrs)}
+	return nil
+}
+
+func (config NewConfig) appendWire(b []byte) ([]byte, error) {
+	return appendProto(b, &raftpb.NewConfig{Members: toInt64s(config.Members), Addrs: toAddrs(config.Addrs)})
+}
+
+func (config *NewConfig) readWire(b []byte) error {
+	var m raftpb.NewConfig
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*config = NewConfig{Members: fromInt64s(m.Members), Addrs: fromAddrs(m.Addrs)}
+	return nil
+}
+
+func (notice RollbackNotice) appendWire(b []byte) ([]byte, error) {
+	return appendProto(b, &raftpb.RollbackNotice{Index: int64(notice.Index)})
+}
+
+func (notice *RollbackNotice) readWire(b []byte) error {
+	var m raftpb.RollbackNotice
+	if err := proto.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*notice = RollbackNotice{Index: int(m.Index)}
+	return nil
+}
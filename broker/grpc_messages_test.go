@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"github.com/townsag/clarity/crdt"
+)
+
+// fields raft.proto doesn't declare, anywhere in m
+func unknownFields(m protoreflect.Message) []string {
+	var unknown []string
+	if len(m.GetUnknown()) > 0 {
+		unknown = append(unknown, string(m.Descriptor().FullName()))
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+					unknown = append(unknown, unknownFields(v.Message())...)
+					return true
+				})
+			}
+		case fd.IsList() && fd.Message() != nil:
+			for i := 0; i < v.List().Len(); i++ {
+				unknown = append(unknown, unknownFields(v.List().Get(i).Message())...)
+			}
+		case fd.Message() != nil:
+			unknown = append(unknown, unknownFields(v.Message())...)
+		}
+		return true
+	})
+	return unknown
+}
+
+// the go values and the messages generated from raft.proto agree: every
+// message the codec writes decodes as its generated message without unknown
+// fields, the values read back are the ones written, and what the generated
+// message writes decodes to the same go value
+func TestWireCodecMatchesRaftProto(t *testing.T) {
+	doc := crdt.NewTextCRDT("r1")
+	doc.LocalInsert(0, "a")
+	op, _ := doc.LocalInsert(1, "b")
+	encodedOp, err := json.Marshal(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations := []any{
+		CRDTMessage{Type: OpInsert, Index: 2, Value: "é", ReplicaID: "r1", OpIndex: 7, Source: "client", SchemaVersion: CurrentSchemaVersion, OpID: "op1", Operation: encodedOp},
+		CRDTMessage{Type: OpDelete, Index: -1, OpIndex: -3},
+		insertOp("a"),
+		-42,
+		JointConfig{Old: []int{0, 1, 2}, New: []int{0, 1, 3}, Addrs: map[int]string{-1: "127.0.0.1:9000", 3: "127.0.0.1:9003"}},
+		NewConfig{Members: []int{0, 1, 3}, Addrs: map[int]string{0: "127.0.0.1:9000", 3: "127.0.0.1:9003"}},
+		CompressedLogEntry{Data: []byte{1, 2, 3}},
+		RollbackNotice{Index: -1},
+		nil,
+	}
+	var entries []LogEntry
+	for _, operation := range operations {
+		entry := LogEntry{CRDTOperation: operation, Term: 3, Document: "doc1"}
+		entry.Checksum = checksumOf(t, entry)
+		entries = append(entries, entry)
+	}
+
+	// values the descriptor has to read back as written, negative ones included
+	cases := []struct {
+		name string
+		msg  wireMessage
+		want map[string]any
+	}{
+		{"RequestVoteArgs", RequestVoteArgs{Term: 2, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1, TraceParent: "00-1-2-01"},
+			map[string]any{"term": int64(2), "candidate_id": int64(1), "last_log_index": int64(-1), "last_log_term": int64(-1)}},
+		{"RequestVoteReply", RequestVoteReply{Term: 2, VoteGranted: true, Id: 1},
+			map[string]any{"term": int64(2), "vote_granted": true, "id": int64(1)}},
+		{"WhoIsLeaderArgs", WhoIsLeaderArgs{}, nil},
+		{"WhoIsLeaderReply", WhoIsLeaderReply{LeaderId: -1, HTTPAddr: "127.0.0.1:8000", Term: 4, Self: true},
+			map[string]any{"leader_id": int64(-1), "http_addr": "127.0.0.1:8000", "term": int64(4), "self": true}},
+		{"AppendEntriesArgs", AppendEntriesArgs{Term: 3, LeaderId: 0, PrevLogIndex: -1, PrevLogTerm: -1, Entries: entries, LeaderCommit: -1, Shard: 1},
+			map[string]any{"term": int64(3), "prev_log_index": int64(-1), "prev_log_term": int64(-1), "leader_commit": int64(-1), "shard": int64(1)}},
+		{"AppendEntriesArgs", AppendEntriesArgs{Term: 3, Compressed: true, CompressedEntries: []byte{4, 5}},
+			map[string]any{"compressed": true, "compressed_entries": []byte{4, 5}}},
+		{"AppendEntriesReply", AppendEntriesReply{Term: 3, Success: false, Id: 2, ConflictIndex: -1, ConflictTerm: -1},
+			map[string]any{"id": int64(2), "conflict_index": int64(-1), "conflict_term": int64(-1)}},
+		{"InstallSnapshotArgs", InstallSnapshotArgs{
+			Term: 3, LeaderId: 1, LastIncludedIndex: 9, LastIncludedTerm: 2, Members: []int{0, 1, 2}, OldMembers: []int{-1},
+			Documents: documentCheckpoint{LastApplied: 9, Documents: map[string]crdt.TextCRDTSnapshot{"doc1": doc.Snapshot()}},
+		}, map[string]any{"last_included_index": int64(9), "last_included_term": int64(2)}},
+		{"InstallSnapshotReply", InstallSnapshotReply{Term: 3, Id: -1}, map[string]any{"id": int64(-1)}},
+		{"LogEntry", entries[1], map[string]any{"term": int64(3), "document": "doc1", "checksum": uint32(entries[1].Checksum)}},
+		{"CRDTMessage", operations[1].(CRDTMessage), map[string]any{"index": int64(-1), "operation_index": int64(-3)}},
+		{"RollbackNotice", RollbackNotice{Index: -1}, map[string]any{"index": int64(-1)}},
+	}
+	for _, c := range cases {
+		messageType, err := protoregistry.GlobalTypes.FindMessageByName(grpcPackage + "." + protoreflect.FullName(c.name))
+		if err != nil {
+			t.Errorf("raft.proto has no message %s: %v", c.name, err)
+			continue
+		}
+		descriptor := messageType.Descriptor()
+		data, err := c.msg.appendWire(nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		decoded := messageType.New().Interface()
+		if err := proto.Unmarshal(data, decoded); err != nil {
+			t.Errorf("%s doesn't decode with raft.proto: %v", c.name, err)
+			continue
+		}
+		if unknown := unknownFields(decoded.ProtoReflect()); len(unknown) > 0 {
+			t.Errorf("%s has fields raft.proto doesn't declare in %v", c.name, unknown)
+		}
+		for name, want := range c.want {
+			got := decoded.ProtoReflect().Get(descriptor.Fields().ByName(protoreflect.Name(name))).Interface()
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s.%s decodes as %v with raft.proto, want %v", c.name, name, got, want)
+			}
+		}
+
+		// and back, the descriptor's encoding reads into the same go value
+		reencoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(decoded)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		read := reflect.New(reflect.TypeOf(c.msg))
+		if err := read.Interface().(wireReader).readWire(reencoded); err != nil {
+			t.Errorf("%s encoded from raft.proto doesn't read back: %v", c.name, err)
+			continue
+		}
+		if got := read.Elem().Interface(); !reflect.DeepEqual(got, c.msg) {
+			t.Errorf("%s encoded from raft.proto reads back as\n%+v\nwant\n%+v", c.name, got, c.msg)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// what /readyz answers
+type Readiness struct {
+	Ready  bool   `json:"ready"`
+	Reason string `json:"reason,omitempty"` // why the broker isn't ready
+}
+
+// ready once rpc connections to a quorum of the cluster are up and a leader is known,
+// this broker included. reads mu2 and mu one after the other like Status
+func (broker *BrokerServer) Readiness() Readiness {
+	broker.mu2.Lock()
+	state, draining := broker.state, broker.draining
+	leaderId := broker.em.leaderId
+	config := broker.rm.membership
+	broker.mu2.Unlock()
+
+	connected := broker.connectedPeers()
+
+	switch {
+	case state == Dead || draining:
+		return Readiness{Reason: "broker is shutting down"}
+	case !config.hasQuorum(func(id int) bool { return id == broker.brokerid || connected[id] }):
+		return Readiness{Reason: "not connected to a quorum of peers"}
+	case leaderId < 0:
+		return Readiness{Reason: "no leader known"}
+	}
+	return Readiness{Ready: true}
+}
+
+// liveness probe, the process is up as long as it answers
+func (broker *BrokerServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// readiness probe, 503 with the reason until Readiness reports ready
+func (broker *BrokerServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := broker.Readiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	// the probe went away, nothing to tell it
+	json.NewEncoder(w).Encode(readiness)
+}
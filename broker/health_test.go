@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getReadyz(t *testing.T, broker *BrokerServer) (int, Readiness) {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://%s/readyz", broker.GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var readiness Readiness
+	if err := json.NewDecoder(resp.Body).Decode(&readiness); err != nil {
+		t.Fatalf("decoding readiness: %v", err)
+	}
+	return resp.StatusCode, readiness
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	brokers := make([]*BrokerServer, 3)
+	ready := make([]chan any, 3)
+	for i := range brokers {
+		var peerIds []int
+		for p := range brokers {
+			if p != i {
+				peerIds = append(peerIds, p)
+			}
+		}
+		ready[i] = make(chan any)
+		broker, err := NewBrokerServer(i, peerIds, map[int]string{}, "127.0.0.1:0", Follower, ready[i], make(chan CommitEntry), BrokerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := broker.Serve(); err != nil {
+			t.Fatal(err)
+		}
+		defer shutdownNow(broker)
+		brokers[i] = broker
+	}
+
+	// serving but not connected to anyone yet
+	for i, broker := range brokers {
+		resp, err := http.Get(fmt.Sprintf("http://%s/healthz", broker.GetHTTPAddr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("broker %d /healthz got status %d, want %d", i, resp.StatusCode, http.StatusOK)
+		}
+
+		status, readiness := getReadyz(t, broker)
+		if status != http.StatusServiceUnavailable || readiness.Ready || readiness.Reason == "" {
+			t.Errorf("broker %d /readyz before connecting got %d %+v, want %d with a reason", i, status, readiness, http.StatusServiceUnavailable)
+		}
+	}
+
+	for i, broker := range brokers {
+		for j, peer := range brokers {
+			if i != j {
+				if err := broker.ConnectToPeer(j, peer.GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	// connected, but nobody knows a leader until the election timers run out
+	if _, readiness := getReadyz(t, brokers[0]); readiness.Ready {
+		t.Errorf("broker 0 ready before an election: %+v", readiness)
+	}
+	for _, c := range ready {
+		close(c)
+	}
+
+	// every broker is ready once the cluster has settled on a leader
+	for i, broker := range brokers {
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			status, readiness := getReadyz(t, broker)
+			if status == http.StatusOK && readiness.Ready {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("broker %d /readyz got %d %+v after the cluster settled", i, status, readiness)
+			}
+			sleepMs(20)
+		}
+	}
+}
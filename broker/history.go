@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var ErrUnknownDocument = errors.New("unknown document")
+var ErrHistoryTrimmed = errors.New("history was trimmed")
+
+// entries returned by one request to /document/{id}/history, the rest are behind the Link header
+const historyPageSize = 1000
+
+// a committed entry and where it is in the log
+type HistoryEntry struct {
+	Index int
+	LogEntry
+}
+
+// committed entries of document with log index in [from, to), oldest first, and
+// at most historyPageSize of them. next is the from of the following page, -1 on the last
+// entries already trimmed into a snapshot return ErrHistoryTrimmed
+func (broker *BrokerServer) DocumentHistory(document string, from int, to int) (entries []HistoryEntry, next int, err error) {
+	rm := broker.router.For(document)
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
+
+	to = min(to, rm.commitIndex+1)
+	if from < rm.logBaseIndex && from < to {
+		return nil, -1, fmt.Errorf("%w: entries before %d are only in the snapshot", ErrHistoryTrimmed, rm.logBaseIndex)
+	}
+
+	known := false
+	next = -1
+	for index := rm.logBaseIndex; index <= rm.commitIndex; index++ {
+		entry := rm.entry(index)
+		if entry.Document != document {
+			continue
+		}
+		known = true
+		if index < from || index >= to {
+			continue
+		}
+		if len(entries) == historyPageSize {
+			next = index
+			break
+		}
+		entry.CRDTOperation = entry.operation()
+		entries = append(entries, HistoryEntry{Index: index, LogEntry: entry})
+	}
+	// documents whose entries were all trimmed are still in the materialized state
+	if !known {
+		if _, ok := rm.documents.representation(document); !ok {
+			return nil, -1, fmt.Errorf("%w %q", ErrUnknownDocument, document)
+		}
+	}
+	return entries, next, nil
+}
+
+// http func for application servers replaying one document after a crash
+// from and to are log indexes, to is exclusive. they default to the whole committed log
+func (broker *BrokerServer) handleDocumentHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := historyBound(query, "from", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := historyBound(query, "to", math.MaxInt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from > to {
+		http.Error(w, fmt.Sprintf("from %d is after to %d", from, to), http.StatusBadRequest)
+		return
+	}
+
+	document := r.PathValue("id")
+	entries, next, err := broker.DocumentHistory(document, from, to)
+	if errors.Is(err, ErrUnknownDocument) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrHistoryTrimmed) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	if next >= 0 {
+		nextQuery := url.Values{"from": {strconv.Itoa(next)}}
+		if query.Has("to") {
+			nextQuery.Set("to", strconv.Itoa(to))
+		}
+		w.Header().Set("Link", fmt.Sprintf(`</document/%s/history?%s>; rel="next"`, url.PathEscape(document), nextQuery.Encode()))
+	}
+	if entries == nil {
+		entries = []HistoryEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		broker.logger.Warn("error encoding document history", "document", document, "err", err)
+	}
+}
+
+// a non-negative log index from the query, or def when it isn't there
+func historyBound(query url.Values, name string, def int) (int, error) {
+	if !query.Has(name) {
+		return def, nil
+	}
+	bound, err := strconv.Atoi(query.Get(name))
+	if err != nil || bound < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative log index, got %q", name, query.Get(name))
+	}
+	return bound, nil
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func getHistory(t *testing.T, broker *BrokerServer, pathAndQuery string) (int, []HistoryEntry, string) {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", broker.GetHTTPAddr(), pathAndQuery))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var entries []HistoryEntry
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatalf("decoding history: %v", err)
+		}
+	}
+	return resp.StatusCode, entries, resp.Header.Get("Link")
+}
+
+func TestDocumentHistory(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+
+	// 50 ops, every third one in doc-b
+	want := map[string][]int{}
+	batch := make([]LogEntry, 50)
+	for i := range batch {
+		document := "doc-a"
+		if i%3 == 0 {
+			document = "doc-b"
+		}
+		batch[i] = LogEntry{CRDTOperation: insertOp(fmt.Sprint(i)), Document: document}
+		want[document] = append(want[document], i)
+	}
+	leader.rm.submitBatch(batch)
+	waitForApplied(t, h, []int{0, 1, 2}, len(batch)-1)
+
+	check := func(pathAndQuery string, wantIndexes []int) {
+		t.Helper()
+		status, entries, link := getHistory(t, leader, pathAndQuery)
+		if status != http.StatusOK {
+			t.Fatalf("GET %s got status %d", pathAndQuery, status)
+		}
+		if link != "" {
+			t.Errorf("GET %s got Link %q for a single page", pathAndQuery, link)
+		}
+		if len(entries) != len(wantIndexes) {
+			t.Fatalf("GET %s got %d entries, want %d", pathAndQuery, len(entries), len(wantIndexes))
+		}
+		for i, entry := range entries {
+			if entry.Index != wantIndexes[i] || entry.CRDTOperation != insertOp(fmt.Sprint(wantIndexes[i])) {
+				t.Errorf("GET %s entry %d is %+v, want the op submitted at %d", pathAndQuery, i, entry, wantIndexes[i])
+			}
+		}
+	}
+	check("/document/doc-a/history", want["doc-a"])
+	check("/document/doc-b/history", want["doc-b"])
+	check("/document/doc-b/history?from=10&to=30", []int{12, 15, 18, 21, 24, 27})
+	check("/document/doc-a/history?from=48", []int{49})
+
+	for pathAndQuery, wantStatus := range map[string]int{
+		"/document/doc-c/history":             http.StatusNotFound,
+		"/document/doc-a/history?from=-1":     http.StatusBadRequest,
+		"/document/doc-a/history?to=x":        http.StatusBadRequest,
+		"/document/doc-a/history?from=9&to=3": http.StatusBadRequest,
+	} {
+		if status, _, _ := getHistory(t, leader, pathAndQuery); status != wantStatus {
+			t.Errorf("GET %s got status %d, want %d", pathAndQuery, status, wantStatus)
+		}
+	}
+}
+
+func TestDocumentHistoryPages(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+
+	total := historyPageSize + 100
+	batch := make([]LogEntry, total)
+	for i := range batch {
+		batch[i] = LogEntry{CRDTOperation: insertOp("a"), Document: "doc-a"}
+	}
+	leader.rm.submitBatch(batch)
+	waitForApplied(t, h, []int{0, 1, 2}, total-1)
+
+	// follow the Link headers to the end
+	var got []HistoryEntry
+	next := "/document/doc-a/history"
+	for pages := 0; next != ""; pages++ {
+		if pages > 2 {
+			t.Fatal("still paging after 3 pages")
+		}
+		status, entries, link := getHistory(t, leader, next)
+		if status != http.StatusOK {
+			t.Fatalf("GET %s got status %d", next, status)
+		}
+		if len(entries) > historyPageSize {
+			t.Fatalf("GET %s got %d entries, want at most %d", next, len(entries), historyPageSize)
+		}
+		got = append(got, entries...)
+
+		next = ""
+		if link != "" {
+			target, params, ok := strings.Cut(strings.TrimPrefix(link, "<"), ">")
+			if !ok || !strings.Contains(params, `rel="next"`) {
+				t.Fatalf("bad Link header %q", link)
+			}
+			next = target
+		}
+	}
+	if len(got) != total {
+		t.Fatalf("got %d entries over every page, want %d", len(got), total)
+	}
+	for i, entry := range got {
+		if entry.Index != i {
+			t.Fatalf("entry %d has index %d", i, entry.Index)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// body of GET /admin/log and POST /admin/snapshot
+type LogInfo struct {
+	// entries in the log, the trimmed ones not included
+	Length     int `json:"length"`
+	FirstIndex int `json:"first_index"`
+	LastIndex  int `json:"last_index"`
+	// last entry folded into the snapshot, -1 before the log was ever trimmed
+	SnapshotIndex int `json:"snapshot_index"`
+
+	// size of the storage on disk, 0 when it is kept in memory
+	DiskBytes int64 `json:"disk_bytes"`
+}
+
+// storage that knows how much space it takes, like BoltStorage
+type sizedStorage interface {
+	Size() (int64, error)
+}
+
+// the log as it is now
+func (broker *BrokerServer) LogInfo() LogInfo {
+	broker.mu2.Lock()
+	info := LogInfo{
+		Length:        len(broker.rm.log),
+		FirstIndex:    broker.rm.logBaseIndex,
+		LastIndex:     broker.rm.lastLogIndex(),
+		SnapshotIndex: broker.rm.logBaseIndex - 1,
+	}
+	broker.mu2.Unlock()
+
+	// outside mu2, storage calls can take a while
+	if storage, ok := broker.options.Storage.(sizedStorage); ok {
+		size, err := storage.Size()
+		if err != nil {
+			broker.logger.Warn("could not get storage size", "err", err)
+		}
+		info.DiskBytes = size
+	}
+	return info
+}
+
+// http func for operators inspecting how large the log has grown
+func (broker *BrokerServer) handleAdminLog(w http.ResponseWriter, r *http.Request) {
+	writeLogInfo(w, broker.LogInfo())
+}
+
+// http func for operators that want the log trimmed now instead of waiting
+// for SnapshotInterval. leader only, followers trim on their own
+func (broker *BrokerServer) handleAdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	broker.mu2.Lock()
+	leader := broker.state == Leader
+	lastApplied := broker.rm.lastApplied
+	broker.mu2.Unlock()
+
+	if !leader {
+		broker.logger.Info("ignores snapshot request: not the leader")
+		http.Error(w, "This server is not the leader", http.StatusForbidden)
+		return
+	}
+
+	broker.logger.Info("snapshot requested", "last_applied", lastApplied)
+	broker.rm.TrimLog(lastApplied)
+	writeLogInfo(w, broker.LogInfo())
+}
+
+// body of POST /admin/stepdown
+type StepDownReply struct {
+	// the term the leader stepped down in, the next leader has a later one
+	Term int `json:"term"`
+}
+
+// http func for operators moving leadership off a broker, e.g. before its host
+// is rebooted. 409 on brokers that aren't the leader
+func (broker *BrokerServer) handleAdminStepDown(w http.ResponseWriter, r *http.Request) {
+	term, err := broker.em.StepDown()
+	if errors.Is(err, ErrNotLeader) {
+		http.Error(w, "This server is not the leader", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(StepDownReply{Term: term}); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding step down reply: %v", err), http.StatusInternalServerError)
+	}
+}
+
+func writeLogInfo(w http.ResponseWriter, info LogInfo) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding log info: %v", err), http.StatusInternalServerError)
+	}
+}
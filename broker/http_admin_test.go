@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "admin-secret"
+
+// send an admin request to broker id, with token when it isn't empty
+// a 200 response is decoded into reply
+func adminRequest(t *testing.T, h *Harness, id int, method, path, token string, reply any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", h.cluster[id].GetHTTPAddr(), path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && reply != nil {
+		if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	const entries = 1000
+
+	options, _ := boltOptions(t, 3)
+	for i := range options {
+		options[i].AdminToken = testAdminToken
+		// the whole batch goes to bolt in one AppendEntries, which under -race
+		// takes longer than the default rpc and election timeouts
+		options[i].RPCTimeout = time.Second
+		options[i].MinElectionTimeout = 600 * time.Millisecond
+		options[i].MaxElectionTimeout = 900 * time.Millisecond
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % 3
+
+	batch := make([]LogEntry, entries)
+	for i := range batch {
+		batch[i] = LogEntry{CRDTOperation: insertOp("a"), Document: "doc1"}
+	}
+	h.cluster[leaderId].rm.submitBatch(batch)
+	waitForApplied(t, h, []int{0, 1, 2}, entries-1)
+
+	if code := adminRequest(t, h, leaderId, http.MethodGet, "/admin/log", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/log without the token got status %d, want %d", code, http.StatusUnauthorized)
+	}
+	var before LogInfo
+	if code := adminRequest(t, h, leaderId, http.MethodGet, "/admin/log", testAdminToken, &before); code != http.StatusOK {
+		t.Fatalf("GET /admin/log got status %d", code)
+	}
+	if before.Length < entries || before.SnapshotIndex != -1 || before.DiskBytes <= 0 {
+		t.Errorf("before the snapshot the log is %+v, want %d entries, no snapshot and a size on disk", before, entries)
+	}
+
+	if code := adminRequest(t, h, followerId, http.MethodPost, "/admin/snapshot", testAdminToken, nil); code != http.StatusForbidden {
+		t.Errorf("POST /admin/snapshot on a follower got status %d, want %d", code, http.StatusForbidden)
+	}
+	var after LogInfo
+	if code := adminRequest(t, h, leaderId, http.MethodPost, "/admin/snapshot", testAdminToken, &after); code != http.StatusOK {
+		t.Fatalf("POST /admin/snapshot got status %d", code)
+	}
+	if after.Length >= before.Length || after.SnapshotIndex != before.LastIndex || after.FirstIndex != before.LastIndex+1 {
+		t.Errorf("after the snapshot the log is %+v, it was %+v", after, before)
+	}
+
+	// a follower that comes back with nothing needs the snapshot, the leader
+	// no longer has the entries
+	h.CrashPeer(followerId)
+	options[followerId].Storage = openBoltStorage(t, filepath.Join(t.TempDir(), "empty.db"))
+	defer options[followerId].Storage.(*BoltStorage).Close()
+	h.RestartPeer(followerId)
+
+	h.cluster[leaderId].rm.submitBatch(batch[:10])
+	waitForApplied(t, h, []int{0, 1, 2}, entries+9)
+	want, _ := h.cluster[leaderId].DocumentState("doc1")
+	if got, _ := h.cluster[followerId].DocumentState("doc1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("restarted follower's document is %d characters, want the leader's %d", len(got), len(want))
+	}
+	if _, baseIndex := logLength(h.cluster[followerId]); baseIndex == 0 {
+		t.Error("restarted follower replayed the whole log instead of installing the snapshot")
+	}
+}
+
+func TestAdminEndpointsNeedAdminToken(t *testing.T) {
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].AuthToken = "app-secret"
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	// without an admin token the application servers' token doesn't open them
+	if code := adminRequest(t, h, leaderId, http.MethodPost, "/admin/snapshot", "app-secret", nil); code != http.StatusNotFound {
+		t.Errorf("POST /admin/snapshot without an admin token configured got status %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestAdminStepDown(t *testing.T) {
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].AdminToken = testAdminToken
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	oldLeaderId, oldTerm := h.CheckSingleLeader()
+	followerId := (oldLeaderId + 1) % 3
+
+	if code := adminRequest(t, h, followerId, http.MethodPost, "/admin/stepdown", testAdminToken, nil); code != http.StatusConflict {
+		t.Errorf("POST /admin/stepdown on a follower got status %d, want %d", code, http.StatusConflict)
+	}
+
+	var reply StepDownReply
+	if code := adminRequest(t, h, oldLeaderId, http.MethodPost, "/admin/stepdown", testAdminToken, &reply); code != http.StatusOK {
+		t.Fatalf("POST /admin/stepdown on the leader got status %d", code)
+	}
+	if reply.Term != oldTerm {
+		t.Errorf("leader stepped down in term %d, want %d", reply.Term, oldTerm)
+	}
+
+	// the old leader holds back, so one of the others takes over
+	sleepMs(500)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId == oldLeaderId {
+		t.Errorf("%d is leading again after stepping down", oldLeaderId)
+	}
+	if newTerm <= oldTerm {
+		t.Errorf("new leader has term %d, want one after %d", newTerm, oldTerm)
+	}
+	if _, term, isLeader := h.cluster[oldLeaderId].em.Report(); isLeader || term != newTerm {
+		t.Errorf("old leader is at term %d leading %v, want a follower at term %d", term, isLeader, newTerm)
+	}
+
+	// and it still takes part in commits
+	h.SubmitToServer(newLeaderId, "doc1", 1)
+	sleepMs(200)
+	if nc, _ := h.CheckCommitted(1); nc != 3 {
+		t.Errorf("%d brokers committed after the step down, want 3", nc)
+	}
+}
@@ -0,0 +1,32 @@
+package broker
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// reject requests without "Authorization: Bearer <token>" with 401
+// an empty token lets every request through
+func authMiddleware(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, got, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="clarity"`)
+			http.Error(w, "Missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scheme the application server reaches brokers with
+func (broker *BrokerServer) httpScheme() string {
+	if broker.httpServerTLS != nil {
+		return "https"
+	}
+	return "http"
+}
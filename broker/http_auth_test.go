@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestCRDTBearerTokenOverHTTPS(t *testing.T) {
+	const token = "s3cret"
+	files := writeTestCerts(t, t.TempDir())
+	opts := make([]BrokerOptions, 3)
+	for i := range opts {
+		opts[i].HTTPTLS = &files
+		opts[i].AuthToken = token
+	}
+	h := NewHarnessWithOptions(t, 3, opts)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	leaderAddr := h.cluster[origLeaderId].GetHTTPAddr()
+
+	_, clientTLS, err := files.load(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	body, _ := json.Marshal(CRDTMessage{Type: OpInsert, Index: 0, Value: "a", ReplicaID: "r1", OpIndex: 1, Source: "client"})
+
+	post := func(client *http.Client, url, authorization string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	url := fmt.Sprintf("https://%s/crdt", leaderAddr)
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"valid token", "Bearer " + token, http.StatusAccepted},
+		{"missing token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer not-" + token, http.StatusUnauthorized},
+		{"wrong scheme", "Basic " + token, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		resp, err := post(client, url, tt.authorization)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without a WWW-Authenticate header", tt.name)
+		}
+	}
+
+	// plain http isn't served any more
+	if resp, err := post(http.DefaultClient, fmt.Sprintf("http://%s/crdt", leaderAddr), "Bearer "+token); err == nil && resp.StatusCode == http.StatusAccepted {
+		t.Errorf("plain http request was accepted")
+	}
+
+	leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+	if len(leaderLog) != 1 {
+		t.Errorf("leader log has %d entries, want only the one with a valid token", len(leaderLog))
+	}
+
+	// peers still reach each other's rpc server through the https address
+	followerId := (origLeaderId + 1) % h.n
+	rpcClient, err := h.cluster[origLeaderId].dialRPCOverHTTP(h.cluster[followerId].GetHTTPAddr())
+	if err != nil {
+		t.Fatalf("rpc over https: %v", err)
+	}
+	defer rpcClient.Close()
+	var reply RequestVoteReply
+	if err := rpcClient.Call(context.Background(), "ElectionModule.RequestVote", RequestVoteArgs{Term: 0, CandidateId: origLeaderId}, &reply); err != nil {
+		t.Errorf("RequestVote over https failed: %v", err)
+	}
+	if reply.VoteGranted {
+		t.Errorf("follower granted a vote for term 0")
+	}
+}
@@ -0,0 +1,98 @@
+package broker
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// whether the client listed gzip in Accept-Encoding without q=0
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	zw          *gzip.Writer
+	wroteHeader bool
+}
+
+// headers are fixed up here rather than up front since handlers like http.Error
+// reset some of them before writing
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			// sniff the uncompressed body, not the gzip stream
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.zw.Write(p)
+}
+
+// gzip the responses of next for clients that accept it
+// used for the read endpoints, whose responses grow with the log
+func compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		zw := gzip.NewWriter(w)
+		gw := &gzipResponseWriter{ResponseWriter: w, zw: zw}
+		next.ServeHTTP(gw, r)
+		if !gw.wroteHeader {
+			gw.WriteHeader(http.StatusOK)
+		}
+		zw.Close()
+	})
+}
+
+// let clients send gzip compressed request bodies with Content-Encoding: gzip
+func decompressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch encoding := r.Header.Get("Content-Encoding"); {
+		case encoding == "" || strings.EqualFold(encoding, "identity"):
+		case strings.EqualFold(encoding, "gzip"):
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid gzip request body", http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			r.Body = zr
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		default:
+			http.Error(w, "Unsupported Content-Encoding "+encoding, http.StatusUnsupportedMediaType)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,154 @@
+package broker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a leader with entries in its log, enough for handleLogGetRequest
+func leaderWithLog(entries []LogEntry) *BrokerServer {
+	return &BrokerServer{state: Leader, rm: &ReplicationModule{log: entries}, logger: slog.Default()}
+}
+
+func testLogEntries(n int) []LogEntry {
+	entries := make([]LogEntry, n)
+	for i := range entries {
+		op := fmt.Sprintf("Type[insert] Index[%d] Value[%c]", i, 'a'+i%26)
+		entries[i] = LogEntry{CRDTOperation: op, Term: 1, Document: "doc1"}
+	}
+	return entries
+}
+
+// get url with the given Accept-Encoding, without the transport decompressing for us
+func getRaw(t testing.TB, url, acceptEncoding string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestLogRequestCompression(t *testing.T) {
+	broker := leaderWithLog(testLogEntries(100))
+	server := httptest.NewServer(compressionMiddleware(http.HandlerFunc(broker.handleLogGetRequest)))
+	defer server.Close()
+
+	resp, plain := getRaw(t, server.URL, "")
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("got Content-Encoding %q without asking for it", resp.Header.Get("Content-Encoding"))
+	}
+	var want []HistoryEntry
+	if err := json.Unmarshal(plain, &want); err != nil || len(want) != 100 {
+		t.Fatalf("uncompressed response has %d entries, err %v", len(want), err)
+	}
+
+	for _, acceptEncoding := range []string{"gzip", "deflate, gzip;q=0.5", "br;q=1.0, GZIP"} {
+		resp, compressed := getRaw(t, server.URL, acceptEncoding)
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding %q got Content-Encoding %q, want gzip", acceptEncoding, resp.Header.Get("Content-Encoding"))
+			continue
+		}
+		if resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got Content-Type %q, want application/json", resp.Header.Get("Content-Type"))
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, plain) {
+			t.Errorf("decompressed response differs from the uncompressed one")
+		}
+		if len(compressed) >= len(plain) {
+			t.Errorf("compressed response is %d bytes, uncompressed %d", len(compressed), len(plain))
+		}
+	}
+
+	// gzip;q=0 means anything but gzip
+	if resp, _ := getRaw(t, server.URL, "gzip;q=0"); resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("got Content-Encoding %q for gzip;q=0", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestCRDTAcceptsGzipBody(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	url := fmt.Sprintf("http://%s/crdt", h.cluster[origLeaderId].GetHTTPAddr())
+
+	body, _ := json.Marshal(CRDTMessage{Type: OpInsert, Index: 0, Value: "a", ReplicaID: "r1", OpIndex: 1, Source: "client"})
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(body)
+	zw.Close()
+
+	post := func(body []byte, encoding string) int {
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post(compressed.Bytes(), "gzip"); status != http.StatusAccepted {
+		t.Errorf("gzip body got status %d, want %d", status, http.StatusAccepted)
+	}
+	if status := post(body, "gzip"); status != http.StatusBadRequest {
+		t.Errorf("plain body labelled gzip got status %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := post(body, "zstd"); status != http.StatusUnsupportedMediaType {
+		t.Errorf("zstd body got status %d, want %d", status, http.StatusUnsupportedMediaType)
+	}
+
+	leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+	if len(leaderLog) != 1 {
+		t.Errorf("leader log has %d entries, want 1", len(leaderLog))
+	}
+}
+
+// go test -bench LogRequestWire -run ^$
+func BenchmarkLogRequestWireSize(b *testing.B) {
+	broker := leaderWithLog(testLogEntries(10000))
+	server := httptest.NewServer(compressionMiddleware(http.HandlerFunc(broker.handleLogGetRequest)))
+	defer server.Close()
+
+	for _, acceptEncoding := range []string{"", "gzip"} {
+		b.Run(fmt.Sprintf("gzip=%t", acceptEncoding != ""), func(b *testing.B) {
+			var wireBytes int
+			for i := 0; i < b.N; i++ {
+				_, body := getRaw(b, server.URL, acceptEncoding)
+				wireBytes = len(body)
+			}
+			b.ReportMetric(float64(wireBytes), "wire-bytes")
+		})
+	}
+}
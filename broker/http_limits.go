@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// largest request body the http server reads when MaxRequestBytes isn't set
+const defaultMaxRequestBytes = 64 << 10
+
+// requests per remote host and a cap on request bodies, in front of every
+// endpoint of the http server. the per source limit on CRDT messages in
+// rate_limit.go comes on top of this
+func limitMiddleware(limiter *rateLimiter, maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.allow(remoteAddrSource(r)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		if maxBytes > 0 {
+			if r.ContentLength > maxBytes {
+				writeBodyTooLarge(w, maxBytes)
+				return
+			}
+			// chunked bodies are only found out once a handler reads past the cap
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// the request's remote host, without the port so every connection of a client
+// shares one bucket
+func remoteAddrSource(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "addr:" + r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// answer 413 when err came from reading past the body cap, false otherwise
+func bodyTooLarge(w http.ResponseWriter, err error) bool {
+	var maxErr *http.MaxBytesError
+	if !errors.As(err, &maxErr) {
+		return false
+	}
+	writeBodyTooLarge(w, maxErr.Limit)
+	return true
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
+
+// body cap from the options, 0 when bodies aren't limited
+func (opts BrokerOptions) maxRequestBytes() int64 {
+	switch {
+	case opts.MaxRequestBytes < 0:
+		return 0
+	case opts.MaxRequestBytes == 0:
+		return defaultMaxRequestBytes
+	default:
+		return opts.MaxRequestBytes
+	}
+}
+
+// timeout from the options, def when it is 0 and none when it is negative
+func httpTimeout(timeout, def time.Duration) time.Duration {
+	switch {
+	case timeout < 0:
+		return 0
+	case timeout == 0:
+		return def
+	default:
+		return timeout
+	}
+}
+
+// a listener that has at most n connections open at once, like
+// netutil.LimitListener. Accept waits for one to be closed
+func LimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{Listener: l, sem: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitListenerConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestRateLimit(t *testing.T) {
+	const burst = 3
+
+	// slow enough refill that no tokens come back during the test
+	limiter := newRateLimiter(0.01, burst)
+	handler := limitMiddleware(limiter, defaultMaxRequestBytes, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	get := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodGet, "/status", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// connections from one host share a bucket whatever their port
+	for i := 0; i < burst; i++ {
+		if code := get(fmt.Sprintf("10.0.0.1:%d", 5000+i)); code != http.StatusNoContent {
+			t.Fatalf("request %d within the burst got status %d", i, code)
+		}
+	}
+	if code := get("10.0.0.1:6000"); code != http.StatusTooManyRequests {
+		t.Errorf("request over the burst got status %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	// another host is unaffected by the flooder
+	for i := 0; i < burst; i++ {
+		if code := get("10.0.0.2:5000"); code != http.StatusNoContent {
+			t.Errorf("request %d from another host got status %d", i, code)
+		}
+	}
+}
+
+func TestRequestSizeLimit(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	url := fmt.Sprintf("http://%s/crdt", h.cluster[leaderId].GetHTTPAddr())
+
+	body := func(value string) []byte {
+		data, _ := json.Marshal(CRDTMessage{Type: OpInsert, Index: 0, Value: value, ReplicaID: "r1", OpIndex: 1, Source: "client"})
+		return data
+	}
+	post := func(r io.Reader) int {
+		resp, err := http.Post(url, "application/json", r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(bytes.NewReader(body("a"))); code != http.StatusAccepted {
+		t.Errorf("small operation got status %d, want %d", code, http.StatusAccepted)
+	}
+
+	large := body(strings.Repeat("a", defaultMaxRequestBytes))
+	if code := post(bytes.NewReader(large)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized operation got status %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+	// without a Content-Length the body is cut off while it is decoded
+	if code := post(io.MultiReader(bytes.NewReader(large))); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized chunked operation got status %d, want %d", code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestSlowClientIsDisconnected(t *testing.T) {
+	const readTimeout = 300 * time.Millisecond
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].HTTPReadTimeout = readTimeout
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	conn, err := net.Dial("tcp", h.cluster[leaderId].GetHTTPAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the headers trickle in a byte at a time and never end
+	start := time.Now()
+	go func() {
+		for _, b := range []byte("GET /status HTTP/1.1\r\nHost: broker\r\nX-Slow: " + strings.Repeat("a", 1000)) {
+			if _, err := conn.Write([]byte{b}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("the connection was still open after 5s")
+	}
+	if elapsed := time.Since(start); elapsed < readTimeout {
+		t.Errorf("the connection was closed after %v, before the read timeout", elapsed)
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := LimitListener(inner, 1)
+	defer l.Close()
+
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("a second connection was accepted while the first is open")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// closing twice frees one slot only
+	first.Close()
+	first.Close()
+	select {
+	case second := <-accepted:
+		second.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the second connection wasn't accepted once the first was closed")
+	}
+}
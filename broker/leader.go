@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type WhoIsLeaderArgs struct{}
+
+// body of GET /leader too. a follower answers with the leader it last got
+// AppendEntries or InstallSnapshot from, which can be out of date until it
+// hears from a newer one
+type WhoIsLeaderReply struct {
+	// -1 when the broker doesn't know of a leader
+	LeaderId int    `json:"leader_id"`
+	HTTPAddr string `json:"http_addr,omitempty"`
+	Term     int    `json:"term"`
+
+	// true when the broker that answered is the leader itself
+	Self bool `json:"self"`
+}
+
+// rpc any broker answers with its best knowledge of the current leader
+func (em *ElectionModule) WhoIsLeader(args WhoIsLeaderArgs, reply *WhoIsLeaderReply) error {
+	// taken before mu2, httpAddr is guarded by mu
+	selfAddr := em.broker.GetHTTPAddr()
+
+	em.broker.mu2.Lock()
+	defer em.broker.mu2.Unlock()
+	if em.broker.paused {
+		return ErrBrokerPaused
+	}
+
+	reply.Term = em.term
+	reply.LeaderId = -1
+	switch {
+	case em.broker.state == Leader:
+		reply.LeaderId = em.id
+		reply.HTTPAddr = selfAddr
+		reply.Self = true
+	case em.leaderId >= 0:
+		reply.LeaderId = em.leaderId
+		reply.HTTPAddr = em.peerAddrs[em.leaderId]
+	}
+	return nil
+}
+
+// the leader as this broker knows it, see WhoIsLeaderReply
+func (broker *BrokerServer) WhoIsLeader() (WhoIsLeaderReply, error) {
+	var reply WhoIsLeaderReply
+	err := broker.em.WhoIsLeader(WhoIsLeaderArgs{}, &reply)
+	return reply, err
+}
+
+// http func for application servers and clients looking for the leader
+// 503 while this broker knows of no leader, e.g. during an election
+func (broker *BrokerServer) handleLeader(w http.ResponseWriter, r *http.Request) {
+	reply, err := broker.WhoIsLeader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if reply.LeaderId < 0 {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, ErrNoLeader.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		http.Error(w, fmt.Sprintf("Error encoding leader: %v", err), http.StatusInternalServerError)
+	}
+}
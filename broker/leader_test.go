@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFollowerReportsLeader(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, term := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % h.n
+	leaderAddr := h.cluster[leaderId].GetHTTPAddr()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/leader", h.cluster[followerId].GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /leader got status %d", resp.StatusCode)
+	}
+	var reply WhoIsLeaderReply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	want := WhoIsLeaderReply{LeaderId: leaderId, HTTPAddr: leaderAddr, Term: term}
+	if reply != want {
+		t.Errorf("follower %d reported %+v, want %+v", followerId, reply, want)
+	}
+
+	// asked over rpc, the leader answers for itself
+	reply = WhoIsLeaderReply{}
+	if err := h.cluster[followerId].Call(context.Background(), leaderId, "ElectionModule.WhoIsLeader", WhoIsLeaderArgs{}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	want.Self = true
+	if reply != want {
+		t.Errorf("leader reported %+v, want %+v", reply, want)
+	}
+}
+
+// GET /leader on broker id, the reply is only decoded on a 200
+func getLeader(t *testing.T, h *Harness, id int) (WhoIsLeaderReply, int) {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://%s/leader", h.cluster[id].GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var reply WhoIsLeaderReply
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reply, resp.StatusCode
+}
+
+func TestLeaderEndpointFollowsFailover(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	oldLeaderId, oldTerm := h.CheckSingleLeader()
+
+	if reply, code := getLeader(t, h, oldLeaderId); code != http.StatusOK || !reply.Self || reply.LeaderId != oldLeaderId {
+		t.Errorf("leader answered %d %+v, want itself", code, reply)
+	}
+
+	h.CrashPeer(oldLeaderId)
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId == oldLeaderId || newTerm <= oldTerm {
+		t.Fatalf("leader %d in term %d after the crash, want a new one after term %d", newLeaderId, newTerm, oldTerm)
+	}
+
+	// the remaining brokers point at the new leader once they heard from it
+	deadline := time.Now().Add(2 * time.Second)
+	for id := range 3 {
+		if id == oldLeaderId {
+			continue
+		}
+		for {
+			reply, code := getLeader(t, h, id)
+			if code == http.StatusOK && reply.LeaderId == newLeaderId && reply.Term == newTerm &&
+				reply.HTTPAddr == h.cluster[newLeaderId].GetHTTPAddr() && reply.Self == (id == newLeaderId) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("broker %d answered %d %+v, want leader %d in term %d", id, code, reply, newLeaderId, newTerm)
+			}
+			sleepMs(20)
+		}
+	}
+}
+
+func TestLeaderEndpointWithoutLeader(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % 3
+
+	// a follower that moved on to a term nobody has won yet has forgotten
+	// the old leader
+	h.DisconnectPeer(followerId)
+	h.cluster[followerId].mu2.Lock()
+	h.cluster[followerId].em.becomeFollower(h.cluster[followerId].em.term + 1)
+	h.cluster[followerId].mu2.Unlock()
+	if _, code := getLeader(t, h, followerId); code != http.StatusServiceUnavailable {
+		t.Errorf("broker without a known leader answered %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"errors"
+	"time"
+)
+
+// a leader that heard back from a majority within the lease can't have been
+// replaced yet, since no follower in that majority starts an election before
+// its election timeout runs out. so it can answer reads from its own log
+// without another round trip. the lease is kept at two thirds of the minimum
+// election timeout to leave room for clock drift between brokers
+func (opts BrokerOptions) leaderLeaseDuration() time.Duration {
+	minTimeout, _ := opts.electionTimeouts()
+	return minTimeout * 2 / 3
+}
+
+// how long ReadIndex waits for a majority to confirm leadership
+const readIndexTimeout = time.Second
+
+var ErrLeadershipNotConfirmed = errors.New("leader could not confirm it is still the leader")
+
+// record that peerId acknowledged this leader for an AE sent at sentAt
+// and move the lease forward if a majority has now acknowledged
+// caller must hold mu2
+func (rm *ReplicationModule) recordHeartbeatAck(peerId int, sentAt time.Time) {
+	if sentAt.After(rm.heartbeatAcks[peerId]) {
+		rm.heartbeatAcks[peerId] = sentAt
+	}
+
+	// the newest time that a majority has acknowledged the leader since
+	for _, candidate := range rm.heartbeatAcks {
+		if !candidate.After(rm.lastMajorityHeartbeat) {
+			continue
+		}
+		confirmed := rm.membership.hasQuorum(func(id int) bool {
+			return id == rm.id || !rm.heartbeatAcks[id].Before(candidate)
+		})
+		if confirmed {
+			rm.lastMajorityHeartbeat = candidate
+		}
+	}
+	// writes are taken again as soon as the majority answers
+	if rm.readOnly {
+		rm.checkQuorumContact()
+	}
+}
+
+// caller must hold mu2
+func (rm *ReplicationModule) leaseValid() bool {
+	return rm.broker.state == Leader && (rm.alone() || time.Since(rm.lastMajorityHeartbeat) < rm.broker.options.leaderLeaseDuration())
+}
+
+// a single broker cluster is its own majority. caller must hold mu2
+func (rm *ReplicationModule) alone() bool {
+	return rm.membership.hasQuorum(func(id int) bool { return id == rm.id })
+}
+
+// copy of the committed prefix of the log, without the trimmed entries. caller must hold mu2
+func (rm *ReplicationModule) committedEntries(upTo int) []LogEntry {
+	return decompressEntries(rm.logSlice(rm.logBaseIndex, upTo+1))
+}
+
+// read the committed log on the leader without going through the log
+// answers from local state while the lease is valid, otherwise falls back to ReadIndex
+func (rm *ReplicationModule) LeaseRead() ([]LogEntry, error) {
+	rm.broker.mu2.Lock()
+	if rm.leaseValid() {
+		defer rm.broker.mu2.Unlock()
+		return rm.committedEntries(rm.commitIndex), nil
+	}
+	rm.broker.mu2.Unlock()
+
+	return rm.ReadIndex()
+}
+
+// read the committed log on the leader after confirming with a majority
+// that it is still the leader. costs one heartbeat round trip
+func (rm *ReplicationModule) ReadIndex() ([]LogEntry, error) {
+	start := time.Now()
+
+	rm.broker.mu2.Lock()
+	if rm.broker.state != Leader {
+		rm.broker.mu2.Unlock()
+		return nil, ErrNotLeader
+	}
+	readIndex := rm.commitIndex
+	rm.broker.mu2.Unlock()
+
+	// don't wait for the next heartbeat
+	select {
+	case rm.triggerAEChan <- struct{}{}:
+	default:
+	}
+
+	for time.Since(start) < readIndexTimeout {
+		rm.broker.mu2.Lock()
+		if rm.broker.state != Leader {
+			rm.broker.mu2.Unlock()
+			return nil, ErrNotLeader
+		}
+		// only acks for AEs sent after the read started count
+		if rm.alone() || !rm.lastMajorityHeartbeat.Before(start) {
+			defer rm.broker.mu2.Unlock()
+			return rm.committedEntries(readIndex), nil
+		}
+		rm.broker.mu2.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil, ErrLeadershipNotConfirmed
+}
@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseReadWithinLease(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	for _, cmd := range []int{1, 2} {
+		if h.SubmitToServer(origLeaderId, "doc1", cmd) < 0 {
+			t.Fatalf("want id=%d leader, but it's not", origLeaderId)
+		}
+		sleepMs(100)
+	}
+	h.CheckCommitted(2)
+
+	// heartbeats keep the lease fresh, so reads don't wait on a round trip
+	rm := h.cluster[origLeaderId].rm
+	start := time.Now()
+	entries, err := rm.LeaseRead()
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("LeaseRead: %v", err)
+	}
+	if elapsed > rm.broker.options.leaderLeaseDuration() {
+		t.Errorf("lease read took %s", elapsed)
+	}
+	if len(entries) != 2 || entries[0].CRDTOperation != 1 || entries[1].CRDTOperation != 2 {
+		t.Errorf("lease read returned %+v, want commands 1 and 2", entries)
+	}
+
+	// followers never hold a lease
+	if _, err := h.cluster[(origLeaderId+1)%h.n].rm.LeaseRead(); err != ErrNotLeader {
+		t.Errorf("follower LeaseRead returned %v, want %v", err, ErrNotLeader)
+	}
+}
+
+func TestLeaseReadFallsBackToReadIndex(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	if h.SubmitToServer(origLeaderId, "doc1", 1) < 0 {
+		t.Fatalf("want id=%d leader, but it's not", origLeaderId)
+	}
+	sleepMs(100)
+	h.CheckCommitted(1)
+
+	// expire the lease, the read still succeeds through ReadIndex
+	rm := h.cluster[origLeaderId].rm
+	h.cluster[origLeaderId].mu2.Lock()
+	rm.lastMajorityHeartbeat = time.Time{}
+	h.cluster[origLeaderId].mu2.Unlock()
+
+	entries, err := rm.LeaseRead()
+	if err != nil {
+		t.Fatalf("LeaseRead after expiry: %v", err)
+	}
+	if len(entries) != 1 || entries[0].CRDTOperation != 1 {
+		t.Errorf("read returned %+v, want command 1", entries)
+	}
+
+	// a leader cut off from the majority loses its lease and can't confirm
+	// leadership, so it refuses to serve a possibly stale read
+	h.DisconnectPeer(origLeaderId)
+	sleepMs(int(rm.broker.options.leaderLeaseDuration() / time.Millisecond))
+	if _, err := rm.LeaseRead(); err == nil {
+		t.Errorf("disconnected leader served a read")
+	}
+}
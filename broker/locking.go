@@ -0,0 +1,46 @@
+package broker
+
+// the locks of a broker. when more than one is held they are taken in this order
+//
+//	mu2             election and replication state: state, term, votes, the log
+//	peerDialer.mu   one redial of a peer at a time, see peer_connections.go
+//	mu              rpc server, listener and connections, peer clients
+//	everything else em.timerMu, the rpc proxy, documents, streams and the
+//	                like, nothing else is taken while holding them
+//
+// no rpc is sent and no peer is dialed while holding mu2 or mu. the http
+// handlers and the logger only need the state, term and leader, they read the
+// view instead of waiting on mu2 behind replication
+
+// state, term and leader of a broker at one point in time. replaced whole
+// so readers never see the state of one term with the leader of another
+type brokerView struct {
+	state    ServerState
+	term     int
+	leaderId int
+}
+
+// the state, term and leader as of the last change, without taking mu2
+func (broker *BrokerServer) currentView() brokerView {
+	if view := broker.view.Load(); view != nil {
+		return *view
+	}
+	return brokerView{state: Follower, leaderId: -1}
+}
+
+// store the current state, term and leader for currentView
+// caller must hold mu2, or be starting the broker before anything else runs
+func (broker *BrokerServer) publishView() {
+	view := &brokerView{state: broker.state, leaderId: -1}
+	if em := broker.em; em != nil {
+		view.term, view.leaderId = em.term, em.leaderId
+	}
+	broker.view.Store(view)
+	broker.loggedState.Store(int32(broker.state))
+}
+
+// remember leaderId as the leader of the current term. caller must hold mu2
+func (em *ElectionModule) setLeader(leaderId int) {
+	em.leaderId = leaderId
+	em.broker.publishView()
+}
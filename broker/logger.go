@@ -0,0 +1,46 @@
+package broker
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// leveled logger the broker writes through, set with BrokerOptions.Logger
+// args are alternating keys and values like slog, so a *slog.Logger works as is
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// adds the broker id and its current state to every record
+type brokerLogger struct {
+	base  Logger
+	id    int
+	state *atomic.Int32
+}
+
+func newBrokerLogger(base Logger, id int, state *atomic.Int32) brokerLogger {
+	if base == nil {
+		base = slog.Default()
+	}
+	return brokerLogger{base: base, id: id, state: state}
+}
+
+func (l brokerLogger) with(args []any) []any {
+	return append([]any{"broker", l.id, "state", ServerState(l.state.Load()).String()}, args...)
+}
+
+func (l brokerLogger) Debug(msg string, args ...any) { l.base.Debug(msg, l.with(args)...) }
+func (l brokerLogger) Info(msg string, args ...any)  { l.base.Info(msg, l.with(args)...) }
+func (l brokerLogger) Warn(msg string, args ...any)  { l.base.Warn(msg, l.with(args)...) }
+func (l brokerLogger) Error(msg string, args ...any) { l.base.Error(msg, l.with(args)...) }
+
+// change the broker's state. caller must hold mu2
+// the state is mirrored for the logger, which can't take mu2 since most logging
+// happens under it, and for the other readers of currentView
+func (broker *BrokerServer) setState(state ServerState) {
+	broker.state = state
+	broker.publishView()
+}
@@ -0,0 +1,100 @@
+package broker
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type capturedRecord struct {
+	level string
+	msg   string
+	args  []any
+	at    time.Time
+}
+
+// keeps every record so tests can assert on what was logged
+type captureLogger struct {
+	mu      sync.Mutex
+	records []capturedRecord
+}
+
+func (l *captureLogger) record(level, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, capturedRecord{level, msg, slices.Clone(args), time.Now()})
+}
+
+func (l *captureLogger) Debug(msg string, args ...any) { l.record("debug", msg, args) }
+func (l *captureLogger) Info(msg string, args ...any)  { l.record("info", msg, args) }
+func (l *captureLogger) Warn(msg string, args ...any)  { l.record("warn", msg, args) }
+func (l *captureLogger) Error(msg string, args ...any) { l.record("error", msg, args) }
+
+// records logged with msg
+func (l *captureLogger) find(msg string) []capturedRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []capturedRecord
+	for _, r := range l.records {
+		if r.msg == msg {
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+// value logged for key, nil when there is none
+func (r capturedRecord) attr(key string) any {
+	for i := 0; i+1 < len(r.args); i += 2 {
+		if r.args[i] == key {
+			return r.args[i+1]
+		}
+	}
+	return nil
+}
+
+func TestInjectedLoggerCapturesElection(t *testing.T) {
+	loggers := make([]*captureLogger, 3)
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		loggers[i] = new(captureLogger)
+		options[i].Logger = loggers[i]
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+
+	leaderId, term := h.CheckSingleLeader()
+	// a few heartbeats
+	sleepMs(100)
+
+	became := loggers[leaderId].find("becomes leader")
+	if len(became) == 0 {
+		t.Fatalf("leader %d never logged becoming leader", leaderId)
+	}
+	last := became[len(became)-1]
+	if last.level != "info" {
+		t.Errorf("becoming leader logged at %s, want info", last.level)
+	}
+	if last.attr("broker") != leaderId || last.attr("state") != "Leader" || last.attr("term") != term {
+		t.Errorf("becoming leader logged with %v, want broker %d, state Leader and term %d", last.args, leaderId, term)
+	}
+
+	// heartbeats are too frequent for anything above debug
+	for i, logger := range loggers {
+		heartbeat := "received AE"
+		if i == leaderId {
+			heartbeat = "sending AE"
+		}
+		if len(logger.find(heartbeat)) == 0 {
+			t.Errorf("broker %d never logged %q", i, heartbeat)
+		}
+		for _, msg := range []string{"sending AE", "received AE", "resets election timer"} {
+			for _, r := range logger.find(msg) {
+				if r.level != "debug" {
+					t.Errorf("broker %d logged %q at %s, want debug", i, msg, r.level)
+				}
+			}
+		}
+	}
+}
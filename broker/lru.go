@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// fixed size cache that evicts the least recently added key when full, and
+// treats keys older than ttl as missing
+type lruCache[K comparable, V any] struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // front is the newest
+	entries  map[K]*list.Element
+
+	// replaced in tests
+	now func() time.Time
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+	added time.Time
+}
+
+func newLRUCache[K comparable, V any](capacity int, ttl time.Duration) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[K]*list.Element),
+		now:      time.Now,
+	}
+}
+
+// caller must hold c.mu
+func (c *lruCache[K, V]) getLocked(key K) (V, bool) {
+	var zero V
+	elem, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := elem.Value.(*lruEntry[K, V])
+	if c.now().Sub(entry.added) > c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getLocked(key)
+}
+
+// add key unless it is already cached, reporting whether it was added
+// checking and adding happen together so concurrent callers can't both add
+func (c *lruCache[K, V]) AddIfAbsent(key K, value V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.getLocked(key); ok {
+		return false
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, added: c.now()})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+	}
+	return true
+}
+
+// replace the value of a cached key without changing its age. does nothing if key isn't cached
+func (c *lruCache[K, V]) Update(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lruEntry[K, V]).value = value
+	}
+}
+
+func (c *lruCache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lruCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,136 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheCapacityAndTTL(t *testing.T) {
+	now := time.Now()
+	cache := newLRUCache[string, bool](3, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if !cache.AddIfAbsent(key, true) {
+			t.Errorf("%s reported as already cached", key)
+		}
+	}
+	if cache.AddIfAbsent("d", true) {
+		t.Errorf("d added twice")
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Errorf("oldest key a wasn't evicted at capacity")
+	}
+	if cache.Len() != 3 {
+		t.Errorf("cache has %d keys, want 3", cache.Len())
+	}
+
+	now = now.Add(time.Minute + time.Second)
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("b still cached after the ttl")
+	}
+	if !cache.AddIfAbsent("c", true) {
+		t.Errorf("expired key c couldn't be added again")
+	}
+}
+
+func TestCRDTDeduplicatesOpID(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	followerId := (origLeaderId + 1) % h.n
+	sleepMs(100)
+
+	post := func(serverId int, body string) int {
+		url := fmt.Sprintf("http://%s/crdt", h.cluster[serverId].GetHTTPAddr())
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	msg := `{"type":"insert","index":0,"value":"a","replica_id":"r1","operation_index":1,"op_id":"%s"}`
+	if status := post(origLeaderId, fmt.Sprintf(msg, "op-1")); status != http.StatusAccepted {
+		t.Errorf("first submit got status %d, want %d", status, http.StatusAccepted)
+	}
+	// the retry of the same action, through the leader or a follower
+	for _, serverId := range []int{origLeaderId, followerId} {
+		if status := post(serverId, fmt.Sprintf(msg, "op-1")); status != http.StatusOK {
+			t.Errorf("duplicate submit to %d got status %d, want %d", serverId, status, http.StatusOK)
+		}
+	}
+	if status := post(origLeaderId, fmt.Sprintf(msg, "op-2")); status != http.StatusAccepted {
+		t.Errorf("another action got status %d, want %d", status, http.StatusAccepted)
+	}
+
+	leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+	if len(leaderLog) != 2 {
+		t.Errorf("leader log has %d entries, want one per op id", len(leaderLog))
+	}
+}
+
+func TestCRDTIdempotencyKeyHeader(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].OpIDTTL = ttl
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	origLeaderId, _ := h.CheckSingleLeader()
+	followerId := (origLeaderId + 1) % h.n
+
+	post := func(serverId int, key string) int {
+		url := fmt.Sprintf("http://%s/crdt", h.cluster[serverId].GetHTTPAddr())
+		req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(`{"type":"insert","index":0,"value":"a","replica_id":"r1","operation_index":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	leaderLogLength := func() int {
+		leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+		return len(leaderLog)
+	}
+
+	// the same key twice, the second time through a follower
+	if status := post(origLeaderId, "key-1"); status != http.StatusAccepted {
+		t.Errorf("first submit got status %d, want %d", status, http.StatusAccepted)
+	}
+	if status := post(followerId, "key-1"); status != http.StatusOK {
+		t.Errorf("replay got status %d, want %d", status, http.StatusOK)
+	}
+	if n := leaderLogLength(); n != 1 {
+		t.Errorf("leader log has %d entries after a replay, want 1", n)
+	}
+
+	if status := post(origLeaderId, "key-2"); status != http.StatusAccepted {
+		t.Errorf("another key got status %d, want %d", status, http.StatusAccepted)
+	}
+	if n := leaderLogLength(); n != 2 {
+		t.Errorf("leader log has %d entries after two keys, want 2", n)
+	}
+
+	// once the key expired it is a new operation
+	sleepMs(int(2 * ttl / time.Millisecond))
+	if status := post(origLeaderId, "key-1"); status != http.StatusAccepted {
+		t.Errorf("expired key got status %d, want %d", status, http.StatusAccepted)
+	}
+	if n := leaderLogLength(); n != 3 {
+		t.Errorf("leader log has %d entries after an expired key, want 3", n)
+	}
+}
@@ -0,0 +1,298 @@
+package broker
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// membership changes use joint consensus (raft paper section 6)
+// AddPeer and RemovePeer first append a JointConfig entry holding both the old
+// and the new member lists. while it is active, elections and commits need the
+// old members and the new members to agree. once the JointConfig commits the
+// leader appends a NewConfig entry and the old members stop mattering
+//
+// every broker uses the latest config entry in its log, committed or not
+
+// log entry payload for the first phase of a membership change
+type JointConfig struct {
+	Old []int
+	New []int
+
+	// rpc addresses of brokers added to the cluster, so every member can dial them
+	Addrs map[int]string
+}
+
+// log entry payload for the second phase of a membership change
+type NewConfig struct {
+	Members []int
+	Addrs   map[int]string
+}
+
+func init() {
+	// config entries travel inside LogEntry.CRDTOperation which is an interface
+	gob.Register(JointConfig{})
+	gob.Register(NewConfig{})
+}
+
+var ErrNotLeader = errors.New("broker is not the leader")
+var ErrConfigChangeInProgress = errors.New("a membership change is already in progress")
+
+// how long each phase of a membership change can take to commit
+const configChangeTimeout = 5 * time.Second
+
+// the set of brokers whose agreement is needed, including this broker
+type membership struct {
+	members []int
+
+	// members of the previous configuration while a JointConfig is active, nil otherwise
+	oldMembers []int
+}
+
+func (m membership) isJoint() bool {
+	return m.oldMembers != nil
+}
+
+func (m membership) contains(id int) bool {
+	return slices.Contains(m.members, id) || slices.Contains(m.oldMembers, id)
+}
+
+// every broker except self that should receive AppendEntries and RequestVote
+func (m membership) peers(self int) []int {
+	var peers []int
+	for _, ids := range [][]int{m.members, m.oldMembers} {
+		for _, id := range ids {
+			if id != self && !slices.Contains(peers, id) {
+				peers = append(peers, id)
+			}
+		}
+	}
+	return peers
+}
+
+// majority of the members, and of the old members during a joint configuration
+func (m membership) hasQuorum(granted func(id int) bool) bool {
+	majority := func(ids []int) bool {
+		count := 0
+		for _, id := range ids {
+			if granted(id) {
+				count++
+			}
+		}
+		return count*2 > len(ids)
+	}
+	if m.isJoint() && !majority(m.oldMembers) {
+		return false
+	}
+	return majority(m.members)
+}
+
+// every member, and every old member during a joint configuration
+// commits are atomic in this implementation so this is used instead of hasQuorum
+func (m membership) allAgree(agrees func(id int) bool) bool {
+	for _, id := range m.peers(-1) {
+		if !agrees(id) {
+			return false
+		}
+	}
+	return true
+}
+
+func isConfigEntry(entry LogEntry) bool {
+	switch entry.CRDTOperation.(type) {
+	case JointConfig, NewConfig:
+		return true
+	}
+	return false
+}
+
+// recompute the active membership from the log after it changed
+// caller must hold mu2
+func (rm *ReplicationModule) refreshMembership() {
+	updated := rm.baseMembership
+	var addrs map[int]string
+	for i := len(rm.log) - 1; i >= 0; i-- {
+		if config, ok := rm.log[i].CRDTOperation.(JointConfig); ok {
+			updated = membership{members: config.New, oldMembers: config.Old}
+			addrs = config.Addrs
+			break
+		}
+		if config, ok := rm.log[i].CRDTOperation.(NewConfig); ok {
+			updated = membership{members: config.Members}
+			addrs = config.Addrs
+			break
+		}
+	}
+	rm.membership = updated
+
+	for _, peerId := range updated.peers(rm.id) {
+		// the leader starts tracking brokers it hasn't replicated to before
+		if rm.broker.state == Leader {
+			if _, ok := rm.nextIndex[peerId]; !ok {
+				rm.nextIndex[peerId] = rm.lastLogIndex() + 1
+				rm.matchIndex[peerId] = -1
+			}
+		}
+		if addr, ok := addrs[peerId]; ok {
+			go rm.broker.connectToPeerAddr(peerId, addr)
+		}
+	}
+}
+
+// the configuration in effect at log index, from the latest config entry at or before it
+// caller must hold mu2
+func (rm *ReplicationModule) membershipAt(index int) membership {
+	for i := index; i >= rm.logBaseIndex; i-- {
+		switch config := rm.entry(i).CRDTOperation.(type) {
+		case JointConfig:
+			return membership{members: config.New, oldMembers: config.Old}
+		case NewConfig:
+			return membership{members: config.Members}
+		}
+	}
+	return rm.baseMembership
+}
+
+// append a config entry on the leader and start using it right away
+// caller must hold mu2
+func (rm *ReplicationModule) appendConfigEntry(config any) (int, error) {
+	index := rm.lastLogIndex() + 1
+	entry := LogEntry{CRDTOperation: config, Term: rm.broker.em.term}
+	var err error
+	if entry.Checksum, err = entry.checksum(); err != nil {
+		return -1, err
+	}
+	rm.log = append(rm.log, entry)
+	rm.refreshMembership()
+	rm.persistToStorage()
+	return index, nil
+}
+
+// poll until the entry at index commits or this broker stops leading
+func (rm *ReplicationModule) waitForConfigCommit(index int) error {
+	deadline := time.Now().Add(configChangeTimeout)
+	for time.Now().Before(deadline) {
+		rm.broker.mu2.Lock()
+		state, commitIndex := rm.broker.state, rm.commitIndex
+		rm.broker.mu2.Unlock()
+
+		if state != Leader {
+			return ErrNotLeader
+		}
+		if commitIndex >= index {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("config entry %d not committed within %s", index, configChangeTimeout)
+}
+
+// run both phases of a membership change on the leader
+func (broker *BrokerServer) changeMembership(update func(current []int) ([]int, error), addrs map[int]string) error {
+	if len(broker.router.Shards()) > 1 {
+		return ErrShardedMembership
+	}
+	rm := broker.rm
+
+	rm.broker.mu2.Lock()
+	if broker.state != Leader {
+		rm.broker.mu2.Unlock()
+		return ErrNotLeader
+	}
+	if rm.membership.isJoint() {
+		rm.broker.mu2.Unlock()
+		return ErrConfigChangeInProgress
+	}
+	current := slices.Clone(rm.membership.members)
+	updated, err := update(slices.Clone(current))
+	if err != nil {
+		rm.broker.mu2.Unlock()
+		return err
+	}
+	jointIndex, err := rm.appendConfigEntry(JointConfig{Old: current, New: updated, Addrs: addrs})
+	rm.broker.mu2.Unlock()
+	if err != nil {
+		return err
+	}
+
+	broker.logger.Info("appended joint config", "old", current, "new", updated, "index", jointIndex)
+	rm.triggerAEChan <- struct{}{}
+	if err := rm.waitForConfigCommit(jointIndex); err != nil {
+		return err
+	}
+
+	rm.broker.mu2.Lock()
+	if broker.state != Leader {
+		rm.broker.mu2.Unlock()
+		return ErrNotLeader
+	}
+	newIndex, err := rm.appendConfigEntry(NewConfig{Members: updated, Addrs: addrs})
+	rm.broker.mu2.Unlock()
+	if err != nil {
+		return err
+	}
+
+	broker.logger.Info("appended new config", "members", updated, "index", newIndex)
+	rm.triggerAEChan <- struct{}{}
+	if err := rm.waitForConfigCommit(newIndex); err != nil {
+		return err
+	}
+
+	// a leader that removed itself hands off by stepping down
+	rm.broker.mu2.Lock()
+	defer rm.broker.mu2.Unlock()
+	if broker.state == Leader && !rm.membership.contains(broker.brokerid) {
+		broker.logger.Info("removed itself from the cluster, stepping down")
+		broker.em.becomeFollower(broker.em.term)
+	}
+	return nil
+}
+
+// add a broker listening for rpcs at addr to the cluster. only works on the leader
+// blocks until both phases of the change have committed
+func (broker *BrokerServer) AddPeer(id int, addr string) error {
+	return broker.changeMembership(func(current []int) ([]int, error) {
+		if slices.Contains(current, id) {
+			return nil, fmt.Errorf("broker %d is already a member", id)
+		}
+		return append(current, id), nil
+	}, map[int]string{id: addr})
+}
+
+// remove a broker from the cluster. only works on the leader
+// the removed broker should be shut down once this returns
+func (broker *BrokerServer) RemovePeer(id int) error {
+	return broker.changeMembership(func(current []int) ([]int, error) {
+		if !slices.Contains(current, id) {
+			return nil, fmt.Errorf("broker %d is not a member", id)
+		}
+		updated := slices.DeleteFunc(current, func(member int) bool { return member == id })
+		if len(updated) == 0 {
+			return nil, fmt.Errorf("can't remove the last member")
+		}
+		return updated, nil
+	}, nil)
+}
+
+// dial a peer learned from a config entry unless already connected
+func (broker *BrokerServer) connectToPeerAddr(peerId int, addr string) {
+	if broker.peerClient(peerId) != nil {
+		return
+	}
+	client, err := broker.dialRPC(addr)
+	if err != nil {
+		broker.logger.Warn("could not connect to new peer", "peer", peerId, "addr", addr, "err", err)
+		return
+	}
+	// dropped again if the peer was disconnected on purpose meanwhile
+	broker.installPeerClient(peerId, client)
+}
+
+// current members of the cluster as seen by this broker
+func (broker *BrokerServer) Members() (members []int, joint bool) {
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
+	return slices.Clone(broker.rm.membership.members), broker.rm.membership.isJoint()
+}
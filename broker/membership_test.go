@@ -0,0 +1,62 @@
+package broker
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAddPeersGrowsCluster(t *testing.T) {
+
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+
+	if h.SubmitToServer(origLeaderId, "doc1", 1) < 0 {
+		t.Fatalf("want id=%d leader, but it's not", origLeaderId)
+	}
+	h.WaitForCommit(0)
+
+	// grow the cluster to 5 brokers one at a time while it keeps running
+	for i := 0; i < 2; i++ {
+		id := h.AddNewServer()
+		if err := h.cluster[origLeaderId].AddPeer(id, h.cluster[id].GetListenAddr().String()); err != nil {
+			t.Fatalf("AddPeer(%d): %v", id, err)
+		}
+	}
+
+	if h.SubmitToServer(origLeaderId, "doc1", 2) < 0 {
+		t.Fatalf("want id=%d leader, but it's not", origLeaderId)
+	}
+
+	// every broker, including the new ones, ends up with both commands
+	// and agrees on the final configuration
+	want := []int{0, 1, 2, 3, 4}
+	const timeout = 5 * time.Second
+	start := time.Now()
+	for serverId := 0; serverId < h.n; serverId++ {
+		for {
+			_, commits, _, _ := h.GetLogsAndCommitIndexFromServer(serverId)
+			members, joint := h.cluster[serverId].Members()
+			slices.Sort(members)
+
+			hasSecond := false
+			for _, entry := range commits {
+				if entry.CRDTOperation == 2 {
+					hasSecond = true
+				}
+			}
+			if hasSecond && !joint && slices.Equal(members, want) {
+				break
+			}
+			if time.Since(start) > timeout {
+				t.Fatalf("server %d: members %v (joint %t), committed %+v", serverId, members, joint, commits)
+			}
+			sleepMs(10)
+		}
+	}
+
+	// the 5 broker cluster still elects a single leader
+	h.CheckSingleLeader()
+}
@@ -0,0 +1,188 @@
+package broker
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// optional settings for a broker server
+// the zero value gives the same behavior the tests have always used
+type BrokerOptions struct {
+	// file the materialized document state is checkpointed to
+	// empty means no checkpointing
+	CheckpointPath string
+
+	// number of applied log entries between checkpoints
+	CheckpointInterval int
+
+	// AppendEntries payloads whose encoded entries are larger than this many
+	// bytes are gzip compressed before being sent. 0 means never compress
+	AECompressionThreshold int
+
+	// crdt operations whose encoding is larger than this many bytes are kept
+	// gzip compressed in the log, see entry_compression.go. 0 means never
+	CompressionThreshold int
+
+	// how long the leader remembers the op id of a CRDT message, or its
+	// Idempotency-Key header, and answers retries with the first receipt
+	// 0 means opIDCacheTTL
+	OpIDTTL time.Duration
+
+	// sustained CRDT messages per second accepted from each source on /crdt
+	// 0 means no rate limiting
+	RateLimit float64
+
+	// number of CRDT messages a source can send in a burst before being limited
+	RateLimitBurst int
+
+	// sustained http requests per second accepted from each remote host on
+	// any endpoint, answered with 429 above it. 0 means no rate limiting
+	RequestRateLimit float64
+
+	// number of http requests a remote host can send in a burst before being limited
+	RequestRateLimitBurst int
+
+	// largest request body in bytes, larger ones are answered with 413
+	// 0 means defaultMaxRequestBytes, negative means no limit
+	MaxRequestBytes int64
+
+	// how long the http server waits for a whole request, for a response to
+	// be written, and for the next request on an idle keep-alive connection.
+	// 0 means the defaults below, negative means no timeout. GET /commits/stream
+	// isn't cut off by the read and write timeouts
+	HTTPReadTimeout  time.Duration
+	HTTPWriteTimeout time.Duration
+	HTTPIdleTimeout  time.Duration
+
+	// most http connections open at once, more wait to be accepted
+	// 0 means no limit
+	MaxHTTPConns int
+
+	// number of applied log entries between tombstone compactions of the
+	// materialized documents. 0 means never compact
+	CompactionInterval int
+
+	// number of applied log entries the log can hold before the ones already
+	// in the documents are trimmed off, see snapshot.go. followers missing
+	// trimmed entries are sent the documents instead, and so are application
+	// servers asking /committedlog?snapshot=true. 0 means never trim
+	SnapshotInterval int
+
+	// where the replicated log is persisted so a restarted broker can pick up
+	// where it left off. nil keeps it in memory only
+	Storage Storage
+
+	// number of replication groups documents are hashed over, each with its
+	// own log so they commit independently, see shard.go. every broker of a
+	// cluster has to use the same number. 0 means one group
+	Shards int
+
+	// where the log of each replication group after the first is persisted,
+	// keyed by group. Storage holds the first. groups without one keep their
+	// log in memory only
+	ShardStorage map[int]Storage
+
+	// how long a leader goes without hearing from a majority before it refuses
+	// writes, see quorum_loss.go. 0 means defaultQuorumLossTimeout, negative never
+	QuorumLossTimeout time.Duration
+
+	// heartbeat intervals a leader goes without hearing from a majority before
+	// it steps down to follower so a new election can run, see quorum_loss.go
+	// 0 means defaultStepDownRounds, negative never
+	StepDownRounds int
+
+	// how long rpcs to peers can take before giving up on them
+	// 0 means defaultRPCTimeout
+	RPCTimeout time.Duration
+
+	// how long Shutdown waits for in flight http requests before closing
+	// their connections. 0 means defaultShutdownGracePeriod
+	ShutdownGracePeriod time.Duration
+
+	// how long POST /crdt and /crdt/batch wait for their entries to commit
+	// before replying, see CRDTReceipt.Committed
+	// 0 means defaultReceiptCommitTimeout, negative doesn't wait
+	ReceiptCommitTimeout time.Duration
+
+	// protocol of rpcs between brokers, every broker of a cluster has to use
+	// the same one. nil means NetRPCTransport, see transport.go
+	Transport Transport
+
+	// faults injected into the rpcs this broker answers, for tests. the rpc
+	// server answers through an RPCProxy that can be changed with
+	// BrokerServer.RPCProxy. nil answers with the modules directly
+	RPCFaults *RPCFaults
+
+	// address the rpc server listens on. empty means any open port, peers
+	// can always reach it through the http address as well
+	RPCAddr string
+
+	// certificates for mutual tls on rpcs between brokers
+	// nil means plain tcp
+	RPCTLS *TLSFiles
+
+	// certificate the http server is served over https with. brokers check
+	// each other's against CAFile. nil means plain http
+	HTTPTLS *TLSFiles
+
+	// shared secret the application server has to send as a bearer token
+	// on every http request. empty means no authentication
+	AuthToken string
+
+	// bearer token operators send to the /admin endpoints, see http_admin.go
+	// separate from AuthToken so application servers can't trim the log.
+	// empty leaves the /admin endpoints out
+	AdminToken string
+
+	// decides which CRDT messages may be written, see authorizer.go
+	// nil means AllowAllAuthorizer
+	Authorizer Authorizer
+
+	// longest extra wait between election attempts after failed elections
+	// 0 means defaultElectionBackoffCeiling
+	ElectionBackoffCeiling time.Duration
+
+	// how often the leader sends AppendEntries when there is nothing new to
+	// send, and the range followers pick their election timeout from. the
+	// heartbeat has to be under half the minimum election timeout so a
+	// follower hears at least twice before giving up on the leader
+	// 0 means defaultHeartbeatInterval, defaultMinElectionTimeout and
+	// defaultMaxElectionTimeout
+	HeartbeatInterval  time.Duration
+	MinElectionTimeout time.Duration
+	MaxElectionTimeout time.Duration
+
+	// where the broker logs to. the broker id and state are added to every
+	// record. nil means slog.Default()
+	Logger Logger
+
+	// where the spans of rpcs and http requests go, see tracing.go
+	// nil means the global provider from otel.GetTracerProvider
+	TracerProvider trace.TracerProvider
+}
+
+const defaultCheckpointInterval = 100
+
+func (opts BrokerOptions) shards() int {
+	return max(opts.Shards, 1)
+}
+
+// a few heartbeat intervals, and under the minimum election timeout so a hung
+// peer can't hold an rpc goroutine longer than a follower waits for a leader
+const defaultRPCTimeout = 4 * defaultHeartbeatInterval
+
+const defaultShutdownGracePeriod = 5 * time.Second
+
+// a few replication rounds
+const defaultReceiptCommitTimeout = time.Second
+
+const defaultElectionBackoffCeiling = time.Second
+
+// long enough for a slow client to send a full CRDT batch, short enough that
+// clients sending nothing don't hold connections for long
+const (
+	defaultHTTPReadTimeout  = 10 * time.Second
+	defaultHTTPWriteTimeout = 30 * time.Second
+	defaultHTTPIdleTimeout  = 2 * time.Minute
+)
@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// kind of crdt operation carried by a CRDTMessage
+type OpType string
+
+const (
+	OpInsert OpType = "insert"
+	OpDelete OpType = "delete"
+)
+
+var ErrUnknownOpType = errors.New("unknown operation type")
+
+func (t OpType) Valid() bool {
+	switch t {
+	case OpInsert, OpDelete:
+		return true
+	}
+	return false
+}
+
+// rejects unknown operation types when the message is decoded instead of
+// letting them through to be dropped later
+func (t *OpType) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if !OpType(s).Valid() {
+		return fmt.Errorf("%w %q", ErrUnknownOpType, s)
+	}
+	*t = OpType(s)
+	return nil
+}
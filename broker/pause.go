@@ -0,0 +1,59 @@
+package broker
+
+import (
+	"errors"
+)
+
+var ErrBrokerPaused = errors.New("broker is paused")
+
+// make the broker unresponsive without shutting it down: AppendEntries and
+// RequestVote fail with ErrBrokerPaused, a leader stops sending heartbeats and
+// a follower doesn't campaign. connections to its peers stay open and it keeps
+// its log and term, so tests can simulate a slow peer and bring it back with Resume
+func (broker *BrokerServer) Pause() {
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
+	if broker.paused || broker.state == Dead {
+		return
+	}
+	broker.paused = true
+	broker.em.stopElectionTimer()
+	// an AE that was asked for before the pause isn't sent after it
+	for _, rm := range broker.router.Shards() {
+		select {
+		case <-rm.triggerAEChan:
+		default:
+		}
+	}
+	broker.logger.Info("paused")
+}
+
+// undo Pause. a follower restarts its election timer right away, a leader
+// sends AppendEntries and finds out from the replies if it was replaced
+func (broker *BrokerServer) Resume() {
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
+	if !broker.paused {
+		return
+	}
+	broker.paused = false
+	broker.logger.Info("resumed")
+	if broker.state == Leader {
+		for _, rm := range broker.router.Shards() {
+			select {
+			case rm.triggerAEChan <- struct{}{}:
+			default:
+			}
+		}
+		return
+	}
+	if broker.state != Dead {
+		broker.em.resetElectionTimer()
+	}
+}
+
+func (broker *BrokerServer) Paused() bool {
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
+	return broker.paused
+}
@@ -0,0 +1,58 @@
+package broker
+
+import (
+	"testing"
+)
+
+func TestPausedLeaderIsReplaced(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	oldLeaderId, oldTerm := h.CheckSingleLeader()
+	oldLeader := h.cluster[oldLeaderId]
+
+	h.SubmitToServer(oldLeaderId, "doc", 41)
+	sleepMs(250)
+	h.CheckCommitted(41)
+
+	oldLeader.Pause()
+	if !oldLeader.Paused() {
+		t.Fatalf("broker %d isn't paused after Pause", oldLeaderId)
+	}
+	var others []int
+	for id := 0; id < h.n; id++ {
+		if id != oldLeaderId {
+			others = append(others, id)
+		}
+	}
+	newLeaderId, newTerm := h.CheckSingleLeaderAmong(others)
+	if newTerm <= oldTerm {
+		t.Errorf("new leader has term %d, want more than %d", newTerm, oldTerm)
+	}
+
+	// the paused broker keeps its connections and doesn't learn about the new term
+	_, term, isLeader := oldLeader.em.Report()
+	if term != oldTerm || !isLeader {
+		t.Errorf("paused broker has term %d and leader %v, want %d and true", term, isLeader, oldTerm)
+	}
+	for _, id := range others {
+		if oldLeader.peerClient(id) == nil {
+			t.Errorf("paused broker lost its connection to %d", id)
+		}
+	}
+
+	h.SubmitToServer(newLeaderId, "doc", 42)
+	sleepMs(250)
+	if status := oldLeader.Status(); status.CommitIndex != 0 {
+		t.Errorf("paused broker committed up to %d, want 0", status.CommitIndex)
+	}
+
+	// after Resume it steps down and catches up
+	oldLeader.Resume()
+	sleepMs(250)
+	if leaderId, _ := h.CheckSingleLeader(); leaderId != newLeaderId {
+		t.Errorf("leader is %d after Resume, want %d", leaderId, newLeaderId)
+	}
+	if nc, _ := h.CheckCommitted(42); nc != h.n {
+		t.Errorf("%d brokers committed 42, want %d", nc, h.n)
+	}
+}
@@ -0,0 +1,334 @@
+package broker
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dial state for one peer. the mutex makes sure only one call redials a peer
+// at a time, and failed dials back off so a dead peer isn't dialed every heartbeat
+type peerDialer struct {
+	mu          sync.Mutex
+	delay       time.Duration
+	nextAttempt time.Time
+}
+
+const (
+	minRedialBackoff = 10 * time.Millisecond
+	maxRedialBackoff = time.Second
+)
+
+// peerClients, dialers, disconnected and suspect are only used through the functions
+// in this file. each holds mu just long enough to look at them, dials happen
+// in between so a slow peer doesn't hold up Call for every other peer
+
+// the client for a peer, nil when it has none right now
+func (broker *BrokerServer) peerClient(peerId int) TransportClient {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return broker.peerClients[peerId]
+}
+
+// the peers that have a client right now
+func (broker *BrokerServer) connectedPeers() map[int]bool {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	connected := make(map[int]bool, len(broker.peerClients))
+	for peerId, client := range broker.peerClients {
+		connected[peerId] = client != nil
+	}
+	return connected
+}
+
+// keep a freshly dialed client for a peer and return the one to use. a peer
+// connected by another call while this one dialed keeps its client, a peer
+// disconnected on purpose meanwhile gets none
+func (broker *BrokerServer) installPeerClient(peerId int, client TransportClient) (TransportClient, error) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if current := broker.peerClients[peerId]; current != nil {
+		client.Close()
+		return current, nil
+	}
+	if broker.disconnected[peerId] {
+		client.Close()
+		return nil, fmt.Errorf("call client %d after it's closed", peerId)
+	}
+	broker.peerClients[peerId] = client
+	return client, nil
+}
+
+// swap the client of a peer for a freshly dialed one and close stale, the
+// client it replaces. a peer that got another client meanwhile keeps that one
+func (broker *BrokerServer) replacePeerClient(peerId int, stale TransportClient, client TransportClient) (TransportClient, error) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.disconnected[peerId] {
+		client.Close()
+		return nil, fmt.Errorf("call client %d after it's closed", peerId)
+	}
+	current := broker.peerClients[peerId]
+	if current != nil && current != stale {
+		client.Close()
+		return current, nil
+	}
+	if current != nil {
+		current.Close()
+	}
+	delete(broker.suspect, peerId)
+	broker.peerClients[peerId] = client
+	return client, nil
+}
+
+// remember that a call timed out on client, the next call to the peer redials
+// it in case the connection is half open and nothing sent on it arrives
+func (broker *BrokerServer) markSuspect(peerId int, client TransportClient) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.peerClients[peerId] == client {
+		broker.suspect[peerId] = client
+	}
+}
+
+func (broker *BrokerServer) isSuspect(peerId int, client TransportClient) bool {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return broker.suspect[peerId] == client
+}
+
+// let a peer disconnected on purpose be dialed again
+// true when it still has a client and doesn't need dialing
+func (broker *BrokerServer) allowPeer(peerId int) bool {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	delete(broker.disconnected, peerId)
+	return broker.peerClients[peerId] != nil
+}
+
+// close the client of a peer and keep it from being redialed
+func (broker *BrokerServer) disconnectPeer(peerId int) error {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.disconnected[peerId] = true
+	delete(broker.suspect, peerId)
+	client := broker.peerClients[peerId]
+	if client == nil {
+		return nil
+	}
+	broker.peerClients[peerId] = nil
+	return client.Close()
+}
+
+// caller must hold broker.mu
+func (broker *BrokerServer) dialerFor(peerId int) *peerDialer {
+	d, ok := broker.dialers[peerId]
+	if !ok {
+		d = new(peerDialer)
+		broker.dialers[peerId] = d
+	}
+	return d
+}
+
+// redial a peer that has no client, using its configured address
+// peers disconnected with DisconnectPeer or DisconnectAll stay disconnected
+// until ConnectToPeer or ConnectToPeerByID is called for them
+func (broker *BrokerServer) reconnect(peerId int) (TransportClient, error) {
+	broker.mu.Lock()
+	addr, ok := broker.peerAddrs[peerId]
+	select {
+	case <-broker.quit:
+		// shut down brokers don't come back to life by redialing
+		ok = false
+	default:
+	}
+	if broker.disconnected[peerId] || !ok {
+		broker.mu.Unlock()
+		return nil, fmt.Errorf("call client %d after it's closed", peerId)
+	}
+	d := broker.dialerFor(peerId)
+	broker.mu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// another call may have reconnected while this one waited for the dial mutex
+	if client := broker.peerClient(peerId); client != nil {
+		return client, nil
+	}
+
+	client, err := d.dial(broker, peerId, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	installed, err := broker.installPeerClient(peerId, client)
+	if installed == client {
+		broker.logger.Info("reconnected to peer", "peer", peerId, "addr", addr)
+	}
+	return installed, err
+}
+
+// dial a peer through its http address unless the last failed dial says to
+// wait. caller must hold d.mu
+func (d *peerDialer) dial(broker *BrokerServer, peerId int, addr string) (TransportClient, error) {
+	if time.Now().Before(d.nextAttempt) {
+		return nil, fmt.Errorf("peer %d is unreachable, next redial in %s", peerId, time.Until(d.nextAttempt).Round(time.Millisecond))
+	}
+
+	client, err := broker.dialRPCOverHTTP(addr)
+	if err != nil {
+		d.delay = min(max(2*d.delay, minRedialBackoff), maxRedialBackoff)
+		d.nextAttempt = time.Now().Add(d.delay)
+		return nil, fmt.Errorf("redialing peer %d at %s: %w", peerId, addr, err)
+	}
+	d.delay = 0
+	d.nextAttempt = time.Time{}
+	return client, nil
+}
+
+// redial a peer whose client a call timed out on and return the client to
+// use. the suspect client is kept when the peer can't be dialed, a peer that
+// is only slow may still answer on it
+func (broker *BrokerServer) refreshSuspect(peerId int, stale TransportClient) TransportClient {
+	broker.mu.Lock()
+	addr, ok := broker.peerAddrs[peerId]
+	d := broker.dialerFor(peerId)
+	broker.mu.Unlock()
+	if !ok {
+		return stale
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// another call may have refreshed it while this one waited for the dial mutex
+	if !broker.isSuspect(peerId, stale) {
+		if current := broker.peerClient(peerId); current != nil {
+			return current
+		}
+		return stale
+	}
+
+	client, err := d.dial(broker, peerId, addr)
+	if err != nil {
+		broker.logger.Debug("keeps suspect client", "peer", peerId, "err", err)
+		return stale
+	}
+	replaced, err := broker.replacePeerClient(peerId, stale, client)
+	if err != nil {
+		return stale
+	}
+	if replaced == client {
+		broker.logger.Info("replaced suspect connection to peer", "peer", peerId, "addr", addr)
+	}
+	return replaced
+}
+
+// how often connectPeers retries peers it couldn't reach yet
+const connectPeersInterval = 100 * time.Millisecond
+
+// dial every peer with a configured address until each has a client or the
+// broker shuts down. peers disconnected on purpose are left alone
+func (broker *BrokerServer) connectPeers() {
+	for {
+		broker.mu.Lock()
+		var pending []int
+		for _, peerId := range broker.peerIds {
+			_, ok := broker.peerAddrs[peerId]
+			if ok && broker.peerClients[peerId] == nil && !broker.disconnected[peerId] {
+				pending = append(pending, peerId)
+			}
+		}
+		broker.mu.Unlock()
+
+		unreachable := 0
+		for _, peerId := range pending {
+			if _, err := broker.reconnect(peerId); err != nil {
+				unreachable++
+			}
+		}
+		if unreachable == 0 {
+			broker.logger.Info("connected to peers", "peers", len(pending))
+			return
+		}
+
+		select {
+		case <-broker.quit:
+			return
+		case <-time.After(connectPeersInterval):
+		}
+	}
+}
+
+// drop a client whose connection broke so the next Call redials
+func (broker *BrokerServer) dropBrokenClient(peerId int, client TransportClient, err error) {
+	if !errors.Is(err, ErrConnectionBroken) {
+		return
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.peerClients[peerId] == client {
+		client.Close()
+		broker.peerClients[peerId] = nil
+		delete(broker.suspect, peerId)
+	}
+}
+
+// serve rpcs on an accepted connection until it or the broker closes
+func (broker *BrokerServer) serveRPCConn(conn net.Conn) {
+	broker.mu.Lock()
+	select {
+	case <-broker.quit:
+		broker.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	broker.rpcConns[conn] = struct{}{}
+	broker.wg.Add(1)
+	broker.mu.Unlock()
+
+	defer func() {
+		broker.mu.Lock()
+		delete(broker.rpcConns, conn)
+		broker.mu.Unlock()
+		broker.wg.Done()
+	}()
+	broker.rpcServer.ServeConn(conn)
+}
+
+// close every connection peers opened to this broker, so they notice it is gone
+func (broker *BrokerServer) closeRPCConns() {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for conn := range broker.rpcConns {
+		conn.Close()
+	}
+}
+
+// same protocol as rpc.Server.ServeHTTP, but the hijacked connection is
+// tracked so Shutdown can close it
+func (broker *BrokerServer) handleRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "405 must CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		broker.logger.Warn("rpc hijacking failed", "remote_addr", r.RemoteAddr, "err", err)
+		return
+	}
+	// the http server's read and write timeouts are still set on the connection
+	conn.SetDeadline(time.Time{})
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	if broker.rpcServerTLS != nil {
+		conn = tls.Server(conn, broker.rpcServerTLS)
+	}
+	broker.serveRPCConn(conn)
+}
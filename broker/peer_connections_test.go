@@ -0,0 +1,310 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeaderRedialsRestartedFollower(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	if h.SubmitToServer(origLeaderId, "doc1", 1) < 0 {
+		t.Fatalf("want id=%d leader, but it's not", origLeaderId)
+	}
+	sleepMs(200)
+
+	// the leader's connection to the follower breaks when its process goes away
+	followerId := (origLeaderId + 1) % h.n
+	h.RestartPeerProcess(followerId)
+
+	if h.SubmitToServer(origLeaderId, "doc1", 2) < 0 {
+		t.Fatalf("want id=%d leader, but it's not", origLeaderId)
+	}
+
+	// the restarted follower starts empty and gets the whole log again
+	const timeout = 5 * time.Second
+	start := time.Now()
+	for {
+		followerLog, _, commitIndex, _ := h.GetLogsAndCommitIndexFromServer(followerId)
+		if len(followerLog) == 2 && commitIndex == 1 {
+			if followerLog[0].CRDTOperation != 1 || followerLog[1].CRDTOperation != 2 {
+				t.Fatalf("follower log %+v, want commands 1 and 2", followerLog)
+			}
+			break
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("follower has log %+v and commitIndex %d after %s", followerLog, commitIndex, timeout)
+		}
+		sleepMs(10)
+	}
+}
+
+// a free port on localhost, for brokers that have to know each other's addresses up front
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestBrokersConnectFromAddresses(t *testing.T) {
+	const n = 3
+	peerAddrs := make(map[int]string)
+	rpcAddrs := make(map[int]string)
+	for i := 0; i < n; i++ {
+		peerAddrs[i] = freeAddr(t)
+		rpcAddrs[i] = freeAddr(t)
+	}
+
+	ready := make(chan any)
+	brokers := make([]*BrokerServer, n)
+	for i := range brokers {
+		var peerIds []int
+		for p := 0; p < n; p++ {
+			if p != i {
+				peerIds = append(peerIds, p)
+			}
+		}
+		broker, err := NewBrokerServerFromConfig(ClusterConfig{
+			BrokerId:     i,
+			PeerIds:      peerIds,
+			PeerAddrs:    peerAddrs,
+			HTTPAddr:     peerAddrs[i],
+			InitialState: Follower,
+			Ready:        ready,
+			CommitChan:   make(chan CommitEntry, 16),
+			Options:      BrokerOptions{RPCAddr: rpcAddrs[i]},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := broker.Serve(); err != nil {
+			t.Fatal(err)
+		}
+		brokers[i] = broker
+		if got := broker.GetListenAddr().String(); got != rpcAddrs[i] {
+			t.Errorf("broker %d serves rpcs on %s, want %s", i, got, rpcAddrs[i])
+		}
+	}
+	defer func() {
+		for _, broker := range brokers {
+			shutdownNow(broker)
+		}
+	}()
+
+	// nothing calls ConnectToPeer, the brokers dial each other before any rpc is sent
+	deadline := time.Now().Add(3 * time.Second)
+	for i, broker := range brokers {
+		for slices.ContainsFunc(broker.Status().Peers, func(p PeerStatus) bool { return !p.Connected }) {
+			if time.Now().After(deadline) {
+				t.Fatalf("broker %d never connected to all of its peers: %+v", i, broker.Status().Peers)
+			}
+			sleepMs(10)
+		}
+	}
+
+	close(ready)
+	for {
+		leaders := 0
+		for _, broker := range brokers {
+			if _, _, isLeader := broker.em.Report(); isLeader {
+				leaders++
+			}
+		}
+		if leaders == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("brokers started from addresses didn't elect a leader")
+		}
+		sleepMs(10)
+	}
+}
+
+func TestConnectToFixedRPCAddr(t *testing.T) {
+	rpcAddr := freeAddr(t)
+	fixed, err := NewBrokerServer(0, []int{1}, map[int]string{}, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), BrokerOptions{RPCAddr: rpcAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fixed.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer shutdownNow(fixed)
+	if got := fixed.GetListenAddr().String(); got != rpcAddr {
+		t.Fatalf("broker serves rpcs on %s, want %s", got, rpcAddr)
+	}
+
+	peer, err := NewBrokerServer(1, []int{0}, map[int]string{}, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), BrokerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer shutdownNow(peer)
+	// the address is known before the broker starts, nothing is read back from it
+	addr, err := net.ResolveTCPAddr("tcp", rpcAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.ConnectToPeer(0, addr); err != nil {
+		t.Fatalf("connecting to %s: %v", rpcAddr, err)
+	}
+	var reply RequestVoteReply
+	args := RequestVoteArgs{Term: 0, CandidateId: 1, LastLogIndex: -1, LastLogTerm: -1}
+	if err := peer.Call(context.Background(), 0, "ElectionModule.RequestVote", args, &reply); err != nil {
+		t.Fatalf("rpc to the fixed address: %v", err)
+	}
+	if reply.Id != 0 {
+		t.Errorf("reply from broker %d, want 0", reply.Id)
+	}
+}
+
+// forwards connections to a broker's rpc listener. stall makes the ones open
+// at the time swallow everything sent on them, like a half open connection
+type stallingRelay struct {
+	listener net.Listener
+	target   string
+
+	mu      sync.Mutex
+	stalled []*atomic.Bool
+}
+
+func newStallingRelay(t *testing.T, target string) *stallingRelay {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &stallingRelay{listener: listener, target: target}
+	go relay.accept()
+	t.Cleanup(func() { listener.Close() })
+	return relay
+}
+
+func (relay *stallingRelay) accept() {
+	for {
+		conn, err := relay.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", relay.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		stalled := new(atomic.Bool)
+		relay.mu.Lock()
+		relay.stalled = append(relay.stalled, stalled)
+		relay.mu.Unlock()
+		go forwardUnlessStalled(conn, upstream, stalled)
+		go forwardUnlessStalled(upstream, conn, stalled)
+	}
+}
+
+func forwardUnlessStalled(dst net.Conn, src net.Conn, stalled *atomic.Bool) {
+	defer dst.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if stalled.Load() {
+			continue
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (relay *stallingRelay) stall() {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	for _, stalled := range relay.stalled {
+		stalled.Store(true)
+	}
+}
+
+// number of connections relayed so far
+func (relay *stallingRelay) conns() int {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	return len(relay.stalled)
+}
+
+func TestStaleConnectionIsReplaced(t *testing.T) {
+	httpAddrs := map[int]string{0: freeAddr(t), 1: freeAddr(t)}
+	target, err := NewBrokerServer(0, []int{1}, httpAddrs, httpAddrs[0], Follower, make(chan any), make(chan CommitEntry), BrokerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer shutdownNow(target)
+	caller, err := NewBrokerServer(1, []int{0}, httpAddrs, httpAddrs[1], Follower, make(chan any), make(chan CommitEntry), BrokerOptions{RPCTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	defer shutdownNow(caller)
+
+	call := func() error {
+		var reply WhoIsLeaderReply
+		return caller.Call(context.Background(), 0, "ElectionModule.WhoIsLeader", WhoIsLeaderArgs{}, &reply)
+	}
+	relay := newStallingRelay(t, target.GetListenAddr().String())
+	relayAddr := relay.listener.Addr()
+
+	// replaces the client the caller dialed on its own when it started
+	if err := caller.Reconnect(0, relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(); err != nil {
+		t.Fatalf("rpc through the relay: %v", err)
+	}
+
+	// the connection goes stale without breaking, connecting again keeps it
+	relay.stall()
+	if err := caller.ConnectToPeer(0, relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(); err == nil {
+		t.Fatal("rpc on the stale connection succeeded")
+	}
+
+	conns := relay.conns()
+	if err := caller.Reconnect(0, relayAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := call(); err != nil {
+		t.Fatalf("rpc after reconnecting: %v", err)
+	}
+	if relay.conns() != conns+1 {
+		t.Fatalf("reconnecting opened %d connections through the relay, want 1", relay.conns()-conns)
+	}
+
+	// a call that timed out gets the next one a new connection by itself
+	relay.stall()
+	if err := call(); err == nil {
+		t.Fatal("rpc on the stale connection succeeded")
+	}
+	if err := call(); err != nil {
+		t.Fatalf("rpc after a timed out one: %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// committed operations posted to an application server in one request, how
+// long one push can take, and how long to wait before trying a failed one again.
+// a broker that just became leader also starts pushing within pushRetryInterval
+const (
+	pushBatchSize     = 100
+	pushTimeout       = 5 * time.Second
+	pushRetryInterval = 500 * time.Millisecond
+)
+
+// body of POST /appservers
+type AppServerRegistration struct {
+	// where committed operations are posted, as a json array of CommittedOperations
+	CallbackURL string `json:"callback_url"`
+}
+
+// body of POST /subscribe, like a registration but for one replication group
+// starting at a given log index in it
+type Subscription struct {
+	URL       string `json:"url"`
+	Shard     int    `json:"shard,omitempty"`
+	FromIndex int    `json:"from_index"`
+}
+
+// a committed crdt operation and its position in the log of its replication
+// group, which application servers use to skip operations pushed twice when
+// the leader changes
+type CommittedOperation struct {
+	Shard    int `json:"shard,omitempty"`
+	LogIndex int `json:"log_index"`
+	CRDTMessage
+}
+
+// an application server that asked to be sent committed operations. pushes
+// are read from the log, so an operation is pushed until the application server
+// acknowledges it, at least once and in log order
+type pushSubscriber struct {
+	callbackURL string
+	shard       int
+
+	// log index of the next entry to push, guarded by commitPusher.mu
+	next int
+	// signalled when a registration moved next
+	moved chan struct{}
+}
+
+// a callback url and the replication group pushed to it
+type pushKey struct {
+	callbackURL string
+	shard       int
+}
+
+// application servers to push to, one subscriber for each group of each
+type commitPusher struct {
+	mu          sync.Mutex
+	subscribers map[pushKey]*pushSubscriber
+	client      *http.Client
+}
+
+func newCommitPusher() *commitPusher {
+	return &commitPusher{
+		subscribers: make(map[pushKey]*pushSubscriber),
+		client:      &http.Client{Timeout: pushTimeout},
+	}
+}
+
+// start pushing operations committed from now on to callbackURL, in every
+// replication group
+func (broker *BrokerServer) RegisterAppServer(callbackURL string) error {
+	for _, rm := range broker.router.Shards() {
+		broker.mu2.Lock()
+		next := rm.lastApplied + 1
+		broker.mu2.Unlock()
+		if err := broker.Subscribe(callbackURL, rm.shard, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start pushing operations committed in replication group shard to
+// callbackURL from log index fromIndex on. subscribing again only moves where
+// pushing resumes. every broker pushes only while it leads, so application
+// servers subscribe with all of them to keep getting operations when the
+// leader changes
+func (broker *BrokerServer) Subscribe(callbackURL string, shard int, fromIndex int) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback url %q must be an absolute http or https url", callbackURL)
+	}
+	if fromIndex < 0 {
+		return fmt.Errorf("from index %d is negative", fromIndex)
+	}
+	if _, err := broker.router.shard(shard); err != nil {
+		return err
+	}
+
+	p := broker.pusher
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := pushKey{callbackURL: callbackURL, shard: shard}
+	if sub, ok := p.subscribers[key]; ok {
+		sub.next = fromIndex
+		select {
+		case sub.moved <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	sub := &pushSubscriber{callbackURL: callbackURL, shard: shard, next: fromIndex, moved: make(chan struct{}, 1)}
+	p.subscribers[key] = sub
+	broker.logger.Info("registered application server", "callback_url", callbackURL, "shard", shard, "from_index", fromIndex)
+	go broker.pushLoop(sub)
+	return nil
+}
+
+func (broker *BrokerServer) handleRegisterAppServer(w http.ResponseWriter, r *http.Request) {
+	var registration AppServerRegistration
+	err := json.NewDecoder(r.Body).Decode(&registration)
+	if bodyTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid registration: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := broker.RegisterAppServer(registration.CallbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (broker *BrokerServer) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	var subscription Subscription
+	err := json.NewDecoder(r.Body).Decode(&subscription)
+	if bodyTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid subscription: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := broker.Subscribe(subscription.URL, subscription.Shard, subscription.FromIndex); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// push to sub until the broker shuts down, waking up when entries are applied,
+// when sub is moved, and every pushRetryInterval to retry or to start after
+// becoming leader
+func (broker *BrokerServer) pushLoop(sub *pushSubscriber) {
+	retry := time.NewTicker(pushRetryInterval)
+	defer retry.Stop()
+	for {
+		// taken before reading the log, so entries applied in between wake us up
+		applied := broker.streams.wait()
+		if broker.pushNext(sub) {
+			continue
+		}
+		select {
+		case <-applied:
+		case <-sub.moved:
+		case <-retry.C:
+		case <-broker.quit:
+			return
+		}
+	}
+}
+
+// post the next batch of applied entries to sub when this broker leads.
+// true when more may be waiting right away
+func (broker *BrokerServer) pushNext(sub *pushSubscriber) bool {
+	broker.mu2.Lock()
+	leading := broker.state == Leader && !broker.paused
+	broker.mu2.Unlock()
+	if !leading {
+		return false
+	}
+
+	p := broker.pusher
+	p.mu.Lock()
+	next := sub.next
+	p.mu.Unlock()
+
+	// checked when it subscribed
+	rm := broker.router.shards[sub.shard]
+	entries, ok := rm.appliedSince(next, pushBatchSize)
+	if !ok {
+		broker.mu2.Lock()
+		base := rm.logBaseIndex
+		broker.mu2.Unlock()
+		broker.logger.Warn("committed operations were trimmed before they were pushed",
+			"callback_url", sub.callbackURL, "shard", sub.shard, "from_index", next, "to_index", base-1)
+		sub.advance(p, next, base)
+		return true
+	}
+	if len(entries) == 0 {
+		return false
+	}
+
+	// config entries aren't pushed
+	var msgs []CommittedOperation
+	for i, entry := range entries {
+		if msg, ok := committedMessage(entry); ok {
+			msgs = append(msgs, CommittedOperation{Shard: sub.shard, LogIndex: next + i, CRDTMessage: msg})
+		}
+	}
+	if len(msgs) > 0 {
+		if err := broker.push(sub.callbackURL, msgs); err != nil {
+			broker.logger.Warn("error pushing committed operations, retrying",
+				"callback_url", sub.callbackURL, "shard", sub.shard, "from_index", next, "err", err)
+			return false
+		}
+	}
+	sub.advance(p, next, next+len(entries))
+	return len(entries) == pushBatchSize
+}
+
+// move sub from from to to, unless a registration moved it in the meantime
+func (sub *pushSubscriber) advance(p *commitPusher, from int, to int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if sub.next == from {
+		sub.next = to
+	}
+}
+
+func (broker *BrokerServer) push(callbackURL string, msgs []CommittedOperation) error {
+	data, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// application servers check the token they send the brokers
+	if token := broker.options.AuthToken; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := broker.pusher.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("application server answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// an application server's POST /commits that fails the first failures pushes
+// and records the log indexes of the operations it accepted
+type pushRecorder struct {
+	mu       sync.Mutex
+	failures int
+	indexes  map[int]CRDTMessage
+	pushes   int
+}
+
+func (rec *pushRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ops []CommittedOperation
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.pushes++
+	if rec.failures > 0 {
+		rec.failures--
+		http.Error(w, "not now", http.StatusServiceUnavailable)
+		return
+	}
+	for _, op := range ops {
+		rec.indexes[op.LogIndex] = op.CRDTMessage
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// wait until every index in want was pushed with its value
+func (rec *pushRecorder) waitFor(t *testing.T, want map[int]string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec.mu.Lock()
+		missing := 0
+		for index, value := range want {
+			if msg, ok := rec.indexes[index]; !ok || msg.Value != value || msg.Source != "broker" {
+				missing++
+			}
+		}
+		rec.mu.Unlock()
+		if missing == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d operations weren't pushed, got %v", missing, len(want), rec.indexes)
+		}
+		sleepMs(10)
+	}
+}
+
+func submitInsert(t *testing.T, broker *BrokerServer, value string) int {
+	t.Helper()
+	msg := CRDTMessage{Type: OpInsert, Index: 0, Value: value, ReplicaID: "r1", OpIndex: 5, Source: "client", SchemaVersion: CurrentSchemaVersion}
+	index, _, err := broker.SubmitOperation(msg)
+	if err != nil || index < 0 {
+		t.Fatalf("SubmitOperation(%+v) = %d, %v", msg, index, err)
+	}
+	return index
+}
+
+func TestPushRetriesFromIndex(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+
+	want := map[int]string{}
+	for i := 0; i < 3; i++ {
+		want[submitInsert(t, leader, fmt.Sprint(i))] = fmt.Sprint(i)
+	}
+	waitForApplied(t, h, []int{leaderId}, 2)
+
+	// operations committed before subscribing are pushed from from_index on,
+	// the failed pushes are retried
+	rec := &pushRecorder{failures: 2, indexes: map[int]CRDTMessage{}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	body, _ := json.Marshal(Subscription{URL: server.URL, FromIndex: 1})
+	resp, err := http.Post(fmt.Sprintf("http://%s/subscribe", leader.GetHTTPAddr()), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("POST /subscribe got status %d", resp.StatusCode)
+	}
+	for i := 3; i < 5; i++ {
+		want[submitInsert(t, leader, fmt.Sprint(i))] = fmt.Sprint(i)
+	}
+	delete(want, 0)
+	rec.waitFor(t, want)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if _, ok := rec.indexes[0]; ok {
+		t.Errorf("operation before from_index was pushed")
+	}
+	if rec.pushes < 3 {
+		t.Errorf("got %d pushes, want the 2 failures and a retry at least", rec.pushes)
+	}
+}
+
+func TestPushSurvivesLeaderChange(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	oldLeaderId, _ := h.CheckSingleLeader()
+
+	rec := &pushRecorder{indexes: map[int]CRDTMessage{}}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	for _, b := range h.cluster {
+		if err := b.RegisterAppServer(server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[int]string{submitInsert(t, h.cluster[oldLeaderId], "a"): "a"}
+	rec.waitFor(t, want)
+
+	// the new leader pushes what is committed under it
+	h.cluster[oldLeaderId].Pause()
+	var others []int
+	for id := 0; id < h.n; id++ {
+		if id != oldLeaderId {
+			others = append(others, id)
+		}
+	}
+	newLeaderId, _ := h.CheckSingleLeaderAmong(others)
+	// commits need every broker, see handleAEReply
+	h.cluster[oldLeaderId].Resume()
+	sleepMs(100)
+	if leaderId, _ := h.CheckSingleLeader(); leaderId != newLeaderId {
+		t.Fatalf("leader is %d after Resume, want %d", leaderId, newLeaderId)
+	}
+	want[submitInsert(t, h.cluster[newLeaderId], "b")] = "b"
+	rec.waitFor(t, want)
+}
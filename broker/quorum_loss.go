@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"net/http"
+	"time"
+)
+
+// a leader cut off from a majority can't commit anything, commits need every
+// member here and a new leader is elected on the other side anyway. once it
+// hasn't heard from a majority for this long it refuses writes instead of
+// taking ones it will never commit, but keeps answering reads from its
+// possibly stale state. well over the election timeout so a slow heartbeat
+// round doesn't trip it
+const defaultQuorumLossTimeout = 500 * time.Millisecond
+
+// 0 when the leader never goes read-only
+func (opts BrokerOptions) quorumLossTimeout() time.Duration {
+	switch {
+	case opts.QuorumLossTimeout < 0:
+		return 0
+	case opts.QuorumLossTimeout == 0:
+		return defaultQuorumLossTimeout
+	default:
+		return opts.QuorumLossTimeout
+	}
+}
+
+// at the default heartbeat a second, so a leader cut off from the majority goes
+// read-only first and gives up on leading well after followers stopped waiting
+const defaultStepDownRounds = 40
+
+// 0 when the leader never steps down on its own
+func (opts BrokerOptions) stepDownRounds() int {
+	switch {
+	case opts.StepDownRounds < 0:
+		return 0
+	case opts.StepDownRounds == 0:
+		return defaultStepDownRounds
+	default:
+		return opts.StepDownRounds
+	}
+}
+
+// when a majority last acknowledged this leader, or when the leadership
+// started if none has yet. caller must hold mu2
+func (rm *ReplicationModule) lastQuorumContact() time.Time {
+	if rm.lastMajorityHeartbeat.Before(rm.leaderSince) {
+		return rm.leaderSince
+	}
+	return rm.lastMajorityHeartbeat
+}
+
+// step down once a majority has been silent for stepDownRounds heartbeats.
+// rounds are counted in heartbeat intervals since AEs triggered by writes
+// come faster than their replies. returns true when the leader stepped down
+// caller must hold mu2
+func (rm *ReplicationModule) stepDownWithoutQuorum() bool {
+	rounds := rm.broker.options.stepDownRounds()
+	if rounds == 0 || rm.broker.state != Leader || rm.alone() {
+		return false
+	}
+	lastContact := rm.lastQuorumContact()
+	missed := int(time.Since(lastContact) / rm.broker.options.heartbeatInterval())
+	if missed < rounds {
+		return false
+	}
+	rm.broker.logger.Warn("no majority heard from, steps down", "term", rm.broker.em.term, "rounds", missed, "last_contact", lastContact)
+	rm.broker.em.becomeFollower(rm.broker.em.term)
+	return true
+}
+
+// update readOnly from how long ago a majority acknowledged this leader,
+// counting from when the leadership started for the first round of heartbeats
+// caller must hold mu2
+func (rm *ReplicationModule) checkQuorumContact() {
+	timeout := rm.broker.options.quorumLossTimeout()
+	if timeout == 0 || rm.broker.state != Leader {
+		return
+	}
+	lastContact := rm.lastQuorumContact()
+	lost := !rm.alone() && time.Since(lastContact) > timeout
+
+	if lost && !rm.readOnly {
+		rm.broker.logger.Warn("lost contact with a majority, refusing writes", "last_contact", lastContact)
+	} else if !lost && rm.readOnly {
+		rm.broker.logger.Info("majority is back, accepting writes again")
+	}
+	rm.readOnly = lost
+}
+
+// true while this broker is a leader that lost contact with a majority
+func (broker *BrokerServer) ReadOnly() bool {
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
+	return broker.state == Leader && broker.rm.readOnly
+}
+
+// answer 503 to a write while the leader is read-only, false otherwise
+func (broker *BrokerServer) refuseWriteIfReadOnly(w http.ResponseWriter) bool {
+	if !broker.ReadOnly() {
+		return false
+	}
+	broker.logger.Info("refuses write: read-only without a majority")
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Leader lost contact with a majority and is read-only", http.StatusServiceUnavailable)
+	return true
+}
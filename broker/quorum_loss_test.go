@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLeaderWithoutMajorityIsReadOnly(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].QuorumLossTimeout = timeout
+		// stays leader while cut off, see TestIsolatedLeaderStepsDown
+		options[i].StepDownRounds = -1
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	base := fmt.Sprintf("http://%s", h.cluster[leaderId].GetHTTPAddr())
+
+	write := func() int {
+		body, _ := json.Marshal(CRDTMessage{Type: OpInsert, Index: 0, Value: "a", ReplicaID: "r1", OpIndex: 1, Source: "client"})
+		resp, err := http.Post(base+"/crdt", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	status := func() BrokerStatus {
+		resp, err := http.Get(base + "/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status BrokerStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	if code := write(); code != http.StatusAccepted {
+		t.Fatalf("write with a majority got status %d, want %d", code, http.StatusAccepted)
+	}
+	if status().ReadOnly {
+		t.Fatal("leader with a majority reports read-only")
+	}
+
+	// the old leader still thinks it leads, it never hears of the new term
+	h.DisconnectPeer(leaderId)
+	sleepMs(int(3 * timeout / time.Millisecond))
+
+	if code := write(); code != http.StatusServiceUnavailable {
+		t.Errorf("write to a leader cut off from the majority got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if s := status(); s.State != Leader.String() || !s.ReadOnly {
+		t.Errorf("cut off leader reports %+v, want a read-only leader", s)
+	}
+	// reads are still answered from its stale state
+	resp, err := http.Get(base + "/committedlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("read from the read-only leader got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// back with the others it steps down and forwards writes to the new leader
+	h.ReconnectPeer(leaderId)
+	sleepMs(300)
+	h.CheckSingleLeader()
+	if code := write(); code != http.StatusAccepted {
+		t.Errorf("write after the partition healed got status %d, want %d", code, http.StatusAccepted)
+	}
+	if status().ReadOnly {
+		t.Error("old leader still reports read-only after the partition healed")
+	}
+}
+
+func TestIsolatedLeaderStepsDown(t *testing.T) {
+	const rounds = 8
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].StepDownRounds = rounds
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, term := h.CheckSingleLeader()
+	window := rounds * options[leaderId].heartbeatInterval()
+
+	h.DisconnectPeer(leaderId)
+	start := time.Now()
+	for {
+		if _, _, isLeader := h.cluster[leaderId].em.Report(); !isLeader {
+			break
+		}
+		if time.Since(start) > window+300*time.Millisecond {
+			t.Fatalf("cut off leader %d still leads %v after losing the majority, want it to step down after %v", leaderId, time.Since(start), window)
+		}
+		sleepMs(5)
+	}
+	// the last heartbeat acked before the cut can be up to one interval old
+	if elapsed := time.Since(start); elapsed < window-options[leaderId].heartbeatInterval() {
+		t.Errorf("cut off leader stepped down after %v, want about %v", elapsed, window)
+	}
+
+	// meanwhile the majority moves on without it
+	newLeaderId, newTerm := h.CheckSingleLeader()
+	if newLeaderId == leaderId || newTerm <= term {
+		t.Errorf("new leader %d in term %d, want one other than %d after term %d", newLeaderId, newTerm, leaderId, term)
+	}
+
+	h.ReconnectPeer(leaderId)
+	sleepMs(300)
+	h.CheckSingleLeader()
+}
@@ -0,0 +1,5 @@
+// Package raftpb holds the protobuf messages brokers exchange over
+// GRPCTransport, generated from raft.proto
+package raftpb
+
+//go:generate protoc --proto_path=.. --go_out=.. --go_opt=paths=source_relative raftpb/raft.proto
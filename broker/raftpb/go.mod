@@ -0,0 +1,5 @@
+module raftpb
+
+go 1.23.2
+
+require google.golang.org/protobuf v1.36.6
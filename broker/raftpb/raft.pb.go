@@ -0,0 +1,1291 @@
+// rpcs between brokers when BrokerOptions.Transport is GRPCTransport. the go
+// messages in raft.pb.go are generated from this file, see generate.go
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: raftpb/raft.proto
+
+package raftpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type RequestVoteArgs struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Term         int64                  `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	CandidateId  int64                  `protobuf:"varint,2,opt,name=candidate_id,json=candidateId,proto3" json:"candidate_id,omitempty"`
+	LastLogIndex int64                  `protobuf:"varint,3,opt,name=last_log_index,json=lastLogIndex,proto3" json:"last_log_index,omitempty"`
+	LastLogTerm  int64                  `protobuf:"varint,4,opt,name=last_log_term,json=lastLogTerm,proto3" json:"last_log_term,omitempty"`
+	// w3c trace context of the candidate's span, empty when it isn't traced
+	TraceParent   string `protobuf:"bytes,5,opt,name=trace_parent,json=traceParent,proto3" json:"trace_parent,omitempty"`
+	TraceState    string `protobuf:"bytes,6,opt,name=trace_state,json=traceState,proto3" json:"trace_state,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RequestVoteArgs) Reset() {
+	*x = RequestVoteArgs{}
+	mi := &file_raftpb_raft_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RequestVoteArgs) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RequestVoteArgs) ProtoMessage() {}
+
+func (x *RequestVoteArgs) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RequestVoteArgs.ProtoReflect.Descriptor instead.
+func (*RequestVoteArgs) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *RequestVoteArgs) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *RequestVoteArgs) GetCandidateId() int64 {
+	if x != nil {
+		return x.CandidateId
+	}
+	return 0
+}
+
+func (x *RequestVoteArgs) GetLastLogIndex() int64 {
+	if x != nil {
+		return x.LastLogIndex
+	}
+	return 0
+}
+
+func (x *RequestVoteArgs) GetLastLogTerm() int64 {
+	if x != nil {
+		return x.LastLogTerm
+	}
+	return 0
+}
+
+func (x *RequestVoteArgs) GetTraceParent() string {
+	if x != nil {
+		return x.TraceParent
+	}
+	return ""
+}
+
+func (x *RequestVoteArgs) GetTraceState() string {
+	if x != nil {
+		return x.TraceState
+	}
+	return ""
+}
+
+type RequestVoteReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Term          int64                  `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	VoteGranted   bool                   `protobuf:"varint,2,opt,name=vote_granted,json=voteGranted,proto3" json:"vote_granted,omitempty"`
+	Id            int64                  `protobuf:"varint,3,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RequestVoteReply) Reset() {
+	*x = RequestVoteReply{}
+	mi := &file_raftpb_raft_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RequestVoteReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RequestVoteReply) ProtoMessage() {}
+
+func (x *RequestVoteReply) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RequestVoteReply.ProtoReflect.Descriptor instead.
+func (*RequestVoteReply) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *RequestVoteReply) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *RequestVoteReply) GetVoteGranted() bool {
+	if x != nil {
+		return x.VoteGranted
+	}
+	return false
+}
+
+func (x *RequestVoteReply) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type WhoIsLeaderArgs struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WhoIsLeaderArgs) Reset() {
+	*x = WhoIsLeaderArgs{}
+	mi := &file_raftpb_raft_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WhoIsLeaderArgs) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WhoIsLeaderArgs) ProtoMessage() {}
+
+func (x *WhoIsLeaderArgs) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WhoIsLeaderArgs.ProtoReflect.Descriptor instead.
+func (*WhoIsLeaderArgs) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{2}
+}
+
+type WhoIsLeaderReply struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// -1 when the broker doesn't know of a leader
+	LeaderId      int64  `protobuf:"varint,1,opt,name=leader_id,json=leaderId,proto3" json:"leader_id,omitempty"`
+	HttpAddr      string `protobuf:"bytes,2,opt,name=http_addr,json=httpAddr,proto3" json:"http_addr,omitempty"`
+	Term          int64  `protobuf:"varint,3,opt,name=term,proto3" json:"term,omitempty"`
+	Self          bool   `protobuf:"varint,4,opt,name=self,proto3" json:"self,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WhoIsLeaderReply) Reset() {
+	*x = WhoIsLeaderReply{}
+	mi := &file_raftpb_raft_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WhoIsLeaderReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WhoIsLeaderReply) ProtoMessage() {}
+
+func (x *WhoIsLeaderReply) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WhoIsLeaderReply.ProtoReflect.Descriptor instead.
+func (*WhoIsLeaderReply) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *WhoIsLeaderReply) GetLeaderId() int64 {
+	if x != nil {
+		return x.LeaderId
+	}
+	return 0
+}
+
+func (x *WhoIsLeaderReply) GetHttpAddr() string {
+	if x != nil {
+		return x.HttpAddr
+	}
+	return ""
+}
+
+func (x *WhoIsLeaderReply) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *WhoIsLeaderReply) GetSelf() bool {
+	if x != nil {
+		return x.Self
+	}
+	return false
+}
+
+type AppendEntriesArgs struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Term         int64                  `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	LeaderId     int64                  `protobuf:"varint,2,opt,name=leader_id,json=leaderId,proto3" json:"leader_id,omitempty"`
+	PrevLogIndex int64                  `protobuf:"varint,3,opt,name=prev_log_index,json=prevLogIndex,proto3" json:"prev_log_index,omitempty"`
+	PrevLogTerm  int64                  `protobuf:"varint,4,opt,name=prev_log_term,json=prevLogTerm,proto3" json:"prev_log_term,omitempty"`
+	Entries      []*LogEntry            `protobuf:"bytes,5,rep,name=entries,proto3" json:"entries,omitempty"`
+	// set when the leader has AECompressionThreshold set, entries is then empty
+	// and compressed_entries holds them gob encoded and gzipped, which only go
+	// brokers can read
+	Compressed        bool   `protobuf:"varint,6,opt,name=compressed,proto3" json:"compressed,omitempty"`
+	CompressedEntries []byte `protobuf:"bytes,7,opt,name=compressed_entries,json=compressedEntries,proto3" json:"compressed_entries,omitempty"`
+	LeaderCommit      int64  `protobuf:"varint,8,opt,name=leader_commit,json=leaderCommit,proto3" json:"leader_commit,omitempty"`
+	// w3c trace context of the leader's span, empty when it isn't traced
+	TraceParent string `protobuf:"bytes,9,opt,name=trace_parent,json=traceParent,proto3" json:"trace_parent,omitempty"`
+	TraceState  string `protobuf:"bytes,10,opt,name=trace_state,json=traceState,proto3" json:"trace_state,omitempty"`
+	// replication group of the entries, 0 unless the brokers are sharded
+	Shard         int64 `protobuf:"varint,11,opt,name=shard,proto3" json:"shard,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AppendEntriesArgs) Reset() {
+	*x = AppendEntriesArgs{}
+	mi := &file_raftpb_raft_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AppendEntriesArgs) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AppendEntriesArgs) ProtoMessage() {}
+
+func (x *AppendEntriesArgs) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AppendEntriesArgs.ProtoReflect.Descriptor instead.
+func (*AppendEntriesArgs) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *AppendEntriesArgs) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *AppendEntriesArgs) GetLeaderId() int64 {
+	if x != nil {
+		return x.LeaderId
+	}
+	return 0
+}
+
+func (x *AppendEntriesArgs) GetPrevLogIndex() int64 {
+	if x != nil {
+		return x.PrevLogIndex
+	}
+	return 0
+}
+
+func (x *AppendEntriesArgs) GetPrevLogTerm() int64 {
+	if x != nil {
+		return x.PrevLogTerm
+	}
+	return 0
+}
+
+func (x *AppendEntriesArgs) GetEntries() []*LogEntry {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+func (x *AppendEntriesArgs) GetCompressed() bool {
+	if x != nil {
+		return x.Compressed
+	}
+	return false
+}
+
+func (x *AppendEntriesArgs) GetCompressedEntries() []byte {
+	if x != nil {
+		return x.CompressedEntries
+	}
+	return nil
+}
+
+func (x *AppendEntriesArgs) GetLeaderCommit() int64 {
+	if x != nil {
+		return x.LeaderCommit
+	}
+	return 0
+}
+
+func (x *AppendEntriesArgs) GetTraceParent() string {
+	if x != nil {
+		return x.TraceParent
+	}
+	return ""
+}
+
+func (x *AppendEntriesArgs) GetTraceState() string {
+	if x != nil {
+		return x.TraceState
+	}
+	return ""
+}
+
+func (x *AppendEntriesArgs) GetShard() int64 {
+	if x != nil {
+		return x.Shard
+	}
+	return 0
+}
+
+type AppendEntriesReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Term          int64                  `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	Success       bool                   `protobuf:"varint,2,opt,name=success,proto3" json:"success,omitempty"`
+	Id            int64                  `protobuf:"varint,3,opt,name=id,proto3" json:"id,omitempty"`
+	ConflictIndex int64                  `protobuf:"varint,4,opt,name=conflict_index,json=conflictIndex,proto3" json:"conflict_index,omitempty"`
+	ConflictTerm  int64                  `protobuf:"varint,5,opt,name=conflict_term,json=conflictTerm,proto3" json:"conflict_term,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AppendEntriesReply) Reset() {
+	*x = AppendEntriesReply{}
+	mi := &file_raftpb_raft_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AppendEntriesReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AppendEntriesReply) ProtoMessage() {}
+
+func (x *AppendEntriesReply) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AppendEntriesReply.ProtoReflect.Descriptor instead.
+func (*AppendEntriesReply) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *AppendEntriesReply) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *AppendEntriesReply) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *AppendEntriesReply) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *AppendEntriesReply) GetConflictIndex() int64 {
+	if x != nil {
+		return x.ConflictIndex
+	}
+	return 0
+}
+
+func (x *AppendEntriesReply) GetConflictTerm() int64 {
+	if x != nil {
+		return x.ConflictTerm
+	}
+	return 0
+}
+
+type InstallSnapshotArgs struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	Term              int64                  `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	LeaderId          int64                  `protobuf:"varint,2,opt,name=leader_id,json=leaderId,proto3" json:"leader_id,omitempty"`
+	LastIncludedIndex int64                  `protobuf:"varint,3,opt,name=last_included_index,json=lastIncludedIndex,proto3" json:"last_included_index,omitempty"`
+	LastIncludedTerm  int64                  `protobuf:"varint,4,opt,name=last_included_term,json=lastIncludedTerm,proto3" json:"last_included_term,omitempty"`
+	Members           []int64                `protobuf:"varint,5,rep,packed,name=members,proto3" json:"members,omitempty"`
+	OldMembers        []int64                `protobuf:"varint,6,rep,packed,name=old_members,json=oldMembers,proto3" json:"old_members,omitempty"`
+	// json of the documents, {"LastApplied": ..., "Documents": {id: snapshot},
+	// "Committed": {id: entries}} with each snapshot in the format of
+	// GET /document/{id}/snapshot
+	Documents []byte `protobuf:"bytes,7,opt,name=documents,proto3" json:"documents,omitempty"`
+	// replication group the snapshot is of, 0 unless the brokers are sharded
+	Shard         int64 `protobuf:"varint,8,opt,name=shard,proto3" json:"shard,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InstallSnapshotArgs) Reset() {
+	*x = InstallSnapshotArgs{}
+	mi := &file_raftpb_raft_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InstallSnapshotArgs) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InstallSnapshotArgs) ProtoMessage() {}
+
+func (x *InstallSnapshotArgs) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InstallSnapshotArgs.ProtoReflect.Descriptor instead.
+func (*InstallSnapshotArgs) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *InstallSnapshotArgs) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *InstallSnapshotArgs) GetLeaderId() int64 {
+	if x != nil {
+		return x.LeaderId
+	}
+	return 0
+}
+
+func (x *InstallSnapshotArgs) GetLastIncludedIndex() int64 {
+	if x != nil {
+		return x.LastIncludedIndex
+	}
+	return 0
+}
+
+func (x *InstallSnapshotArgs) GetLastIncludedTerm() int64 {
+	if x != nil {
+		return x.LastIncludedTerm
+	}
+	return 0
+}
+
+func (x *InstallSnapshotArgs) GetMembers() []int64 {
+	if x != nil {
+		return x.Members
+	}
+	return nil
+}
+
+func (x *InstallSnapshotArgs) GetOldMembers() []int64 {
+	if x != nil {
+		return x.OldMembers
+	}
+	return nil
+}
+
+func (x *InstallSnapshotArgs) GetDocuments() []byte {
+	if x != nil {
+		return x.Documents
+	}
+	return nil
+}
+
+func (x *InstallSnapshotArgs) GetShard() int64 {
+	if x != nil {
+		return x.Shard
+	}
+	return 0
+}
+
+type InstallSnapshotReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Term          int64                  `protobuf:"varint,1,opt,name=term,proto3" json:"term,omitempty"`
+	Id            int64                  `protobuf:"varint,2,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InstallSnapshotReply) Reset() {
+	*x = InstallSnapshotReply{}
+	mi := &file_raftpb_raft_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InstallSnapshotReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InstallSnapshotReply) ProtoMessage() {}
+
+func (x *InstallSnapshotReply) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InstallSnapshotReply.ProtoReflect.Descriptor instead.
+func (*InstallSnapshotReply) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *InstallSnapshotReply) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *InstallSnapshotReply) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type LogEntry struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// unset for entries without an operation
+	//
+	// Types that are valid to be assigned to Operation:
+	//
+	//	*LogEntry_CrdtMessage
+	//	*LogEntry_Text
+	//	*LogEntry_Number
+	//	*LogEntry_JointConfig
+	//	*LogEntry_NewConfig
+	//	*LogEntry_Compressed
+	//	*LogEntry_RollbackNotice
+	Operation isLogEntry_Operation `protobuf_oneof:"operation"`
+	Term      int64                `protobuf:"varint,8,opt,name=term,proto3" json:"term,omitempty"`
+	Document  string               `protobuf:"bytes,9,opt,name=document,proto3" json:"document,omitempty"`
+	// crc32 the leader set, see LogEntry.checksum
+	Checksum      uint32 `protobuf:"varint,10,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogEntry) Reset() {
+	*x = LogEntry{}
+	mi := &file_raftpb_raft_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogEntry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogEntry) ProtoMessage() {}
+
+func (x *LogEntry) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogEntry.ProtoReflect.Descriptor instead.
+func (*LogEntry) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *LogEntry) GetOperation() isLogEntry_Operation {
+	if x != nil {
+		return x.Operation
+	}
+	return nil
+}
+
+func (x *LogEntry) GetCrdtMessage() *CRDTMessage {
+	if x != nil {
+		if x, ok := x.Operation.(*LogEntry_CrdtMessage); ok {
+			return x.CrdtMessage
+		}
+	}
+	return nil
+}
+
+func (x *LogEntry) GetText() string {
+	if x != nil {
+		if x, ok := x.Operation.(*LogEntry_Text); ok {
+			return x.Text
+		}
+	}
+	return ""
+}
+
+func (x *LogEntry) GetNumber() int64 {
+	if x != nil {
+		if x, ok := x.Operation.(*LogEntry_Number); ok {
+			return x.Number
+		}
+	}
+	return 0
+}
+
+func (x *LogEntry) GetJointConfig() *JointConfig {
+	if x != nil {
+		if x, ok := x.Operation.(*LogEntry_JointConfig); ok {
+			return x.JointConfig
+		}
+	}
+	return nil
+}
+
+func (x *LogEntry) GetNewConfig() *NewConfig {
+	if x != nil {
+		if x, ok := x.Operation.(*LogEntry_NewConfig); ok {
+			return x.NewConfig
+		}
+	}
+	return nil
+}
+
+func (x *LogEntry) GetCompressed() []byte {
+	if x != nil {
+		if x, ok := x.Operation.(*LogEntry_Compressed); ok {
+			return x.Compressed
+		}
+	}
+	return nil
+}
+
+func (x *LogEntry) GetRollbackNotice() *RollbackNotice {
+	if x != nil {
+		if x, ok := x.Operation.(*LogEntry_RollbackNotice); ok {
+			return x.RollbackNotice
+		}
+	}
+	return nil
+}
+
+func (x *LogEntry) GetTerm() int64 {
+	if x != nil {
+		return x.Term
+	}
+	return 0
+}
+
+func (x *LogEntry) GetDocument() string {
+	if x != nil {
+		return x.Document
+	}
+	return ""
+}
+
+func (x *LogEntry) GetChecksum() uint32 {
+	if x != nil {
+		return x.Checksum
+	}
+	return 0
+}
+
+type isLogEntry_Operation interface {
+	isLogEntry_Operation()
+}
+
+type LogEntry_CrdtMessage struct {
+	CrdtMessage *CRDTMessage `protobuf:"bytes,1,opt,name=crdt_message,json=crdtMessage,proto3,oneof"`
+}
+
+type LogEntry_Text struct {
+	// operations of older logs, formatted as Type[%s] Index[%d] Value[%+v]
+	Text string `protobuf:"bytes,2,opt,name=text,proto3,oneof"`
+}
+
+type LogEntry_Number struct {
+	Number int64 `protobuf:"varint,3,opt,name=number,proto3,oneof"`
+}
+
+type LogEntry_JointConfig struct {
+	JointConfig *JointConfig `protobuf:"bytes,4,opt,name=joint_config,json=jointConfig,proto3,oneof"`
+}
+
+type LogEntry_NewConfig struct {
+	NewConfig *NewConfig `protobuf:"bytes,5,opt,name=new_config,json=newConfig,proto3,oneof"`
+}
+
+type LogEntry_Compressed struct {
+	// gob encoded and gzipped when larger than CompressionThreshold, only go
+	// brokers can read it
+	Compressed []byte `protobuf:"bytes,6,opt,name=compressed,proto3,oneof"`
+}
+
+type LogEntry_RollbackNotice struct {
+	RollbackNotice *RollbackNotice `protobuf:"bytes,7,opt,name=rollback_notice,json=rollbackNotice,proto3,oneof"`
+}
+
+func (*LogEntry_CrdtMessage) isLogEntry_Operation() {}
+
+func (*LogEntry_Text) isLogEntry_Operation() {}
+
+func (*LogEntry_Number) isLogEntry_Operation() {}
+
+func (*LogEntry_JointConfig) isLogEntry_Operation() {}
+
+func (*LogEntry_NewConfig) isLogEntry_Operation() {}
+
+func (*LogEntry_Compressed) isLogEntry_Operation() {}
+
+func (*LogEntry_RollbackNotice) isLogEntry_Operation() {}
+
+// the body of POST /crdt
+type CRDTMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Type  string                 `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Index int64                  `protobuf:"varint,2,opt,name=index,proto3" json:"index,omitempty"`
+	// json of the value, the way it came in on /crdt
+	ValueJson      string `protobuf:"bytes,3,opt,name=value_json,json=valueJson,proto3" json:"value_json,omitempty"`
+	ReplicaId      string `protobuf:"bytes,4,opt,name=replica_id,json=replicaId,proto3" json:"replica_id,omitempty"`
+	OperationIndex int64  `protobuf:"varint,5,opt,name=operation_index,json=operationIndex,proto3" json:"operation_index,omitempty"`
+	Source         string `protobuf:"bytes,6,opt,name=source,proto3" json:"source,omitempty"`
+	SchemaVersion  int64  `protobuf:"varint,7,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+	OpId           string `protobuf:"bytes,8,opt,name=op_id,json=opId,proto3" json:"op_id,omitempty"`
+	// json of the crdt operation, see CRDTMessage.Operation
+	OperationJson string `protobuf:"bytes,9,opt,name=operation_json,json=operationJson,proto3" json:"operation_json,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CRDTMessage) Reset() {
+	*x = CRDTMessage{}
+	mi := &file_raftpb_raft_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CRDTMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CRDTMessage) ProtoMessage() {}
+
+func (x *CRDTMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CRDTMessage.ProtoReflect.Descriptor instead.
+func (*CRDTMessage) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *CRDTMessage) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *CRDTMessage) GetIndex() int64 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *CRDTMessage) GetValueJson() string {
+	if x != nil {
+		return x.ValueJson
+	}
+	return ""
+}
+
+func (x *CRDTMessage) GetReplicaId() string {
+	if x != nil {
+		return x.ReplicaId
+	}
+	return ""
+}
+
+func (x *CRDTMessage) GetOperationIndex() int64 {
+	if x != nil {
+		return x.OperationIndex
+	}
+	return 0
+}
+
+func (x *CRDTMessage) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *CRDTMessage) GetSchemaVersion() int64 {
+	if x != nil {
+		return x.SchemaVersion
+	}
+	return 0
+}
+
+func (x *CRDTMessage) GetOpId() string {
+	if x != nil {
+		return x.OpId
+	}
+	return ""
+}
+
+func (x *CRDTMessage) GetOperationJson() string {
+	if x != nil {
+		return x.OperationJson
+	}
+	return ""
+}
+
+type JointConfig struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Old           []int64                `protobuf:"varint,1,rep,packed,name=old,proto3" json:"old,omitempty"`
+	New           []int64                `protobuf:"varint,2,rep,packed,name=new,proto3" json:"new,omitempty"`
+	Addrs         map[int64]string       `protobuf:"bytes,3,rep,name=addrs,proto3" json:"addrs,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *JointConfig) Reset() {
+	*x = JointConfig{}
+	mi := &file_raftpb_raft_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *JointConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*JointConfig) ProtoMessage() {}
+
+func (x *JointConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use JointConfig.ProtoReflect.Descriptor instead.
+func (*JointConfig) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *JointConfig) GetOld() []int64 {
+	if x != nil {
+		return x.Old
+	}
+	return nil
+}
+
+func (x *JointConfig) GetNew() []int64 {
+	if x != nil {
+		return x.New
+	}
+	return nil
+}
+
+func (x *JointConfig) GetAddrs() map[int64]string {
+	if x != nil {
+		return x.Addrs
+	}
+	return nil
+}
+
+type NewConfig struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Members       []int64                `protobuf:"varint,1,rep,packed,name=members,proto3" json:"members,omitempty"`
+	Addrs         map[int64]string       `protobuf:"bytes,2,rep,name=addrs,proto3" json:"addrs,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NewConfig) Reset() {
+	*x = NewConfig{}
+	mi := &file_raftpb_raft_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NewConfig) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NewConfig) ProtoMessage() {}
+
+func (x *NewConfig) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NewConfig.ProtoReflect.Descriptor instead.
+func (*NewConfig) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *NewConfig) GetMembers() []int64 {
+	if x != nil {
+		return x.Members
+	}
+	return nil
+}
+
+func (x *NewConfig) GetAddrs() map[int64]string {
+	if x != nil {
+		return x.Addrs
+	}
+	return nil
+}
+
+type RollbackNotice struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Index         int64                  `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RollbackNotice) Reset() {
+	*x = RollbackNotice{}
+	mi := &file_raftpb_raft_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RollbackNotice) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RollbackNotice) ProtoMessage() {}
+
+func (x *RollbackNotice) ProtoReflect() protoreflect.Message {
+	mi := &file_raftpb_raft_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RollbackNotice.ProtoReflect.Descriptor instead.
+func (*RollbackNotice) Descriptor() ([]byte, []int) {
+	return file_raftpb_raft_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *RollbackNotice) GetIndex() int64 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+var File_raftpb_raft_proto protoreflect.FileDescriptor
+
+const file_raftpb_raft_proto_rawDesc = "" +
+	"\n" +
+	"\x11raftpb/raft.proto\x12\x0eclarity.broker\"\xd6\x01\n" +
+	"\x0fRequestVoteArgs\x12\x12\n" +
+	"\x04term\x18\x01 \x01(\x03R\x04term\x12!\n" +
+	"\fcandidate_id\x18\x02 \x01(\x03R\vcandidateId\x12$\n" +
+	"\x0elast_log_index\x18\x03 \x01(\x03R\flastLogIndex\x12\"\n" +
+	"\rlast_log_term\x18\x04 \x01(\x03R\vlastLogTerm\x12!\n" +
+	"\ftrace_parent\x18\x05 \x01(\tR\vtraceParent\x12\x1f\n" +
+	"\vtrace_state\x18\x06 \x01(\tR\n" +
+	"traceState\"Y\n" +
+	"\x10RequestVoteReply\x12\x12\n" +
+	"\x04term\x18\x01 \x01(\x03R\x04term\x12!\n" +
+	"\fvote_granted\x18\x02 \x01(\bR\vvoteGranted\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\x03R\x02id\"\x11\n" +
+	"\x0fWhoIsLeaderArgs\"t\n" +
+	"\x10WhoIsLeaderReply\x12\x1b\n" +
+	"\tleader_id\x18\x01 \x01(\x03R\bleaderId\x12\x1b\n" +
+	"\thttp_addr\x18\x02 \x01(\tR\bhttpAddr\x12\x12\n" +
+	"\x04term\x18\x03 \x01(\x03R\x04term\x12\x12\n" +
+	"\x04self\x18\x04 \x01(\bR\x04self\"\x90\x03\n" +
+	"\x11AppendEntriesArgs\x12\x12\n" +
+	"\x04term\x18\x01 \x01(\x03R\x04term\x12\x1b\n" +
+	"\tleader_id\x18\x02 \x01(\x03R\bleaderId\x12$\n" +
+	"\x0eprev_log_index\x18\x03 \x01(\x03R\fprevLogIndex\x12\"\n" +
+	"\rprev_log_term\x18\x04 \x01(\x03R\vprevLogTerm\x122\n" +
+	"\aentries\x18\x05 \x03(\v2\x18.clarity.broker.LogEntryR\aentries\x12\x1e\n" +
+	"\n" +
+	"compressed\x18\x06 \x01(\bR\n" +
+	"compressed\x12-\n" +
+	"\x12compressed_entries\x18\a \x01(\fR\x11compressedEntries\x12#\n" +
+	"\rleader_commit\x18\b \x01(\x03R\fleaderCommit\x12!\n" +
+	"\ftrace_parent\x18\t \x01(\tR\vtraceParent\x12\x1f\n" +
+	"\vtrace_state\x18\n" +
+	" \x01(\tR\n" +
+	"traceState\x12\x14\n" +
+	"\x05shard\x18\v \x01(\x03R\x05shard\"\x9e\x01\n" +
+	"\x12AppendEntriesReply\x12\x12\n" +
+	"\x04term\x18\x01 \x01(\x03R\x04term\x12\x18\n" +
+	"\asuccess\x18\x02 \x01(\bR\asuccess\x12\x0e\n" +
+	"\x02id\x18\x03 \x01(\x03R\x02id\x12%\n" +
+	"\x0econflict_index\x18\x04 \x01(\x03R\rconflictIndex\x12#\n" +
+	"\rconflict_term\x18\x05 \x01(\x03R\fconflictTerm\"\x93\x02\n" +
+	"\x13InstallSnapshotArgs\x12\x12\n" +
+	"\x04term\x18\x01 \x01(\x03R\x04term\x12\x1b\n" +
+	"\tleader_id\x18\x02 \x01(\x03R\bleaderId\x12.\n" +
+	"\x13last_included_index\x18\x03 \x01(\x03R\x11lastIncludedIndex\x12,\n" +
+	"\x12last_included_term\x18\x04 \x01(\x03R\x10lastIncludedTerm\x12\x18\n" +
+	"\amembers\x18\x05 \x03(\x03R\amembers\x12\x1f\n" +
+	"\vold_members\x18\x06 \x03(\x03R\n" +
+	"oldMembers\x12\x1c\n" +
+	"\tdocuments\x18\a \x01(\fR\tdocuments\x12\x14\n" +
+	"\x05shard\x18\b \x01(\x03R\x05shard\":\n" +
+	"\x14InstallSnapshotReply\x12\x12\n" +
+	"\x04term\x18\x01 \x01(\x03R\x04term\x12\x0e\n" +
+	"\x02id\x18\x02 \x01(\x03R\x02id\"\xc0\x03\n" +
+	"\bLogEntry\x12@\n" +
+	"\fcrdt_message\x18\x01 \x01(\v2\x1b.clarity.broker.CRDTMessageH\x00R\vcrdtMessage\x12\x14\n" +
+	"\x04text\x18\x02 \x01(\tH\x00R\x04text\x12\x18\n" +
+	"\x06number\x18\x03 \x01(\x03H\x00R\x06number\x12@\n" +
+	"\fjoint_config\x18\x04 \x01(\v2\x1b.clarity.broker.JointConfigH\x00R\vjointConfig\x12:\n" +
+	"\n" +
+	"new_config\x18\x05 \x01(\v2\x19.clarity.broker.NewConfigH\x00R\tnewConfig\x12 \n" +
+	"\n" +
+	"compressed\x18\x06 \x01(\fH\x00R\n" +
+	"compressed\x12I\n" +
+	"\x0frollback_notice\x18\a \x01(\v2\x1e.clarity.broker.RollbackNoticeH\x00R\x0erollbackNotice\x12\x12\n" +
+	"\x04term\x18\b \x01(\x03R\x04term\x12\x1a\n" +
+	"\bdocument\x18\t \x01(\tR\bdocument\x12\x1a\n" +
+	"\bchecksum\x18\n" +
+	" \x01(\rR\bchecksumB\v\n" +
+	"\toperation\"\x99\x02\n" +
+	"\vCRDTMessage\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x14\n" +
+	"\x05index\x18\x02 \x01(\x03R\x05index\x12\x1d\n" +
+	"\n" +
+	"value_json\x18\x03 \x01(\tR\tvalueJson\x12\x1d\n" +
+	"\n" +
+	"replica_id\x18\x04 \x01(\tR\treplicaId\x12'\n" +
+	"\x0foperation_index\x18\x05 \x01(\x03R\x0eoperationIndex\x12\x16\n" +
+	"\x06source\x18\x06 \x01(\tR\x06source\x12%\n" +
+	"\x0eschema_version\x18\a \x01(\x03R\rschemaVersion\x12\x13\n" +
+	"\x05op_id\x18\b \x01(\tR\x04opId\x12%\n" +
+	"\x0eoperation_json\x18\t \x01(\tR\roperationJson\"\xa9\x01\n" +
+	"\vJointConfig\x12\x10\n" +
+	"\x03old\x18\x01 \x03(\x03R\x03old\x12\x10\n" +
+	"\x03new\x18\x02 \x03(\x03R\x03new\x12<\n" +
+	"\x05addrs\x18\x03 \x03(\v2&.clarity.broker.JointConfig.AddrsEntryR\x05addrs\x1a8\n" +
+	"\n" +
+	"AddrsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x03R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x9b\x01\n" +
+	"\tNewConfig\x12\x18\n" +
+	"\amembers\x18\x01 \x03(\x03R\amembers\x12:\n" +
+	"\x05addrs\x18\x02 \x03(\v2$.clarity.broker.NewConfig.AddrsEntryR\x05addrs\x1a8\n" +
+	"\n" +
+	"AddrsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x03R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"&\n" +
+	"\x0eRollbackNotice\x12\x14\n" +
+	"\x05index\x18\x01 \x01(\x03R\x05index2\xb4\x01\n" +
+	"\x0eElectionModule\x12P\n" +
+	"\vRequestVote\x12\x1f.clarity.broker.RequestVoteArgs\x1a .clarity.broker.RequestVoteReply\x12P\n" +
+	"\vWhoIsLeader\x12\x1f.clarity.broker.WhoIsLeaderArgs\x1a .clarity.broker.WhoIsLeaderReply2\xc9\x01\n" +
+	"\x11ReplicationModule\x12V\n" +
+	"\rAppendEntries\x12!.clarity.broker.AppendEntriesArgs\x1a\".clarity.broker.AppendEntriesReply\x12\\\n" +
+	"\x0fInstallSnapshot\x12#.clarity.broker.InstallSnapshotArgs\x1a$.clarity.broker.InstallSnapshotReplyB*Z(github.com/townsag/clarity/broker/raftpbb\x06proto3"
+
+var (
+	file_raftpb_raft_proto_rawDescOnce sync.Once
+	file_raftpb_raft_proto_rawDescData []byte
+)
+
+func file_raftpb_raft_proto_rawDescGZIP() []byte {
+	file_raftpb_raft_proto_rawDescOnce.Do(func() {
+		file_raftpb_raft_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_raftpb_raft_proto_rawDesc), len(file_raftpb_raft_proto_rawDesc)))
+	})
+	return file_raftpb_raft_proto_rawDescData
+}
+
+var file_raftpb_raft_proto_msgTypes = make([]protoimpl.MessageInfo, 15)
+var file_raftpb_raft_proto_goTypes = []any{
+	(*RequestVoteArgs)(nil),      // 0: clarity.broker.RequestVoteArgs
+	(*RequestVoteReply)(nil),     // 1: clarity.broker.RequestVoteReply
+	(*WhoIsLeaderArgs)(nil),      // 2: clarity.broker.WhoIsLeaderArgs
+	(*WhoIsLeaderReply)(nil),     // 3: clarity.broker.WhoIsLeaderReply
+	(*AppendEntriesArgs)(nil),    // 4: clarity.broker.AppendEntriesArgs
+	(*AppendEntriesReply)(nil),   // 5: clarity.broker.AppendEntriesReply
+	(*InstallSnapshotArgs)(nil),  // 6: clarity.broker.InstallSnapshotArgs
+	(*InstallSnapshotReply)(nil), // 7: clarity.broker.InstallSnapshotReply
+	(*LogEntry)(nil),             // 8: clarity.broker.LogEntry
+	(*CRDTMessage)(nil),          // 9: clarity.broker.CRDTMessage
+	(*JointConfig)(nil),          // 10: clarity.broker.JointConfig
+	(*NewConfig)(nil),            // 11: clarity.broker.NewConfig
+	(*RollbackNotice)(nil),       // 12: clarity.broker.RollbackNotice
+	nil,                          // 13: clarity.broker.JointConfig.AddrsEntry
+	nil,                          // 14: clarity.broker.NewConfig.AddrsEntry
+}
+var file_raftpb_raft_proto_depIdxs = []int32{
+	8,  // 0: clarity.broker.AppendEntriesArgs.entries:type_name -> clarity.broker.LogEntry
+	9,  // 1: clarity.broker.LogEntry.crdt_message:type_name -> clarity.broker.CRDTMessage
+	10, // 2: clarity.broker.LogEntry.joint_config:type_name -> clarity.broker.JointConfig
+	11, // 3: clarity.broker.LogEntry.new_config:type_name -> clarity.broker.NewConfig
+	12, // 4: clarity.broker.LogEntry.rollback_notice:type_name -> clarity.broker.RollbackNotice
+	13, // 5: clarity.broker.JointConfig.addrs:type_name -> clarity.broker.JointConfig.AddrsEntry
+	14, // 6: clarity.broker.NewConfig.addrs:type_name -> clarity.broker.NewConfig.AddrsEntry
+	0,  // 7: clarity.broker.ElectionModule.RequestVote:input_type -> clarity.broker.RequestVoteArgs
+	2,  // 8: clarity.broker.ElectionModule.WhoIsLeader:input_type -> clarity.broker.WhoIsLeaderArgs
+	4,  // 9: clarity.broker.ReplicationModule.AppendEntries:input_type -> clarity.broker.AppendEntriesArgs
+	6,  // 10: clarity.broker.ReplicationModule.InstallSnapshot:input_type -> clarity.broker.InstallSnapshotArgs
+	1,  // 11: clarity.broker.ElectionModule.RequestVote:output_type -> clarity.broker.RequestVoteReply
+	3,  // 12: clarity.broker.ElectionModule.WhoIsLeader:output_type -> clarity.broker.WhoIsLeaderReply
+	5,  // 13: clarity.broker.ReplicationModule.AppendEntries:output_type -> clarity.broker.AppendEntriesReply
+	7,  // 14: clarity.broker.ReplicationModule.InstallSnapshot:output_type -> clarity.broker.InstallSnapshotReply
+	11, // [11:15] is the sub-list for method output_type
+	7,  // [7:11] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_raftpb_raft_proto_init() }
+func file_raftpb_raft_proto_init() {
+	if File_raftpb_raft_proto != nil {
+		return
+	}
+	file_raftpb_raft_proto_msgTypes[8].OneofWrappers = []any{
+		(*LogEntry_CrdtMessage)(nil),
+		(*LogEntry_Text)(nil),
+		(*LogEntry_Number)(nil),
+		(*LogEntry_JointConfig)(nil),
+		(*LogEntry_NewConfig)(nil),
+		(*LogEntry_Compressed)(nil),
+		(*LogEntry_RollbackNotice)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_raftpb_raft_proto_rawDesc), len(file_raftpb_raft_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   15,
+			NumExtensions: 0,
+			NumServices:   2,
+		},
+		GoTypes:           file_raftpb_raft_proto_goTypes,
+		DependencyIndexes: file_raftpb_raft_proto_depIdxs,
+		MessageInfos:      file_raftpb_raft_proto_msgTypes,
+	}.Build()
+	File_raftpb_raft_proto = out.File
+	file_raftpb_raft_proto_goTypes = nil
+	file_raftpb_raft_proto_depIdxs = nil
+}
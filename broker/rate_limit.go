@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// token bucket per source so one app server can't flood the leader
+// each bucket holds up to burst tokens and refills at rate tokens per second
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// returns nil when rate limiting is turned off
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take a token for source, false if its bucket is empty
+func (rl *rateLimiter) allow(source string) bool {
+	if rl == nil {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	bucket, ok := rl.buckets[source]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[source] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rl.rate
+	if bucket.tokens > rl.burst {
+		bucket.tokens = rl.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// messages are limited by the replica that sent them, or by the remote host
+// when the app server didn't set one
+func rateLimitSource(msg CRDTMessage, r *http.Request) string {
+	if msg.ReplicaID != "" {
+		return "replica:" + msg.ReplicaID
+	}
+	return remoteAddrSource(r)
+}
@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCRDTEndpointRateLimit(t *testing.T) {
+
+	const burst = 5
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		// slow enough refill that no tokens come back during the test
+		options[i].RateLimit = 0.01
+		options[i].RateLimitBurst = burst
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[origLeaderId]
+
+	post := func(replicaID string, index int64) int {
+		body, _ := json.Marshal(CRDTMessage{
+			Type:      "insert",
+			Index:     index,
+			Value:     "a",
+			ReplicaID: replicaID,
+			OpIndex:   1,
+			Source:    "client",
+		})
+		req := httptest.NewRequest(http.MethodPost, "/crdt", bytes.NewReader(body))
+		rec := httptest.NewRecorder()
+		leader.handleCRDTOperation(rec, req)
+		return rec.Code
+	}
+
+	// a burst twice the limit from one replica, only the first burst gets through
+	accepted, limited := 0, 0
+	for i := 0; i < 2*burst; i++ {
+		switch code := post("flooder", int64(i)); code {
+		case http.StatusAccepted:
+			accepted++
+		case http.StatusTooManyRequests:
+			limited++
+		default:
+			t.Fatalf("unexpected status %d", code)
+		}
+	}
+	if accepted != burst || limited != burst {
+		t.Errorf("got %d accepted and %d limited, want %d of each", accepted, limited, burst)
+	}
+
+	// a replica staying under the limit is unaffected by the flooder
+	for i := 0; i < burst; i++ {
+		if code := post("polite", int64(i)); code != http.StatusAccepted {
+			t.Errorf("compliant request %d got status %d, want %d", i, code, http.StatusAccepted)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var ErrEntriesCompacted = errors.New("entries were compacted")
+
+// committed entries with log index since and up, oldest first, for debugging
+// and for application servers re-syncing from where they left off. an index
+// past the commit index gives no entries. ErrEntriesCompacted when since was
+// trimmed off the log, those entries are only in the snapshot now
+func (rm *ReplicationModule) EntriesSince(since int) ([]CommitEntry, error) {
+	rm.broker.mu2.Lock()
+	defer rm.broker.mu2.Unlock()
+
+	if since < rm.logBaseIndex && since <= rm.commitIndex {
+		return nil, fmt.Errorf("%w: entries before %d are only in the snapshot", ErrEntriesCompacted, rm.logBaseIndex)
+	}
+	entries := []CommitEntry{}
+	for index := max(since, rm.logBaseIndex); index <= rm.commitIndex; index++ {
+		entry := rm.entry(index)
+		entries = append(entries, CommitEntry{CRDTOperation: entry.operation(), Index: index, Term: entry.Term, Shard: rm.shard})
+	}
+	return entries, nil
+}
+
+// GET /logrequest?since=N. unlike the whole log this is answered by followers
+// too, committed entries are the same on every broker
+func (broker *BrokerServer) handleEntriesSince(w http.ResponseWriter, r *http.Request) {
+	since, err := historyBound(r.URL.Query(), "since", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rm, err := broker.shardOf(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := rm.EntriesSince(since)
+	if errors.Is(err, ErrEntriesCompacted) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		broker.logger.Warn("error encoding entries", "since", since, "err", err)
+	}
+}
@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestEntriesSince(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % 3
+	leader := h.cluster[leaderId].rm
+
+	batch := make([]LogEntry, 10)
+	for i := range batch {
+		batch[i] = LogEntry{CRDTOperation: insertOp(fmt.Sprint(i)), Document: "doc1"}
+	}
+	first, _ := leader.submitBatch(batch)
+	last := first + len(batch) - 1
+	waitForApplied(t, h, []int{0, 1, 2}, last)
+
+	checkTail := func(entries []CommitEntry, since int) {
+		t.Helper()
+		if len(entries) != last-since+1 {
+			t.Fatalf("got %d entries since %d, want %d", len(entries), since, last-since+1)
+		}
+		for i, entry := range entries {
+			index := since + i
+			if want := insertOp(fmt.Sprint(index - first)); entry.Index != index || entry.CRDTOperation != want {
+				t.Errorf("entry %d is %+v, want index %d with %q", i, entry, index, want)
+			}
+		}
+	}
+	since := first + 5
+	entries, err := leader.EntriesSince(since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTail(entries, since)
+
+	// followers answer from their own committed entries
+	get := func(brokerId int, since int) (*http.Response, []CommitEntry) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/logrequest?since=%d", h.cluster[brokerId].GetHTTPAddr(), since))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var entries []CommitEntry
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, entries
+	}
+	resp, entries := get(followerId, since)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /logrequest?since=%d on a follower got status %d", since, resp.StatusCode)
+	}
+	checkTail(entries, since)
+
+	if entries, err := leader.EntriesSince(last + 1); err != nil || len(entries) != 0 {
+		t.Errorf("entries after the commit index are %v, %v, want none", entries, err)
+	}
+
+	leader.TrimLog(since)
+	if _, err := leader.EntriesSince(since); !errors.Is(err, ErrEntriesCompacted) {
+		t.Errorf("entries from a trimmed index gave %v, want %v", err, ErrEntriesCompacted)
+	}
+	if resp, _ := get(leaderId, since); resp.StatusCode != http.StatusGone {
+		t.Errorf("GET /logrequest?since=%d after trimming got status %d, want %d", since, resp.StatusCode, http.StatusGone)
+	}
+	entries, err = leader.EntriesSince(since + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTail(entries, since+1)
+}
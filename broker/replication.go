@@ -1,21 +1,61 @@
 package broker
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type CommitEntry struct {
 	CRDTOperation any
 
+	// position of the entry in the log. consecutive entries sent on
+	// commitChan have consecutive indices, also after a restart from storage.
+	// only a follower installing a snapshot skips the entries folded into it
 	Index int
 
+	// term the entry was created in
 	Term int
+
+	// replication group the entry was committed in, Index counts within it
+	// always 0 unless BrokerOptions.Shards is set, see shard.go
+	Shard int
 }
 
 type LogEntry struct {
 	CRDTOperation any
 	Term          int
 	Document      string
+
+	// crc32 of the fields above, set when the leader appends the entry and
+	// checked by followers in AppendEntries. 0 for entries from before checksums
+	Checksum uint32
+}
+
+// checksum of every field but Checksum, over the entry's protobuf encoding
+// see grpc_messages.go. it writes maps in key order and leaves out empty
+// slices like gob does, so the entry hashes the same after either transport.
+// operations without an encoding return ErrUnencodableEntry, leaders refuse
+// to append them
+func (entry LogEntry) checksum() (uint32, error) {
+	entry.Checksum = 0
+	b, err := entry.appendWire(nil)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(b), nil
+}
+
+// false when the entry was changed after its checksum was set or can't be
+// encoded at all. a Checksum of 0 is an entry from before checksums
+func (entry LogEntry) intact() bool {
+	checksum, err := entry.checksum()
+	return err == nil && (entry.Checksum == 0 || entry.Checksum == checksum)
 }
 
 type ReplicationModule struct {
@@ -24,37 +64,140 @@ type ReplicationModule struct {
 	// id of connected server
 	id int
 
-	peerIds []int
+	// which of the broker's replication groups this is, see shard.go
+	// and the documents built from its committed entries
+	shard     int
+	documents *documentStore
+
+	// cluster configuration from the latest config entry in the log, see membership.go
+	// baseMembership is used while the log has no config entries
+	membership     membership
+	baseMembership membership
 
 	// working log structure for appends
+	// rm.log[0] is the entry at logBaseIndex, the ones before it were trimmed
+	// after a snapshot, see snapshot.go. use entry and logSlice to index it
 	log []LogEntry
 
-	// storage for committed log entries
-	committedLog []LogEntry
+	// log index of rm.log[0] and the term of the entry just before it
+	logBaseIndex int
+	logBaseTerm  int
+
+	// leader only. times the log was rolled back, see Rollback
+	rollbacks int
+
+	// leader only. span each uncommitted entry was submitted in, if it was
+	// traced, see tracing.go
+	entryTraces map[int]trace.SpanContext
 
 	commitIndex int
 
+	// leader only. index of the next log entry to send to each peer
+	// and the highest log entry known to be replicated on each peer
+	// map is like a python dict
+	nextIndex  map[int]int
+	matchIndex map[int]int
+
+	// leader only. send time of the newest AE each peer has acknowledged
+	// and the newest time a majority had acknowledged, see lease.go
+	heartbeatAcks         map[int]time.Time
+	lastMajorityHeartbeat time.Time
+
+	// leader only. when this leadership started, and whether it has gone
+	// without a majority for too long to take writes, see quorum_loss.go
+	leaderSince time.Time
+	readOnly    bool
+
 	commitChan chan<- CommitEntry
 
+	// leader only. peers with an AE in flight, and whether another was asked
+	// for while it was out, see leaderSendAEs
+	aeInFlight map[int]bool
+	aePending  map[int]bool
+
 	// channel to coordiate commits
 	// added to in leaderSendAEs and AppendEntries
 	// consumed in commitChanSender
 	newCommitReadyChan chan struct{}
 
+	// closed when commitChanSender returns
+	senderDone chan struct{}
+
 	// AE stands for appendentry. used also for heartbeat
 	triggerAEChan chan struct{}
 
+	// leader only. cancelled when this leadership ends, so AppendEntries still
+	// in flight don't touch nextIndex and matchIndex afterwards
+	leaderCtx    context.Context
+	cancelLeader context.CancelFunc
+
 	lastApplied int
+
+	// where the log, commitIndex and lastApplied are persisted, nil to keep them in memory only
+	storage Storage
+	// storage holds the entries before storedEnd, the ones from storedValid on
+	// were replaced since and are rewritten on the next persistToStorage
+	storedEnd   int
+	storedValid int
+}
+
+// storage keeps the log, commitIndex and lastApplied, they're picked up from
+// whatever a previous run left there. entries that were already applied aren't
+// sent on commitChan again. nil storage keeps them in memory only
+// a storage that can't be read returns an error and no module
+func NewRM(id int, peerIds []int, broker *BrokerServer, commitChan chan<- CommitEntry, storage Storage) (*ReplicationModule, error) {
+	rm := newRM(id, peerIds, broker, commitChan)
+	rm.documents = broker.documents
+	if err := rm.start(storage); err != nil {
+		return nil, err
+	}
+	return rm, nil
+}
+
+// pick up what storage holds, then start sending committed entries on commitChan
+func (rm *ReplicationModule) start(storage Storage) error {
+	rm.storage = storage
+	if storage != nil {
+		restored, err := rm.restoreFromStorage()
+		if err != nil {
+			return fmt.Errorf("restoring replication state of shard %d: %w", rm.shard, err)
+		}
+		if restored {
+			rm.refreshMembership()
+
+			if rm.commitIndex >= 0 {
+				// no-op for entries already covered by the document checkpoint
+				for i, entry := range rm.logSlice(rm.logBaseIndex, rm.lastApplied+1) {
+					rm.documents.apply(rm.logBaseIndex+i, entry)
+				}
+			}
+			rm.broker.logger.Info("restored replication state", "shard", rm.shard, "entries", len(rm.log), "commit_index", rm.commitIndex, "last_applied", rm.lastApplied)
+		}
+	}
+
+	rm.broker.wg.Add(1)
+	go rm.commitChanSender()
+	return nil
 }
 
-func NewRM(id int, peerIds []int, broker *BrokerServer, commitChan chan<- CommitEntry) *ReplicationModule {
+func newRM(id int, peerIds []int, broker *BrokerServer, commitChan chan<- CommitEntry) *ReplicationModule {
 
 	rm := new(ReplicationModule)
 
 	rm.broker = broker
 	rm.id = id
-	rm.peerIds = peerIds
+	rm.baseMembership = membership{members: append([]int{id}, peerIds...)}
+	rm.membership = rm.baseMembership
 	rm.commitIndex = -1
+	rm.lastApplied = -1
+	rm.logBaseTerm = -1
+
+	rm.nextIndex = make(map[int]int)
+	rm.matchIndex = make(map[int]int)
+	rm.heartbeatAcks = make(map[int]time.Time)
+	rm.aeInFlight = make(map[int]bool)
+	rm.aePending = make(map[int]bool)
+	rm.entryTraces = make(map[int]trace.SpanContext)
 
 	rm.commitChan = commitChan
 
@@ -62,179 +205,471 @@ func NewRM(id int, peerIds []int, broker *BrokerServer, commitChan chan<- Commit
 
 	// 16 is buffer size. it means that 100 notifs can be held in channel;
 	rm.newCommitReadyChan = make(chan struct{}, 100)
+	rm.senderDone = make(chan struct{})
 
 	// 1 ensures only 1 AppendEntry is pending
 	rm.triggerAEChan = make(chan struct{}, 1)
 
-	go rm.commitChanSender()
-
 	return rm
 }
 
+// structure to keep track of follower log indexes
+// called when a broker becomes leader. caller must hold mu2
+func (rm *ReplicationModule) initializeLeaderState() {
+	rm.stopReplicating()
+	rm.leaderCtx, rm.cancelLeader = context.WithCancel(context.Background())
+
+	for _, peerId := range rm.membership.peers(rm.id) {
+		rm.nextIndex[peerId] = rm.lastLogIndex() + 1
+		rm.matchIndex[peerId] = -1
+	}
+
+	// entries of an earlier leadership were submitted on whichever broker led then
+	clear(rm.entryTraces)
+
+	// a new leadership stint starts without a lease
+	clear(rm.heartbeatAcks)
+	rm.lastMajorityHeartbeat = time.Time{}
+	rm.leaderSince = time.Now()
+	rm.readOnly = false
+}
+
+// end the current leadership's context so AppendEntries still in flight are
+// abandoned and their replies ignored. caller must hold mu2
+func (rm *ReplicationModule) stopReplicating() {
+	if rm.cancelLeader != nil {
+		rm.cancelLeader()
+		rm.leaderCtx, rm.cancelLeader = nil, nil
+	}
+}
+
+// index of the last entry in the log, counting trimmed entries. caller must hold mu2
+func (rm *ReplicationModule) lastLogIndex() int {
+	return rm.logBaseIndex + len(rm.log) - 1
+}
+
+// entry at log index, which must not have been trimmed. caller must hold mu2
+func (rm *ReplicationModule) entry(index int) LogEntry {
+	return rm.log[index-rm.logBaseIndex]
+}
+
+// entries from log index from up to but not including to, like rm.log[from:to]
+// before anything was trimmed. caller must hold mu2
+func (rm *ReplicationModule) logSlice(from int, to int) []LogEntry {
+	return rm.log[from-rm.logBaseIndex : to-rm.logBaseIndex]
+}
+
+// term of the entry at index, which can also be the last trimmed one
+// -1 before the start of the log. caller must hold mu2
+func (rm *ReplicationModule) termAt(index int) int {
+	if index < 0 {
+		return -1
+	}
+	if index == rm.logBaseIndex-1 {
+		return rm.logBaseTerm
+	}
+	return rm.entry(index).Term
+}
+
+// whether the committed entry at index is the one appended in term. trimmed
+// entries were committed, and only a leader's own entries end up in its term.
+// caller must hold mu2
+func (rm *ReplicationModule) committedInTerm(index int, term int) bool {
+	return index < rm.logBaseIndex-1 || rm.termAt(index) == term
+}
+
+// send heartbeats by using leaderSendAEs, and AppendEntries whenever
+// triggerAEChan asks for them, until the broker stops leading
+// heartbeats are just blank AppendEntries
+func (rm *ReplicationModule) sendHeartbeats(heartbeatTimeout time.Duration) {
+	rm.leaderSendAEs()
+
+	heartbeat := time.NewTimer(heartbeatTimeout)
+	defer heartbeat.Stop()
+	for {
+		doSend := false
+		select {
+		case <-heartbeat.C:
+			doSend = true
+
+			heartbeat.Stop()
+			heartbeat.Reset(heartbeatTimeout)
+		case _, ok := <-rm.triggerAEChan:
+			if ok {
+				doSend = true
+			} else {
+				return
+			}
+
+			if !heartbeat.Stop() {
+				<-heartbeat.C
+			}
+			heartbeat.Reset(heartbeatTimeout)
+		}
+
+		// send another heartbeat
+		if doSend {
+			rm.broker.mu2.Lock()
+			if rm.broker.state != Leader {
+				rm.broker.mu2.Unlock()
+				return
+			}
+			rm.broker.mu2.Unlock()
+			rm.leaderSendAEs()
+		}
+	}
+}
+
 // main function for leader to send AppendEntry commands to followers
-// also used in election.go for heartbeat
+// also used by sendHeartbeats
 func (rm *ReplicationModule) leaderSendAEs() {
+	_, span := rm.broker.tracer.Start(context.Background(), "ReplicationModule.leaderSendAEs")
+	defer span.End()
+
 	rm.broker.mu2.Lock()
 
 	// if broker is not leader. don't let it send AppendEntries
-	if rm.broker.state != Leader {
+	// a paused leader goes quiet like a slow one would
+	if rm.broker.state != Leader || rm.leaderCtx == nil || rm.broker.paused {
 		rm.broker.mu2.Unlock()
 		return
 	}
 
-	currentTerm := rm.broker.em.term
+	// every heartbeat round checks how long the majority has been silent
+	rm.checkQuorumContact()
+	if rm.stepDownWithoutQuorum() {
+		rm.broker.mu2.Unlock()
+		return
+	}
+
+	// one AE in flight per peer, triggers while it is out are coalesced into
+	// one more, so a slow peer doesn't pile up goroutines
+	for _, peerId := range rm.membership.peers(rm.id) {
+		rm.aePending[peerId] = true
+		if !rm.aeInFlight[peerId] {
+			rm.aeInFlight[peerId] = true
+			go rm.replicateTo(peerId)
+		}
+	}
 	rm.broker.mu2.Unlock()
+}
 
-	for _, peerId := range rm.peerIds {
+// send AEs to peerId one after the other until no more were asked for
+func (rm *ReplicationModule) replicateTo(peerId int) {
+	for {
+		rm.broker.mu2.Lock()
+		if !rm.aePending[peerId] || rm.broker.state != Leader || rm.leaderCtx == nil || rm.broker.paused {
+			delete(rm.aeInFlight, peerId)
+			delete(rm.aePending, peerId)
+			rm.broker.mu2.Unlock()
+			return
+		}
+		rm.aePending[peerId] = false
+		// the leadership can change between two AEs
+		currentTerm := rm.broker.em.term
+		ctx := rm.leaderCtx
+		rm.broker.mu2.Unlock()
 
-		// get the most recent index of the leader's log
-		// replication for followers will start from there
-		go func(peerId int) {
-			rm.broker.mu2.Lock()
-			nextIndex := rm.broker.em.nextIndex[peerId]
+		rm.sendAE(ctx, currentTerm, peerId)
+	}
+}
 
-			prevLogIndex := nextIndex - 1
-			prevLogTerm := -1
+// false once the leadership ctx was created for has ended, see stopReplicating
+func stillLeading(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	default:
+		return true
+	}
+}
 
-			if prevLogIndex >= 0 {
-				prevLogTerm = rm.log[prevLogIndex].Term
-			}
-			entries := rm.log[nextIndex:]
-
-			args := AppendEntriesArgs{
-				Term:         currentTerm,
-				LeaderId:     rm.id,
-				PrevLogIndex: prevLogIndex,
-				PrevLogTerm:  prevLogTerm,
-				Entries:      entries,
-				LeaderCommit: rm.commitIndex,
-			}
-			rm.broker.mu2.Unlock()
+// send peerId the entries it is missing, or a heartbeat, and handle the reply
+// ctx ends when this leadership does, which also abandons the call
+func (rm *ReplicationModule) sendAE(ctx context.Context, currentTerm int, peerId int) {
+	// get the most recent index of the leader's log
+	// replication for followers will start from there
+	rm.broker.mu2.Lock()
+	if !stillLeading(ctx) {
+		rm.broker.mu2.Unlock()
+		return
+	}
+	nextIndex := rm.nextIndex[peerId]
+
+	// the entries the peer needs were trimmed, it has to start from a snapshot
+	if nextIndex < rm.logBaseIndex {
+		rm.broker.mu2.Unlock()
+		rm.sendSnapshot(ctx, currentTerm, peerId)
+		return
+	}
 
-			log.Printf("%d sending AE Call to %d: %+v", rm.id, peerId, args)
+	prevLogIndex := nextIndex - 1
+	prevLogTerm := rm.termAt(prevLogIndex)
+	entries := rm.logSlice(nextIndex, rm.lastLogIndex()+1)
+	rollbacks := rm.rollbacks
+
+	args := AppendEntriesArgs{
+		Shard:        rm.shard,
+		Term:         currentTerm,
+		LeaderId:     rm.id,
+		PrevLogIndex: prevLogIndex,
+		PrevLogTerm:  prevLogTerm,
+		Entries:      entries,
+		LeaderCommit: rm.commitIndex,
+	}
+	submitted, traced := rm.entryTrace(nextIndex, nextIndex+len(entries)-1)
+	rm.broker.mu2.Unlock()
 
-			var reply AppendEntriesReply
-			if err := rm.broker.Call(peerId, "ReplicationModule.AppendEntries", args, &reply); err == nil {
-				log.Printf("%s %d receives AE reply from %d", rm.broker.state, rm.id, reply.Id)
-				rm.broker.mu2.Lock()
+	// entries submitted in a span are replicated in a child of it
+	if traced {
+		spanCtx, span := rm.broker.tracer.Start(trace.ContextWithSpanContext(ctx, submitted), "ReplicationModule.sendAE",
+			trace.WithAttributes(attribute.Int("peer", peerId), attribute.Int("entries", len(entries))))
+		defer span.End()
+		injectTrace(spanCtx, &args.TraceParent, &args.TraceState)
+	}
 
-				// if it detects through heartbeat that own term is out of date, become follower
-				if reply.Term > rm.broker.em.term {
-					log.Printf("leader %d's term is outdated", rm.id)
-					rm.broker.em.becomeFollower(reply.Term)
-					rm.broker.mu2.Unlock()
-					return
-				}
+	// large catch ups are compressed, small heartbeats are left alone
+	if threshold := rm.broker.options.AECompressionThreshold; threshold > 0 {
+		if err := args.compress(threshold); err != nil {
+			rm.broker.logger.Warn("could not compress AE entries", "peer", peerId, "err", err)
+		}
+	}
+
+	rm.broker.logger.Debug("sending AE", "peer", peerId, "args", args)
+	sentAt := time.Now()
 
-				// if broker is leader and it's term is up to date
-				if rm.broker.state == Leader && currentTerm == reply.Term {
-					if reply.Success {
-						log.Printf("%d replies successful append", reply.Id)
-						rm.broker.em.nextIndex[peerId] = nextIndex + len(entries)
-						rm.broker.em.matchIndex[peerId] = rm.broker.em.nextIndex[peerId] - 1
-
-						// get replies from followers to decide whether or not to send commit
-						savedCommitIndex := rm.commitIndex
-						for i := rm.commitIndex + 1; i < len(rm.log); i++ {
-							if rm.log[i].Term == rm.broker.em.term {
-								matches := 1
-								for _, peerId := range rm.peerIds {
-									if rm.broker.em.matchIndex[peerId] >= i {
-										log.Printf("%d is ready to commit", peerId)
-										matches++
-									}
-								}
-								// currently set to atomic. real raft does majority
-								// if matches*2 > len(rm.peerIds)+1
-								if matches == len(rm.peerIds) {
-									log.Printf("all followers ready to commit, %s %d updates commitIndex to %d", rm.broker.state, rm.id, i)
-
-									rm.commitIndex = i
-								}
-							}
+	// a hung peer only costs its own goroutine a few heartbeats
+	callCtx, cancel := context.WithTimeout(ctx, rm.broker.rpcTimeout())
+	defer cancel()
 
+	var reply AppendEntriesReply
+	err := rm.broker.Call(callCtx, peerId, "ReplicationModule.AppendEntries", args, &reply)
+	if err == nil {
+		rm.handleAEReply(ctx, currentTerm, peerId, nextIndex, len(entries), rollbacks, sentAt, reply)
+		return
+	}
+	// the peer counts as unreachable until the next round retries from the same nextIndex
+	// a cancelled ctx just means this leadership ended, that's not the peer's fault
+	if errors.Is(err, context.DeadlineExceeded) && stillLeading(ctx) {
+		rm.broker.logger.Warn("AE timed out, peer unreachable this round", "peer", peerId, "timeout", rm.broker.rpcTimeout())
+	}
+}
+
+// update the indexes of peerId from its reply to an AE of nextIndex and the sent entries after it
+// rollbacks is rm.rollbacks when the AE was sent
+func (rm *ReplicationModule) handleAEReply(ctx context.Context, currentTerm int, peerId int, nextIndex int, sent int, rollbacks int, sentAt time.Time, reply AppendEntriesReply) {
+	rm.broker.logger.Debug("receives AE reply", "peer", reply.Id)
+	rm.broker.mu2.Lock()
+
+	// if it detects through heartbeat that own term is out of date, become follower
+	if reply.Term > rm.broker.em.term {
+		rm.broker.logger.Info("term is outdated", "term", rm.broker.em.term, "peer_term", reply.Term)
+		rm.broker.em.becomeFollower(reply.Term)
+		rm.broker.mu2.Unlock()
+		return
+	}
+
+	// the leadership that sent the AE has ended, even if this broker leads again by now
+	// ctx is cancelled while holding mu2 so this can't change until the unlock
+	if !stillLeading(ctx) {
+		rm.broker.logger.Debug("drops AE reply sent in an earlier leadership", "peer", peerId)
+		rm.broker.mu2.Unlock()
+		return
+	}
+
+	// if broker is leader and it's term is up to date
+	if rm.broker.state == Leader && currentTerm == reply.Term {
+		// any reply in our term, even a failed append, still acknowledges us as leader
+		rm.recordHeartbeatAck(peerId, sentAt)
+
+		// the entries it acknowledges may be gone, see Rollback
+		if reply.Success && rollbacks != rm.rollbacks {
+			rm.broker.logger.Debug("drops AE reply sent before a rollback", "peer", peerId)
+			rm.broker.mu2.Unlock()
+			return
+		}
+
+		if reply.Success {
+			rm.broker.logger.Debug("peer replies successful append", "peer", reply.Id)
+			rm.nextIndex[peerId] = nextIndex + sent
+			rm.matchIndex[peerId] = rm.nextIndex[peerId] - 1
+
+			// get replies from followers to decide whether or not to send commit
+			savedCommitIndex := rm.commitIndex
+			for i := rm.commitIndex + 1; i <= rm.lastLogIndex(); i++ {
+				if rm.entry(i).Term == rm.broker.em.term {
+					// currently set to atomic. real raft does majority
+					// rm.membership.hasQuorum(...)
+					allMatch := rm.membership.allAgree(func(peerId int) bool {
+						if peerId == rm.id {
+							return true
 						}
-						// notify followers of commit
-						if rm.commitIndex != savedCommitIndex {
-							rm.broker.mu2.Unlock()
-							rm.newCommitReadyChan <- struct{}{}
-							rm.triggerAEChan <- struct{}{}
-						} else {
-							rm.broker.mu2.Unlock()
+						if rm.matchIndex[peerId] >= i {
+							return true
 						}
+						return false
+					})
+					if allMatch {
+						rm.broker.logger.Debug("all followers ready to commit, updates commitIndex", "commit_index", i)
 
-					} else { // if reply.success = false
-						if reply.ConflictTerm >= 0 {
-							lastIndexOfTerm := -1
-							for i := len(rm.log) - 1; i >= 0; i-- {
-								if rm.log[i].Term == reply.ConflictTerm {
-									lastIndexOfTerm = i
-									break
-								}
-							}
-
-							if lastIndexOfTerm >= 0 {
-								rm.broker.em.nextIndex[peerId] = lastIndexOfTerm + 1
-							} else {
-								rm.broker.em.nextIndex[peerId] = reply.ConflictIndex
-							}
-						} else {
-							rm.broker.em.nextIndex[peerId] = reply.ConflictIndex
-						}
+						rm.setCommitIndex(i)
+					}
+				}
 
-						rm.broker.mu2.Unlock()
+			}
+			// notify followers of commit
+			if rm.commitIndex != savedCommitIndex {
+				rm.traceCommits(savedCommitIndex+1, rm.commitIndex)
+				rm.persistToStorage()
+				rm.broker.mu2.Unlock()
+				rm.newCommitReadyChan <- struct{}{}
+				rm.triggerAEChan <- struct{}{}
+			} else {
+				rm.broker.mu2.Unlock()
+			}
+
+		} else { // if reply.success = false
+			if reply.ConflictTerm >= 0 {
+				lastIndexOfTerm := -1
+				for i := rm.lastLogIndex(); i >= rm.logBaseIndex; i-- {
+					if rm.entry(i).Term == reply.ConflictTerm {
+						lastIndexOfTerm = i
+						break
 					}
+				}
 
+				if lastIndexOfTerm >= 0 {
+					rm.nextIndex[peerId] = lastIndexOfTerm + 1
 				} else {
-					rm.broker.mu2.Unlock()
+					rm.nextIndex[peerId] = reply.ConflictIndex
 				}
-
+			} else {
+				rm.nextIndex[peerId] = reply.ConflictIndex
 			}
 
-		}(peerId)
+			rm.broker.mu2.Unlock()
+		}
+
+	} else {
+		rm.broker.mu2.Unlock()
 	}
+}
 
+// move the commit index and wake up WaitForCommit. caller must hold mu2
+func (rm *ReplicationModule) setCommitIndex(index int) {
+	rm.commitIndex = index
+	rm.broker.commitCond.Broadcast()
 }
 
 func (rm *ReplicationModule) commitChanSender() {
+	// Shutdown waits for this so commitChan can be closed once it returns
+	defer rm.broker.wg.Done()
+	defer close(rm.senderDone)
 
 	for range rm.newCommitReadyChan {
-		log.Printf("enter commitChanSender()")
 		rm.broker.mu2.Lock()
-		savedTerm := rm.broker.em.term
-		savedLastApplied := rm.lastApplied
-
 		var entries []LogEntry
-		//log.Printf("in commitChanSender lastApplied: %d   commitIndex: %d", rm.lastApplied, rm.commitIndex)
-
-		// handle base case for first commit
-		if rm.commitIndex == 0 {
-			entries = rm.log[rm.lastApplied : rm.commitIndex+1]
-			rm.lastApplied = rm.commitIndex
-		} else if rm.commitIndex > rm.lastApplied { // standard case for subsequent commits
-			entries = rm.log[rm.lastApplied+1 : rm.commitIndex+1]
-			rm.lastApplied = rm.commitIndex
+		// log index of entries[0], every entry is sent with its own position
+		// in the log so indices carry on from lastApplied whatever happened
+		// to the log in between
+		firstIndex := rm.lastApplied + 1
+		if rm.commitIndex >= firstIndex {
+			entries = rm.logSlice(firstIndex, rm.commitIndex+1)
 		}
 		rm.broker.mu2.Unlock()
-		log.Printf("%s %d commitChanSender entries=%v, savedLastApplied=%d", rm.broker.state, rm.id, entries, savedLastApplied)
+		rm.broker.logger.Debug("sending committed entries", "entries", len(entries), "first_index", firstIndex)
 
 		for i, entry := range entries {
-			// add committed entry to committedLog
-			rm.committedLog = append(rm.committedLog, entry)
+			index := firstIndex + i
 
-			rm.commitChan <- CommitEntry{
-				CRDTOperation: entry.CRDTOperation,
-				Index:         savedLastApplied + i + 1,
-				Term:          savedTerm,
+			// keep the materialized document state up to date
+			rm.documents.apply(index, entry)
+
+			commit := CommitEntry{
+				CRDTOperation: entry.operation(),
+				Index:         index,
+				Term:          entry.Term,
+				Shard:         rm.shard,
+			}
+			// nobody may be reading commitChan anymore once the broker is shut down
+			select {
+			case rm.commitChan <- commit:
+			case <-rm.broker.quit:
+				return
 			}
-			log.Printf("%s %d committed %+v to committedLog", rm.broker.state, rm.id, entry)
+
+			// only counted as applied once it was sent, so a restart picks up
+			// right after the last entry the application saw. max since an
+			// installed snapshot can move lastApplied past it meanwhile
+			rm.broker.mu2.Lock()
+			rm.lastApplied = max(rm.lastApplied, index)
+			rm.broker.notifySubscribersLocked(commit)
+			rm.broker.mu2.Unlock()
+			rm.broker.logger.Debug("committed entry", "entry", entry)
+		}
+
+		rm.broker.mu2.Lock()
+		rm.persistToStorage()
+		rm.broker.mu2.Unlock()
+
+		if len(entries) > 0 {
+			// wakes up commit streams and pushes to application servers
+			rm.broker.streams.notify()
+			rm.documents.maybeCompact(rm.safeIndex())
+			rm.maybeTrimLog()
+		}
+	}
+}
+
+// highest log index every member is known to have
+// the leader uses matchIndex and needs every peer connected, followers rely on
+// commits being atomic so everything up to commitIndex is on every member
+func (rm *ReplicationModule) safeIndex() int {
+	rm.broker.mu2.Lock()
+	safe := rm.commitIndex
+	peers := rm.membership.peers(rm.id)
+	if rm.broker.state == Leader {
+		for _, peerId := range peers {
+			safe = min(safe, rm.matchIndex[peerId])
+		}
+	}
+	rm.broker.mu2.Unlock()
+
+	connected := rm.broker.connectedPeers()
+	for _, peerId := range peers {
+		if !connected[peerId] {
+			return -1
 		}
 	}
+	return safe
+}
+
+// how many entries each peer is missing from the leader's log
+// nil on followers, which don't track their peers
+func (rm *ReplicationModule) ReplicationLag() map[int]int {
+	rm.broker.mu2.Lock()
+	defer rm.broker.mu2.Unlock()
+	return rm.replicationLag()
+}
+
+// caller must hold mu2
+func (rm *ReplicationModule) replicationLag() map[int]int {
+	if rm.broker.state != Leader {
+		return nil
+	}
+	lag := make(map[int]int)
+	for _, peerId := range rm.membership.peers(rm.id) {
+		lag[peerId] = rm.lastLogIndex() - rm.matchIndex[peerId]
+	}
+	return lag
 }
 
 // rpc request from leader to follower
 // handles both heartbeat and actual log entries
 type AppendEntriesArgs struct {
+	// replication group of the entries, see shard.go
+	Shard int
+
 	Term     int
 	LeaderId int
 
@@ -243,7 +678,15 @@ type AppendEntriesArgs struct {
 
 	Entries []LogEntry
 
+	// set when Entries was gzip compressed into CompressedEntries by the leader
+	Compressed        bool
+	CompressedEntries []byte
+
 	LeaderCommit int
+
+	// trace context of the leader's span, see tracing.go
+	TraceParent string
+	TraceState  string
 }
 
 // rpc reply from follower to leader
@@ -258,10 +701,31 @@ type AppendEntriesReply struct {
 
 // this func is primarily for followers to accept replication from leader
 func (rm *ReplicationModule) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
-	log.Printf("%s %d received AE from %d: %+v", rm.broker.state, rm.id, args.LeaderId, args)
+	if args.Compressed {
+		if err := args.decompress(); err != nil {
+			return err
+		}
+	}
+
+	if hook := rm.broker.beforeAppendEntries.Load(); hook != nil {
+		(*hook)(&args)
+	}
+
+	_, span := rm.broker.tracer.Start(extractTrace(args.TraceParent, args.TraceState), "ReplicationModule.AppendEntries",
+		trace.WithAttributes(attribute.Int("leader", args.LeaderId), attribute.Int("entries", len(args.Entries))))
+	defer span.End()
+
+	rm.broker.logger.Debug("received AE", "leader", args.LeaderId, "args", args)
 	rm.broker.mu2.Lock()
 	defer rm.broker.mu2.Unlock()
 
+	if rm.broker.state == Dead {
+		return nil
+	}
+	if rm.broker.paused {
+		return ErrBrokerPaused
+	}
+
 	// if log entry to append has higher term. become follower
 	if args.Term > rm.broker.em.term {
 		rm.broker.em.becomeFollower(args.Term)
@@ -271,15 +735,37 @@ func (rm *ReplicationModule) AppendEntries(args AppendEntriesArgs, reply *Append
 
 	if args.Term == rm.broker.em.term {
 		if rm.broker.state != Follower {
-			rm.broker.em.becomeFollower(args.Term)
+			rm.broker.em.stepDownFor(args.LeaderId, args.Term)
 		}
-		log.Printf("%s %d detects heartbeat or command from leaderid %d", rm.broker.state, rm.id, args.LeaderId)
 
+		// a leader is making progress, back to the normal election timeout
+		rm.broker.em.failedElections.Store(0)
 		rm.broker.em.resetElectionTimer()
 
+		// remembered so http requests sent to this follower can be redirected
+		rm.broker.em.setLeader(args.LeaderId)
+
+		// entries this broker already trimmed are committed, so they match the leader's
+		if skip := rm.logBaseIndex - 1 - args.PrevLogIndex; skip > 0 {
+			args.Entries = args.Entries[min(skip, len(args.Entries)):]
+			args.PrevLogIndex, args.PrevLogTerm = rm.logBaseIndex-1, rm.logBaseTerm
+		}
+
+		// a corrupted entry is rejected like a conflict at the first entry sent,
+		// so the leader sends the same entries again
+		for i, entry := range args.Entries {
+			if !entry.intact() {
+				rm.broker.logger.Warn("rejects AE with a corrupted entry", "index", args.PrevLogIndex+1+i)
+				reply.ConflictIndex = args.PrevLogIndex + 1
+				reply.ConflictTerm = -1
+				reply.Term = rm.broker.em.term
+				reply.Id = rm.id
+				return nil
+			}
+		}
+
 		// check if follower log contains previous entry (correct term and index)
-		if args.PrevLogIndex == -1 || (args.PrevLogIndex < len(rm.log) && args.PrevLogTerm == rm.log[args.PrevLogIndex].Term) {
-			log.Printf("%s %d contains previous entry, Accepts AE", rm.broker.state, rm.id)
+		if args.PrevLogIndex == -1 || (args.PrevLogIndex <= rm.lastLogIndex() && args.PrevLogTerm == rm.termAt(args.PrevLogIndex)) {
 
 			reply.Success = true
 
@@ -290,11 +776,18 @@ func (rm *ReplicationModule) AppendEntries(args AppendEntriesArgs, reply *Append
 			for {
 				// end of follower log reached meaning log is either shorter and must be appended upon
 				// or follower log is up to date
-				if logInsertIndex >= len(rm.log) || newEntriesIndex >= len(args.Entries) {
+				if logInsertIndex > rm.lastLogIndex() || newEntriesIndex >= len(args.Entries) {
 					break
 				}
 				// mismatch found, start appending from this index
-				if rm.log[logInsertIndex].Term != args.Entries[newEntriesIndex].Term {
+				have, leaders := rm.entry(logInsertIndex), args.Entries[newEntriesIndex]
+				// an AE sent before a rollback this broker already got, the
+				// rest of its entries were dropped
+				if rolledBackOver(leaders, have) {
+					args.Entries = args.Entries[:newEntriesIndex]
+					break
+				}
+				if have.Term != leaders.Term || rolledBackOver(have, leaders) {
 					break
 				}
 				logInsertIndex++
@@ -303,32 +796,36 @@ func (rm *ReplicationModule) AppendEntries(args AppendEntriesArgs, reply *Append
 
 			// append missing entries to follower log
 			if newEntriesIndex < len(args.Entries) {
-				rm.log = append(rm.log[:logInsertIndex], args.Entries[newEntriesIndex:]...)
-				log.Printf("%+v appended from index %d for term %d", args.Entries, newEntriesIndex, rm.log[newEntriesIndex].Term)
+				rm.log = append(rm.logSlice(rm.logBaseIndex, logInsertIndex), args.Entries[newEntriesIndex:]...)
+				rm.invalidateStoredLog(logInsertIndex)
+				rm.broker.logger.Debug("appended entries", "from", logInsertIndex, "entries", len(args.Entries)-newEntriesIndex)
+
+				// the appended or truncated entries may have changed the configuration
+				rm.refreshMembership()
+				rm.persistToStorage()
 			}
-			log.Printf("args.LeaderCommit > rm.commitIndex is %t", args.LeaderCommit > rm.commitIndex)
-			log.Printf("args.LeaderCommit: %d    rm.commitIndex: %d", args.LeaderCommit, rm.commitIndex)
 
 			if args.LeaderCommit > rm.commitIndex {
 				// follower updates own commitindex here
-				rm.commitIndex = min(args.LeaderCommit, len(rm.log)-1)
-				log.Printf("%s %d updates commitIndex to %d", rm.broker.state, rm.id, rm.commitIndex)
+				rm.setCommitIndex(min(args.LeaderCommit, rm.lastLogIndex()))
+				rm.broker.logger.Debug("updates commitIndex", "commit_index", rm.commitIndex)
+				rm.persistToStorage()
 
 				rm.newCommitReadyChan <- struct{}{}
 			}
 
 		} else {
-			log.Printf("%s %d detects previous log mismatch, reject AE", rm.broker.state, rm.id)
+			rm.broker.logger.Debug("detects previous log mismatch, rejects AE", "prev_log_index", args.PrevLogIndex)
 
-			if args.PrevLogIndex >= len(rm.log) {
-				reply.ConflictIndex = len(rm.log)
+			if args.PrevLogIndex > rm.lastLogIndex() {
+				reply.ConflictIndex = rm.lastLogIndex() + 1
 				reply.ConflictTerm = -1
 			} else {
-				reply.ConflictTerm = rm.log[args.PrevLogIndex].Term
+				reply.ConflictTerm = rm.termAt(args.PrevLogIndex)
 
 				var i int
-				for i = args.PrevLogIndex - 1; i >= 0; i-- {
-					if rm.log[i].Term != reply.ConflictTerm {
+				for i = args.PrevLogIndex - 1; i >= rm.logBaseIndex; i-- {
+					if rm.entry(i).Term != reply.ConflictTerm {
 						break
 					}
 				}
@@ -347,18 +844,84 @@ func (rm *ReplicationModule) AppendEntries(args AppendEntriesArgs, reply *Append
 //THESE FUNCS ARE FOR TESTING AND DEPLOYMENT
 ////////////////////////////////////////////////////////////////////
 
+// returns copies of nextIndex and matchIndex so callers can't race with replication
+func (rm *ReplicationModule) PeerIndexes() (map[int]int, map[int]int) {
+	rm.broker.mu2.Lock()
+	defer rm.broker.mu2.Unlock()
+
+	nextIndex := make(map[int]int, len(rm.nextIndex))
+	matchIndex := make(map[int]int, len(rm.matchIndex))
+	for peerId, idx := range rm.nextIndex {
+		nextIndex[peerId] = idx
+	}
+	for peerId, idx := range rm.matchIndex {
+		matchIndex[peerId] = idx
+	}
+	return nextIndex, matchIndex
+}
+
 func (rm *ReplicationModule) Submit(document string, command any) int {
+	index, _, err := rm.submit(context.Background(), document, command)
+	if err != nil {
+		rm.broker.logger.Error("refuses to submit entry", "err", err)
+		return -1
+	}
+	return index
+}
+
+// like Submit but also returns the term the entry was appended in, and
+// ErrUnencodableEntry for a command that can't be sent to the followers
+// the entry is traced in the span of ctx, if it has one
+func (rm *ReplicationModule) submit(ctx context.Context, document string, command any) (index int, term int, err error) {
+	return rm.submitBatchContext(ctx, []LogEntry{{CRDTOperation: command, Document: document}})
+}
+
+// append entries to the log in order, all in the same term, and return the
+// index of the first one. -1 if this broker isn't the leader or one of the
+// entries can't be encoded, then none is appended
+func (rm *ReplicationModule) submitBatch(entries []LogEntry) (firstIndex int, term int) {
+	firstIndex, term, err := rm.submitBatchContext(context.Background(), entries)
+	if err != nil {
+		return -1, -1
+	}
+	return firstIndex, term
+}
+
+// like submitBatch, the entries are traced in the span of ctx if it has one
+// an entry without a protobuf encoding gets ErrUnencodableEntry
+func (rm *ReplicationModule) submitBatchContext(ctx context.Context, entries []LogEntry) (firstIndex int, term int, err error) {
 	rm.broker.mu2.Lock()
 
-	if rm.broker.state == Leader {
-		submitIndex := len(rm.log)
-		rm.log = append(rm.log, LogEntry{CRDTOperation: command, Term: rm.broker.em.term, Document: document})
+	if rm.broker.state == Leader && !rm.broker.draining {
+		submitIndex := rm.lastLogIndex() + 1
+		submitTerm := rm.broker.em.term
+		threshold := rm.broker.options.CompressionThreshold
+		appending := make([]LogEntry, 0, len(entries))
+		for _, entry := range entries {
+			if threshold > 0 {
+				operation, err := compressOperation(entry.CRDTOperation, threshold)
+				if err != nil {
+					rm.broker.logger.Warn("could not compress log entry", "err", err)
+				} else {
+					entry.CRDTOperation = operation
+				}
+			}
+			entry.Term = submitTerm
+			if entry.Checksum, err = entry.checksum(); err != nil {
+				rm.broker.mu2.Unlock()
+				return -1, -1, err
+			}
+			appending = append(appending, entry)
+		}
+		rm.log = append(rm.log, appending...)
+		rm.traceEntries(ctx, submitIndex, len(entries))
+		rm.persistToStorage()
 
 		rm.broker.mu2.Unlock()
 		rm.triggerAEChan <- struct{}{}
-		return submitIndex
+		return submitIndex, submitTerm, nil
 	}
 
 	rm.broker.mu2.Unlock()
-	return -1
+	return -1, -1, nil
 }
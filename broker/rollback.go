@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrAlreadyCommitted = errors.New("entry is already committed")
+
+// entry the leader appends right after rolling its log back to Index. the
+// entries it drops can have the same terms as the ones followers hold, which
+// AppendEntries takes as a match, so followers truncate at the notice instead
+type RollbackNotice struct {
+	Index int
+}
+
+func init() {
+	gob.Register(RollbackNotice{})
+}
+
+func isRollbackNotice(entry LogEntry) bool {
+	_, ok := entry.CRDTOperation.(RollbackNotice)
+	return ok
+}
+
+// true when the follower's entry and the leader's at the same index can't be
+// the same entry even though their terms match
+func rolledBackOver(have LogEntry, leaders LogEntry) bool {
+	return isRollbackNotice(leaders) && have.CRDTOperation != leaders.CRDTOperation
+}
+
+// drop every entry after index from the leader's log, for tests and for
+// recovering from a bad batch of writes without stopping the cluster. the
+// entries are replaced with a RollbackNotice that makes followers drop them too
+// ErrAlreadyCommitted when index is before commitIndex, committed entries stay
+func (rm *ReplicationModule) Rollback(index int) error {
+	rm.broker.mu2.Lock()
+
+	if rm.broker.state != Leader {
+		rm.broker.mu2.Unlock()
+		return ErrNotLeader
+	}
+	if index < rm.commitIndex {
+		rm.broker.mu2.Unlock()
+		return fmt.Errorf("%w: %d is before commit index %d", ErrAlreadyCommitted, index, rm.commitIndex)
+	}
+	if index >= rm.lastLogIndex() {
+		rm.broker.mu2.Unlock()
+		return nil
+	}
+
+	rm.broker.logger.Warn("rolls back log", "to", index, "dropped", rm.lastLogIndex()-index)
+
+	// a copy, AppendEntries in flight still hold the dropped entries
+	rm.log = slices.Clone(rm.logSlice(rm.logBaseIndex, index+1))
+	rm.invalidateStoredLog(index + 1)
+	rm.dropEntryTraces(index + 1)
+	notice := LogEntry{CRDTOperation: RollbackNotice{Index: index}, Term: rm.broker.em.term}
+	// a RollbackNotice always has an encoding
+	notice.Checksum, _ = notice.checksum()
+	rm.log = append(rm.log, notice)
+	rm.rollbacks++
+
+	// a dropped entry may have changed the configuration
+	rm.refreshMembership()
+	rm.persistToStorage()
+
+	for _, peerId := range rm.membership.peers(rm.id) {
+		rm.nextIndex[peerId] = index + 1
+		rm.matchIndex[peerId] = min(rm.matchIndex[peerId], index)
+	}
+
+	rm.broker.mu2.Unlock()
+	rm.triggerAEChan <- struct{}{}
+	return nil
+}
@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRollbackDropsUncommittedEntries(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % 3
+	ids := []int{0, 1, 2}
+
+	submit := func(leaderId int, value string, n int) int {
+		batch := make([]LogEntry, n)
+		for i := range batch {
+			batch[i] = LogEntry{CRDTOperation: insertOp(value), Document: "doc1"}
+		}
+		first, _ := h.cluster[leaderId].rm.submitBatch(batch)
+		if first < 0 {
+			t.Fatalf("leader %d refused the batch", leaderId)
+		}
+		return first
+	}
+
+	submit(leaderId, "a", 10)
+	waitForApplied(t, h, ids, 9)
+
+	// commits need every broker, so with one of them gone the next ten are
+	// only replicated to the other follower
+	h.DisconnectPeer(followerId)
+	submit(leaderId, "b", 6)
+	submit(leaderId, "dropped", 4)
+	sleepMs(100)
+
+	leader := h.cluster[leaderId].rm
+	if err := leader.Rollback(5); !errors.Is(err, ErrAlreadyCommitted) {
+		t.Errorf("Rollback(5) after 10 commits returned %v, want %v", err, ErrAlreadyCommitted)
+	}
+	if err := h.cluster[(leaderId+2)%3].rm.Rollback(15); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("Rollback on a follower returned %v, want %v", err, ErrNotLeader)
+	}
+	if err := leader.Rollback(15); err != nil {
+		t.Fatalf("Rollback(15): %v", err)
+	}
+
+	h.ReconnectPeer(followerId)
+	leaderId, _ = h.CheckSingleLeader()
+	last := submit(leaderId, "c", 3) + 2
+	waitForApplied(t, h, ids, last)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id := range 3 {
+		for _, commit := range h.commits[id] {
+			if commit.CRDTOperation == insertOp("dropped") {
+				t.Errorf("broker %d committed a rolled back entry at %d", id, commit.Index)
+			}
+			if commit.Index == 16 {
+				if _, ok := commit.CRDTOperation.(RollbackNotice); !ok {
+					t.Errorf("broker %d committed %v at 16, want the rollback notice", id, commit.CRDTOperation)
+				}
+			}
+		}
+	}
+}
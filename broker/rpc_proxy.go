@@ -0,0 +1,174 @@
+package broker
+
+import (
+	"errors"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+// faults an RPCProxy injects into the rpcs a broker answers. rates are the
+// chance from 0 to 1 that a call gets the fault. the draws come from a rand
+// seeded with Seed, so a failing test can be run again with the same faults
+type RPCFaults struct {
+	Seed int64
+
+	// service methods the faults apply to, like ReplicationModule.AppendEntries
+	// empty means every rpc
+	Methods []string
+
+	// the call is never answered, the caller gives up after its rpc timeout
+	DropRate float64
+
+	// the call fails right away with ErrInjectedFault
+	ErrorRate float64
+
+	// the call is answered Delay late
+	DelayRate float64
+	Delay     time.Duration
+
+	// the call is handled twice, the caller gets the second reply
+	DuplicateRate float64
+}
+
+// returned for calls an RPCProxy failed on purpose
+var ErrInjectedFault = errors.New("injected rpc fault")
+
+// how many calls an RPCProxy tampered with
+type RPCFaultStats struct {
+	Dropped    int
+	Errored    int
+	Delayed    int
+	Duplicated int
+}
+
+// sits between the rpc server and the election and replication modules and
+// injects the faults it is set to, for tests. enabled with
+// BrokerOptions.RPCFaults, see BrokerServer.RPCProxy
+type RPCProxy struct {
+	em   ElectionService
+	rm   ReplicationService
+	quit <-chan any
+
+	mu     sync.Mutex
+	faults RPCFaults
+	rand   *rand.Rand
+	stats  RPCFaultStats
+}
+
+func newRPCProxy(em ElectionService, rm ReplicationService, quit <-chan any, faults RPCFaults) *RPCProxy {
+	p := &RPCProxy{em: em, rm: rm, quit: quit}
+	p.SetFaults(faults)
+	return p
+}
+
+// replace the faults injected from now on and reseed the draws.
+// calls already held back stay dropped or delayed
+func (p *RPCProxy) SetFaults(faults RPCFaults) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults = faults
+	p.rand = rand.New(rand.NewSource(faults.Seed))
+}
+
+func (p *RPCProxy) Stats() RPCFaultStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// the faults for one call to serviceMethod
+type rpcFault struct {
+	drop, fail, duplicate bool
+	delay                 time.Duration
+}
+
+func (p *RPCProxy) draw(serviceMethod string) rpcFault {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.faults.Methods) > 0 && !slices.Contains(p.faults.Methods, serviceMethod) {
+		return rpcFault{}
+	}
+	// always four draws, so the faults of a call don't depend on the rates of the ones before
+	var fault rpcFault
+	fault.drop = p.rand.Float64() < p.faults.DropRate
+	fault.fail = p.rand.Float64() < p.faults.ErrorRate
+	if p.rand.Float64() < p.faults.DelayRate {
+		fault.delay = p.faults.Delay
+	}
+	fault.duplicate = p.rand.Float64() < p.faults.DuplicateRate
+
+	switch {
+	case fault.drop:
+		p.stats.Dropped++
+	case fault.fail:
+		p.stats.Errored++
+	default:
+		if fault.delay > 0 {
+			p.stats.Delayed++
+		}
+		if fault.duplicate {
+			p.stats.Duplicated++
+		}
+	}
+	return fault
+}
+
+// handle one call with the faults drawn for it
+func proxyCall[Args any, Reply any](p *RPCProxy, serviceMethod string, handle func(Args, *Reply) error, args Args, reply *Reply) error {
+	fault := p.draw(serviceMethod)
+	switch {
+	case fault.drop:
+		// hold the call until shutdown, the caller's timeout ends it on its side
+		<-p.quit
+		return ErrInjectedFault
+	case fault.fail:
+		return ErrInjectedFault
+	}
+	if fault.delay > 0 {
+		select {
+		case <-time.After(fault.delay):
+		case <-p.quit:
+			return ErrInjectedFault
+		}
+	}
+	if fault.duplicate {
+		// the reply to the first delivery is lost on the way back
+		var lost Reply
+		handle(args, &lost)
+	}
+	return handle(args, reply)
+}
+
+// registered as ElectionModule and ReplicationModule instead of the modules
+type rpcProxyElection struct {
+	p *RPCProxy
+}
+
+func (s rpcProxyElection) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error {
+	return proxyCall(s.p, "ElectionModule.RequestVote", s.p.em.RequestVote, args, reply)
+}
+
+func (s rpcProxyElection) WhoIsLeader(args WhoIsLeaderArgs, reply *WhoIsLeaderReply) error {
+	return proxyCall(s.p, "ElectionModule.WhoIsLeader", s.p.em.WhoIsLeader, args, reply)
+}
+
+type rpcProxyReplication struct {
+	p *RPCProxy
+}
+
+func (s rpcProxyReplication) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return proxyCall(s.p, "ReplicationModule.AppendEntries", s.p.rm.AppendEntries, args, reply)
+}
+
+func (s rpcProxyReplication) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return proxyCall(s.p, "ReplicationModule.InstallSnapshot", s.p.rm.InstallSnapshot, args, reply)
+}
+
+// the proxy the rpc server answers with, nil unless BrokerOptions.RPCFaults is set
+func (broker *BrokerServer) RPCProxy() *RPCProxy {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return broker.rpcProxy
+}
@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRPCFaultsAreSeeded(t *testing.T) {
+	faults := RPCFaults{Seed: 7, DropRate: 0.2, ErrorRate: 0.2, DelayRate: 0.3, Delay: time.Millisecond, DuplicateRate: 0.3}
+	draws := func() []rpcFault {
+		p := newRPCProxy(nil, nil, nil, faults)
+		var drawn []rpcFault
+		for range 50 {
+			drawn = append(drawn, p.draw("ReplicationModule.AppendEntries"))
+		}
+		return drawn
+	}
+	if first, second := draws(), draws(); !reflect.DeepEqual(first, second) {
+		t.Errorf("the same seed drew %v and %v", first, second)
+	}
+
+	faults.Methods = []string{"ElectionModule.RequestVote"}
+	p := newRPCProxy(nil, nil, nil, faults)
+	for range 50 {
+		if fault := p.draw("ReplicationModule.AppendEntries"); fault != (rpcFault{}) {
+			t.Fatalf("AppendEntries got %+v with faults only for RequestVote", fault)
+		}
+	}
+}
+
+func TestDroppedAppendEntriesForceBacktracking(t *testing.T) {
+	// broker 2 answers through a proxy and is slow to campaign, so it stays
+	// a follower while it doesn't hear from the leader
+	const followerId = 2
+	options := make([]BrokerOptions, 3)
+	options[followerId].RPCFaults = &RPCFaults{}
+	options[followerId].MinElectionTimeout = 3 * time.Second
+	options[followerId].MaxElectionTimeout = 4 * time.Second
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	ids := []int{0, 1, 2}
+
+	submit := func(leaderId int, value string, n int) int {
+		batch := make([]LogEntry, n)
+		for i := range batch {
+			batch[i] = LogEntry{CRDTOperation: insertOp(value), Document: "doc1"}
+		}
+		first, _ := h.cluster[leaderId].rm.submitBatch(batch)
+		if first < 0 {
+			t.Fatalf("leader %d refused the batch", leaderId)
+		}
+		return first + n - 1
+	}
+
+	leaderId, _ := h.CheckSingleLeader()
+	if leaderId == followerId {
+		t.Fatalf("broker %d with the long election timeout leads", followerId)
+	}
+	otherId := 3 - leaderId - followerId
+	waitForApplied(t, h, ids, submit(leaderId, "a", 3))
+
+	// the follower misses the next entries, only the other broker gets them
+	proxy := h.cluster[followerId].RPCProxy()
+	proxy.SetFaults(RPCFaults{Seed: 1, Methods: []string{"ReplicationModule.AppendEntries"}, DropRate: 1})
+	last := submit(leaderId, "b", 5)
+	for deadline := time.Now().Add(time.Second); ; sleepMs(10) {
+		if length, _ := logLength(h.cluster[otherId]); length > last {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broker %d never got the entries up to %d", otherId, last)
+		}
+	}
+
+	// the other broker takes over and starts out sending the follower
+	// entries after ones it doesn't have
+	if _, err := h.cluster[leaderId].em.StepDown(); err != nil {
+		t.Fatal(err)
+	}
+	if newLeaderId, _ := h.CheckSingleLeader(); newLeaderId != otherId {
+		t.Fatalf("broker %d took over, want %d", newLeaderId, otherId)
+	}
+	newLeader := h.cluster[otherId]
+	newLeader.mu2.Lock()
+	nextIndex := newLeader.rm.nextIndex[followerId]
+	newLeader.mu2.Unlock()
+	if have, _ := logLength(h.cluster[followerId]); nextIndex <= have {
+		t.Fatalf("new leader's next index for the follower is %d, its log is only %d long", nextIndex, have)
+	}
+	if proxy.Stats().Dropped == 0 {
+		t.Error("no AppendEntries were dropped")
+	}
+
+	// the follower's conflict index brings the new leader back to where its log ends
+	proxy.SetFaults(RPCFaults{})
+	waitForApplied(t, h, ids, submit(otherId, "c", 2))
+	h.CompareCommittedLogs()
+}
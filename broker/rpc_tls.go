@@ -0,0 +1,135 @@
+package broker
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+)
+
+// pem files for tls. for rpcs every broker presents its certificate and only
+// accepts peers whose certificate is signed by the CA. for http the CA is only
+// used by brokers to check each other's certificates
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	// name peer certificates are checked against. empty means the host
+	// being dialed, which has to be in the certificate's SANs
+	ServerName string
+}
+
+var ErrInvalidTLSConfig = errors.New("invalid tls config")
+
+// server and client side configs. the client checks the server certificate
+// is signed by the CA, and with mutual set the server checks the client's
+func (files *TLSFiles) load(mutual bool) (server *tls.Config, client *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidTLSConfig, err)
+	}
+	caPEM, err := os.ReadFile(files.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidTLSConfig, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("%w: no certificates in %s", ErrInvalidTLSConfig, files.CAFile)
+	}
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if mutual {
+		server.ClientCAs = pool
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   files.ServerName,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return server, client, nil
+}
+
+// dial the rpc listener of a peer, see GetListenAddr
+func (broker *BrokerServer) dialRPC(addr string) (TransportClient, error) {
+	return broker.transport().NewClient(func() (net.Conn, error) {
+		if broker.rpcClientTLS == nil {
+			return net.Dial("tcp", addr)
+		}
+		return tls.Dial("tcp", addr, broker.rpcClientTLS)
+	})
+}
+
+// with server name defaulting to the host of addr
+func clientTLSFor(config *tls.Config, addr string) (*tls.Config, error) {
+	if config.ServerName != "" {
+		return config, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config, nil
+}
+
+// dial the rpc server of a peer through the CONNECT endpoint on its http address
+func (broker *BrokerServer) dialRPCOverHTTP(addr string) (TransportClient, error) {
+	return broker.transport().NewClient(func() (net.Conn, error) {
+		return broker.connectRPCOverHTTP(addr)
+	})
+}
+
+// a connection to the rpc server of a peer tunneled through its http address
+// with rpc tls the handshake happens inside the tunnel, see handleRPC
+func (broker *BrokerServer) connectRPCOverHTTP(addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if broker.httpClientTLS != nil {
+		conn, err = tls.Dial("tcp", addr, broker.httpClientTLS)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+
+	// the server doesn't send anything after the response until the client
+	// starts the handshake, so nothing is lost in the bufio.Reader
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if broker.rpcClientTLS == nil {
+		return conn, nil
+	}
+	config, err := clientTLSFor(broker.rpcClientTLS, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testBrokerServerName = "clarity-broker"
+
+// self-signed CA and a broker certificate signed by it, written to dir
+func writeTestCerts(t *testing.T, dir string) TLSFiles {
+	t.Helper()
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "clarity test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: testBrokerServerName},
+		DNSNames:     []string{testBrokerServerName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return TLSFiles{
+		CertFile:   writePEM("broker.pem", "CERTIFICATE", certDER),
+		KeyFile:    writePEM("broker-key.pem", "EC PRIVATE KEY", keyDER),
+		CAFile:     writePEM("ca.pem", "CERTIFICATE", caDER),
+		ServerName: testBrokerServerName,
+	}
+}
+
+func TestRPCMutualTLS(t *testing.T) {
+	files := writeTestCerts(t, t.TempDir())
+	opts := make([]BrokerOptions, 3)
+	for i := range opts {
+		opts[i].RPCTLS = &files
+	}
+	h := NewHarnessWithOptions(t, 3, opts)
+	defer h.Shutdown()
+
+	// the cluster elects and replicates over tls
+	origLeaderId, origTerm := h.CheckSingleLeader()
+	h.SubmitToServer(origLeaderId, "doc1", 42)
+	sleepMs(250)
+	h.CheckCommitted(42)
+
+	// a client without tls can't get an rpc through
+	leaderAddr := h.cluster[origLeaderId].GetListenAddr().String()
+	args := RequestVoteArgs{Term: origTerm + 10, CandidateId: 9, LastLogIndex: 100, LastLogTerm: origTerm + 10}
+	if client, err := rpc.Dial("tcp", leaderAddr); err == nil {
+		var reply RequestVoteReply
+		if err := client.Call("ElectionModule.RequestVote", args, &reply); err == nil {
+			t.Errorf("plain tcp RequestVote succeeded with reply %+v", reply)
+		}
+		client.Close()
+	}
+	if client, err := rpc.DialHTTP("tcp", h.cluster[origLeaderId].GetHTTPAddr()); err == nil {
+		var reply RequestVoteReply
+		if err := client.Call("ElectionModule.RequestVote", args, &reply); err == nil {
+			t.Errorf("plain RequestVote over http succeeded with reply %+v", reply)
+		}
+		client.Close()
+	}
+
+	// neither can one that trusts the CA but has no certificate of its own
+	_, clientTLS, err := files.load(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS.Certificates = nil
+	if conn, err := tls.Dial("tcp", leaderAddr, clientTLS); err == nil {
+		client := rpc.NewClient(conn)
+		var reply RequestVoteReply
+		if err := client.Call("ElectionModule.RequestVote", args, &reply); err == nil {
+			t.Errorf("RequestVote without a client certificate succeeded with reply %+v", reply)
+		}
+		client.Close()
+	}
+
+	// the rejected requests didn't disturb the leader
+	leaderId, term := h.CheckSingleLeader()
+	if leaderId != origLeaderId || term != origTerm {
+		t.Errorf("leader %d in term %d after rejected rpcs, want %d in term %d", leaderId, term, origLeaderId, origTerm)
+	}
+}
+
+func TestRPCTLSMissingFiles(t *testing.T) {
+	files := TLSFiles{CertFile: "missing.pem", KeyFile: "missing-key.pem", CAFile: "missing-ca.pem"}
+	_, err := NewBrokerServer(0, nil, map[int]string{}, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), BrokerOptions{RPCTLS: &files})
+	if !errors.Is(err, ErrInvalidTLSConfig) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidTLSConfig)
+	}
+}
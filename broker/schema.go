@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// version of the CRDTMessage json shape the broker submits. bump it and add a
+// migration from the previous version whenever a field is added, renamed or
+// changes meaning, so application servers that haven't been updated keep working
+const CurrentSchemaVersion = 1
+
+// messages from before versioning have no schema_version and decode as 0
+const MinSchemaVersion = 0
+
+var ErrUnsupportedSchemaVersion = errors.New("unsupported schema version")
+
+// upgrades the raw fields of a message from the version it is keyed by to the next one
+type schemaMigration func(fields map[string]json.RawMessage) error
+
+var schemaMigrations = map[int]schemaMigration{
+	// unversioned messages already have the version 1 fields
+	0: func(fields map[string]json.RawMessage) error { return nil },
+}
+
+// decode a CRDTMessage of any supported schema version, migrating older
+// messages to CurrentSchemaVersion before the fields are decoded
+func decodeCRDTMessage(r io.Reader) (CRDTMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&fields); err != nil {
+		return CRDTMessage{}, err
+	}
+	return migrateCRDTMessage(fields)
+}
+
+// a message in a batch that couldn't be decoded
+type batchDecodeError struct {
+	position int
+	err      error
+}
+
+func (e *batchDecodeError) Error() string {
+	return fmt.Sprintf("message %d: %v", e.position, e.err)
+}
+
+func (e *batchDecodeError) Unwrap() error {
+	return e.err
+}
+
+// decode a json array of CRDTMessages, each of any supported schema version
+func decodeCRDTBatch(r io.Reader) ([]CRDTMessage, error) {
+	var batch []map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&batch); err != nil {
+		return nil, err
+	}
+	msgs := make([]CRDTMessage, len(batch))
+	for i, fields := range batch {
+		msg, err := migrateCRDTMessage(fields)
+		if err != nil {
+			return nil, &batchDecodeError{position: i, err: err}
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+func migrateCRDTMessage(fields map[string]json.RawMessage) (CRDTMessage, error) {
+	version := 0
+	if raw, ok := fields["schema_version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return CRDTMessage{}, fmt.Errorf("schema_version: %w", err)
+		}
+	}
+	if version < MinSchemaVersion || version > CurrentSchemaVersion {
+		return CRDTMessage{}, fmt.Errorf("%w %d, this broker supports %d to %d",
+			ErrUnsupportedSchemaVersion, version, MinSchemaVersion, CurrentSchemaVersion)
+	}
+
+	for ; version < CurrentSchemaVersion; version++ {
+		migrate, ok := schemaMigrations[version]
+		if !ok {
+			return CRDTMessage{}, fmt.Errorf("%w %d, no migration to %d", ErrUnsupportedSchemaVersion, version, version+1)
+		}
+		if err := migrate(fields); err != nil {
+			return CRDTMessage{}, fmt.Errorf("migrating schema version %d to %d: %w", version, version+1, err)
+		}
+	}
+	fields["schema_version"] = json.RawMessage(fmt.Sprint(CurrentSchemaVersion))
+
+	migrated, err := json.Marshal(fields)
+	if err != nil {
+		return CRDTMessage{}, err
+	}
+	var msg CRDTMessage
+	err = json.Unmarshal(migrated, &msg)
+	return msg, err
+}
@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCRDTSchemaVersion(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	url := fmt.Sprintf("http://%s/crdt", h.cluster[origLeaderId].GetHTTPAddr())
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"current version", `{"schema_version":1,"type":"insert","index":0,"value":"a","replica_id":"r1","operation_index":1}`, http.StatusAccepted},
+		{"unversioned", `{"type":"insert","index":1,"value":"b","replica_id":"r1","operation_index":1}`, http.StatusAccepted},
+		{"future version", `{"schema_version":2,"type":"insert","index":2,"value":"c","replica_id":"r1","operation_index":1}`, http.StatusBadRequest},
+		{"negative version", `{"schema_version":-1,"type":"insert","index":2,"value":"c","replica_id":"r1","operation_index":1}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(url, "application/json", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+		if tt.want == http.StatusBadRequest && !strings.Contains(string(body), ErrUnsupportedSchemaVersion.Error()) {
+			t.Errorf("%s: response %q doesn't say the version is unsupported", tt.name, body)
+		}
+	}
+
+	leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+	if len(leaderLog) != 2 {
+		t.Errorf("leader log has %d entries, want 2", len(leaderLog))
+	}
+}
+
+func TestCRDTSchemaMigration(t *testing.T) {
+	// pretend unversioned messages called the operation type "op"
+	orig := schemaMigrations[0]
+	defer func() { schemaMigrations[0] = orig }()
+	schemaMigrations[0] = func(fields map[string]json.RawMessage) error {
+		if op, ok := fields["op"]; ok {
+			fields["type"] = op
+			delete(fields, "op")
+		}
+		return nil
+	}
+
+	msg, err := decodeCRDTMessage(strings.NewReader(`{"op":"delete","index":4,"operation_index":7}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := CRDTMessage{Type: OpDelete, Index: 4, OpIndex: 7, SchemaVersion: CurrentSchemaVersion}
+	if !reflect.DeepEqual(msg, want) {
+		t.Errorf("migrated message %+v, want %+v", msg, want)
+	}
+
+	// current messages are left alone
+	if _, err := decodeCRDTMessage(strings.NewReader(`{"schema_version":1,"op":"delete","index":4}`)); err != nil {
+		t.Errorf("current message without a type failed to decode: %v", err)
+	}
+	if _, err := decodeCRDTMessage(strings.NewReader(`{"schema_version":9}`)); !errors.Is(err, ErrUnsupportedSchemaVersion) {
+		t.Errorf("got error %v, want %v", err, ErrUnsupportedSchemaVersion)
+	}
+}
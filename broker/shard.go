@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+)
+
+// documents spread over several replication groups, see BrokerOptions.Shards.
+// each group is a ReplicationModule with its own log, commit index and
+// nextIndex bookkeeping, so a hot document or a follower that is slow for one
+// group only holds up the documents hashed to that group. the groups share
+// the election module, one election picks the leader of all of them. commits
+// need every member, so whichever broker wins has every group's committed entries
+//
+// the first group is the broker's rm and the only one that holds membership
+// changes. every group is persisted to its own Storage and checkpointed to its
+// own file, see ShardPath. commit indexes count within a group, so they
+// collide across groups: /committedlog, /logrequest and /commits/stream take a
+// ?shard= parameter, /status lists every group, pushes, SubscribeCommits and
+// WaitForCommit are per group. without a group they mean the first
+
+var ErrUnknownShard = errors.New("unknown shard")
+
+// membership changes are config entries in the first group's log, the others
+// would keep replicating to the old members
+var ErrShardedMembership = errors.New("membership can't change while documents are sharded")
+
+// the replication group of every document
+type DocumentRouter struct {
+	shards []*ReplicationModule
+}
+
+// where group shard keeps what the first group keeps at path. empty stays empty
+func ShardPath(path string, shard int) string {
+	if path == "" || shard == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.shard%d", path, shard)
+}
+
+// the broker's rm as the first group and a new one for each of the others,
+// restored from their storage. the groups made so far are returned with the
+// error so they can be stopped
+func newDocumentRouter(broker *BrokerServer) (*DocumentRouter, error) {
+	router := &DocumentRouter{shards: []*ReplicationModule{broker.rm}}
+
+	for shard := 1; shard < broker.options.shards(); shard++ {
+		opts := broker.options
+		opts.CheckpointPath = ShardPath(opts.CheckpointPath, shard)
+		rm := newRM(broker.brokerid, broker.peerIds, broker, broker.commitChan)
+		rm.shard = shard
+		rm.documents = newDocumentStore(broker.brokerid, opts, broker.logger)
+		if err := rm.start(opts.ShardStorage[shard]); err != nil {
+			return router, err
+		}
+		router.shards = append(router.shards, rm)
+	}
+	return router, nil
+}
+
+// the group of document. the same on every broker with the same number of shards
+func (router *DocumentRouter) Shard(document string) int {
+	if len(router.shards) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(document))
+	return int(h.Sum32() % uint32(len(router.shards)))
+}
+
+// the group that replicates document
+func (router *DocumentRouter) For(document string) *ReplicationModule {
+	return router.shards[router.Shard(document)]
+}
+
+// every group, the broker's rm first
+func (router *DocumentRouter) Shards() []*ReplicationModule {
+	return router.shards
+}
+
+func (router *DocumentRouter) shard(shard int) (*ReplicationModule, error) {
+	if shard < 0 || shard >= len(router.shards) {
+		return nil, fmt.Errorf("%w %d, this broker has %d", ErrUnknownShard, shard, len(router.shards))
+	}
+	return router.shards[shard], nil
+}
+
+// the group named by ?shard= in query, the first when there is none
+func (broker *BrokerServer) shardOf(query url.Values) (*ReplicationModule, error) {
+	if !query.Has("shard") {
+		return broker.rm, nil
+	}
+	shard, err := strconv.Atoi(query.Get("shard"))
+	if err != nil {
+		return nil, fmt.Errorf("shard must be a number, got %q", query.Get("shard"))
+	}
+	return broker.router.shard(shard)
+}
+
+// registered as ReplicationModule, answers each rpc with the group it was sent for
+type routedReplication struct {
+	router *DocumentRouter
+}
+
+func (s routedReplication) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error {
+	rm, err := s.router.shard(args.Shard)
+	if err != nil {
+		return err
+	}
+	return rm.AppendEntries(args, reply)
+}
+
+func (s routedReplication) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	rm, err := s.router.shard(args.Shard)
+	if err != nil {
+		return err
+	}
+	return rm.InstallSnapshot(args, reply)
+}
+
+// the groups documents are replicated in, nil before Serve
+func (broker *BrokerServer) Router() *DocumentRouter {
+	return broker.router
+}
+
+// end the leadership of every group. caller must hold mu2
+func (broker *BrokerServer) stopReplicating() {
+	for _, rm := range broker.router.Shards() {
+		rm.stopReplicating()
+	}
+}
@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a document in each shard, the hash decides which
+func documentsPerShard(t *testing.T, router *DocumentRouter) []string {
+	t.Helper()
+	documents := make([]string, len(router.Shards()))
+	found := 0
+	for i := 0; found < len(documents) && i < 1000; i++ {
+		document := fmt.Sprintf("doc%d", i)
+		if shard := router.Shard(document); documents[shard] == "" {
+			documents[shard] = document
+			found++
+		}
+	}
+	if found < len(documents) {
+		t.Fatalf("no document hashed to some of the %d shards", len(documents))
+	}
+	return documents
+}
+
+func TestShardedDocumentsCommitIndependently(t *testing.T) {
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].Shards = 2
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	ids := []int{0, 1, 2}
+
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+	documents := documentsPerShard(t, leader.Router())
+	const fast, slow = 0, 1
+
+	// one follower holds on to the AppendEntries of the slow shard until released
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	defer unblock()
+	hold := func(args *AppendEntriesArgs) {
+		if args.Shard == slow {
+			<-release
+		}
+	}
+	h.cluster[(leaderId+1)%3].beforeAppendEntries.Store(&hold)
+
+	const writes = 5
+	submit := func(shard int) {
+		for i := range writes {
+			if index := leader.Router().For(documents[shard]).Submit(documents[shard], insertOp(fmt.Sprint(i))); index < 0 {
+				t.Fatalf("leader %d refused write %d to shard %d", leaderId, i, shard)
+			}
+		}
+	}
+	watermarks := func(shard int) (lowest int) {
+		lowest = writes
+		for _, id := range ids {
+			lowest = min(lowest, h.cluster[id].DocumentWatermark(documents[shard]))
+		}
+		return lowest
+	}
+	waitForWatermark := func(shard int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); watermarks(shard) < writes; sleepMs(10) {
+			if time.Now().After(deadline) {
+				t.Fatalf("shard %d got %d of %d writes applied everywhere", shard, watermarks(shard), writes)
+			}
+		}
+	}
+
+	submit(slow)
+	submit(fast)
+	waitForWatermark(fast)
+	if got := leader.DocumentWatermark(documents[slow]); got != 0 {
+		t.Fatalf("slow shard committed %d writes while a follower held its AppendEntries", got)
+	}
+	// each group counts its own commit index
+	status := leader.Status()
+	if got := status.Shards[fast].CommitIndex; got != writes-1 {
+		t.Errorf("fast shard has commit index %d, want %d", got, writes-1)
+	}
+	if got := status.Shards[slow].CommitIndex; got != -1 {
+		t.Errorf("slow shard has commit index %d while held, want -1", got)
+	}
+
+	unblock()
+	if err := leader.WaitForCommit(slow, writes-1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitForWatermark(slow)
+
+	for shard, document := range documents {
+		for _, id := range ids {
+			state, ok := h.cluster[id].DocumentState(document)
+			if !ok || len(state) != writes {
+				t.Errorf("broker %d has %v of %q in shard %d, want %d characters", id, state, document, shard, writes)
+			}
+		}
+	}
+}
+
+func TestShardedLogsArePersistedAndServedPerGroup(t *testing.T) {
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].Shards = 2
+		options[i].Storage = NewMemoryStorage()
+		options[i].ShardStorage = map[int]Storage{1: NewMemoryStorage()}
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+	documents := documentsPerShard(t, leader.Router())
+
+	// one write to the first group, three to the second
+	leader.Router().For(documents[0]).Submit(documents[0], insertOp("a"))
+	for i := range 3 {
+		leader.Router().For(documents[1]).Submit(documents[1], insertOp(fmt.Sprint(i)))
+	}
+	for id := range 3 {
+		if err := h.cluster[id].WaitForCommit(1, 2, 5*time.Second); err != nil {
+			t.Fatalf("broker %d: %v", id, err)
+		}
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/committedlog?shard=1&snapshot=true", leader.GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log CommittedLog
+	err = json.NewDecoder(resp.Body).Decode(&log)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.Shard != 1 || log.Shards != 2 || len(log.Entries) != 3 {
+		t.Fatalf("committed log of shard 1 is %+v, want 3 entries of 2 shards", log)
+	}
+	for _, entry := range log.Entries {
+		if entry.Document != documents[1] {
+			t.Errorf("shard 1 served an entry of %q", entry.Document)
+		}
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/committedlog?shard=2", leader.GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("committed log of a shard the broker doesn't have answered %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// each group's log is in its own storage, a restarted broker restores both
+	followerId := (leaderId + 1) % 3
+	h.CrashPeer(followerId)
+	for shard, want := range []int{1, 3} {
+		storage := options[followerId].Storage
+		if shard > 0 {
+			storage = options[followerId].ShardStorage[shard]
+		}
+		entries, err := storage.Entries(0, math.MaxInt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != want {
+			t.Errorf("storage of shard %d has %d entries, want %d", shard, len(entries), want)
+		}
+	}
+	h.RestartPeer(followerId)
+	follower := h.cluster[followerId]
+	for shard, want := range []int{1, 3} {
+		if err := follower.WaitForCommit(shard, want-1, 5*time.Second); err != nil {
+			t.Fatalf("restarted broker, shard %d: %v", shard, err)
+		}
+		if state, _ := follower.DocumentState(documents[shard]); len(state) != want {
+			t.Errorf("restarted broker has %v of %q, want %d characters", state, documents[shard], want)
+		}
+	}
+}
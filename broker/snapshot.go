@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// the materialized documents double as a raft snapshot (raft paper section 7)
+// once they include an entry it can be trimmed off the log, which would
+// otherwise grow forever. a follower that needs entries the leader already
+// trimmed is sent the documents with InstallSnapshot instead. entries covered
+// by an installed snapshot are never sent on that follower's commitChan
+
+// trim the log once SnapshotInterval applied entries have piled up in it
+func (rm *ReplicationModule) maybeTrimLog() {
+	interval := rm.broker.options.SnapshotInterval
+	if interval <= 0 {
+		return
+	}
+	applied := rm.documents.appliedIndex()
+
+	rm.broker.mu2.Lock()
+	due := applied-rm.logBaseIndex+1 >= interval
+	rm.broker.mu2.Unlock()
+
+	if due {
+		rm.TrimLog(applied)
+	}
+}
+
+// remove every entry with index <= upToIndex from the log
+// upToIndex is capped at the last entry applied to the documents, which hold what was trimmed
+func (rm *ReplicationModule) TrimLog(upToIndex int) {
+	var snapshot documentCheckpoint
+	if rm.storage != nil {
+		snapshot = rm.documents.snapshot()
+	} else {
+		snapshot.LastApplied = rm.documents.appliedIndex()
+	}
+
+	rm.broker.mu2.Lock()
+	defer rm.broker.mu2.Unlock()
+
+	upToIndex = min(upToIndex, snapshot.LastApplied, rm.lastApplied, rm.lastLogIndex())
+	if upToIndex < rm.logBaseIndex {
+		return
+	}
+
+	rm.baseMembership = rm.membershipAt(upToIndex)
+	rm.logBaseTerm = rm.termAt(upToIndex)
+	// copied so the trimmed entries can be garbage collected
+	rm.log = slices.Clone(rm.logSlice(upToIndex+1, rm.lastLogIndex()+1))
+	rm.logBaseIndex = upToIndex + 1
+
+	rm.persistSnapshot(snapshot)
+	rm.persistToStorage()
+	rm.broker.logger.Info("trimmed log", "up_to", upToIndex, "entries", len(rm.log))
+}
+
+// rpc request from leader to a follower missing entries the leader trimmed
+type InstallSnapshotArgs struct {
+	// replication group the snapshot is of, see shard.go
+	Shard int
+
+	Term     int
+	LeaderId int
+
+	// the snapshot replaces every entry up to and including this one
+	LastIncludedIndex int
+	LastIncludedTerm  int
+
+	// configuration as of LastIncludedIndex
+	Members    []int
+	OldMembers []int
+
+	Documents documentCheckpoint
+}
+
+type InstallSnapshotReply struct {
+	Term int
+	Id   int
+}
+
+// send peerId the leader's documents and the index they're up to
+// ctx ends when this leadership does, which also abandons the call
+func (rm *ReplicationModule) sendSnapshot(ctx context.Context, currentTerm int, peerId int) {
+	documents := rm.documents.snapshot()
+
+	rm.broker.mu2.Lock()
+	if !stillLeading(ctx) {
+		rm.broker.mu2.Unlock()
+		return
+	}
+	// documents restored from a checkpoint can be ahead of the log
+	if documents.LastApplied < rm.logBaseIndex-1 || documents.LastApplied > rm.lastLogIndex() {
+		rm.broker.mu2.Unlock()
+		rm.broker.logger.Warn("documents don't match the log, can't send snapshot", "peer", peerId, "index", documents.LastApplied)
+		return
+	}
+	config := rm.membershipAt(documents.LastApplied)
+	args := InstallSnapshotArgs{
+		Shard:             rm.shard,
+		Term:              currentTerm,
+		LeaderId:          rm.id,
+		LastIncludedIndex: documents.LastApplied,
+		LastIncludedTerm:  rm.termAt(documents.LastApplied),
+		Members:           config.members,
+		OldMembers:        config.oldMembers,
+		Documents:         documents,
+	}
+	rm.broker.mu2.Unlock()
+
+	rm.broker.logger.Info("sending snapshot", "peer", peerId, "last_included_index", args.LastIncludedIndex)
+	sentAt := time.Now()
+
+	callCtx, cancel := context.WithTimeout(ctx, rm.broker.rpcTimeout())
+	defer cancel()
+
+	var reply InstallSnapshotReply
+	err := rm.broker.Call(callCtx, peerId, "ReplicationModule.InstallSnapshot", args, &reply)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) && stillLeading(ctx) {
+			rm.broker.logger.Warn("snapshot timed out, peer unreachable this round", "peer", peerId, "timeout", rm.broker.rpcTimeout())
+		}
+		return
+	}
+
+	rm.broker.mu2.Lock()
+	defer rm.broker.mu2.Unlock()
+
+	if reply.Term > rm.broker.em.term {
+		rm.broker.logger.Info("term is outdated", "term", rm.broker.em.term, "peer_term", reply.Term)
+		rm.broker.em.becomeFollower(reply.Term)
+		return
+	}
+	if !stillLeading(ctx) || rm.broker.state != Leader || reply.Term != currentTerm {
+		return
+	}
+	rm.recordHeartbeatAck(peerId, sentAt)
+	// the next AE continues right after the snapshot
+	rm.nextIndex[peerId] = max(rm.nextIndex[peerId], args.LastIncludedIndex+1)
+	rm.matchIndex[peerId] = max(rm.matchIndex[peerId], args.LastIncludedIndex)
+}
+
+// this func is for followers to replace the start of their log with the leader's snapshot
+func (rm *ReplicationModule) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	rm.broker.logger.Info("received snapshot", "leader", args.LeaderId, "last_included_index", args.LastIncludedIndex)
+	rm.broker.mu2.Lock()
+	defer rm.broker.mu2.Unlock()
+
+	if rm.broker.state == Dead {
+		return nil
+	}
+
+	if args.Term > rm.broker.em.term {
+		rm.broker.em.becomeFollower(args.Term)
+	}
+
+	reply.Term = rm.broker.em.term
+	reply.Id = rm.id
+
+	if args.Term < rm.broker.em.term {
+		return nil
+	}
+	if rm.broker.state != Follower {
+		rm.broker.em.stepDownFor(args.LeaderId, args.Term)
+	}
+	rm.broker.em.failedElections.Store(0)
+	rm.broker.em.resetElectionTimer()
+	rm.broker.em.setLeader(args.LeaderId)
+
+	// a stale or repeated snapshot, the log already starts after it
+	if args.LastIncludedIndex < rm.logBaseIndex {
+		return nil
+	}
+
+	// keep the entries after the snapshot if the log agrees with it, otherwise start over
+	if args.LastIncludedIndex <= rm.lastLogIndex() && rm.termAt(args.LastIncludedIndex) == args.LastIncludedTerm {
+		rm.log = slices.Clone(rm.logSlice(args.LastIncludedIndex+1, rm.lastLogIndex()+1))
+	} else {
+		rm.log = nil
+	}
+	rm.logBaseIndex = args.LastIncludedIndex + 1
+	rm.logBaseTerm = args.LastIncludedTerm
+	rm.baseMembership = membership{members: args.Members, oldMembers: args.OldMembers}
+	rm.refreshMembership()
+
+	rm.documents.installSnapshot(args.Documents)
+	rm.setCommitIndex(max(rm.commitIndex, args.LastIncludedIndex))
+	rm.lastApplied = max(rm.lastApplied, args.LastIncludedIndex)
+
+	rm.persistSnapshot(args.Documents)
+	rm.persistToStorage()
+	return nil
+}
@@ -0,0 +1,235 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/crdt"
+)
+
+// an insert at the start of doc, in the format handleCRDTOperation submits
+func insertOp(value string) string {
+	return fmt.Sprintf("Type[%s] Index[%d] Value[%s]", OpInsert, 0, value)
+}
+
+// poll until every broker in ids applied the entry at index to its documents
+func waitForApplied(t *testing.T, h *Harness, ids []int, index int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for h.cluster[id].documents.appliedIndex() < index {
+			if time.Now().After(deadline) {
+				t.Fatalf("broker %d applied up to %d, want %d", id, h.cluster[id].documents.appliedIndex(), index)
+			}
+			sleepMs(5)
+		}
+	}
+}
+
+func logLength(broker *BrokerServer) (length int, baseIndex int) {
+	broker.mu2.Lock()
+	defer broker.mu2.Unlock()
+	return len(broker.rm.log), broker.rm.logBaseIndex
+}
+
+func TestLogStaysBoundedWithSnapshots(t *testing.T) {
+	const interval = 1000
+	const batchSize = 100
+	const total = 10000
+	// spread over documents so the text crdts, which are linear in their length, stay short
+	const documents = 100
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].SnapshotInterval = interval
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	ids := []int{0, 1, 2}
+
+	longest := 0
+	for submitted := 0; submitted < total; submitted += batchSize {
+		batch := make([]LogEntry, batchSize)
+		for i := range batch {
+			batch[i] = LogEntry{CRDTOperation: insertOp("a"), Document: fmt.Sprintf("doc%d", i%documents)}
+		}
+		first, _ := h.cluster[leaderId].rm.submitBatch(batch)
+		if first != submitted {
+			t.Fatalf("batch submitted at %d, want %d", first, submitted)
+		}
+		waitForApplied(t, h, ids, first+batchSize-1)
+
+		for _, id := range ids {
+			length, _ := logLength(h.cluster[id])
+			longest = max(longest, length)
+		}
+	}
+
+	// a trim can still be pending from the previous batch when the next one arrives
+	if longest > interval+2*batchSize {
+		t.Errorf("log grew to %d entries, want at most %d", longest, interval+2*batchSize)
+	}
+	for _, id := range ids {
+		if _, baseIndex := logLength(h.cluster[id]); baseIndex < total-interval {
+			t.Errorf("broker %d's log starts at %d, want it trimmed past %d", id, baseIndex, total-interval)
+		}
+		for doc := 0; doc < documents; doc++ {
+			name := fmt.Sprintf("doc%d", doc)
+			got, _ := h.cluster[id].DocumentState(name)
+			if len(got) != total/documents {
+				t.Fatalf("broker %d's %s has %d characters, want %d", id, name, len(got), total/documents)
+			}
+		}
+	}
+
+	// trimmed entries don't get in the way of new ones
+	if h.SubmitToServer(leaderId, "doc0", insertOp("b")) != total {
+		t.Fatalf("want id=%d leader, but it's not", leaderId)
+	}
+	waitForApplied(t, h, ids, total)
+}
+
+func TestNewServerCatchesUpFromSnapshot(t *testing.T) {
+	const interval = 100
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].SnapshotInterval = interval
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	batch := make([]LogEntry, 3*interval)
+	for i := range batch {
+		batch[i] = LogEntry{CRDTOperation: insertOp("a"), Document: "doc1"}
+	}
+	h.cluster[leaderId].rm.submitBatch(batch)
+	waitForApplied(t, h, []int{0, 1, 2}, len(batch)-1)
+	if _, baseIndex := logLength(h.cluster[leaderId]); baseIndex == 0 {
+		t.Fatal("leader never trimmed its log")
+	}
+
+	// the new broker needs entries the leader no longer has
+	id := h.AddNewServer()
+	if err := h.cluster[leaderId].AddPeer(id, h.cluster[id].GetListenAddr().String()); err != nil {
+		t.Fatalf("AddPeer(%d): %v", id, err)
+	}
+	index := h.SubmitToServer(leaderId, "doc1", insertOp("b"))
+	if index < 0 {
+		t.Fatalf("want id=%d leader, but it's not", leaderId)
+	}
+	waitForApplied(t, h, []int{leaderId, id}, index)
+
+	want, _ := h.cluster[leaderId].DocumentState("doc1")
+	if got, _ := h.cluster[id].DocumentState("doc1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("new broker's document is %d characters, want the leader's %d", len(got), len(want))
+	}
+	if _, baseIndex := logLength(h.cluster[id]); baseIndex == 0 {
+		t.Error("new broker replayed the whole log instead of installing a snapshot")
+	}
+	// the entries folded into the snapshot still count
+	if got, want := h.cluster[id].DocumentWatermark("doc1"), len(batch)+1; got != want {
+		t.Errorf("new broker's watermark of doc1 is %d, want %d", got, want)
+	}
+}
+
+func TestTrimmedLogSurvivesRestart(t *testing.T) {
+	const interval = 100
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].SnapshotInterval = interval
+		options[i].Storage = NewMemoryStorage()
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % 3
+
+	batch := make([]LogEntry, 2*interval+50)
+	for i := range batch {
+		batch[i] = LogEntry{CRDTOperation: insertOp("a"), Document: "doc1"}
+	}
+	h.cluster[leaderId].rm.submitBatch(batch)
+	waitForApplied(t, h, []int{0, 1, 2}, len(batch)-1)
+	want, _ := h.cluster[followerId].DocumentState("doc1")
+	// the log is trimmed a little after the entries are applied
+	wantLength, wantBase := logLength(h.cluster[followerId])
+	for deadline := time.Now().Add(time.Second); wantBase == 0 && time.Now().Before(deadline); {
+		sleepMs(5)
+		wantLength, wantBase = logLength(h.cluster[followerId])
+	}
+	if wantBase == 0 {
+		t.Fatalf("follower %d never trimmed its log", followerId)
+	}
+
+	h.CrashPeer(followerId)
+	h.RestartPeer(followerId)
+
+	// the documents come back from the snapshot and the rest of the log
+	if length, baseIndex := logLength(h.cluster[followerId]); length != wantLength || baseIndex != wantBase {
+		t.Errorf("restarted follower has %d entries from %d, want %d from %d", length, baseIndex, wantLength, wantBase)
+	}
+	if got, _ := h.cluster[followerId].DocumentState("doc1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("restarted follower's document is %d characters, want %d", len(got), len(want))
+	}
+	if got := h.cluster[followerId].DocumentWatermark("doc1"); got != len(batch) {
+		t.Errorf("restarted follower's watermark of doc1 is %d, want %d", got, len(batch))
+	}
+}
+
+func TestCommittedLogAfterTrim(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+
+	for _, value := range []string{"a", "b", "c", "d"} {
+		h.SubmitToServer(leaderId, "7", insertOp(value))
+	}
+	waitForApplied(t, h, []int{leaderId}, 3)
+	leader.rm.TrimLog(1)
+
+	// the entries alone would leave out the trimmed ones
+	resp, err := http.Get(fmt.Sprintf("http://%s/committedlog", leader.GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("committed log after a trim answered %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/committedlog?snapshot=true", leader.GetHTTPAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var log CommittedLog
+	if err := json.NewDecoder(resp.Body).Decode(&log); err != nil {
+		t.Fatal(err)
+	}
+	if log.FirstIndex < 2 || log.FirstIndex+len(log.Entries) != 4 {
+		t.Fatalf("got entries %d to %d, want the ones after the snapshot up to 3", log.FirstIndex, log.FirstIndex+len(log.Entries)-1)
+	}
+	snapshot, ok := log.Documents["7"]
+	if !ok {
+		t.Fatal("no snapshot of document 7")
+	}
+	doc := crdt.NewTextCRDTFromSnapshot(snapshot)
+	for _, entry := range log.Entries {
+		if err := applyToDocument(doc, entry.operation()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, _ := leader.DocumentState("7")
+	if got := doc.Representation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot and entries give %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,273 @@
+package broker
+
+import (
+	"math"
+	"slices"
+	"sync"
+)
+
+// durable raft state that has to survive a restart: the log, the term, vote and
+// commit progress, and the snapshot the trimmed start of the log was folded into.
+// log indexes are the ReplicationModule's, the first entry ever appended is at 0
+type Storage interface {
+	// add entries to the end of the stored log
+	AppendEntries(entries []LogEntry) error
+
+	// stored entries from index lo up to but not including hi, fewer when the
+	// log starts after lo or ends before hi
+	Entries(lo, hi int) ([]LogEntry, error)
+
+	// remove every entry from index from on
+	TruncateSuffix(from int) error
+
+	// remove every entry before index to, the log then starts at to even if
+	// it ended before it
+	TruncatePrefix(to int) error
+
+	SetHardState(state HardState) error
+
+	// false when no hard state was ever set
+	GetHardState() (HardState, bool, error)
+
+	SaveSnapshot(snapshot StorageSnapshot) error
+
+	// false when no snapshot was ever saved
+	LoadSnapshot() (StorageSnapshot, bool, error)
+}
+
+// what the election and replication modules persist besides the log
+type HardState struct {
+	Term     int
+	VotedFor int
+
+	CommitIndex int
+	LastApplied int
+}
+
+// the documents the log up to LastIncludedIndex was trimmed into, with the
+// term and configuration at that index, see snapshot.go
+type StorageSnapshot struct {
+	LastIncludedIndex int
+	LastIncludedTerm  int
+	Members           []int
+	OldMembers        []int
+
+	Documents documentCheckpoint
+}
+
+// in memory Storage, survives a broker restart inside one process
+type MemoryStorage struct {
+	mu sync.Mutex
+
+	// log index of entries[0]
+	firstIndex int
+	entries    []LogEntry
+
+	hardState *HardState
+	snapshot  *StorageSnapshot
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (ms *MemoryStorage) AppendEntries(entries []LogEntry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.entries = append(ms.entries, entries...)
+	return nil
+}
+
+func (ms *MemoryStorage) Entries(lo, hi int) ([]LogEntry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	lo = max(lo, ms.firstIndex) - ms.firstIndex
+	hi = min(hi, ms.firstIndex+len(ms.entries)) - ms.firstIndex
+	if lo >= hi {
+		return nil, nil
+	}
+	return slices.Clone(ms.entries[lo:hi]), nil
+}
+
+func (ms *MemoryStorage) TruncateSuffix(from int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if keep := from - ms.firstIndex; keep < len(ms.entries) {
+		ms.entries = ms.entries[:max(keep, 0)]
+	}
+	return nil
+}
+
+func (ms *MemoryStorage) TruncatePrefix(to int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if to <= ms.firstIndex {
+		return nil
+	}
+	drop := min(to-ms.firstIndex, len(ms.entries))
+	// copied so the dropped entries can be garbage collected
+	ms.entries = slices.Clone(ms.entries[drop:])
+	ms.firstIndex = to
+	return nil
+}
+
+func (ms *MemoryStorage) SetHardState(state HardState) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.hardState = &state
+	return nil
+}
+
+func (ms *MemoryStorage) GetHardState() (HardState, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.hardState == nil {
+		return HardState{}, false, nil
+	}
+	return *ms.hardState, true, nil
+}
+
+func (ms *MemoryStorage) SaveSnapshot(snapshot StorageSnapshot) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.snapshot = &snapshot
+	return nil
+}
+
+func (ms *MemoryStorage) LoadSnapshot() (StorageSnapshot, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.snapshot == nil {
+		return StorageSnapshot{}, false, nil
+	}
+	return *ms.snapshot, true, nil
+}
+
+// the term and vote of the election module and the commit progress of the
+// first replication group, saved together. caller must hold mu2
+func (broker *BrokerServer) hardState() HardState {
+	return broker.rm.hardState()
+}
+
+// like the broker's hard state, with the commit progress of rm's group
+// caller must hold mu2
+func (rm *ReplicationModule) hardState() HardState {
+	return HardState{
+		Term:        rm.broker.em.term,
+		VotedFor:    rm.broker.em.votedFor,
+		CommitIndex: rm.commitIndex,
+		LastApplied: rm.lastApplied,
+	}
+}
+
+// save the log entries storage doesn't have yet, or that changed since they
+// were saved, and the hard state. caller must hold mu2
+func (rm *ReplicationModule) persistToStorage() {
+	if rm.storage == nil {
+		return
+	}
+
+	// entries after storedValid were replaced after a conflict
+	if rm.storedValid < rm.storedEnd {
+		if err := rm.storage.TruncateSuffix(rm.storedValid); err != nil {
+			rm.broker.logger.Error("could not truncate stored log", "from", rm.storedValid, "err", err)
+			return
+		}
+		rm.storedEnd = rm.storedValid
+	}
+	if end := rm.lastLogIndex() + 1; end > rm.storedEnd {
+		if err := rm.storage.AppendEntries(rm.logSlice(rm.storedEnd, end)); err != nil {
+			rm.broker.logger.Error("could not append to stored log", "from", rm.storedEnd, "err", err)
+			return
+		}
+		rm.storedEnd = end
+	}
+	rm.storedValid = rm.storedEnd
+
+	if err := rm.storage.SetHardState(rm.hardState()); err != nil {
+		rm.broker.logger.Error("could not save hard state", "err", err)
+	}
+}
+
+// the stored entries from index from on no longer match the log. caller must hold mu2
+func (rm *ReplicationModule) invalidateStoredLog(from int) {
+	rm.storedValid = min(rm.storedValid, from)
+}
+
+// save the snapshot the log was trimmed into, then drop the trimmed entries
+// from storage. the log must already start after the snapshot. caller must hold mu2
+func (rm *ReplicationModule) persistSnapshot(documents documentCheckpoint) {
+	if rm.storage == nil {
+		return
+	}
+
+	snapshot := StorageSnapshot{
+		LastIncludedIndex: rm.logBaseIndex - 1,
+		LastIncludedTerm:  rm.logBaseTerm,
+		Members:           rm.baseMembership.members,
+		OldMembers:        rm.baseMembership.oldMembers,
+		Documents:         documents,
+	}
+	if err := rm.storage.SaveSnapshot(snapshot); err != nil {
+		rm.broker.logger.Error("could not save snapshot", "err", err)
+		return
+	}
+	if err := rm.storage.TruncatePrefix(rm.logBaseIndex); err != nil {
+		rm.broker.logger.Error("could not trim stored log", "to", rm.logBaseIndex, "err", err)
+		return
+	}
+	// a stored log that ended before the snapshot now starts, empty, after it
+	rm.storedEnd = max(rm.storedEnd, rm.logBaseIndex)
+	rm.storedValid = max(rm.storedValid, rm.logBaseIndex)
+}
+
+// load the snapshot, hard state and log a previous run left in storage. false
+// when there was nothing to load. only called before the rm starts
+func (rm *ReplicationModule) restoreFromStorage() (bool, error) {
+	state, found, err := rm.storage.GetHardState()
+	if err != nil || !found {
+		return false, err
+	}
+	rm.setCommitIndex(state.CommitIndex)
+	rm.lastApplied = state.LastApplied
+
+	snapshot, found, err := rm.storage.LoadSnapshot()
+	if err != nil {
+		return false, err
+	}
+	if found {
+		rm.logBaseIndex = snapshot.LastIncludedIndex + 1
+		rm.logBaseTerm = snapshot.LastIncludedTerm
+		rm.baseMembership = membership{members: snapshot.Members, oldMembers: snapshot.OldMembers}
+		rm.documents.installSnapshot(snapshot.Documents)
+	}
+
+	rm.log, err = rm.storage.Entries(rm.logBaseIndex, math.MaxInt)
+	if err != nil {
+		return false, err
+	}
+	rm.storedEnd = rm.lastLogIndex() + 1
+	rm.storedValid = rm.storedEnd
+	return true, nil
+}
+
+// save term and votedFor, with the rest of the hard state. caller must hold mu2
+func (em *ElectionModule) persistToStorage() {
+	if em.storage == nil {
+		return
+	}
+	if err := em.storage.SetHardState(em.broker.hardState()); err != nil {
+		em.broker.logger.Error("could not save hard state", "err", err)
+	}
+}
+
+// load the term and vote a previous run left in storage. only called before the em starts
+func (em *ElectionModule) restoreFromStorage() error {
+	state, found, err := em.storage.GetHardState()
+	if err != nil || !found {
+		return err
+	}
+	em.term = state.Term
+	em.votedFor = state.VotedFor
+	return nil
+}
@@ -0,0 +1,394 @@
+package broker
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/crdt"
+)
+
+func openBoltStorage(t *testing.T, path string) *BoltStorage {
+	storage, err := NewBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+// commands of the stored entries from lo to hi
+func storedCommands(t *testing.T, storage Storage, lo, hi int) []any {
+	entries, err := storage.Entries(lo, hi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := []any{}
+	for _, entry := range entries {
+		commands = append(commands, entry.CRDTOperation)
+	}
+	return commands
+}
+
+func appendCommands(t *testing.T, storage Storage, commands ...int) {
+	entries := make([]LogEntry, len(commands))
+	for i, cmd := range commands {
+		entries[i] = LogEntry{CRDTOperation: cmd, Term: 1, Document: "doc1"}
+	}
+	if err := storage.AppendEntries(entries); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	storages := map[string]func(t *testing.T) Storage{
+		"memory": func(t *testing.T) Storage { return NewMemoryStorage() },
+		"bolt": func(t *testing.T) Storage {
+			storage := openBoltStorage(t, filepath.Join(t.TempDir(), "broker.db"))
+			t.Cleanup(func() { storage.Close() })
+			return storage
+		},
+	}
+	for name, open := range storages {
+		t.Run(name, func(t *testing.T) {
+			storage := open(t)
+
+			if _, found, _ := storage.GetHardState(); found {
+				t.Error("new storage has a hard state")
+			}
+			if _, found, _ := storage.LoadSnapshot(); found {
+				t.Error("new storage has a snapshot")
+			}
+
+			appendCommands(t, storage, 0, 1, 2, 3, 4)
+			if got := storedCommands(t, storage, 1, 3); !reflect.DeepEqual(got, []any{1, 2}) {
+				t.Errorf("entries 1 to 3 are %v", got)
+			}
+			// clamped to the stored log
+			if got := storedCommands(t, storage, -5, 100); !reflect.DeepEqual(got, []any{0, 1, 2, 3, 4}) {
+				t.Errorf("every entry is %v", got)
+			}
+
+			if err := storage.TruncateSuffix(3); err != nil {
+				t.Fatal(err)
+			}
+			appendCommands(t, storage, 30)
+			if got := storedCommands(t, storage, 0, 100); !reflect.DeepEqual(got, []any{0, 1, 2, 30}) {
+				t.Errorf("after truncating from 3 and appending, entries are %v", got)
+			}
+
+			if err := storage.TruncatePrefix(2); err != nil {
+				t.Fatal(err)
+			}
+			if got := storedCommands(t, storage, 0, 100); !reflect.DeepEqual(got, []any{2, 30}) {
+				t.Errorf("after truncating before 2, entries are %v", got)
+			}
+
+			// past the end of the log, appends then continue from the new start
+			if err := storage.TruncatePrefix(10); err != nil {
+				t.Fatal(err)
+			}
+			appendCommands(t, storage, 10, 11)
+			if got := storedCommands(t, storage, 10, 12); !reflect.DeepEqual(got, []any{10, 11}) {
+				t.Errorf("after truncating before 10 and appending, entries from 10 are %v", got)
+			}
+			if got := storedCommands(t, storage, 0, 10); len(got) != 0 {
+				t.Errorf("entries before 10 are %v, want none", got)
+			}
+
+			state := HardState{Term: 3, VotedFor: 2, CommitIndex: 10, LastApplied: 9}
+			if err := storage.SetHardState(state); err != nil {
+				t.Fatal(err)
+			}
+			if got, found, err := storage.GetHardState(); err != nil || !found || got != state {
+				t.Errorf("hard state is %+v, %v, %v, want %+v", got, found, err, state)
+			}
+
+			snapshot := StorageSnapshot{
+				LastIncludedIndex: 9,
+				LastIncludedTerm:  1,
+				Members:           []int{0, 1, 2},
+				Documents:         documentCheckpoint{LastApplied: 9, Documents: map[string]crdt.TextCRDTSnapshot{"doc1": {ReplicaID: "broker0", VersionVector: map[string]int64{"r1": 2}}}},
+			}
+			if err := storage.SaveSnapshot(snapshot); err != nil {
+				t.Fatal(err)
+			}
+			if got, found, err := storage.LoadSnapshot(); err != nil || !found || !reflect.DeepEqual(got, snapshot) {
+				t.Errorf("snapshot is %+v, %v, %v, want %+v", got, found, err, snapshot)
+			}
+		})
+	}
+}
+
+func TestBoltStorageSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.db")
+	storage := openBoltStorage(t, path)
+
+	appendCommands(t, storage, 0, 1, 2, 3)
+	storage.TruncatePrefix(2)
+	state := HardState{Term: 2, VotedFor: 1, CommitIndex: 3, LastApplied: 3}
+	storage.SetHardState(state)
+	storage.Close()
+
+	storage = openBoltStorage(t, path)
+	defer storage.Close()
+
+	if got, _, err := storage.GetHardState(); err != nil || got != state {
+		t.Errorf("reopened hard state is %+v, %v, want %+v", got, err, state)
+	}
+	if got := storedCommands(t, storage, 0, 100); !reflect.DeepEqual(got, []any{2, 3}) {
+		t.Errorf("reopened entries are %v", got)
+	}
+	// the log still starts at 2, not at whatever is stored first
+	storage.TruncateSuffix(2)
+	appendCommands(t, storage, 20)
+	if got := storedCommands(t, storage, 2, 3); !reflect.DeepEqual(got, []any{20}) {
+		t.Errorf("entry appended to the emptied log is %v, want it at index 2", got)
+	}
+}
+
+// a broker per database file. reopen stands in for the process dying and the
+// database being opened again from disk
+func boltOptions(t *testing.T, n int) (options []BrokerOptions, reopen func(id int)) {
+	dir := t.TempDir()
+	path := func(id int) string { return filepath.Join(dir, fmt.Sprintf("broker%d.db", id)) }
+
+	options = make([]BrokerOptions, n)
+	storages := make([]*BoltStorage, n)
+	for i := range options {
+		storages[i] = openBoltStorage(t, path(i))
+		options[i].Storage = storages[i]
+	}
+	t.Cleanup(func() {
+		for _, storage := range storages {
+			storage.Close()
+		}
+	})
+	reopen = func(id int) {
+		storages[id].Close()
+		storages[id] = openBoltStorage(t, path(id))
+		options[id].Storage = storages[id]
+	}
+	return options, reopen
+}
+
+func TestFollowerRecoversLogFromBoltStorage(t *testing.T) {
+	options, reopen := boltOptions(t, 3)
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	submit := func(from, to int) {
+		for cmd := from; cmd < to; cmd++ {
+			if h.SubmitToServer(origLeaderId, "doc1", cmd) < 0 {
+				t.Fatalf("want id=%d leader, but it's not", origLeaderId)
+			}
+			if cmd == 0 {
+				sleepMs(100)
+			}
+		}
+	}
+
+	submit(0, 20)
+	sleepMs(200)
+	h.CheckCommitted(19)
+
+	followerId := (origLeaderId + 1) % h.n
+	h.CrashPeer(followerId)
+	reopen(followerId)
+
+	// the remaining two can't commit without the follower, commits are atomic
+	submit(20, 30)
+	sleepMs(100)
+
+	h.RestartPeer(followerId)
+
+	// the follower starts from its persisted log, so it only needs the last 10
+	// entries from the leader before everything commits, and only sends those
+	// on its commit channel since it applied the first 20 before the crash
+	const timeout = 5 * time.Second
+	start := time.Now()
+	for {
+		_, commits, _, _ := h.GetLogsAndCommitIndexFromServer(followerId)
+		if len(commits) == 10 {
+			for i, commit := range commits {
+				if commit.Index != 20+i || commit.CRDTOperation != 20+i {
+					t.Fatalf("commit %d is %+v, want command %d at index %d", i, commit, 20+i, 20+i)
+				}
+			}
+			break
+		}
+		if time.Since(start) > timeout {
+			t.Fatalf("follower sent %d commits within %s, want 10", len(commits), timeout)
+		}
+		sleepMs(10)
+	}
+}
+
+func TestTrimmedLogSurvivesReopenedBoltStorage(t *testing.T) {
+	const interval = 100
+
+	options, reopen := boltOptions(t, 3)
+	for i := range options {
+		options[i].SnapshotInterval = interval
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % 3
+
+	batch := make([]LogEntry, 2*interval+50)
+	for i := range batch {
+		batch[i] = LogEntry{CRDTOperation: insertOp("a"), Document: "doc1"}
+	}
+	h.cluster[leaderId].rm.submitBatch(batch)
+	waitForApplied(t, h, []int{0, 1, 2}, len(batch)-1)
+	want, _ := h.cluster[followerId].DocumentState("doc1")
+	wantLength, wantBase := logLength(h.cluster[followerId])
+	if wantBase == 0 {
+		t.Fatalf("follower %d never trimmed its log", followerId)
+	}
+
+	h.CrashPeer(followerId)
+	reopen(followerId)
+	h.RestartPeer(followerId)
+
+	if length, baseIndex := logLength(h.cluster[followerId]); length != wantLength || baseIndex != wantBase {
+		t.Errorf("restarted follower has %d entries from %d, want %d from %d", length, baseIndex, wantLength, wantBase)
+	}
+	if got, _ := h.cluster[followerId].DocumentState("doc1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("restarted follower's document is %d characters, want %d", len(got), len(want))
+	}
+
+	// and it keeps committing with the others
+	h.cluster[leaderId].rm.submitBatch(batch[:10])
+	waitForApplied(t, h, []int{0, 1, 2}, len(batch)+9)
+}
+
+func TestVoteSurvivesRestart(t *testing.T) {
+	storage := NewMemoryStorage()
+	peerAddrs := map[int]string{1: "127.0.0.1:1", 2: "127.0.0.1:2"}
+	start := func() *BrokerServer {
+		// ready is never closed so no election timer fires during the test
+		broker, err := NewBrokerServer(0, []int{1, 2}, peerAddrs, "127.0.0.1:0", Follower, make(chan any), make(chan CommitEntry), BrokerOptions{Storage: storage})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := broker.Serve(); err != nil {
+			t.Fatal(err)
+		}
+		return broker
+	}
+	requestVote := func(broker *BrokerServer, candidateId int) RequestVoteReply {
+		var reply RequestVoteReply
+		args := RequestVoteArgs{Term: 5, CandidateId: candidateId, LastLogIndex: -1, LastLogTerm: -1}
+		if err := broker.em.RequestVote(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	broker := start()
+	if reply := requestVote(broker, 1); !reply.VoteGranted {
+		t.Fatalf("first vote in term 5 not granted: %+v", reply)
+	}
+	shutdownNow(broker)
+
+	restarted := start()
+	defer shutdownNow(restarted)
+
+	if _, term, _ := restarted.em.Report(); term != 5 {
+		t.Fatalf("restarted broker has term %d, want 5", term)
+	}
+	if reply := requestVote(restarted, 2); reply.VoteGranted {
+		t.Fatalf("restarted broker voted for 2 after voting for 1 in the same term: %+v", reply)
+	}
+	// asking again for the same candidate is fine, the reply may have been lost
+	if reply := requestVote(restarted, 1); !reply.VoteGranted {
+		t.Fatalf("restarted broker refused to repeat its vote for 1: %+v", reply)
+	}
+}
+
+// indices of the entries broker id sent on its commitChan, once the last one
+// is lastIndex
+func waitForCommitIndices(t *testing.T, h *Harness, id int, lastIndex int) []int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.mu.Lock()
+		indices := make([]int, len(h.commits[id]))
+		for i, commit := range h.commits[id] {
+			indices[i] = commit.Index
+		}
+		h.mu.Unlock()
+		if len(indices) > 0 && indices[len(indices)-1] >= lastIndex {
+			return indices
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broker %d sent commits with indices %v, want them up to %d", id, indices, lastIndex)
+		}
+		sleepMs(5)
+	}
+}
+
+func checkContiguous(t *testing.T, id int, indices []int, first int, last int) {
+	t.Helper()
+	if len(indices) != last-first+1 || indices[0] != first {
+		t.Errorf("broker %d sent commits with indices %v, want %d to %d", id, indices, first, last)
+		return
+	}
+	for i := range indices {
+		if indices[i] != first+i {
+			t.Errorf("broker %d sent commits with indices %v, want %d to %d", id, indices, first, last)
+			return
+		}
+	}
+}
+
+func TestCommitIndicesAreContiguousAcrossRestarts(t *testing.T) {
+	options, reopen := boltOptions(t, 3)
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	followerId := (leaderId + 1) % 3
+
+	submit := func(n int) int {
+		batch := make([]LogEntry, n)
+		for i := range batch {
+			batch[i] = LogEntry{CRDTOperation: insertOp("a"), Document: "doc1"}
+		}
+		first, _ := h.cluster[leaderId].rm.submitBatch(batch)
+		if first < 0 {
+			t.Fatalf("leader %d refused the batch", leaderId)
+		}
+		return first + n - 1
+	}
+
+	// several batches, each committed before the next is sent
+	var last int
+	for _, n := range []int{1, 5, 3} {
+		last = submit(n)
+		waitForApplied(t, h, []int{0, 1, 2}, last)
+	}
+	before := waitForCommitIndices(t, h, followerId, last)
+	checkContiguous(t, followerId, before, 0, last)
+
+	// the restarted follower doesn't send what it sent before the crash again
+	// and doesn't skip anything either
+	h.CrashPeer(followerId)
+	reopen(followerId)
+	h.RestartPeer(followerId)
+	for _, n := range []int{4, 2} {
+		last = submit(n)
+		waitForApplied(t, h, []int{0, 1, 2}, last)
+	}
+
+	for id := range 3 {
+		first := 0
+		if id == followerId {
+			first = before[len(before)-1] + 1
+		}
+		checkContiguous(t, id, waitForCommitIndices(t, h, id, last), first, last)
+	}
+}
@@ -0,0 +1,178 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often an idle stream gets a comment, so proxies don't close it
+const streamKeepAlive = 15 * time.Second
+
+// data of each event of GET /commits/stream. the event id is the log index,
+// clients that reconnect send the last one they got as Last-Event-ID
+type StreamedCommit struct {
+	// replication group of the entry, Index counts within it. see ?shard=
+	Shard     int         `json:"shard,omitempty"`
+	Index     int         `json:"index"`
+	Term      int         `json:"term"`
+	Document  string      `json:"document"`
+	Operation CRDTMessage `json:"operation"`
+}
+
+// wakes up the commit streams and the push loops whenever entries are applied
+type commitNotifier struct {
+	mu sync.Mutex
+	// closed and replaced every time entries are applied
+	applied chan struct{}
+
+	// closed when the http server shuts down, streams never finish on their own
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+func newCommitNotifier() *commitNotifier {
+	return &commitNotifier{applied: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+// closed the next time entries are applied
+func (n *commitNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.applied
+}
+
+func (n *commitNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.applied)
+	n.applied = make(chan struct{})
+}
+
+func (n *commitNotifier) stop() {
+	n.stopOnce.Do(func() { close(n.stopped) })
+}
+
+// the crdt message of a committed entry as application servers get it, false
+// for entries that aren't operations like config entries
+func committedMessage(entry LogEntry) (CRDTMessage, bool) {
+	msg, err := entry.Operation()
+	if err != nil {
+		return CRDTMessage{}, false
+	}
+	// operations from logs written before they were structured only have the document name
+	if opIndex, err := strconv.ParseInt(entry.Document, 10, 64); err == nil {
+		msg.OpIndex = opIndex
+	}
+	msg.Source = "broker"
+	return msg, true
+}
+
+// up to limit applied entries from log index next on, all of them when limit
+// is 0. false when next was trimmed after a snapshot
+func (rm *ReplicationModule) appliedSince(next int, limit int) ([]LogEntry, bool) {
+	rm.broker.mu2.Lock()
+	defer rm.broker.mu2.Unlock()
+	if next < rm.logBaseIndex {
+		return nil, false
+	}
+	if next > rm.lastApplied {
+		return nil, true
+	}
+	to := rm.lastApplied + 1
+	if limit > 0 {
+		to = min(to, next+limit)
+	}
+	return slices.Clone(rm.logSlice(next, to)), true
+}
+
+// http func streaming committed entries to application servers as server-sent
+// events, starting after Last-Event-ID or at the oldest entry still in the log.
+// one replication group per stream, see ?shard=
+func (broker *BrokerServer) handleCommitStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	rm, err := broker.shardOf(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	broker.mu2.Lock()
+	next := rm.logBaseIndex
+	broker.mu2.Unlock()
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		last, err := strconv.Atoi(lastID)
+		if err != nil || last < -1 {
+			http.Error(w, fmt.Sprintf("Invalid Last-Event-ID %q", lastID), http.StatusBadRequest)
+			return
+		}
+		if last+1 < next {
+			http.Error(w, fmt.Sprintf("Entries before %d were trimmed after a snapshot", next), http.StatusGone)
+			return
+		}
+		next = last + 1
+	}
+
+	// streams stay open for as long as the client wants, past the http server's timeouts
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		// taken before reading the log, so entries applied in between wake us up
+		applied := broker.streams.wait()
+		entries, ok := rm.appliedSince(next, 0)
+		if !ok {
+			// the client reconnects and is told what was trimmed
+			return
+		}
+		for i, entry := range entries {
+			if err := writeCommitEvent(w, rm.shard, next+i, entry); err != nil {
+				return
+			}
+		}
+		next += len(entries)
+		flusher.Flush()
+
+		select {
+		case <-applied:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-broker.streams.stopped:
+			return
+		}
+	}
+}
+
+// entries that aren't operations are left out, their index is just skipped
+func writeCommitEvent(w http.ResponseWriter, shard int, index int, entry LogEntry) error {
+	msg, ok := committedMessage(entry)
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(StreamedCommit{Shard: shard, Index: index, Term: entry.Term, Document: entry.Document, Operation: msg})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", index, data)
+	return err
+}
@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// GET /commits/stream, resuming after lastID when it isn't empty
+func openCommitStream(t *testing.T, broker *BrokerServer, lastID string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/commits/stream", broker.GetHTTPAddr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// the next event of the stream, keep-alive comments are skipped
+func readCommitEvent(t *testing.T, r *bufio.Reader) (string, StreamedCommit) {
+	t.Helper()
+	var id string
+	var commit StreamedCommit
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && id != "":
+			return id, commit
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &commit); err != nil {
+				t.Fatalf("decoding event %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestCommitStreamResumes(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+
+	submit := func(value string) {
+		t.Helper()
+		msg := CRDTMessage{Type: OpInsert, Index: 0, Value: value, ReplicaID: "r1", OpIndex: 3, Source: "client", SchemaVersion: CurrentSchemaVersion}
+		if index, _, err := leader.SubmitOperation(msg); err != nil || index < 0 {
+			t.Fatalf("SubmitOperation(%+v) = %d, %v", msg, index, err)
+		}
+	}
+	check := func(id string, commit StreamedCommit, index int) {
+		t.Helper()
+		if id != strconv.Itoa(index) || commit.Index != index {
+			t.Errorf("event %s holds index %d, want %d", id, commit.Index, index)
+		}
+		want := CRDTMessage{Type: OpInsert, Index: 0, Value: fmt.Sprint(index), ReplicaID: "r1", OpIndex: 3, Source: "broker", SchemaVersion: CurrentSchemaVersion}
+		if !reflect.DeepEqual(commit.Operation, want) || commit.Document != "3" || commit.Term < 1 {
+			t.Errorf("event %s is %+v, want %+v in \"3\"", id, commit, want)
+		}
+	}
+
+	// the first entries are committed before anyone listens, the stream starts with them
+	for i := 0; i < 3; i++ {
+		submit(fmt.Sprint(i))
+	}
+	waitForApplied(t, h, []int{leaderId}, 2)
+
+	resp := openCommitStream(t, leader, "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream got status %d and content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(resp.Body)
+	var lastID string
+	for i := 0; i < 3; i++ {
+		var commit StreamedCommit
+		lastID, commit = readCommitEvent(t, stream)
+		check(lastID, commit, i)
+	}
+	// then the ones committed while it is open
+	submit("3")
+	lastID, commit := readCommitEvent(t, stream)
+	check(lastID, commit, 3)
+
+	// the connection drops and entries keep being committed
+	resp.Body.Close()
+	for i := 4; i < 8; i++ {
+		submit(fmt.Sprint(i))
+	}
+
+	resp = openCommitStream(t, leader, lastID)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("resumed stream got status %d", resp.StatusCode)
+	}
+	stream = bufio.NewReader(resp.Body)
+	for i := 4; i < 8; i++ {
+		id, commit := readCommitEvent(t, stream)
+		check(id, commit, i)
+	}
+
+	bad := openCommitStream(t, leader, "x")
+	bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Errorf("Last-Event-ID x got status %d, want %d", bad.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,146 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+)
+
+// committed entries for code embedding a broker, for as many consumers as it
+// has, each at its own pace. commitChanSender of every replication group hands
+// each entry it applies to the subscribers of the group without waiting, a
+// goroutine per subscriber passes them on, so a slow subscriber never holds up
+// commits or the others. what a subscriber hasn't read yet is queued for it
+
+// what SubscribeCommits returns. C is closed once Cancel is called, the
+// broker shuts down or the subscription can't start, Err says which
+type CommitSubscription struct {
+	C <-chan CommitEntry
+
+	cancelled chan struct{}
+	cancel    sync.Once
+
+	// wakes up the goroutine passing entries on, buffered so queueing never waits
+	wake chan struct{}
+
+	mu sync.Mutex
+	// applied entries the subscriber hasn't been sent yet
+	pending []CommitEntry
+	err     error
+
+	// the replication group subscribed to and the first log index in it the
+	// subscriber wants. guarded by mu2
+	shard int
+	next  int
+}
+
+// stop the subscription, C is closed soon after
+func (sub *CommitSubscription) Cancel() {
+	sub.cancel.Do(func() { close(sub.cancelled) })
+}
+
+// why C was closed. nil while it is open and after Cancel, ErrEntriesCompacted
+// when fromIndex was trimmed off the log, ErrUnknownShard for a group the
+// broker doesn't have and ErrBrokerDead after Shutdown
+func (sub *CommitSubscription) Err() error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return sub.err
+}
+
+// entries of replication group shard from log index fromIndex on that were
+// already applied, then every entry applied in it after them, in the order
+// they were applied, see shard.go. when entries from fromIndex on were trimmed
+// after a snapshot C is closed right away, like GET /commits/stream answers
+// 410. only call it after Serve
+func (broker *BrokerServer) SubscribeCommits(shard int, fromIndex int) *CommitSubscription {
+	commits := make(chan CommitEntry)
+	sub := &CommitSubscription{
+		C:         commits,
+		cancelled: make(chan struct{}),
+		wake:      make(chan struct{}, 1),
+		shard:     shard,
+		next:      max(fromIndex, 0),
+	}
+
+	rm, err := broker.router.shard(shard)
+	if err != nil {
+		sub.err = err
+		close(commits)
+		return sub
+	}
+	broker.mu2.Lock()
+	if sub.next < rm.logBaseIndex && sub.next <= rm.lastApplied {
+		sub.err = fmt.Errorf("%w: entries before %d are only in the snapshot", ErrEntriesCompacted, rm.logBaseIndex)
+		broker.mu2.Unlock()
+		close(commits)
+		return sub
+	}
+	// what was applied before now, later entries come from commitChanSender
+	for index := sub.next; index <= rm.lastApplied; index++ {
+		entry := rm.entry(index)
+		sub.pending = append(sub.pending, CommitEntry{CRDTOperation: entry.operation(), Index: index, Term: entry.Term, Shard: shard})
+	}
+	sub.next = max(sub.next, rm.lastApplied+1)
+	broker.subscribers[sub] = struct{}{}
+	broker.mu2.Unlock()
+
+	go func() {
+		defer close(commits)
+		defer func() {
+			broker.mu2.Lock()
+			delete(broker.subscribers, sub)
+			broker.mu2.Unlock()
+		}()
+		for {
+			sub.mu.Lock()
+			entries := sub.pending
+			sub.pending = nil
+			sub.mu.Unlock()
+
+			for _, commit := range entries {
+				select {
+				case commits <- commit:
+				case <-sub.cancelled:
+					return
+				case <-broker.quit:
+					sub.stop(ErrBrokerDead)
+					return
+				}
+			}
+
+			select {
+			case <-sub.wake:
+			case <-sub.cancelled:
+				return
+			case <-broker.quit:
+				sub.stop(ErrBrokerDead)
+				return
+			}
+		}
+	}()
+	return sub
+}
+
+func (sub *CommitSubscription) stop(err error) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.err = err
+}
+
+// queue an entry commitChanSender applied for every subscriber
+// caller must hold mu2
+func (broker *BrokerServer) notifySubscribersLocked(commit CommitEntry) {
+	for sub := range broker.subscribers {
+		// entries before next were queued when it subscribed
+		if commit.Shard != sub.shard || commit.Index < sub.next {
+			continue
+		}
+		sub.mu.Lock()
+		sub.pending = append(sub.pending, commit)
+		sub.mu.Unlock()
+		select {
+		case sub.wake <- struct{}{}:
+		default:
+		}
+	}
+}
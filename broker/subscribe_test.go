@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// the next n commits on a subscription
+func receiveCommits(t *testing.T, commits <-chan CommitEntry, n int) []CommitEntry {
+	t.Helper()
+	var got []CommitEntry
+	timeout := time.After(5 * time.Second)
+	for len(got) < n {
+		select {
+		case commit, ok := <-commits:
+			if !ok {
+				t.Fatalf("subscription closed after %d of %d commits", len(got), n)
+			}
+			got = append(got, commit)
+		case <-timeout:
+			t.Fatalf("got %d of %d commits", len(got), n)
+		}
+	}
+	return got
+}
+
+func TestSubscribersGetConsistentCommits(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+
+	submit := func(from int, n int) {
+		batch := make([]LogEntry, n)
+		for i := range batch {
+			batch[i] = LogEntry{CRDTOperation: insertOp(fmt.Sprint(from + i)), Document: "doc1"}
+		}
+		if first, _ := leader.rm.submitBatch(batch); first < 0 {
+			t.Fatalf("leader %d refused the batch", leaderId)
+		}
+	}
+
+	// one subscriber from the start, one that joins later from the middle
+	fromStart := leader.SubscribeCommits(0, 0)
+	defer fromStart.Cancel()
+	submit(0, 10)
+	waitForApplied(t, h, []int{leaderId}, 9)
+	fromMiddle := leader.SubscribeCommits(0, 5)
+	submit(10, 10)
+
+	all := receiveCommits(t, fromStart.C, 20)
+	later := receiveCommits(t, fromMiddle.C, 15)
+	for i, commit := range all {
+		if commit.Index != i {
+			t.Fatalf("commit %d has index %d", i, commit.Index)
+		}
+	}
+	if !reflect.DeepEqual(later, all[5:]) {
+		t.Errorf("subscriber from 5 got %+v, want %+v", later, all[5:])
+	}
+
+	// cancelling one leaves the other subscribed
+	fromMiddle.Cancel()
+	for range fromMiddle.C {
+	}
+	if err := fromMiddle.Err(); err != nil {
+		t.Errorf("cancelled subscription ended with %v", err)
+	}
+	submit(20, 1)
+	if next := receiveCommits(t, fromStart.C, 1); next[0].Index != 20 {
+		t.Errorf("commit after cancelling the other subscriber has index %d, want 20", next[0].Index)
+	}
+}
+
+func TestSubscribingToTrimmedEntries(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+
+	for i := 0; i < 4; i++ {
+		h.SubmitToServer(leaderId, "doc1", insertOp(fmt.Sprint(i)))
+	}
+	waitForApplied(t, h, []int{leaderId}, 3)
+	leader.rm.TrimLog(1)
+
+	// like GET /commits/stream answering 410, instead of starting at the snapshot
+	trimmed := leader.SubscribeCommits(0, 0)
+	if _, ok := <-trimmed.C; ok {
+		t.Fatal("subscription from a trimmed entry got a commit")
+	}
+	if err := trimmed.Err(); !errors.Is(err, ErrEntriesCompacted) {
+		t.Errorf("subscription from a trimmed entry ended with %v, want %v", err, ErrEntriesCompacted)
+	}
+
+	// entries after the trim are still there
+	kept := leader.SubscribeCommits(0, 2)
+	if got := receiveCommits(t, kept.C, 2); got[0].Index != 2 || got[1].Index != 3 {
+		t.Errorf("subscription from 2 got %+v", got)
+	}
+
+	// shutting down ends it
+	h.CrashPeer(leaderId)
+	for range kept.C {
+	}
+	if err := kept.Err(); !errors.Is(err, ErrBrokerDead) {
+		t.Errorf("subscription ended with %v after shutdown, want %v", err, ErrBrokerDead)
+	}
+}
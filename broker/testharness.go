@@ -1,8 +1,11 @@
 package broker
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"reflect"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -34,9 +37,19 @@ type Harness struct {
 	t *testing.T
 
 	peerAddrs map[int]string
+
+	options []BrokerOptions
+
+	// pairs of brokers split by PartitionPeers, reconnected by HealPartition
+	partitioned [][2]int
 }
 
 func NewHarness(t *testing.T, n int) *Harness {
+	return NewHarnessWithOptions(t, n, make([]BrokerOptions, n))
+}
+
+// options[i] is passed to broker i, and again when it is restarted
+func NewHarnessWithOptions(t *testing.T, n int, options []BrokerOptions) *Harness {
 	ns := make([]*BrokerServer, n)
 	connected := make([]bool, n)
 	alive := make([]bool, n)
@@ -59,8 +72,23 @@ func NewHarness(t *testing.T, n int) *Harness {
 		}
 
 		commitChans[i] = make(chan CommitEntry)
-		ns[i] = NewBrokerServer(i, peerIds, peerAddrs, peerAddrs[i], Follower, ready, commitChans[i])
-		ns[i].Serve()
+		var err error
+		ns[i], err = NewBrokerServerFromConfig(ClusterConfig{
+			BrokerId:     i,
+			PeerIds:      peerIds,
+			PeerAddrs:    peerAddrs,
+			HTTPAddr:     peerAddrs[i],
+			InitialState: Follower,
+			Ready:        ready,
+			CommitChan:   commitChans[i],
+			Options:      options[i],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ns[i].Serve(); err != nil {
+			t.Fatal(err)
+		}
 		alive[i] = true
 
 	}
@@ -85,6 +113,8 @@ func NewHarness(t *testing.T, n int) *Harness {
 		alive:       alive,
 		n:           n,
 		t:           t,
+		peerAddrs:   peerAddrs,
+		options:     options,
 	}
 
 	for i := 0; i < n; i++ {
@@ -102,7 +132,7 @@ func (h *Harness) Shutdown() {
 	for i := 0; i < h.n; i++ {
 		if h.alive[i] {
 			h.alive[i] = false
-			h.cluster[i].Shutdown()
+			shutdownNow(h.cluster[i])
 		}
 	}
 	for i := 0; i < h.n; i++ {
@@ -111,6 +141,13 @@ func (h *Harness) Shutdown() {
 
 }
 
+// shut a broker down without waiting for its entries to commit, like a crash
+func shutdownNow(broker *BrokerServer) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	broker.Shutdown(ctx)
+}
+
 func (h *Harness) DisconnectPeer(id int) {
 	tlog("Disconnect %d", id)
 	h.cluster[id].DisconnectAll()
@@ -139,11 +176,12 @@ func (h *Harness) ReconnectPeer(id int) {
 
 // simulates crash by disconnecting and shutting down server
 // the same server is not reconnected so will have empty logs
+// unless its options have a Storage to restore from
 func (h *Harness) CrashPeer(id int) {
 	tlog("Crash %d", id)
 	h.DisconnectPeer(id)
 	h.alive[id] = false
-	h.cluster[id].Shutdown()
+	shutdownNow(h.cluster[id])
 
 	h.mu.Lock()
 	h.commits[id] = h.commits[id][:0]
@@ -164,8 +202,14 @@ func (h *Harness) RestartPeer(id int) {
 	}
 
 	ready := make(chan any)
-	h.cluster[id] = NewBrokerServer(id, peerIds, h.peerAddrs, h.peerAddrs[id], Follower, ready, h.commitChans[id])
-	h.cluster[id].Serve()
+	server, err := NewBrokerServer(id, peerIds, h.peerAddrs, h.peerAddrs[id], Follower, ready, h.commitChans[id], h.options[id])
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.cluster[id] = server
+	if err := h.cluster[id].Serve(); err != nil {
+		h.t.Fatal(err)
+	}
 	h.ReconnectPeer(id)
 	close(ready)
 	h.alive[id] = true
@@ -173,6 +217,84 @@ func (h *Harness) RestartPeer(id int) {
 
 }
 
+// simulates a process restart. the broker is shut down without telling its
+// peers and a new one is started on the same addresses. no connections are
+// made for it, the peers have to find it again on their own
+func (h *Harness) RestartPeerProcess(id int) {
+	tlog("Restart process %d", id)
+	shutdownNow(h.cluster[id])
+
+	peerIds := make([]int, 0)
+	for p := 0; p < h.n; p++ {
+		if p != id {
+			peerIds = append(peerIds, p)
+		}
+	}
+
+	// the election timer starts on the first heartbeat from the leader
+	server, err := NewBrokerServer(id, peerIds, h.peerAddrs, h.peerAddrs[id], Follower, make(chan any), h.commitChans[id], h.options[id])
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.cluster[id] = server
+	if err := h.cluster[id].Serve(); err != nil {
+		h.t.Fatal(err)
+	}
+
+	h.mu.Lock()
+	h.commits[id] = h.commits[id][:0]
+	h.mu.Unlock()
+}
+
+// start a broker that isn't part of the cluster configuration yet and connect
+// it to every live broker. it won't time out and campaign until it hears from
+// a leader, so the caller can add it with AddPeer. returns the new broker's id
+func (h *Harness) AddNewServer() int {
+	id := h.n
+	tlog("Add new server %d", id)
+
+	peerIds := make([]int, 0)
+	peerAddrs := make(map[int]string)
+	for p := 0; p < id; p++ {
+		peerIds = append(peerIds, p)
+		peerAddrs[p] = h.peerAddrs[p]
+	}
+	peerAddrs[id] = fmt.Sprintf("127.0.0.1:%d", 8000+id)
+
+	commitChan := make(chan CommitEntry)
+	server, err := NewBrokerServer(id, peerIds, peerAddrs, peerAddrs[id], Follower, make(chan any), commitChan, BrokerOptions{})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		h.t.Fatal(err)
+	}
+
+	h.mu.Lock()
+	h.cluster = append(h.cluster, server)
+	h.commitChans = append(h.commitChans, commitChan)
+	h.commits = append(h.commits, nil)
+	h.connected = append(h.connected, true)
+	h.alive = append(h.alive, true)
+	h.options = append(h.options, BrokerOptions{})
+	h.n++
+	h.mu.Unlock()
+
+	for j := 0; j < id; j++ {
+		if h.alive[j] {
+			if err := server.ConnectToPeer(j, h.cluster[j].GetListenAddr()); err != nil {
+				h.t.Fatal(err)
+			}
+			if err := h.cluster[j].ConnectToPeer(id, server.GetListenAddr()); err != nil {
+				h.t.Fatal(err)
+			}
+		}
+	}
+
+	go h.collectCommits(id)
+	return id
+}
+
 func (h *Harness) CheckSingleLeader() (int, int) {
 	retries := 10
 	for r := 0; r < retries; r++ {
@@ -213,6 +335,62 @@ func (h *Harness) CheckNoLeader() {
 	}
 }
 
+// cut the connections between every broker in groupA and every broker in groupB
+// brokers on the same side keep talking to each other
+func (h *Harness) PartitionPeers(groupA, groupB []int) {
+	tlog("Partition %v / %v", groupA, groupB)
+	for _, a := range groupA {
+		for _, b := range groupB {
+			h.cluster[a].DisconnectPeer(b)
+			h.cluster[b].DisconnectPeer(a)
+			h.partitioned = append(h.partitioned, [2]int{a, b})
+		}
+	}
+}
+
+// reconnect every pair of brokers split by PartitionPeers
+func (h *Harness) HealPartition() {
+	tlog("Heal partition")
+	for _, pair := range h.partitioned {
+		a, b := pair[0], pair[1]
+		if !h.alive[a] || !h.alive[b] {
+			continue
+		}
+		if err := h.cluster[a].ConnectToPeer(b, h.cluster[b].GetListenAddr()); err != nil {
+			h.t.Fatal(err)
+		}
+		if err := h.cluster[b].ConnectToPeer(a, h.cluster[a].GetListenAddr()); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+	h.partitioned = nil
+}
+
+// like CheckSingleLeader but only looks at the brokers in ids, e.g. one side of a partition
+func (h *Harness) CheckSingleLeaderAmong(ids []int) (int, int) {
+	h.t.Helper()
+	for r := 0; r < 10; r++ {
+		leaderId := -1
+		leaderTerm := -1
+		for _, i := range ids {
+			_, term, isLeader := h.cluster[i].em.Report()
+			if isLeader {
+				if leaderId >= 0 {
+					h.t.Fatalf("both %d and %d think they're leaders", leaderId, i)
+				}
+				leaderId = i
+				leaderTerm = term
+			}
+		}
+		if leaderId >= 0 {
+			return leaderId, leaderTerm
+		}
+		time.Sleep(150 * time.Millisecond)
+	}
+	h.t.Fatalf("leader not found among %v", ids)
+	return -1, -1
+}
+
 func (h *Harness) CompareCommittedLogs() {
 	h.t.Helper()
 	h.mu.Lock()
@@ -244,7 +422,7 @@ func (h *Harness) CompareCommittedLogs() {
 				for j := 0; j < h.n; j++ {
 					if i != j && h.connected[j] {
 						// If any entry differs between servers, log the error
-						if h.commits[j][c].CRDTOperation != operation {
+						if !reflect.DeepEqual(h.commits[j][c].CRDTOperation, operation) {
 							h.t.Errorf("commits[%d][%d].CRDTOperation mismatch: got %v, want %v", j, c, h.commits[j][c].CRDTOperation, operation)
 						}
 						if h.commits[j][c].Index != index {
@@ -310,6 +488,36 @@ func (h *Harness) CheckCommitted(cmd int) (nc int, index int) {
 	return -1, -1
 }
 
+// every connected broker reaches commit index index in the first replication
+// group and has sent the entry at index on its commit channel within 5 seconds
+func (h *Harness) WaitForCommit(index int) {
+	h.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; i < h.n; i++ {
+		if !h.connected[i] {
+			continue
+		}
+		if err := h.cluster[i].WaitForCommit(0, index, time.Until(deadline)); err != nil {
+			h.t.Fatalf("server %d: %v", i, err)
+		}
+		// commitChanSender delivers after the commit index moved
+		for !h.delivered(i, index) {
+			if time.Now().After(deadline) {
+				h.t.Fatalf("server %d: entry %d committed but not delivered on its commit channel", i, index)
+			}
+			sleepMs(5)
+		}
+	}
+}
+
+// whether collectCommits got the entry at index from broker i
+func (h *Harness) delivered(i, index int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	commits := h.commits[i]
+	return len(commits) > 0 && commits[len(commits)-1].Index >= index
+}
+
 func (h *Harness) SubmitToServer(serverId int, document string, cmd any) int {
 	return h.cluster[serverId].rm.Submit(document, cmd)
 }
@@ -332,11 +540,18 @@ func (h *Harness) collectCommits(i int) {
 	}
 }
 
-func (h *Harness) GetLogsAndCommitIndexFromServer(serverId int) ([]LogEntry, []LogEntry, int, int) {
+// the broker's log, the entries it sent on its commit channel since it was
+// last started, its commit index and the length of its log
+func (h *Harness) GetLogsAndCommitIndexFromServer(serverId int) ([]LogEntry, []CommitEntry, int, int) {
+	h.mu.Lock()
+	// copies, the broker keeps appending after the locks are released
+	commits := slices.Clone(h.commits[serverId])
+	h.mu.Unlock()
+
 	server := h.cluster[serverId]
-	server.mu.Lock()
-	defer server.mu.Unlock()
-	return server.rm.log, server.rm.committedLog, server.rm.commitIndex, len(server.rm.log)
+	server.mu2.Lock()
+	defer server.mu2.Unlock()
+	return slices.Clone(server.rm.log), commits, server.rm.commitIndex, len(server.rm.log)
 }
 
 // expose broker server cluster to appserver
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spans for the rpcs between brokers and the http requests they answer, see
+// BrokerOptions.TracerProvider. the trace context crosses rpcs in the
+// TraceParent and TraceState fields of the args, in the format of the w3c
+// traceparent and tracestate headers. a CRDT message submitted on /crdt is
+// followed to the AppendEntries that replicate it and to its commit
+
+const tracerName = "clarity/broker"
+
+var tracePropagator = propagation.TraceContext{}
+
+func (opts BrokerOptions) tracerProvider() trace.TracerProvider {
+	if opts.TracerProvider == nil {
+		return otel.GetTracerProvider()
+	}
+	return opts.TracerProvider
+}
+
+// the trace context fields of rpc args, as a carrier for tracePropagator
+type traceFields struct {
+	parent *string
+	state  *string
+}
+
+func (f traceFields) Get(key string) string {
+	switch key {
+	case "traceparent":
+		return *f.parent
+	case "tracestate":
+		return *f.state
+	}
+	return ""
+}
+
+func (f traceFields) Set(key string, value string) {
+	switch key {
+	case "traceparent":
+		*f.parent = value
+	case "tracestate":
+		*f.state = value
+	}
+}
+
+func (f traceFields) Keys() []string {
+	return []string{"traceparent", "tracestate"}
+}
+
+// write the trace context of ctx into the fields of rpc args
+func injectTrace(ctx context.Context, parent *string, state *string) {
+	tracePropagator.Inject(ctx, traceFields{parent, state})
+}
+
+// a ctx with the trace context an rpc was sent with, if any
+func extractTrace(parent string, state string) context.Context {
+	return tracePropagator.Extract(context.Background(), traceFields{&parent, &state})
+}
+
+// remember the span entries from index first on were submitted in, so their
+// replication and commit show up in the same trace. caller must hold mu2
+func (rm *ReplicationModule) traceEntries(ctx context.Context, first int, n int) {
+	span := trace.SpanContextFromContext(ctx)
+	if !span.IsValid() {
+		return
+	}
+	for index := first; index < first+n; index++ {
+		rm.entryTraces[index] = span
+	}
+}
+
+// the span the first traced entry in [from, to] was submitted in
+// caller must hold mu2
+func (rm *ReplicationModule) entryTrace(from int, to int) (trace.SpanContext, bool) {
+	for index := from; index <= to && len(rm.entryTraces) > 0; index++ {
+		if span, ok := rm.entryTraces[index]; ok {
+			return span, true
+		}
+	}
+	return trace.SpanContext{}, false
+}
+
+// end the traces of the entries committed in [from, to] with a commit span
+// caller must hold mu2
+func (rm *ReplicationModule) traceCommits(from int, to int) {
+	for index := from; index <= to && len(rm.entryTraces) > 0; index++ {
+		span, ok := rm.entryTraces[index]
+		if !ok {
+			continue
+		}
+		delete(rm.entryTraces, index)
+		ctx := trace.ContextWithSpanContext(context.Background(), span)
+		_, commit := rm.broker.tracer.Start(ctx, "ReplicationModule.commit",
+			trace.WithAttributes(attribute.Int("index", index), attribute.Int("term", rm.broker.em.term)))
+		commit.End()
+	}
+}
+
+// forget the traces of entries from index on, they were dropped from the log
+// caller must hold mu2
+func (rm *ReplicationModule) dropEntryTraces(from int) {
+	for index := range rm.entryTraces {
+		if index >= from {
+			delete(rm.entryTraces, index)
+		}
+	}
+}
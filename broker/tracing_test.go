@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInsertIsTracedThroughCommit(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].TracerProvider = provider
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+
+	body, _ := json.Marshal(CRDTMessage{Type: OpInsert, Index: 0, Value: "a", ReplicaID: "r1", OpIndex: 1, Source: "client"})
+	resp, err := http.Post(fmt.Sprintf("http://%s/crdt", h.cluster[leaderId].GetHTTPAddr()), "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var receipt CRDTReceipt
+	if err := json.NewDecoder(resp.Body).Decode(&receipt); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForApplied(t, h, []int{0, 1, 2}, receipt.Index)
+
+	// spans named name whose parent is one of parents
+	childrenOf := func(spans tracetest.SpanStubs, parents tracetest.SpanStubs, name string) tracetest.SpanStubs {
+		var children tracetest.SpanStubs
+		for _, span := range spans {
+			for _, parent := range parents {
+				if span.Name == name && span.Parent.SpanID() == parent.SpanContext.SpanID() {
+					children = append(children, span)
+				}
+			}
+		}
+		return children
+	}
+	// the commit span is ended after the entry is applied on the leader
+	deadline := time.Now().Add(time.Second)
+	for {
+		spans := exporter.GetSpans()
+		var request tracetest.SpanStubs
+		for _, span := range spans {
+			if span.Name == "POST /crdt" {
+				request = append(request, span)
+			}
+		}
+		handled := childrenOf(spans, request, "BrokerServer.handleCRDTOperation")
+		sent := childrenOf(spans, handled, "ReplicationModule.sendAE")
+		appended := childrenOf(spans, sent, "ReplicationModule.AppendEntries")
+		committed := childrenOf(spans, handled, "ReplicationModule.commit")
+		if len(request) == 1 && len(handled) == 1 && len(sent) >= 2 && len(appended) >= 2 && len(committed) == 1 {
+			if trace := handled[0].SpanContext.TraceID(); appended[0].SpanContext.TraceID() != trace || committed[0].SpanContext.TraceID() != trace {
+				t.Errorf("replication and commit are in other traces than trace %s of the insert", trace)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d request, %d handler, %d sendAE, %d AppendEntries and %d commit spans, want 1, 1, 2 or more, 2 or more and 1",
+				len(request), len(handled), len(sent), len(appended), len(committed))
+		}
+		sleepMs(10)
+	}
+}
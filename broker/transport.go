@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+)
+
+// how brokers send each other rpcs. methods are named like net/rpc service
+// methods: ElectionModule.RequestVote, ElectionModule.WhoIsLeader,
+// ReplicationModule.AppendEntries and ReplicationModule.InstallSnapshot.
+// the broker dials and accepts the connections, with tls when RPCTLS is set,
+// and the transport speaks its protocol over them
+type Transport interface {
+	// a client for the rpc server at the other end of the connections dial
+	// opens. it may call dial again to reconnect
+	NewClient(dial func() (net.Conn, error)) (TransportClient, error)
+
+	// a server answering rpcs with election and replication
+	NewServer(election ElectionService, replication ReplicationService) (TransportServer, error)
+}
+
+// the rpcs a broker answers, served by ElectionModule and ReplicationModule
+// or by an RPCProxy in front of them
+type ElectionService interface {
+	RequestVote(args RequestVoteArgs, reply *RequestVoteReply) error
+	WhoIsLeader(args WhoIsLeaderArgs, reply *WhoIsLeaderReply) error
+}
+
+type ReplicationService interface {
+	AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error
+}
+
+// wrapped by the errors of calls that failed because the connection to the
+// peer is gone. the broker drops the client and redials the peer's http
+// address on the next call, a restarted peer listens for rpcs somewhere else
+var ErrConnectionBroken = errors.New("rpc connection broken")
+
+type TransportClient interface {
+	// call serviceMethod, returning ctx.Err() once ctx is done. reply must
+	// not be read if an error is returned, the call may still be writing it
+	Call(ctx context.Context, serviceMethod string, args any, reply any) error
+	Close() error
+}
+
+type TransportServer interface {
+	// answer rpcs on conn until it is closed
+	ServeConn(conn net.Conn)
+	Close() error
+}
+
+// net/rpc with gob, the transport brokers have always used
+type NetRPCTransport struct{}
+
+func (NetRPCTransport) NewClient(dial func() (net.Conn, error)) (TransportClient, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return netRPCClient{rpc.NewClient(conn)}, nil
+}
+
+func (NetRPCTransport) NewServer(election ElectionService, replication ReplicationService) (TransportServer, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("ElectionModule", election); err != nil {
+		return nil, err
+	}
+	if err := server.RegisterName("ReplicationModule", replication); err != nil {
+		return nil, err
+	}
+	return netRPCServer{server}, nil
+}
+
+type netRPCClient struct {
+	*rpc.Client
+}
+
+func (c netRPCClient) Call(ctx context.Context, serviceMethod string, args any, reply any) error {
+	call := c.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err := call.Error
+		if errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("%w: %w", ErrConnectionBroken, err)
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type netRPCServer struct {
+	server *rpc.Server
+}
+
+func (s netRPCServer) ServeConn(conn net.Conn) {
+	s.server.ServeConn(conn)
+}
+
+func (netRPCServer) Close() error {
+	return nil
+}
+
+func (broker *BrokerServer) transport() Transport {
+	if broker.options.Transport != nil {
+		return broker.options.Transport
+	}
+	return NetRPCTransport{}
+}
@@ -0,0 +1,222 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// grpc with the services and messages in raftpb/raft.proto, so brokers and test
+// doubles don't have to be written in go. tls is done by the broker on the
+// connections like for net/rpc, so grpc itself runs without credentials
+type GRPCTransport struct{}
+
+// the package of raft.proto
+const grpcPackage = "clarity.broker"
+
+// the grpc method of a net/rpc style service method,
+// ElectionModule.RequestVote is /clarity.broker.ElectionModule/RequestVote
+func grpcMethod(serviceMethod string) string {
+	return "/" + grpcPackage + "." + strings.Replace(serviceMethod, ".", "/", 1)
+}
+
+// protobuf through the generated messages, see grpc_messages.go. named proto
+// so the content type is the one grpc peers in other languages expect
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T has no protobuf encoding", v)
+	}
+	return m.appendWire(nil)
+}
+
+func (wireCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(wireReader)
+	if !ok {
+		return fmt.Errorf("%T has no protobuf encoding", v)
+	}
+	return m.readWire(data)
+}
+
+func (wireCodec) Name() string {
+	return "proto"
+}
+
+func (GRPCTransport) NewClient(dial func() (net.Conn, error)) (TransportClient, error) {
+	conn, err := grpc.NewClient("passthrough:///broker",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return dial()
+		}),
+		// reconnect like reconnect does for net/rpc, grpc's own backoff
+		// goes up to two minutes which is far longer than an election
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  minRedialBackoff,
+				Multiplier: 2,
+				Jitter:     0.2,
+				MaxDelay:   maxRedialBackoff,
+			},
+		}),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(wireCodec{}), grpc.MaxCallRecvMsgSize(math.MaxInt32)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// grpc connects lazily, start now so the first heartbeat doesn't wait
+	conn.Connect()
+	return grpcClient{conn}, nil
+}
+
+type grpcClient struct {
+	conn *grpc.ClientConn
+}
+
+func (c grpcClient) Call(ctx context.Context, serviceMethod string, args any, reply any) error {
+	err := c.conn.Invoke(ctx, grpcMethod(serviceMethod), args, reply)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if status.Code(err) == codes.Unavailable {
+		return fmt.Errorf("%w: %w", ErrConnectionBroken, err)
+	}
+	return err
+}
+
+func (c grpcClient) Close() error {
+	return c.conn.Close()
+}
+
+// the handler of a unary method, decoding into Args and answering with Reply
+func grpcHandler[Args any, Reply any](call func(srv any, args Args, reply *Reply) error) grpc.MethodHandler {
+	return func(srv any, _ context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+		var args Args
+		if err := dec(&args); err != nil {
+			return nil, err
+		}
+		reply := new(Reply)
+		if err := call(srv, args, reply); err != nil {
+			return nil, err
+		}
+		return reply, nil
+	}
+}
+
+var grpcElectionServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcPackage + ".ElectionModule",
+	HandlerType: (*ElectionService)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "RequestVote", Handler: grpcHandler(func(srv any, args RequestVoteArgs, reply *RequestVoteReply) error {
+			return srv.(ElectionService).RequestVote(args, reply)
+		})},
+		{MethodName: "WhoIsLeader", Handler: grpcHandler(func(srv any, args WhoIsLeaderArgs, reply *WhoIsLeaderReply) error {
+			return srv.(ElectionService).WhoIsLeader(args, reply)
+		})},
+	},
+	Metadata: "raftpb/raft.proto",
+}
+
+var grpcReplicationServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcPackage + ".ReplicationModule",
+	HandlerType: (*ReplicationService)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "AppendEntries", Handler: grpcHandler(func(srv any, args AppendEntriesArgs, reply *AppendEntriesReply) error {
+			return srv.(ReplicationService).AppendEntries(args, reply)
+		})},
+		{MethodName: "InstallSnapshot", Handler: grpcHandler(func(srv any, args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+			return srv.(ReplicationService).InstallSnapshot(args, reply)
+		})},
+	},
+	Metadata: "raftpb/raft.proto",
+}
+
+func (GRPCTransport) NewServer(election ElectionService, replication ReplicationService) (TransportServer, error) {
+	// snapshots and batches of entries can be larger than grpc's default 4MB
+	server := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}), grpc.MaxRecvMsgSize(math.MaxInt32))
+	server.RegisterService(&grpcElectionServiceDesc, election)
+	server.RegisterService(&grpcReplicationServiceDesc, replication)
+
+	s := &grpcServer{
+		server: server,
+		listener: &connListener{
+			conns:  make(chan net.Conn),
+			closed: make(chan struct{}),
+		},
+	}
+	go server.Serve(s.listener)
+	return s, nil
+}
+
+type grpcServer struct {
+	server   *grpc.Server
+	listener *connListener
+}
+
+func (s *grpcServer) ServeConn(conn net.Conn) {
+	served := &servedConn{Conn: conn, done: make(chan struct{})}
+	select {
+	case s.listener.conns <- served:
+	case <-s.listener.closed:
+		conn.Close()
+		return
+	}
+	<-served.done
+}
+
+func (s *grpcServer) Close() error {
+	s.server.Stop()
+	return s.listener.Close()
+}
+
+// the listener grpc serves, it accepts the connections ServeConn is given
+type connListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return connListenerAddr{}
+}
+
+type connListenerAddr struct{}
+
+func (connListenerAddr) Network() string { return "broker" }
+func (connListenerAddr) String() string  { return "rpc connections" }
+
+// a connection handed to grpc, done is closed once grpc closes it
+type servedConn struct {
+	net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *servedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
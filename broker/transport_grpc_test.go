@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/townsag/clarity/crdt"
+)
+
+func TestGRPCMessagesRoundTrip(t *testing.T) {
+	operations := []any{
+		CRDTMessage{Type: OpInsert, Index: 2, Value: "é", ReplicaID: "r1", OpIndex: 7, Source: "client", SchemaVersion: CurrentSchemaVersion, OpID: "op1"},
+		insertOp("a"),
+		"",
+		42,
+		JointConfig{Old: []int{0, 1, 2}, New: []int{0, 1, 3}, Addrs: map[int]string{3: "127.0.0.1:9003"}},
+		NewConfig{Members: []int{0, 1, 3}, Addrs: map[int]string{0: "127.0.0.1:9000", 3: "127.0.0.1:9003"}},
+		CompressedLogEntry{Data: []byte{1, 2, 3}},
+		RollbackNotice{Index: 15},
+		nil,
+	}
+	args := AppendEntriesArgs{Term: 3, LeaderId: 0, PrevLogIndex: -1, PrevLogTerm: -1, LeaderCommit: 4}
+	for _, operation := range operations {
+		entry := LogEntry{CRDTOperation: operation, Term: 3, Document: "doc1"}
+		entry.Checksum = checksumOf(t, entry)
+		args.Entries = append(args.Entries, entry)
+	}
+
+	data, err := wireCodec{}.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded AppendEntriesArgs
+	if err := (wireCodec{}).Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, args) {
+		t.Errorf("AppendEntriesArgs decoded as\n%+v\nwant\n%+v", decoded, args)
+	}
+	for i, entry := range decoded.Entries {
+		if !entry.intact() {
+			t.Errorf("entry %d with %T fails its checksum after decoding", i, operations[i])
+		}
+	}
+
+	doc := crdt.NewTextCRDT("r1")
+	doc.LocalInsert(0, "a")
+	doc.LocalInsert(1, "b")
+	doc.LocalDelete(0)
+	snapshot := InstallSnapshotArgs{
+		Term: 3, LeaderId: 1, LastIncludedIndex: 9, LastIncludedTerm: 2,
+		Members: []int{0, 1, 2}, OldMembers: []int{0, 1},
+		Documents: documentCheckpoint{LastApplied: 9, Documents: map[string]crdt.TextCRDTSnapshot{"doc1": doc.Snapshot()}},
+	}
+	if data, err = (wireCodec{}).Marshal(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	var decodedSnapshot InstallSnapshotArgs
+	if err := (wireCodec{}).Unmarshal(data, &decodedSnapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodedSnapshot, snapshot) {
+		t.Errorf("InstallSnapshotArgs decoded as\n%+v\nwant\n%+v", decodedSnapshot, snapshot)
+	}
+
+	if _, err := (wireCodec{}).Marshal(AppendEntriesArgs{Entries: []LogEntry{{CRDTOperation: 1.5}}}); err == nil {
+		t.Errorf("an operation without a protobuf encoding was encoded")
+	}
+}
+
+func TestClusterOverGRPC(t *testing.T) {
+	options := make([]BrokerOptions, 3)
+	for i := range options {
+		options[i].Transport = GRPCTransport{}
+	}
+	h := NewHarnessWithOptions(t, 3, options)
+	defer h.Shutdown()
+	ids := []int{0, 1, 2}
+
+	submit := func(leaderId int, values ...string) int {
+		var last int
+		for _, value := range values {
+			msg := CRDTMessage{Type: OpInsert, Index: 0, Value: value, ReplicaID: "r1", OpIndex: 1, Source: "client", SchemaVersion: CurrentSchemaVersion}
+			index, _, err := h.cluster[leaderId].SubmitOperation(msg)
+			if err != nil || index < 0 {
+				t.Fatalf("SubmitOperation(%+v) on %d = %d, %v", msg, leaderId, index, err)
+			}
+			last = index
+		}
+		return last
+	}
+
+	leaderId, _ := h.CheckSingleLeader()
+	waitForApplied(t, h, ids, submit(leaderId, "a", "b", "c"))
+
+	// the restarted leader's peers reconnect to it through its http address
+	h.RestartPeerProcess(leaderId)
+	newLeaderId, _ := h.CheckSingleLeader()
+	waitForApplied(t, h, ids, submit(newLeaderId, "d", "e"))
+
+	leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(newLeaderId)
+	for _, id := range ids {
+		log, _, _, _ := h.GetLogsAndCommitIndexFromServer(id)
+		if !reflect.DeepEqual(log, leaderLog) {
+			t.Errorf("broker %d has log %v, leader %d has %v", id, log, newLeaderId, leaderLog)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// a CRDTMessage that decoded but can't be submitted, because of Field
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+
+	// position of the message in a POST /crdt/batch, nil for POST /crdt
+	Position *int `json:"message,omitempty"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.Position != nil {
+		return fmt.Sprintf("message %d: %s: %s", *e.Position, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// check the fields of a message before it is replicated to every broker
+func validateCRDTMessage(msg CRDTMessage) *ValidationError {
+	if !msg.Type.Valid() {
+		return &ValidationError{Field: "type", Message: fmt.Sprintf("must be %q or %q", OpInsert, OpDelete)}
+	}
+	if msg.Index < 0 {
+		return &ValidationError{Field: "index", Message: "must not be negative"}
+	}
+	if msg.ReplicaID == "" {
+		return &ValidationError{Field: "replica_id", Message: "must not be empty"}
+	}
+	// deletes may carry the deleted value or nothing, inserts need something to insert
+	if msg.Type == OpInsert {
+		if value, ok := msg.Value.(string); !ok || value == "" {
+			return &ValidationError{Field: "value", Message: "insert needs a non-empty string"}
+		}
+	}
+	return nil
+}
+
+// a decoding error that is really a bad field value rather than malformed json
+func validationErrorFromDecode(err error) *ValidationError {
+	if errors.Is(err, ErrUnknownOpType) {
+		return &ValidationError{Field: "type", Message: err.Error()}
+	}
+	return nil
+}
+
+// 422 with the ValidationError as json
+func writeValidationError(w http.ResponseWriter, verr *ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	// the client went away, nothing to tell it
+	json.NewEncoder(w).Encode(verr)
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCRDTValidation(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	origLeaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[origLeaderId]
+
+	tests := []struct {
+		name  string
+		body  string
+		want  int
+		field string
+	}{
+		{"valid insert", `{"type":"insert","index":0,"value":"a","replica_id":"r1","operation_index":1}`, http.StatusAccepted, ""},
+		{"valid delete without value", `{"type":"delete","index":0,"replica_id":"r1","operation_index":1}`, http.StatusAccepted, ""},
+		{"unknown type", `{"type":"upsert","index":0,"value":"a","replica_id":"r1","operation_index":1}`, http.StatusUnprocessableEntity, "type"},
+		{"empty type", `{"type":"","index":0,"value":"a","replica_id":"r1","operation_index":1}`, http.StatusUnprocessableEntity, "type"},
+		{"missing type", `{"index":0,"value":"a","replica_id":"r1","operation_index":1}`, http.StatusUnprocessableEntity, "type"},
+		{"negative index", `{"type":"insert","index":-1,"value":"a","replica_id":"r1","operation_index":1}`, http.StatusUnprocessableEntity, "index"},
+		{"missing replica id", `{"type":"insert","index":0,"value":"a","operation_index":1}`, http.StatusUnprocessableEntity, "replica_id"},
+		{"insert without value", `{"type":"insert","index":0,"replica_id":"r1","operation_index":1}`, http.StatusUnprocessableEntity, "value"},
+		{"insert of empty string", `{"type":"insert","index":0,"value":"","replica_id":"r1","operation_index":1}`, http.StatusUnprocessableEntity, "value"},
+		{"insert of a number", `{"type":"insert","index":0,"value":7,"replica_id":"r1","operation_index":1}`, http.StatusUnprocessableEntity, "value"},
+		{"type of the wrong json type", `{"type":7,"index":0,"value":"a","replica_id":"r1","operation_index":1}`, http.StatusBadRequest, ""},
+	}
+	accepted := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/crdt", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			leader.handleCRDTOperation(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if rec.Code == http.StatusAccepted {
+				accepted++
+			}
+			if tt.field == "" {
+				return
+			}
+			var verr ValidationError
+			if err := json.NewDecoder(rec.Body).Decode(&verr); err != nil {
+				t.Fatalf("decoding error response: %v", err)
+			}
+			if verr.Field != tt.field || verr.Message == "" {
+				t.Errorf("got error %+v, want one naming %s", verr, tt.field)
+			}
+		})
+	}
+
+	leaderLog, _, _, _ := h.GetLogsAndCommitIndexFromServer(origLeaderId)
+	if len(leaderLog) != accepted {
+		t.Errorf("leader log has %d entries, want only the %d valid messages", len(leaderLog), accepted)
+	}
+}
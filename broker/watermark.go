@@ -0,0 +1,67 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// longest GET /document/{id}/watermark?min waits for the document to get there
+const watermarkWait = 5 * time.Second
+
+// body of GET /document/{id}/watermark
+type DocumentWatermark struct {
+	Document  string `json:"document"`
+	Committed int    `json:"committed"`
+}
+
+// number of committed entries of document this broker has applied
+// 0 for documents it hasn't heard of
+func (broker *BrokerServer) DocumentWatermark(document string) int {
+	return broker.router.For(document).documents.watermark(document)
+}
+
+// http func for application servers waiting for their own writes. with ?min
+// the answer is held back until min entries of the document are committed or
+// watermarkWait passes, the client compares committed against min either way
+func (broker *BrokerServer) handleDocumentWatermark(w http.ResponseWriter, r *http.Request) {
+	document := r.PathValue("id")
+	want := 0
+	if query := r.URL.Query(); query.Has("min") {
+		var err error
+		want, err = strconv.Atoi(query.Get("min"))
+		if err != nil || want < 0 {
+			http.Error(w, fmt.Sprintf("min must be a non-negative count, got %q", query.Get("min")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	timeout := time.NewTimer(watermarkWait)
+	defer timeout.Stop()
+	committed := 0
+wait:
+	for {
+		// taken before reading the count, so entries applied in between wake us up
+		applied := broker.streams.wait()
+		committed = broker.DocumentWatermark(document)
+		if committed >= want {
+			break
+		}
+		select {
+		case <-applied:
+		case <-timeout.C:
+			break wait
+		case <-r.Context().Done():
+			return
+		case <-broker.streams.stopped:
+			break wait
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(DocumentWatermark{Document: document, Committed: committed}); err != nil {
+		broker.logger.Warn("error encoding document watermark", "document", document, "err", err)
+	}
+}
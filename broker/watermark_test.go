@@ -0,0 +1,88 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getWatermark(t *testing.T, broker *BrokerServer, pathAndQuery string) (int, DocumentWatermark) {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", broker.GetHTTPAddr(), pathAndQuery))
+	if err != nil {
+		t.Error(err)
+		return 0, DocumentWatermark{}
+	}
+	defer resp.Body.Close()
+	var watermark DocumentWatermark
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&watermark); err != nil {
+			t.Errorf("decoding watermark: %v", err)
+		}
+	}
+	return resp.StatusCode, watermark
+}
+
+func TestDocumentWatermark(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	leaderId, _ := h.CheckSingleLeader()
+	leader := h.cluster[leaderId]
+	ids := []int{0, 1, 2}
+
+	submit := func(document string, n int) int {
+		batch := make([]LogEntry, n)
+		for i := range batch {
+			batch[i] = LogEntry{CRDTOperation: insertOp(fmt.Sprint(i)), Document: document}
+		}
+		first, _ := leader.rm.submitBatch(batch)
+		if first < 0 {
+			t.Fatalf("leader %d refused the batch", leaderId)
+		}
+		return first + n - 1
+	}
+	submit("A", 5)
+	waitForApplied(t, h, ids, submit("B", 3))
+
+	for _, id := range ids {
+		for document, want := range map[string]int{"A": 5, "B": 3, "C": 0} {
+			status, watermark := getWatermark(t, h.cluster[id], "/document/"+document+"/watermark")
+			if status != http.StatusOK || watermark != (DocumentWatermark{Document: document, Committed: want}) {
+				t.Errorf("broker %d watermark of %s is %d %+v, want %d", id, document, status, watermark, want)
+			}
+		}
+	}
+
+	// held back until two more of A's entries are committed
+	type answer struct {
+		watermark DocumentWatermark
+		after     time.Duration
+	}
+	answered := make(chan answer, 1)
+	start := time.Now()
+	go func() {
+		_, watermark := getWatermark(t, leader, "/document/A/watermark?min=7")
+		answered <- answer{watermark, time.Since(start)}
+	}()
+	sleepMs(200)
+	select {
+	case got := <-answered:
+		t.Fatalf("watermark with min=7 answered %+v before A got there", got.watermark)
+	default:
+	}
+	submit("B", 1)
+	submit("A", 2)
+	got := <-answered
+	if got.watermark.Committed != 7 || got.after >= watermarkWait {
+		t.Errorf("watermark with min=7 answered %+v after %v, want 7 as soon as it's committed", got.watermark, got.after)
+	}
+	if status, watermark := getWatermark(t, leader, "/document/B/watermark?min=4"); status != http.StatusOK || watermark.Committed != 4 {
+		t.Errorf("B's watermark is %d %+v, want 4", status, watermark)
+	}
+
+	if status, _ := getWatermark(t, leader, "/document/A/watermark?min=-1"); status != http.StatusBadRequest {
+		t.Errorf("min=-1 got status %d, want %d", status, http.StatusBadRequest)
+	}
+}
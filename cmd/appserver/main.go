@@ -0,0 +1,66 @@
+// runs an application server until SIGINT or SIGTERM
+//
+//	appserver --config appserver.json [--replica-id a] [--listen :8080] [--brokers host:8000,host:8001]
+//
+// settings come from the config file, then CLARITY_* environment variables,
+// then flags. see the config package
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/townsag/clarity/config"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "appserver:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("appserver", flag.ContinueOnError)
+	configPath := flags.String("config", "", "json config file. empty means environment variables and flags only")
+	replicaId := flags.String("replica-id", "", "replica id of this application server's documents")
+	listenAddr := flags.String("listen", "", "address websocket clients connect to")
+	brokers := flags.String("brokers", "", "http addresses of the brokers, separated by commas")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(*configPath, func(cfg *config.Config) error {
+		if cfg.AppServer == nil {
+			cfg.AppServer = new(config.AppServerConfig)
+		}
+		// only the flags that were given, the rest keep the config's values
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "replica-id":
+				cfg.AppServer.ReplicaId = *replicaId
+			case "listen":
+				cfg.AppServer.ListenAddr = *listenAddr
+			case "brokers":
+				cfg.AppServer.Brokers = strings.Split(*brokers, ",")
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s, err := cfg.AppServer.NewAppServer()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return s.ServeContext(ctx, cfg.AppServer.ListenAddr)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// build the binary in the package directory, so the smoke tests run what main does
+func buildBinary(t *testing.T) string {
+	t.Helper()
+	binary := filepath.Join(t.TempDir(), "appserver")
+	if out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building: %v\n%s", err, out)
+	}
+	return binary
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestAppServerStartsAndStopsOnSignal(t *testing.T) {
+	binary := buildBinary(t)
+	listenAddr := freeAddr(t)
+
+	// the brokers don't have to be up for the application server to start
+	cmd := exec.Command(binary, "--replica-id", "smoke", "--listen", listenAddr, "--brokers", freeAddr(t))
+	cmd.Env = []string{}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer cmd.Process.Kill()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + listenAddr + "/document/1/presence")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("application server never answered: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cmd.Process.Signal(syscall.SIGINT)
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("application server exited with %v after SIGINT, want a clean exit", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("application server didn't exit after SIGINT")
+	}
+}
+
+func TestAppServerFailsOnBadConfig(t *testing.T) {
+	binary := buildBinary(t)
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	for _, args := range [][]string{
+		{"--config", filepath.Join(t.TempDir(), "appserver.yaml")},
+		// no brokers to talk to
+		{"--replica-id", "smoke", "--listen", "127.0.0.1:0"},
+		// the address is taken
+		{"--replica-id", "smoke", "--listen", taken.Addr().String(), "--brokers", "127.0.0.1:2"},
+	} {
+		cmd := exec.Command(binary, args...)
+		cmd.Env = []string{}
+		out, err := cmd.CombinedOutput()
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() == 0 {
+			t.Errorf("%v: got %v, want a non-zero exit\n%s", args, err, out)
+		}
+	}
+}
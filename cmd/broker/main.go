@@ -0,0 +1,108 @@
+// runs one broker of a clarity cluster until SIGINT or SIGTERM
+//
+//	broker --config broker.json [--id 1] [--http-addr :8000] [--rpc-addr :9000] [--peers 0=host:8000,1=host:8000]
+//
+// settings come from the config file, then CLARITY_* environment variables,
+// then flags. see the config package
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+	"github.com/townsag/clarity/config"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "broker:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("broker", flag.ContinueOnError)
+	configPath := flags.String("config", "", "json config file. empty means environment variables and flags only")
+	id := flags.Int("id", 0, "id of this broker")
+	httpAddr := flags.String("http-addr", "", "address the http server listens on")
+	rpcAddr := flags.String("rpc-addr", "", "address the rpc server listens on")
+	peers := flags.String("peers", "", "every broker including this one, as id=addr pairs separated by commas")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 10*time.Second, "how long to keep delivering committed entries after a signal")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(*configPath, func(cfg *config.Config) error {
+		if cfg.Broker == nil {
+			cfg.Broker = new(config.BrokerConfig)
+		}
+		var err error
+		// only the flags that were given, the rest keep the config's values
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "id":
+				cfg.Broker.Id = *id
+			case "http-addr":
+				cfg.Broker.HTTPAddr = *httpAddr
+			case "rpc-addr":
+				cfg.Broker.RPCAddr = *rpcAddr
+			case "peers":
+				cfg.Broker.Peers, err = config.ParsePeers(*peers)
+			}
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// nothing else reads committed entries yet, the documents are kept by the broker
+	commits := make(chan broker.CommitEntry, 64)
+	go func() {
+		for entry := range commits {
+			slog.Debug("committed entry", "index", entry.Index, "term", entry.Term)
+		}
+	}()
+
+	ready := make(chan any)
+	cluster, err := cfg.Broker.ClusterConfig(ready, commits)
+	if err != nil {
+		return err
+	}
+	b, err := broker.NewBrokerServerFromConfig(cluster)
+	if err != nil {
+		return err
+	}
+	if err := b.Serve(); err != nil {
+		return err
+	}
+	close(ready)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down", "broker", cfg.Broker.Id)
+	case serveErr = <-b.ServeErrors():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := b.Shutdown(shutdownCtx); err != nil {
+		// the other brokers still have the entries
+		slog.Warn("shut down before delivering every committed entry", "err", err)
+	}
+	if serveErr != nil {
+		return errors.Join(errors.New("stopped serving"), serveErr)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// build the binary in the package directory, so the smoke tests run what main does
+func buildBinary(t *testing.T) string {
+	t.Helper()
+	binary := filepath.Join(t.TempDir(), "broker")
+	if out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput(); err != nil {
+		t.Fatalf("building: %v\n%s", err, out)
+	}
+	return binary
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestBrokerStartsAndStopsOnSignal(t *testing.T) {
+	binary := buildBinary(t)
+	httpAddr := freeAddr(t)
+	configPath := filepath.Join(t.TempDir(), "broker.json")
+	config := fmt.Sprintf(`{"broker": {"id": 0, "peers": [{"id": 0, "addr": %q}], "rpc_addr": "127.0.0.1:0"}}`, httpAddr)
+	if err := os.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(binary, "--config", configPath)
+	cmd.Env = []string{}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer cmd.Process.Kill()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + httpAddr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broker never became healthy: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("broker exited with %v after SIGTERM, want a clean exit", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("broker didn't exit after SIGTERM")
+	}
+}
+
+func TestBrokerFailsOnBadConfig(t *testing.T) {
+	binary := buildBinary(t)
+	for _, args := range [][]string{
+		{"--config", filepath.Join(t.TempDir(), "missing.json")},
+		// no entry for broker 2 itself
+		{"--id", "2", "--peers", "0=127.0.0.1:1,1=127.0.0.1:2"},
+		{"--no-such-flag"},
+	} {
+		cmd := exec.Command(binary, args...)
+		cmd.Env = []string{}
+		out, err := cmd.CombinedOutput()
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() == 0 {
+			t.Errorf("%v: got %v, want a non-zero exit\n%s", args, err, out)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+module cmd
+
+go 1.23.2
+
+require (
+	github.com/townsag/clarity/broker v0.0.0-00010101000000-000000000000
+	github.com/townsag/clarity/config v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/felixge/httpsnoop v1.0.4 // indirect
+	github.com/go-logr/logr v1.4.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/golang-jwt/jwt/v5 v5.3.1 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/syndtr/goleveldb v1.0.1-0.20220721030215-126854af5e6d // indirect
+	github.com/townsag/clarity/appserver v0.0.0-00010101000000-000000000000 // indirect
+	github.com/townsag/clarity/auth v0.0.0-00010101000000-000000000000 // indirect
+	github.com/townsag/clarity/broker/raftpb v0.0.0-00010101000000-000000000000 // indirect
+	github.com/townsag/clarity/crdt v0.1.0 // indirect
+	github.com/vmihailenco/msgpack/v5 v5.4.1 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	go.etcd.io/bbolt v1.4.3 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.62.0 // indirect
+	go.opentelemetry.io/otel v1.37.0 // indirect
+	go.opentelemetry.io/otel/metric v1.37.0 // indirect
+	go.opentelemetry.io/otel/trace v1.37.0 // indirect
+	golang.org/x/net v0.41.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.26.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250707201910-8d1bb00bc6a7 // indirect
+	google.golang.org/grpc v1.75.1 // indirect
+	google.golang.org/protobuf v1.36.6 // indirect
+)
+
+replace github.com/townsag/clarity/crdt => ../crdt
+
+replace github.com/townsag/clarity/broker => ../broker
+
+replace github.com/townsag/clarity/appserver => ../appserver
+
+replace github.com/townsag/clarity/config => ../config
+
+replace github.com/townsag/clarity/auth => ../auth
+
+replace github.com/townsag/clarity/broker/raftpb => ../broker/raftpb
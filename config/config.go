@@ -0,0 +1,546 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/townsag/clarity/appserver"
+	"github.com/townsag/clarity/broker"
+)
+
+// settings of a broker, an application server or both, loaded from a json file
+// with CLARITY_* environment variables taking precedence, see applyEnv
+type Config struct {
+	Broker    *BrokerConfig    `json:"broker,omitempty"`
+	AppServer *AppServerConfig `json:"appserver,omitempty"`
+}
+
+type BrokerConfig struct {
+	Id int `json:"id"`
+
+	// every broker in the cluster, this one included
+	Peers []Peer `json:"peers"`
+
+	// address the http server listens on. empty means this broker's address in Peers
+	HTTPAddr string `json:"http_addr,omitempty"`
+
+	// address the rpc server listens on. empty means any open port
+	RPCAddr string `json:"rpc_addr,omitempty"`
+
+	// "net_rpc" or "grpc", every broker has to use the same. empty means net_rpc
+	RPCTransport string `json:"rpc_transport,omitempty"`
+
+	RPCTimeout             Duration `json:"rpc_timeout,omitempty"`
+	ShutdownGracePeriod    Duration `json:"shutdown_grace_period,omitempty"`
+	ElectionBackoffCeiling Duration `json:"election_backoff_ceiling,omitempty"`
+
+	// the heartbeat has to be under half of min_election_timeout, 0 means the broker's defaults
+	HeartbeatInterval  Duration `json:"heartbeat_interval,omitempty"`
+	MinElectionTimeout Duration `json:"min_election_timeout,omitempty"`
+	MaxElectionTimeout Duration `json:"max_election_timeout,omitempty"`
+
+	// how long a leader that lost its majority keeps taking writes, 0 means the broker's default
+	QuorumLossTimeout Duration `json:"quorum_loss_timeout,omitempty"`
+
+	// heartbeats a leader goes without a majority before stepping down, 0 means the broker's default
+	StepDownRounds int `json:"step_down_rounds,omitempty"`
+
+	// how long the leader answers retries of an op id with the first receipt, 0 means the broker's default
+	OpIDTTL Duration `json:"op_id_ttl,omitempty"`
+
+	// http server timeouts and connection cap, 0 means the broker's defaults
+	HTTPReadTimeout  Duration `json:"http_read_timeout,omitempty"`
+	HTTPWriteTimeout Duration `json:"http_write_timeout,omitempty"`
+	HTTPIdleTimeout  Duration `json:"http_idle_timeout,omitempty"`
+	MaxHTTPConns     int      `json:"max_http_conns,omitempty"`
+
+	RPCTLS  *TLSFiles `json:"rpc_tls,omitempty"`
+	HTTPTLS *TLSFiles `json:"http_tls,omitempty"`
+
+	AuthToken string `json:"auth_token,omitempty"`
+	// for the /admin endpoints, which are left out when it is empty
+	AdminToken string `json:"admin_token,omitempty"`
+
+	// bbolt database the log and vote are persisted in. empty keeps them in memory only
+	// with more than one shard every replication group after the first gets
+	// its own database and checkpoint next to these, see broker.ShardPath
+	StoragePath string `json:"storage_path,omitempty"`
+
+	CheckpointPath   string `json:"checkpoint_path,omitempty"`
+	SnapshotInterval int    `json:"snapshot_interval,omitempty"`
+
+	// replication groups documents are hashed over, the same on every broker
+	Shards int `json:"shards,omitempty"`
+}
+
+// a broker and the http address the others reach it on
+type Peer struct {
+	Id   int    `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type TLSFiles struct {
+	CertFile   string `json:"cert_file"`
+	KeyFile    string `json:"key_file"`
+	CAFile     string `json:"ca_file"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+type AppServerConfig struct {
+	ReplicaId string `json:"replica_id"`
+
+	// address websocket clients connect to
+	ListenAddr string `json:"listen_addr"`
+
+	// http addresses of the brokers. empty means the peers of the broker section
+	Brokers []string `json:"brokers,omitempty"`
+
+	BrokerAuthToken string `json:"broker_auth_token,omitempty"`
+
+	// websocket clients have to send a jwt signed with this secret. empty lets every client connect
+	JWTSecret string `json:"jwt_secret,omitempty"`
+
+	// reach the brokers over https, checking their certificates against this CA
+	BrokerCAFile string `json:"broker_ca_file,omitempty"`
+
+	BatchSize     int      `json:"batch_size,omitempty"`
+	BatchInterval Duration `json:"batch_interval,omitempty"`
+
+	// http server timeouts and connection cap, 0 means the application server's defaults
+	HTTPReadTimeout  Duration `json:"http_read_timeout,omitempty"`
+	HTTPWriteTimeout Duration `json:"http_write_timeout,omitempty"`
+	HTTPIdleTimeout  Duration `json:"http_idle_timeout,omitempty"`
+	MaxHTTPConns     int      `json:"max_http_conns,omitempty"`
+}
+
+// a time.Duration written like "250ms" or "5s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations are strings like \"250ms\", got %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+func invalidConfig(format string, a ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, a...))
+}
+
+// read the config file at path, apply the environment, then overrides in
+// order, and validate the result. an empty path means the environment only
+func Load(path string, overrides ...func(*Config) error) (*Config, error) {
+	if path == "" {
+		return parse([]byte("{}"), os.LookupEnv, overrides)
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return nil, invalidConfig("%s: only json config files are supported", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parse(data, os.LookupEnv, overrides)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// like Load with the file contents and environment passed in
+func Parse(data []byte, lookupEnv func(string) (string, bool)) (*Config, error) {
+	return parse(data, lookupEnv, nil)
+}
+
+func parse(data []byte, lookupEnv func(string) (string, bool), overrides []func(*Config) error) (*Config, error) {
+	cfg := new(Config)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// a misspelled field would otherwise be silently left at its default
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		if err := override(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// overrides from the environment, for settings that differ between otherwise
+// identical deployments. setting one of a section's variables adds the section
+//
+//	CLARITY_BROKER_ID            id of this broker
+//	CLARITY_BROKER_PEERS         every broker as id=addr, comma separated
+//	CLARITY_BROKER_HTTP_ADDR
+//	CLARITY_BROKER_RPC_ADDR
+//	CLARITY_BROKER_RPC_TIMEOUT   a duration like 250ms
+//	CLARITY_BROKER_ADMIN_TOKEN   token for the broker's /admin endpoints
+//	CLARITY_AUTH_TOKEN           the brokers' token, sent by the application server too
+//	CLARITY_APPSERVER_REPLICA_ID
+//	CLARITY_APPSERVER_LISTEN_ADDR
+//	CLARITY_APPSERVER_BROKERS    broker http addresses, comma separated
+//	CLARITY_APPSERVER_JWT_SECRET secret the websocket clients' jwts are signed with
+func (cfg *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	brokerSection := func() *BrokerConfig {
+		if cfg.Broker == nil {
+			cfg.Broker = new(BrokerConfig)
+		}
+		return cfg.Broker
+	}
+	appServerSection := func() *AppServerConfig {
+		if cfg.AppServer == nil {
+			cfg.AppServer = new(AppServerConfig)
+		}
+		return cfg.AppServer
+	}
+
+	if v, ok := lookupEnv("CLARITY_BROKER_ID"); ok {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return invalidConfig("CLARITY_BROKER_ID must be an integer, got %q", v)
+		}
+		brokerSection().Id = id
+	}
+	if v, ok := lookupEnv("CLARITY_BROKER_PEERS"); ok {
+		peers, err := ParsePeers(v)
+		if err != nil {
+			return fmt.Errorf("CLARITY_BROKER_PEERS: %w", err)
+		}
+		brokerSection().Peers = peers
+	}
+	if v, ok := lookupEnv("CLARITY_BROKER_HTTP_ADDR"); ok {
+		brokerSection().HTTPAddr = v
+	}
+	if v, ok := lookupEnv("CLARITY_BROKER_RPC_ADDR"); ok {
+		brokerSection().RPCAddr = v
+	}
+	if v, ok := lookupEnv("CLARITY_BROKER_RPC_TIMEOUT"); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return invalidConfig("CLARITY_BROKER_RPC_TIMEOUT: %v", err)
+		}
+		brokerSection().RPCTimeout = Duration(timeout)
+	}
+	if v, ok := lookupEnv("CLARITY_AUTH_TOKEN"); ok {
+		if cfg.Broker != nil {
+			cfg.Broker.AuthToken = v
+		}
+		if cfg.AppServer != nil {
+			cfg.AppServer.BrokerAuthToken = v
+		}
+	}
+	if v, ok := lookupEnv("CLARITY_BROKER_ADMIN_TOKEN"); ok {
+		brokerSection().AdminToken = v
+	}
+	if v, ok := lookupEnv("CLARITY_APPSERVER_REPLICA_ID"); ok {
+		appServerSection().ReplicaId = v
+	}
+	if v, ok := lookupEnv("CLARITY_APPSERVER_LISTEN_ADDR"); ok {
+		appServerSection().ListenAddr = v
+	}
+	if v, ok := lookupEnv("CLARITY_APPSERVER_JWT_SECRET"); ok {
+		appServerSection().JWTSecret = v
+	}
+	if v, ok := lookupEnv("CLARITY_APPSERVER_BROKERS"); ok {
+		appServerSection().Brokers = strings.Split(v, ",")
+	}
+	return nil
+}
+
+// peers written as "0=host:8000,1=host:8001"
+func ParsePeers(v string) ([]Peer, error) {
+	var peers []Peer
+	for _, pair := range strings.Split(v, ",") {
+		idString, addr, ok := strings.Cut(pair, "=")
+		id, err := strconv.Atoi(idString)
+		if !ok || err != nil {
+			return nil, invalidConfig("peers are id=addr pairs, got %q", pair)
+		}
+		peers = append(peers, Peer{Id: id, Addr: addr})
+	}
+	return peers, nil
+}
+
+// check every section that is present. errors name the offending setting
+func (cfg *Config) Validate() error {
+	if cfg.Broker == nil && cfg.AppServer == nil {
+		return invalidConfig("needs a broker or an appserver section")
+	}
+	if cfg.Broker != nil {
+		if err := cfg.Broker.validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.AppServer != nil {
+		if err := cfg.AppServer.validate(cfg.Broker); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BrokerConfig) validate() error {
+	if b.Id < 0 {
+		return invalidConfig("broker: id %d is negative", b.Id)
+	}
+	if len(b.Peers) == 0 {
+		return invalidConfig("broker: peers is empty, it must list every broker including this one")
+	}
+	seenAddrs := make(map[string]int)
+	for i, peer := range b.Peers {
+		if peer.Id < 0 {
+			return invalidConfig("broker: peer id %d is negative", peer.Id)
+		}
+		if slices.ContainsFunc(b.Peers[:i], func(p Peer) bool { return p.Id == peer.Id }) {
+			return invalidConfig("broker: peer id %d is listed more than once", peer.Id)
+		}
+		if peer.Addr == "" {
+			return invalidConfig("broker: peer %d has no addr", peer.Id)
+		}
+		if other, ok := seenAddrs[peer.Addr]; ok {
+			return invalidConfig("broker: peers %d and %d have the same addr %s", other, peer.Id, peer.Addr)
+		}
+		seenAddrs[peer.Addr] = peer.Id
+	}
+	if _, ok := b.selfAddr(); !ok {
+		return invalidConfig("broker: peers has no entry for broker %d itself", b.Id)
+	}
+
+	for name, d := range map[string]Duration{
+		"rpc_timeout":              b.RPCTimeout,
+		"shutdown_grace_period":    b.ShutdownGracePeriod,
+		"election_backoff_ceiling": b.ElectionBackoffCeiling,
+		"quorum_loss_timeout":      b.QuorumLossTimeout,
+		"op_id_ttl":                b.OpIDTTL,
+		"heartbeat_interval":       b.HeartbeatInterval,
+		"min_election_timeout":     b.MinElectionTimeout,
+		"max_election_timeout":     b.MaxElectionTimeout,
+		"http_read_timeout":        b.HTTPReadTimeout,
+		"http_write_timeout":       b.HTTPWriteTimeout,
+		"http_idle_timeout":        b.HTTPIdleTimeout,
+	} {
+		if d < 0 {
+			return invalidConfig("broker: %s %s is negative", name, time.Duration(d))
+		}
+	}
+	for name, files := range map[string]*TLSFiles{"rpc_tls": b.RPCTLS, "http_tls": b.HTTPTLS} {
+		if files != nil && (files.CertFile == "" || files.KeyFile == "" || files.CAFile == "") {
+			return invalidConfig("broker: %s needs cert_file, key_file and ca_file", name)
+		}
+	}
+	if b.SnapshotInterval < 0 {
+		return invalidConfig("broker: snapshot_interval %d is negative", b.SnapshotInterval)
+	}
+	if b.Shards < 0 {
+		return invalidConfig("broker: shards %d is negative", b.Shards)
+	}
+	if _, ok := rpcTransports[b.RPCTransport]; !ok {
+		return invalidConfig("broker: rpc_transport %q is not net_rpc or grpc", b.RPCTransport)
+	}
+	if b.MaxHTTPConns < 0 {
+		return invalidConfig("broker: max_http_conns %d is negative", b.MaxHTTPConns)
+	}
+	if b.StepDownRounds < 0 {
+		return invalidConfig("broker: step_down_rounds %d is negative", b.StepDownRounds)
+	}
+	return nil
+}
+
+var rpcTransports = map[string]broker.Transport{
+	"":        nil,
+	"net_rpc": broker.NetRPCTransport{},
+	"grpc":    broker.GRPCTransport{},
+}
+
+func (b *BrokerConfig) selfAddr() (string, bool) {
+	for _, peer := range b.Peers {
+		if peer.Id == b.Id {
+			return peer.Addr, true
+		}
+	}
+	return "", false
+}
+
+// the application server defaults to the brokers of the broker section
+func (a *AppServerConfig) validate(b *BrokerConfig) error {
+	if a.ReplicaId == "" {
+		return invalidConfig("appserver: replica_id is empty")
+	}
+	if a.ListenAddr == "" {
+		return invalidConfig("appserver: listen_addr is empty")
+	}
+	if len(a.Brokers) == 0 {
+		if b == nil {
+			return invalidConfig("appserver: brokers is empty and there is no broker section to take them from")
+		}
+		for _, peer := range b.Peers {
+			a.Brokers = append(a.Brokers, peer.Addr)
+		}
+	}
+	for i, addr := range a.Brokers {
+		if addr == "" {
+			return invalidConfig("appserver: broker %d has an empty address", i)
+		}
+	}
+	if a.BatchSize < 0 || a.BatchInterval < 0 {
+		return invalidConfig("appserver: batch_size and batch_interval can't be negative")
+	}
+	if a.HTTPReadTimeout < 0 || a.HTTPWriteTimeout < 0 || a.HTTPIdleTimeout < 0 || a.MaxHTTPConns < 0 {
+		return invalidConfig("appserver: http_read_timeout, http_write_timeout, http_idle_timeout and max_http_conns can't be negative")
+	}
+	return nil
+}
+
+// the options NewBrokerServer takes. opens the storage file when there is one
+func (b *BrokerConfig) Options() (broker.BrokerOptions, error) {
+	opts := broker.BrokerOptions{
+		RPCAddr:                b.RPCAddr,
+		Transport:              rpcTransports[b.RPCTransport],
+		RPCTimeout:             time.Duration(b.RPCTimeout),
+		ShutdownGracePeriod:    time.Duration(b.ShutdownGracePeriod),
+		ElectionBackoffCeiling: time.Duration(b.ElectionBackoffCeiling),
+		QuorumLossTimeout:      time.Duration(b.QuorumLossTimeout),
+		StepDownRounds:         b.StepDownRounds,
+		OpIDTTL:                time.Duration(b.OpIDTTL),
+		HeartbeatInterval:      time.Duration(b.HeartbeatInterval),
+		MinElectionTimeout:     time.Duration(b.MinElectionTimeout),
+		MaxElectionTimeout:     time.Duration(b.MaxElectionTimeout),
+		RPCTLS:                 b.RPCTLS.brokerFiles(),
+		HTTPTLS:                b.HTTPTLS.brokerFiles(),
+		AuthToken:              b.AuthToken,
+		AdminToken:             b.AdminToken,
+		CheckpointPath:         b.CheckpointPath,
+		SnapshotInterval:       b.SnapshotInterval,
+		Shards:                 b.Shards,
+		HTTPReadTimeout:        time.Duration(b.HTTPReadTimeout),
+		HTTPWriteTimeout:       time.Duration(b.HTTPWriteTimeout),
+		HTTPIdleTimeout:        time.Duration(b.HTTPIdleTimeout),
+		MaxHTTPConns:           b.MaxHTTPConns,
+	}
+	if b.StoragePath != "" {
+		storage, err := broker.NewBoltStorage(b.StoragePath)
+		if err != nil {
+			return opts, fmt.Errorf("opening storage_path: %w", err)
+		}
+		opts.Storage = storage
+
+		for shard := 1; shard < b.Shards; shard++ {
+			path := broker.ShardPath(b.StoragePath, shard)
+			storage, err := broker.NewBoltStorage(path)
+			if err != nil {
+				return opts, fmt.Errorf("opening storage of shard %d at %s: %w", shard, path, err)
+			}
+			if opts.ShardStorage == nil {
+				opts.ShardStorage = make(map[int]broker.Storage)
+			}
+			opts.ShardStorage[shard] = storage
+		}
+	}
+	return opts, nil
+}
+
+// everything broker.NewBrokerServerFromConfig needs. the broker starts as a follower
+func (b *BrokerConfig) ClusterConfig(ready <-chan any, commitChan chan<- broker.CommitEntry) (broker.ClusterConfig, error) {
+	opts, err := b.Options()
+	if err != nil {
+		return broker.ClusterConfig{}, err
+	}
+
+	httpAddr, _ := b.selfAddr()
+	if b.HTTPAddr != "" {
+		httpAddr = b.HTTPAddr
+	}
+	cluster := broker.ClusterConfig{
+		BrokerId:     b.Id,
+		PeerAddrs:    make(map[int]string),
+		HTTPAddr:     httpAddr,
+		InitialState: broker.Follower,
+		Ready:        ready,
+		CommitChan:   commitChan,
+		Options:      opts,
+	}
+	// this broker's own entry is left out, the http address it listens on
+	// can differ from the one the others reach it on
+	for _, peer := range b.Peers {
+		if peer.Id != b.Id {
+			cluster.PeerIds = append(cluster.PeerIds, peer.Id)
+			cluster.PeerAddrs[peer.Id] = peer.Addr
+		}
+	}
+	return cluster, nil
+}
+
+func (files *TLSFiles) brokerFiles() *broker.TLSFiles {
+	if files == nil {
+		return nil
+	}
+	return &broker.TLSFiles{CertFile: files.CertFile, KeyFile: files.KeyFile, CAFile: files.CAFile, ServerName: files.ServerName}
+}
+
+// the options NewAppServerWithOptions takes. loads the broker CA when there is one
+func (a *AppServerConfig) Options() (appserver.Options, error) {
+	opts := appserver.Options{
+		BrokerAuthToken:  a.BrokerAuthToken,
+		BatchSize:        a.BatchSize,
+		BatchInterval:    time.Duration(a.BatchInterval),
+		HTTPReadTimeout:  time.Duration(a.HTTPReadTimeout),
+		HTTPWriteTimeout: time.Duration(a.HTTPWriteTimeout),
+		HTTPIdleTimeout:  time.Duration(a.HTTPIdleTimeout),
+		MaxHTTPConns:     a.MaxHTTPConns,
+	}
+	if a.JWTSecret != "" {
+		opts.JWTSecret = []byte(a.JWTSecret)
+	}
+	if a.BrokerCAFile != "" {
+		caPEM, err := os.ReadFile(a.BrokerCAFile)
+		if err != nil {
+			return opts, fmt.Errorf("reading broker_ca_file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return opts, fmt.Errorf("no certificates in broker_ca_file %s", a.BrokerCAFile)
+		}
+		opts.BrokerTLS = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return opts, nil
+}
+
+// the application server described by a, ready to Serve on ListenAddr
+func (a *AppServerConfig) NewAppServer() (*appserver.AppServer, error) {
+	opts, err := a.Options()
+	if err != nil {
+		return nil, err
+	}
+	return appserver.NewAppServerWithOptions(a.ReplicaId, a.Brokers, opts), nil
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/townsag/clarity/broker"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Parse(mustRead(t, "example.json"), env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := cfg.Broker.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.RPCAddr != ":9000" || opts.RPCTimeout != 250*time.Millisecond || opts.ShutdownGracePeriod != 5*time.Second ||
+		opts.ElectionBackoffCeiling != time.Second || opts.HeartbeatInterval != 25*time.Millisecond ||
+		opts.MinElectionTimeout != 150*time.Millisecond || opts.MaxElectionTimeout != 300*time.Millisecond || opts.SnapshotInterval != 1000 || opts.AuthToken != "change-me" {
+		t.Errorf("broker options %+v don't match example.json", opts)
+	}
+	if opts.Transport != (broker.NetRPCTransport{}) {
+		t.Errorf("rpc transport %T, want net/rpc", opts.Transport)
+	}
+	wantTLS := &broker.TLSFiles{CertFile: "/etc/clarity/broker.crt", KeyFile: "/etc/clarity/broker.key", CAFile: "/etc/clarity/ca.crt", ServerName: "clarity-broker"}
+	if !reflect.DeepEqual(opts.RPCTLS, wantTLS) || opts.HTTPTLS != nil {
+		t.Errorf("rpc tls %+v, http tls %+v, want %+v and none", opts.RPCTLS, opts.HTTPTLS, wantTLS)
+	}
+
+	cluster, err := cfg.Broker.ClusterConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster.BrokerId != 0 || cluster.HTTPAddr != ":8000" || cluster.InitialState != broker.Follower {
+		t.Errorf("cluster config %+v, want broker 0 following on :8000", cluster)
+	}
+	if !reflect.DeepEqual(cluster.PeerIds, []int{1, 2}) {
+		t.Errorf("peer ids %v, want [1 2]", cluster.PeerIds)
+	}
+	if want := map[int]string{1: "broker-1:8000", 2: "broker-2:8000"}; !reflect.DeepEqual(cluster.PeerAddrs, want) {
+		t.Errorf("peer addrs %v, want %v", cluster.PeerAddrs, want)
+	}
+
+	app := cfg.AppServer
+	if app.ReplicaId != "appserver-0" || app.ListenAddr != ":8080" {
+		t.Errorf("appserver %+v doesn't match example.json", app)
+	}
+	// brokers default to the broker section's peers
+	if want := []string{"broker-0:8000", "broker-1:8000", "broker-2:8000"}; !reflect.DeepEqual(app.Brokers, want) {
+		t.Errorf("appserver brokers %v, want %v", app.Brokers, want)
+	}
+	appOpts, err := app.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appOpts.BatchSize != 64 || appOpts.BatchInterval != 5*time.Millisecond || appOpts.BrokerAuthToken != "change-me" || appOpts.BrokerTLS != nil {
+		t.Errorf("appserver options %+v don't match example.json", appOpts)
+	}
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	cfg, err := Parse(mustRead(t, "example.json"), env(map[string]string{
+		"CLARITY_BROKER_ID":            "2",
+		"CLARITY_BROKER_PEERS":         "1=10.0.0.1:8000,2=10.0.0.2:8000",
+		"CLARITY_BROKER_HTTP_ADDR":     ":8100",
+		"CLARITY_BROKER_RPC_TIMEOUT":   "1s",
+		"CLARITY_AUTH_TOKEN":           "secret",
+		"CLARITY_BROKER_ADMIN_TOKEN":   "admin-secret",
+		"CLARITY_APPSERVER_BROKERS":    "10.0.0.1:8000,10.0.0.2:8000",
+		"CLARITY_APPSERVER_JWT_SECRET": "jwt-secret",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster, err := cfg.Broker.ClusterConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster.BrokerId != 2 || cluster.HTTPAddr != ":8100" || !reflect.DeepEqual(cluster.PeerAddrs, map[int]string{1: "10.0.0.1:8000"}) {
+		t.Errorf("cluster config %+v doesn't have the overrides", cluster)
+	}
+	if cluster.Options.RPCTimeout != time.Second || cluster.Options.AuthToken != "secret" || cluster.Options.AdminToken != "admin-secret" {
+		t.Errorf("broker options %+v don't have the overrides", cluster.Options)
+	}
+	if cfg.AppServer.BrokerAuthToken != "secret" || len(cfg.AppServer.Brokers) != 2 {
+		t.Errorf("appserver %+v doesn't have the overrides", cfg.AppServer)
+	}
+	if appOpts, err := cfg.AppServer.Options(); err != nil || string(appOpts.JWTSecret) != "jwt-secret" {
+		t.Errorf("appserver options %+v, %v don't have the jwt secret", appOpts, err)
+	}
+
+	// the environment alone is enough
+	cfg, err = Parse([]byte("{}"), env(map[string]string{
+		"CLARITY_APPSERVER_REPLICA_ID":  "a",
+		"CLARITY_APPSERVER_LISTEN_ADDR": ":8080",
+		"CLARITY_APPSERVER_BROKERS":     "localhost:8000",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Broker != nil || cfg.AppServer.ReplicaId != "a" {
+		t.Errorf("config %+v, want only an appserver section", cfg)
+	}
+}
+
+func TestInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		want   string
+	}{
+		{"empty", `{}`, nil, "needs a broker or an appserver section"},
+		{"unknown field", `{"broker": {"idd": 1}}`, nil, `unknown field "idd"`},
+		{"bad duration", `{"broker": {"rpc_timeout": 250}}`, nil, "durations are strings"},
+		{"no peers", `{"broker": {"id": 0}}`, nil, "peers is empty"},
+		{"duplicate id", `{"broker": {"peers": [{"id": 0, "addr": "a:1"}, {"id": 0, "addr": "b:1"}]}}`, nil, "peer id 0 is listed more than once"},
+		{"duplicate addr", `{"broker": {"peers": [{"id": 0, "addr": "a:1"}, {"id": 1, "addr": "a:1"}]}}`, nil, "peers 0 and 1 have the same addr a:1"},
+		{"missing self", `{"broker": {"id": 2, "peers": [{"id": 0, "addr": "a:1"}, {"id": 1, "addr": "b:1"}]}}`, nil, "no entry for broker 2 itself"},
+		{"missing addr", `{"broker": {"peers": [{"id": 0}]}}`, nil, "peer 0 has no addr"},
+		{"unknown transport", `{"broker": {"peers": [{"id": 0, "addr": "a:1"}], "rpc_transport": "http"}}`, nil, `rpc_transport "http" is not net_rpc or grpc`},
+		{"half tls", `{"broker": {"peers": [{"id": 0, "addr": "a:1"}], "http_tls": {"cert_file": "c"}}}`, nil, "http_tls needs cert_file, key_file and ca_file"},
+		{"no replica id", `{"appserver": {"listen_addr": ":1", "brokers": ["a:1"]}}`, nil, "replica_id is empty"},
+		{"no brokers", `{"appserver": {"replica_id": "a", "listen_addr": ":1"}}`, nil, "no broker section to take them from"},
+		{"bad env id", `{}`, map[string]string{"CLARITY_BROKER_ID": "zero"}, "CLARITY_BROKER_ID must be an integer"},
+		{"bad env peers", `{}`, map[string]string{"CLARITY_BROKER_PEERS": "0:a:1"}, "peers are id=addr pairs"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.config), env(test.env))
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("got %v, want ErrInvalidConfig", err)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %q, want it to mention %q", err, test.want)
+			}
+		})
+	}
+
+	if _, err := Load("clarity.yaml"); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("loading yaml: got %v, want ErrInvalidConfig", err)
+	}
+}
@@ -0,0 +1,98 @@
+package crdt
+
+// tombstones can't be dropped as soon as a character is deleted because a
+// replica that hasn't seen the delete may still send operations that reference
+// the node. once every replica has seen both the insert and the delete the
+// tombstone is only needed if it still has children, a format span points at it
+// or a replica that didn't compact it can still insert under it
+
+// Compact removes tombstones whose insert and delete are dominated by
+// safeVectorClock and returns the number of nodes removed
+func (crdt *TextCRDT) Compact(safeVectorClock VectorClock) int {
+	// format spans are anchored on node ids, so their endpoints have to stay
+	anchored := make(map[ID]bool, 2*len(crdt.formatSpans))
+	for _, formatOp := range crdt.formatSpans {
+		anchored[formatOp.startNodeID] = true
+		anchored[formatOp.endNodeID] = true
+	}
+	origins := crdt.originCandidates(safeVectorClock)
+
+	removable := func(node *Node) bool {
+		return node.value == nil &&
+			len(node.leftChildren) == 0 &&
+			len(node.rightChildren) == 0 &&
+			!anchored[node.nodeID] &&
+			!origins[node] &&
+			safeVectorClock.dominates(node.nodeID) &&
+			safeVectorClock.dominates(node.deletedBy)
+	}
+
+	removed := 0
+	var compactChildren func(children []*Node) []*Node
+	compactChildren = func(children []*Node) []*Node {
+		kept := children[:0]
+		for _, child := range children {
+			// compact bottom up so a chain of tombstones collapses in one pass
+			child.leftChildren = compactChildren(child.leftChildren)
+			child.rightChildren = compactChildren(child.rightChildren)
+			if removable(child) {
+				removed++
+				continue
+			}
+			kept = append(kept, child)
+		}
+		return kept
+	}
+	crdt.root.leftChildren = compactChildren(crdt.root.leftChildren)
+	crdt.root.rightChildren = compactChildren(crdt.root.rightChildren)
+	return removed
+}
+
+// the nodes LocalInsert can pick as an origin on a replica that has seen
+// safeVectorClock, see findOriginsHelper. the left origin is the first node or
+// a node with a value, the right origin the node right after it, which can be
+// a tombstone. the new node becomes a child of one of them, so a replica that
+// still has a tombstone in that position can send an insert under it at any
+// time. such a replica may not have the nodes inserted after safeVectorClock,
+// and still has a value in the nodes deleted after it
+func (crdt *TextCRDT) originCandidates(safeVectorClock VectorClock) map[*Node]bool {
+	origins := make(map[*Node]bool)
+	first := true
+	previousIsLeftOrigin := false
+	var visit func(*Node)
+	visit = func(node *Node) {
+		for _, leftChild := range node.leftChildren {
+			visit(leftChild)
+		}
+		if node == crdt.root || safeVectorClock.dominates(node.nodeID) {
+			hasValue := node.value != nil || !safeVectorClock.dominates(node.deletedBy)
+			isLeftOrigin := first || hasValue
+			if isLeftOrigin || previousIsLeftOrigin {
+				origins[node] = true
+			}
+			first = false
+			previousIsLeftOrigin = isLeftOrigin
+		}
+		for _, rightChild := range node.rightChildren {
+			visit(rightChild)
+		}
+	}
+	visit(crdt.root)
+	return origins
+}
+
+// number of nodes in the tree including tombstones and the root
+func (crdt *TextCRDT) NodeCount() int {
+	var countHelper func(*Node) int
+	countHelper = func(currentNode *Node) int {
+		count := 1
+		for _, leftChild := range currentNode.leftChildren {
+			count += countHelper(leftChild)
+		}
+		for _, rightChild := range currentNode.rightChildren {
+			count += countHelper(rightChild)
+		}
+		return count
+	}
+	return countHelper(crdt.root)
+}
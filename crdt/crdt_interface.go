@@ -1,9 +1,23 @@
 package crdt
 
-
+// a replicated document the application server can edit and keep in sync
+// TextCRDT is the text implementation, other document types only need these
 type CRDT interface {
-	Insert(value interface{}, index int, replica_id string, operation_index int64) error
-	Delete(index int, replica_id string, operation_index int64) error
-	Traverse(index int) ([]interface{}, error)
-	String() string
-}
\ No newline at end of file
+	// edits made on this replica, returning the operation to send to the others
+	// NoOp and an error when the document didn't change, ErrOutOfRange when
+	// there is no position index
+	LocalInsert(index int64, value interface{}) (Operation, error)
+	LocalDelete(index int64) (Operation, error)
+
+	// an operation made on another replica, false when it changed nothing
+	// e.g. because it was applied before. false and ErrAlreadyDeleted for
+	// deletes of a character that is deleted already
+	Apply(operation Operation) (bool, error)
+
+	Representation() []interface{}
+
+	// every operation this replica has generated, sent along with its operations
+	VersionClock() VectorClock
+}
+
+var _ CRDT = (*TextCRDT)(nil)
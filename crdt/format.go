@@ -0,0 +1,123 @@
+package crdt
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// a run of consecutive characters that share the same attributes
+type Span struct {
+	Text  string
+	Attrs map[string]interface{}
+}
+
+// format operations are anchored to node IDs instead of indexes because the
+// index of a character changes as other replicas insert and delete around it
+//
+// formats are resolved with last writer wins on each attribute key. every
+// format carries a lamport timestamp one past the highest the replica had
+// seen, so a format made after another was applied always sorts after it.
+// concurrent formats can share a timestamp, the replica id breaks the tie.
+// spans are kept sorted in that order so applying them in slice order lets
+// the winner overwrite the losers on every replica
+// false when the span was already there
+func (crdt *TextCRDT) insertFormatSpan(formatOp *FormatOperation) bool {
+	crdt.formatClock = max(crdt.formatClock, formatOp.lamport)
+	index := 0
+	for index < len(crdt.formatSpans) && formatOpLess(crdt.formatSpans[index], formatOp) {
+		index += 1
+	}
+	// applying the same format operation twice is a no-op
+	if index < len(crdt.formatSpans) && crdt.formatSpans[index].currentNodeID == formatOp.currentNodeID {
+		return false
+	}
+	crdt.formatSpans = append(
+		crdt.formatSpans[:index],
+		append([]*FormatOperation{formatOp}, crdt.formatSpans[index:]...)...,
+	)
+	return true
+}
+
+func formatOpLess(a *FormatOperation, b *FormatOperation) bool {
+	if a.lamport != b.lamport {
+		return a.lamport < b.lamport
+	}
+	if a.currentNodeID.replicaID != b.currentNodeID.replicaID {
+		return a.currentNodeID.replicaID < b.currentNodeID.replicaID
+	}
+	return a.currentNodeID.operationOffset < b.currentNodeID.operationOffset
+}
+
+// like Representation but groups the characters into spans of equal attributes
+func (crdt *TextCRDT) FormattedRepresentation() (spans []Span) {
+	// in order traversal including tombstones so that format ranges anchored
+	// on deleted characters still cover the characters between them
+	var nodes []*Node
+	var inOrderTraversalHelper func(*Node)
+	inOrderTraversalHelper = func(currentNode *Node) {
+		for _, leftChild := range currentNode.leftChildren {
+			inOrderTraversalHelper(leftChild)
+		}
+		if currentNode != crdt.root {
+			nodes = append(nodes, currentNode)
+		}
+		for _, rightChild := range currentNode.rightChildren {
+			inOrderTraversalHelper(rightChild)
+		}
+	}
+	inOrderTraversalHelper(crdt.root)
+
+	position := make(map[ID]int, len(nodes))
+	for i, node := range nodes {
+		position[node.nodeID] = i
+	}
+
+	attrs := make([]map[string]interface{}, len(nodes))
+	for _, formatOp := range crdt.formatSpans {
+		start, okStart := position[formatOp.startNodeID]
+		end, okEnd := position[formatOp.endNodeID]
+		if !okStart || !okEnd {
+			continue
+		}
+		for i := start; i <= end; i++ {
+			if attrs[i] == nil {
+				attrs[i] = make(map[string]interface{})
+			}
+			for key, value := range formatOp.attrs {
+				// a nil value removes the attribute
+				if value == nil {
+					delete(attrs[i], key)
+				} else {
+					attrs[i][key] = value
+				}
+			}
+		}
+	}
+
+	for i, node := range nodes {
+		if node.value == nil {
+			continue
+		}
+		current := attrs[i]
+		if current == nil {
+			current = map[string]interface{}{}
+		}
+		if len(spans) > 0 && reflect.DeepEqual(spans[len(spans)-1].Attrs, current) {
+			spans[len(spans)-1].Text += valueToString(node.value)
+		} else {
+			spans = append(spans, Span{Text: valueToString(node.value), Attrs: current})
+		}
+	}
+	return spans
+}
+
+func valueToString(value interface{}) string {
+	switch v := value.(type) {
+	case rune:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
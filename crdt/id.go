@@ -3,4 +3,12 @@ package crdt
 type ID struct {
 	replicaID 		string
 	operationOffset int64
+}
+
+// total order over ids so replicas resolve ties between concurrent operations the same way
+func (id ID) less(other ID) bool {
+	if id.replicaID != other.replicaID {
+		return id.replicaID < other.replicaID
+	}
+	return id.operationOffset < other.operationOffset
 }
\ No newline at end of file
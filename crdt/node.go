@@ -5,6 +5,8 @@ type Node struct {
 	// parentNodeID 	*ID
 	// side 			*side
 	value 			interface{}
+	// operation that deleted this node, only meaningful for tombstones
+	deletedBy		ID
 	leftChildren	[]*Node
 	rightChildren	[]*Node
 }
@@ -4,6 +4,8 @@ type OperationType int8
 const (
 	Insert = iota
 	Delete = iota
+	Format = iota
+	Noop = iota
 )
 
 type side int8
@@ -43,12 +45,62 @@ func (op *InsertOperation) Type() OperationType {
 
 type DeleteOperation struct {
 	currentNodeID ID
+	// identifies the delete itself so tombstones can be garbage collected
+	// once every replica has seen it, see compact.go
+	operationID ID
 }
 
-func NewDeleteOperation(currentNodeID ID) (*DeleteOperation) {
-	return &DeleteOperation{currentNodeID: currentNodeID}
+func NewDeleteOperation(currentNodeID ID, operationID ID) (*DeleteOperation) {
+	return &DeleteOperation{currentNodeID: currentNodeID, operationID: operationID}
 }
 
 func (op *DeleteOperation) Type() OperationType {
 	return Delete
+}
+
+// a format operation applies attrs to every character between the start node
+// and the end node (inclusive) in the in order traversal of the tree
+type FormatOperation struct {
+	currentNodeID ID
+	startNodeID ID
+	endNodeID ID
+	attrs map[string]interface{}
+	// lamport timestamp, higher than every format the replica had seen when it
+	// made this one. decides which format wins, see format.go
+	lamport int64
+}
+
+func NewFormatOperation(
+	currentNodeID ID,
+	startNodeID ID,
+	endNodeID ID,
+	attrs map[string]interface{},
+	lamport int64,
+) (*FormatOperation) {
+	return &FormatOperation{
+		currentNodeID: currentNodeID,
+		startNodeID: startNodeID,
+		endNodeID: endNodeID,
+		attrs: attrs,
+		lamport: lamport,
+	}
+}
+
+func (op *FormatOperation) Type() OperationType {
+	return Format
+}
+
+// returned instead of an operation when a local edit doesn't change the
+// document, like deleting a character that is already gone
+// there is nothing for other replicas to apply so it shouldn't be sent
+type NoOperation struct {}
+
+var NoOp = &NoOperation{}
+
+func (op *NoOperation) Type() OperationType {
+	return Noop
+}
+
+func IsNoOp(op Operation) bool {
+	return op == nil || op.Type() == Noop
 }
\ No newline at end of file
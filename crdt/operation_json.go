@@ -0,0 +1,196 @@
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// version of the json operations are sent to clients in. existing fields
+// are never renamed or given a new meaning without bumping it, new optional
+// fields can be added without
+const OperationVersion = 1
+
+var ErrUnsupportedOperationVersion = errors.New("unsupported operation version")
+
+// the json form of every operation. it is kept apart from the operation
+// structs so their fields can be refactored without changing the wire format
+// fields that don't apply to the type are left out
+//
+//	{"version": 1, "type": "insert", "id": {...}, "value": ..., "parent": {...}, "side": "left"}
+//	{"version": 1, "type": "delete", "id": {...}, "deleted": {...}}
+//	{"version": 1, "type": "format", "id": {...}, "start": {...}, "end": {...}, "attrs": {...}, "lamport": 3}
+//	{"version": 1, "type": "noop"}
+type operationJSON struct {
+	// OperationVersion when it was encoded
+	Version int `json:"version"`
+	// "insert", "delete", "format" or "noop"
+	Type string `json:"type"`
+	// the operation itself, for inserts and formats also the node it creates
+	ID *idJSON `json:"id,omitempty"`
+
+	// inserts: the value, the node it is a child of and on which "side",
+	// "left" or "right". values decode as the types encoding/json picks
+	Value  interface{} `json:"value,omitempty"`
+	Parent *idJSON     `json:"parent,omitempty"`
+	Side   string      `json:"side,omitempty"`
+
+	// deletes: the node being deleted
+	Deleted *idJSON `json:"deleted,omitempty"`
+
+	// formats: the first and last node of the range, the attributes and the
+	// lamport timestamp deciding which format wins
+	Start   *idJSON                `json:"start,omitempty"`
+	End     *idJSON                `json:"end,omitempty"`
+	Attrs   map[string]interface{} `json:"attrs,omitempty"`
+	Lamport int64                  `json:"lamport,omitempty"`
+}
+
+type idJSON struct {
+	ReplicaID string `json:"replica_id"`
+	Offset    int64  `json:"offset"`
+}
+
+const (
+	insertJSONType = "insert"
+	deleteJSONType = "delete"
+	formatJSONType = "format"
+	noopJSONType   = "noop"
+)
+
+func toIDJSON(id ID) *idJSON {
+	return &idJSON{ReplicaID: id.replicaID, Offset: id.operationOffset}
+}
+
+func (id *idJSON) toID() ID {
+	if id == nil {
+		return ID{}
+	}
+	return ID{replicaID: id.ReplicaID, operationOffset: id.Offset}
+}
+
+func sideJSON(s side) string {
+	if s == left {
+		return "left"
+	}
+	return "right"
+}
+
+func (op *InsertOperation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(operationJSON{
+		Version: OperationVersion,
+		Type:    insertJSONType,
+		ID:      toIDJSON(op.currentNodeID),
+		Value:   op.value,
+		Parent:  toIDJSON(op.parentNodeID),
+		Side:    sideJSON(op.side),
+	})
+}
+
+func (op *DeleteOperation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(operationJSON{
+		Version: OperationVersion,
+		Type:    deleteJSONType,
+		ID:      toIDJSON(op.operationID),
+		Deleted: toIDJSON(op.currentNodeID),
+	})
+}
+
+func (op *FormatOperation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(operationJSON{
+		Version: OperationVersion,
+		Type:    formatJSONType,
+		ID:      toIDJSON(op.currentNodeID),
+		Start:   toIDJSON(op.startNodeID),
+		End:     toIDJSON(op.endNodeID),
+		Attrs:   op.attrs,
+		Lamport: op.lamport,
+	})
+}
+
+func (op *NoOperation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(operationJSON{Version: OperationVersion, Type: noopJSONType})
+}
+
+// the json of an operation of type want
+func decodeOperationJSON(data []byte, want string) (operationJSON, error) {
+	var decoded operationJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return decoded, err
+	}
+	if decoded.Version > OperationVersion {
+		return decoded, fmt.Errorf("%w: %d, up to %d is supported", ErrUnsupportedOperationVersion, decoded.Version, OperationVersion)
+	}
+	if want != "" && decoded.Type != want {
+		return decoded, fmt.Errorf("operation of type %q, want %q", decoded.Type, want)
+	}
+	return decoded, nil
+}
+
+func (op *InsertOperation) UnmarshalJSON(data []byte) error {
+	decoded, err := decodeOperationJSON(data, insertJSONType)
+	if err != nil {
+		return err
+	}
+	*op = *decoded.insert()
+	return nil
+}
+
+func (op *DeleteOperation) UnmarshalJSON(data []byte) error {
+	decoded, err := decodeOperationJSON(data, deleteJSONType)
+	if err != nil {
+		return err
+	}
+	*op = *decoded.delete()
+	return nil
+}
+
+func (op *FormatOperation) UnmarshalJSON(data []byte) error {
+	decoded, err := decodeOperationJSON(data, formatJSONType)
+	if err != nil {
+		return err
+	}
+	*op = *decoded.format()
+	return nil
+}
+
+func (op *NoOperation) UnmarshalJSON(data []byte) error {
+	_, err := decodeOperationJSON(data, noopJSONType)
+	return err
+}
+
+func (decoded operationJSON) insert() *InsertOperation {
+	childSide := side(right)
+	if decoded.Side == "left" {
+		childSide = left
+	}
+	return NewInsertOperation(decoded.ID.toID(), decoded.Value, decoded.Parent.toID(), childSide)
+}
+
+func (decoded operationJSON) delete() *DeleteOperation {
+	return NewDeleteOperation(decoded.Deleted.toID(), decoded.ID.toID())
+}
+
+func (decoded operationJSON) format() *FormatOperation {
+	return NewFormatOperation(decoded.ID.toID(), decoded.Start.toID(), decoded.End.toID(), decoded.Attrs, decoded.Lamport)
+}
+
+// an operation of any type from its json, Operation is an interface so
+// json.Unmarshal can't pick the type itself
+func UnmarshalOperation(data []byte) (Operation, error) {
+	decoded, err := decodeOperationJSON(data, "")
+	if err != nil {
+		return nil, err
+	}
+	switch decoded.Type {
+	case insertJSONType:
+		return decoded.insert(), nil
+	case deleteJSONType:
+		return decoded.delete(), nil
+	case formatJSONType:
+		return decoded.format(), nil
+	case noopJSONType:
+		return NoOp, nil
+	}
+	return nil, fmt.Errorf("unknown operation type %q", decoded.Type)
+}
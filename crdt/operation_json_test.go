@@ -0,0 +1,78 @@
+package crdt
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// one operation of each type, as a client would get them
+func representativeOperations() []Operation {
+	return []Operation{
+		NewInsertOperation(ID{replicaID: "replica1", operationOffset: 3}, "h", ID{replicaID: "root", operationOffset: 0}, right),
+		NewInsertOperation(ID{replicaID: "replica2", operationOffset: 1}, "i", ID{replicaID: "replica1", operationOffset: 3}, left),
+		NewDeleteOperation(ID{replicaID: "replica1", operationOffset: 3}, ID{replicaID: "replica2", operationOffset: 2}),
+		NewFormatOperation(
+			ID{replicaID: "replica1", operationOffset: 4},
+			ID{replicaID: "replica1", operationOffset: 3},
+			ID{replicaID: "replica2", operationOffset: 1},
+			map[string]interface{}{"bold": true, "color": "red"},
+			2,
+		),
+		NoOp,
+	}
+}
+
+// a change to this file is a change to what clients are sent, bump
+// OperationVersion if an existing field changed
+func TestOperationJSONGolden(t *testing.T) {
+	golden := filepath.Join("testdata", "operations.golden.json")
+	got, err := json.MarshalIndent(representativeOperations(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+	if *updateGolden {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("operations encode as\n%s\nwant\n%s", got, want)
+	}
+
+	var encoded []json.RawMessage
+	if err := json.Unmarshal(want, &encoded); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range representativeOperations() {
+		op, err := UnmarshalOperation(encoded[i])
+		if err != nil {
+			t.Fatalf("UnmarshalOperation(%s): %v", encoded[i], err)
+		}
+		if !reflect.DeepEqual(op, want) {
+			t.Errorf("%s decoded as %+v, want %+v", encoded[i], op, want)
+		}
+	}
+}
+
+func TestOperationJSONRejectsNewerVersions(t *testing.T) {
+	data := []byte(`{"version": 2, "type": "noop"}`)
+	if _, err := UnmarshalOperation(data); !errors.Is(err, ErrUnsupportedOperationVersion) {
+		t.Errorf("UnmarshalOperation of version 2 returned %v, want %v", err, ErrUnsupportedOperationVersion)
+	}
+	var insert InsertOperation
+	if err := json.Unmarshal([]byte(`{"version": 1, "type": "delete"}`), &insert); err == nil {
+		t.Errorf("a delete decoded as an insert")
+	}
+}
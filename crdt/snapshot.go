@@ -0,0 +1,215 @@
+package crdt
+
+import (
+	"fmt"
+)
+
+// the tree, version vector and format spans use unexported fields, so these
+// exported mirrors are what gets serialized when the state is saved or sent
+
+type NodeSnapshot struct {
+	ReplicaID          string         `json:"replica_id"`
+	OperationOffset    int64          `json:"operation_offset"`
+	Value              interface{}    `json:"value"` // nil for tombstones
+	DeletedByReplicaID string         `json:"deleted_by_replica_id,omitempty"`
+	DeletedByOffset    int64          `json:"deleted_by_operation_offset,omitempty"`
+	LeftChildren       []NodeSnapshot `json:"left_children"`
+	RightChildren      []NodeSnapshot `json:"right_children"`
+}
+
+type FormatSnapshot struct {
+	ReplicaID       string                 `json:"replica_id"`
+	OperationOffset int64                  `json:"operation_offset"`
+	StartReplicaID  string                 `json:"start_replica_id"`
+	StartOffset     int64                  `json:"start_offset"`
+	EndReplicaID    string                 `json:"end_replica_id"`
+	EndOffset       int64                  `json:"end_offset"`
+	Attrs           map[string]interface{} `json:"attrs"`
+	Lamport         int64                  `json:"lamport,omitempty"`
+}
+
+type TextCRDTSnapshot struct {
+	ReplicaID     string           `json:"replica_id"`
+	Root          NodeSnapshot     `json:"root"`
+	VersionVector map[string]int64 `json:"version_vector"`
+	FormatSpans   []FormatSnapshot `json:"format_spans"`
+}
+
+func (crdt *TextCRDT) Snapshot() TextCRDTSnapshot {
+	var nodeHelper func(*Node) NodeSnapshot
+	nodeHelper = func(currentNode *Node) NodeSnapshot {
+		snapshot := NodeSnapshot{
+			ReplicaID:          currentNode.nodeID.replicaID,
+			OperationOffset:    currentNode.nodeID.operationOffset,
+			Value:              currentNode.value,
+			DeletedByReplicaID: currentNode.deletedBy.replicaID,
+			DeletedByOffset:    currentNode.deletedBy.operationOffset,
+			LeftChildren:       make([]NodeSnapshot, 0, len(currentNode.leftChildren)),
+			RightChildren:      make([]NodeSnapshot, 0, len(currentNode.rightChildren)),
+		}
+		for _, leftChild := range currentNode.leftChildren {
+			snapshot.LeftChildren = append(snapshot.LeftChildren, nodeHelper(leftChild))
+		}
+		for _, rightChild := range currentNode.rightChildren {
+			snapshot.RightChildren = append(snapshot.RightChildren, nodeHelper(rightChild))
+		}
+		return snapshot
+	}
+
+	counters := make(map[string]int64, len(crdt.versionVector.counters))
+	for replicaID, counter := range crdt.versionVector.counters {
+		counters[replicaID] = counter
+	}
+
+	formatSpans := make([]FormatSnapshot, 0, len(crdt.formatSpans))
+	for _, formatOp := range crdt.formatSpans {
+		formatSpans = append(formatSpans, FormatSnapshot{
+			ReplicaID:       formatOp.currentNodeID.replicaID,
+			OperationOffset: formatOp.currentNodeID.operationOffset,
+			StartReplicaID:  formatOp.startNodeID.replicaID,
+			StartOffset:     formatOp.startNodeID.operationOffset,
+			EndReplicaID:    formatOp.endNodeID.replicaID,
+			EndOffset:       formatOp.endNodeID.operationOffset,
+			Attrs:           formatOp.attrs,
+			Lamport:         formatOp.lamport,
+		})
+	}
+
+	return TextCRDTSnapshot{
+		ReplicaID:     crdt.replicaID,
+		Root:          nodeHelper(crdt.root),
+		VersionVector: counters,
+		FormatSpans:   formatSpans,
+	}
+}
+
+func NewTextCRDTFromSnapshot(snapshot TextCRDTSnapshot) *TextCRDT {
+	var nodeHelper func(NodeSnapshot) *Node
+	nodeHelper = func(nodeSnapshot NodeSnapshot) *Node {
+		node := NewNode(
+			ID{replicaID: nodeSnapshot.ReplicaID, operationOffset: nodeSnapshot.OperationOffset},
+			nodeSnapshot.Value,
+		)
+		node.deletedBy = ID{replicaID: nodeSnapshot.DeletedByReplicaID, operationOffset: nodeSnapshot.DeletedByOffset}
+		for _, leftChild := range nodeSnapshot.LeftChildren {
+			node.leftChildren = append(node.leftChildren, nodeHelper(leftChild))
+		}
+		for _, rightChild := range nodeSnapshot.RightChildren {
+			node.rightChildren = append(node.rightChildren, nodeHelper(rightChild))
+		}
+		return node
+	}
+
+	crdt := NewTextCRDT(snapshot.ReplicaID)
+	crdt.root = nodeHelper(snapshot.Root)
+	for replicaID, counter := range snapshot.VersionVector {
+		crdt.versionVector.counters[replicaID] = counter
+	}
+	for _, formatSnapshot := range snapshot.FormatSpans {
+		crdt.insertFormatSpan(NewFormatOperation(
+			ID{replicaID: formatSnapshot.ReplicaID, operationOffset: formatSnapshot.OperationOffset},
+			ID{replicaID: formatSnapshot.StartReplicaID, operationOffset: formatSnapshot.StartOffset},
+			ID{replicaID: formatSnapshot.EndReplicaID, operationOffset: formatSnapshot.EndOffset},
+			formatSnapshot.Attrs,
+			formatSnapshot.Lamport,
+		))
+	}
+	return crdt
+}
+
+// an operation in a form that can be saved and read back with
+// NewOperationFromSnapshot, fields that don't apply to its type are left empty
+type OperationSnapshot struct {
+	Type            OperationType `json:"type"`
+	ReplicaID       string        `json:"replica_id,omitempty"`
+	OperationOffset int64         `json:"operation_offset,omitempty"`
+
+	// inserts: the value and the parent node it is a child of
+	Value           interface{} `json:"value,omitempty"`
+	ParentReplicaID string      `json:"parent_replica_id,omitempty"`
+	ParentOffset    int64       `json:"parent_operation_offset,omitempty"`
+	LeftChild       bool        `json:"left_child,omitempty"`
+
+	// deletes: the node being deleted
+	DeletedReplicaID string `json:"deleted_replica_id,omitempty"`
+	DeletedOffset    int64  `json:"deleted_operation_offset,omitempty"`
+
+	// formats: the first and last node of the range, the attributes and the
+	// lamport timestamp
+	StartReplicaID string                 `json:"start_replica_id,omitempty"`
+	StartOffset    int64                  `json:"start_offset,omitempty"`
+	EndReplicaID   string                 `json:"end_replica_id,omitempty"`
+	EndOffset      int64                  `json:"end_offset,omitempty"`
+	Attrs          map[string]interface{} `json:"attrs,omitempty"`
+	Lamport        int64                  `json:"lamport,omitempty"`
+}
+
+// operations of other crdts come back as a noop
+func SnapshotOperation(operation Operation) OperationSnapshot {
+	switch op := operation.(type) {
+	case *InsertOperation:
+		return OperationSnapshot{
+			Type:            Insert,
+			ReplicaID:       op.currentNodeID.replicaID,
+			OperationOffset: op.currentNodeID.operationOffset,
+			Value:           op.value,
+			ParentReplicaID: op.parentNodeID.replicaID,
+			ParentOffset:    op.parentNodeID.operationOffset,
+			LeftChild:       op.side == left,
+		}
+	case *DeleteOperation:
+		return OperationSnapshot{
+			Type:             Delete,
+			ReplicaID:        op.operationID.replicaID,
+			OperationOffset:  op.operationID.operationOffset,
+			DeletedReplicaID: op.currentNodeID.replicaID,
+			DeletedOffset:    op.currentNodeID.operationOffset,
+		}
+	case *FormatOperation:
+		return OperationSnapshot{
+			Type:            Format,
+			ReplicaID:       op.currentNodeID.replicaID,
+			OperationOffset: op.currentNodeID.operationOffset,
+			StartReplicaID:  op.startNodeID.replicaID,
+			StartOffset:     op.startNodeID.operationOffset,
+			EndReplicaID:    op.endNodeID.replicaID,
+			EndOffset:       op.endNodeID.operationOffset,
+			Attrs:           op.attrs,
+			Lamport:         op.lamport,
+		}
+	}
+	return OperationSnapshot{Type: Noop}
+}
+
+func NewOperationFromSnapshot(snapshot OperationSnapshot) (Operation, error) {
+	operationID := ID{replicaID: snapshot.ReplicaID, operationOffset: snapshot.OperationOffset}
+	switch snapshot.Type {
+	case Insert:
+		var childSide side = right
+		if snapshot.LeftChild {
+			childSide = left
+		}
+		return NewInsertOperation(
+			operationID,
+			snapshot.Value,
+			ID{replicaID: snapshot.ParentReplicaID, operationOffset: snapshot.ParentOffset},
+			childSide,
+		), nil
+	case Delete:
+		return NewDeleteOperation(
+			ID{replicaID: snapshot.DeletedReplicaID, operationOffset: snapshot.DeletedOffset},
+			operationID,
+		), nil
+	case Format:
+		return NewFormatOperation(
+			operationID,
+			ID{replicaID: snapshot.StartReplicaID, operationOffset: snapshot.StartOffset},
+			ID{replicaID: snapshot.EndReplicaID, operationOffset: snapshot.EndOffset},
+			snapshot.Attrs,
+			snapshot.Lamport,
+		), nil
+	case Noop:
+		return NoOp, nil
+	}
+	return nil, fmt.Errorf("unknown operation type %d", snapshot.Type)
+}
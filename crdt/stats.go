@@ -0,0 +1,39 @@
+package crdt
+
+import (
+	"strings"
+	"unicode"
+)
+
+// the document as text, tombstones left out
+func (crdt *TextCRDT) String() string {
+	var builder strings.Builder
+	for _, value := range crdt.Representation() {
+		builder.WriteString(valueToString(value))
+	}
+	return builder.String()
+}
+
+// number of characters in the document, tombstones left out
+func (crdt *TextCRDT) CharacterCount() int {
+	var countHelper func(*Node) int
+	countHelper = func(currentNode *Node) int {
+		count := 0
+		if currentNode.value != nil {
+			count = 1
+		}
+		for _, leftChild := range currentNode.leftChildren {
+			count += countHelper(leftChild)
+		}
+		for _, rightChild := range currentNode.rightChildren {
+			count += countHelper(rightChild)
+		}
+		return count
+	}
+	return countHelper(crdt.root)
+}
+
+// number of runs of non space characters in the document
+func (crdt *TextCRDT) WordCount() int {
+	return len(strings.FieldsFunc(crdt.String(), unicode.IsSpace))
+}
@@ -1,13 +1,28 @@
 package crdt
 
 import (
+	"errors"
 	"fmt"
 )
 
+// a delete found its character tombstoned already, usually because another
+// replica deleted the same character concurrently. the document is the same
+// as if the delete had gone through, so callers can treat it as a no-op
+var ErrAlreadyDeleted = errors.New("character already deleted")
+
+// a local edit at an index the document doesn't have, e.g. from a client with
+// a stale copy or a bad message. nothing changed
+var ErrOutOfRange = errors.New("index out of range")
+
 type TextCRDT struct {
 	replicaID 		string
 	root 			*Node
 	versionVector	*VersionVector
+	// attribute spans are stored separately from the character tree
+	// sorted in last writer wins order, see format.go
+	formatSpans		[]*FormatOperation
+	// highest lamport timestamp of the format operations seen
+	formatClock		int64
 }
 
 func NewTextCRDT(replicaID string) *TextCRDT {
@@ -18,6 +33,7 @@ func NewTextCRDT(replicaID string) *TextCRDT {
 			nil,
 		),
 		versionVector: NewVersionVector(replicaID),
+		formatSpans: make([]*FormatOperation, 0),
 	}
 }
 
@@ -27,13 +43,20 @@ func NewTextCRDT(replicaID string) *TextCRDT {
 //		- one for receiving an operation from another replica and applying that operation
 //		- one for inserting values originating at this replica
 // TODO: test that this handles the case where there is no right origin
-func (crdt *TextCRDT) Apply(operation Operation) {
+// returns false when the operation changed nothing, e.g. it was already applied
+// deletes of a tombstone return false and ErrAlreadyDeleted. an error always
+// comes with false
+func (crdt *TextCRDT) Apply(operation Operation) (bool, error) {
 	switch operation.Type() {
 	case Insert:
 		insertOp := operation.(*InsertOperation)
+		// the same insert delivered twice
+		if _, err := crdt.findNodeByID(insertOp.currentNodeID); err == nil {
+			return false, nil
+		}
 		parentNode, err := crdt.findNodeByID(insertOp.parentNodeID)
 		if err != nil {
-			panic(err)
+			return false, err
 		}
 		switch insertOp.side{
 		case left:
@@ -41,26 +64,61 @@ func (crdt *TextCRDT) Apply(operation Operation) {
 		case right:
 			parentNode.insertRightChild(NewNode(insertOp.currentNodeID, insertOp.value))
 		}
+		crdt.catchUp(insertOp.currentNodeID)
+		return true, nil
 	case Delete:
 		deleteOp := operation.(*DeleteOperation)
 		toDelete, err := crdt.findNodeByID(deleteOp.currentNodeID)
 		if err != nil {
-			panic(err)
+			return false, err
+		}
+		// deleting a tombstone again changes nothing. when replicas delete the same
+		// character concurrently every replica keeps the smallest delete id, the
+		// text is the same either way
+		if toDelete.value == nil {
+			if deleteOp.operationID.less(toDelete.deletedBy) {
+				toDelete.deletedBy = deleteOp.operationID
+			}
+			crdt.catchUp(deleteOp.operationID)
+			return false, ErrAlreadyDeleted
 		}
-		// TODO: we should be checking here if the value has already been deleted, so something with the error
 		toDelete.value = nil
+		toDelete.deletedBy = deleteOp.operationID
+		crdt.catchUp(deleteOp.operationID)
+		return true, nil
+	case Format:
+		formatOp := operation.(*FormatOperation)
+		changed := crdt.insertFormatSpan(formatOp)
+		crdt.catchUp(formatOp.currentNodeID)
+		return changed, nil
 	}
+	return false, nil
 }
 
-func (crdt *TextCRDT) LocalInsert(index int64, value interface{}) (*InsertOperation) {
+// record an applied operation in the version vector, so VersionClock covers
+// the operations of other replicas too. operations this replica made before a
+// restart come back through Apply when they are replayed, its counter has to
+// pass them or new local ids would collide
+func (crdt *TextCRDT) catchUp(operationID ID) {
+	if crdt.versionVector.counters[operationID.replicaID] < operationID.operationOffset {
+		crdt.versionVector.counters[operationID.replicaID] = operationID.operationOffset
+	}
+}
+
+// inserting before 0 or past the end is a no-op and returns NoOp and ErrOutOfRange
+func (crdt *TextCRDT) LocalInsert(index int64, value interface{}) (Operation, error) {
 	var leftOrigin, rightOrigin *Node
 	var err error
 	var newOperationOffset int64
 	var parentNodeID ID
 	var side side
+	// index -1 would have no left origin
+	if index < 0 {
+		return NoOp, fmt.Errorf("%w: insert at %d", ErrOutOfRange, index)
+	}
 	leftOrigin, rightOrigin, err = crdt.findOriginsHelper(index)
 	if err != nil {
-		panic(err)
+		return NoOp, fmt.Errorf("%w: %v", ErrOutOfRange, err)
 	}
 	newOperationOffset, _ = crdt.versionVector.IncrementVersion(crdt.replicaID);
 	// if there does not exist a right child of the left origin node
@@ -82,16 +140,53 @@ func (crdt *TextCRDT) LocalInsert(index int64, value interface{}) (*InsertOperat
 		parentNodeID = rightOrigin.nodeID
 	}
 	newNodeID := ID{replicaID: crdt.replicaID, operationOffset: newOperationOffset}
-	return NewInsertOperation(newNodeID, value, parentNodeID, side)	
+	return NewInsertOperation(newNodeID, value, parentNodeID, side), nil
 }
 
-func (crdt *TextCRDT) LocalDelete(index int64) (*DeleteOperation) {
+// deleting before 0 or past the end of the document is a no-op and returns
+// NoOp and ErrOutOfRange, it's what a client deleting a character from a stale
+// copy sees when another replica deleted it first. it can't crash the replica
+func (crdt *TextCRDT) LocalDelete(index int64) (Operation, error) {
+	// index -1 would find the root
+	if index < 0 {
+		return NoOp, fmt.Errorf("%w: delete at %d", ErrOutOfRange, index)
+	}
 	nodeToDelete, err := crdt.findNodeByIndex(index)
 	if err != nil {
-		panic(err)
+		return NoOp, fmt.Errorf("%w: nothing at index %d", ErrOutOfRange, index)
 	}
+	newOperationOffset, _ := crdt.versionVector.IncrementVersion(crdt.replicaID)
+	operationID := ID{replicaID: crdt.replicaID, operationOffset: newOperationOffset}
 	nodeToDelete.value = nil
-	return NewDeleteOperation(nodeToDelete.nodeID)
+	nodeToDelete.deletedBy = operationID
+	return NewDeleteOperation(nodeToDelete.nodeID, operationID), nil
+}
+
+// format the characters from start up to but not including end
+// an empty range or one past the end of the document is a no-op and returns
+// NoOp and ErrOutOfRange
+func (crdt *TextCRDT) LocalFormat(start int64, end int64, attrs map[string]interface{}) (Operation, error) {
+	if start < 0 || start >= end {
+		return NoOp, fmt.Errorf("%w: format of [%d, %d)", ErrOutOfRange, start, end)
+	}
+	startNode, err := crdt.findNodeByIndex(start)
+	if err != nil {
+		return NoOp, fmt.Errorf("%w: %v", ErrOutOfRange, err)
+	}
+	endNode, err := crdt.findNodeByIndex(end - 1)
+	if err != nil {
+		return NoOp, fmt.Errorf("%w: %v", ErrOutOfRange, err)
+	}
+	newOperationOffset, _ := crdt.versionVector.IncrementVersion(crdt.replicaID)
+	formatOp := NewFormatOperation(
+		ID{replicaID: crdt.replicaID, operationOffset: newOperationOffset},
+		startNode.nodeID,
+		endNode.nodeID,
+		attrs,
+		crdt.formatClock + 1,
+	)
+	crdt.insertFormatSpan(formatOp)
+	return formatOp, nil
 }
 
 // use helper function and closure to implement find origins
@@ -208,6 +303,11 @@ func (crdt *TextCRDT) findNodeByID(nodeID ID) (node *Node, err error) {
 	return node, err
 }
 
+// every operation this replica has generated, used to decide what can be compacted
+func (crdt *TextCRDT) VersionClock() VectorClock {
+	return crdt.versionVector.Clock()
+}
+
 func (crdt *TextCRDT) Representation() (values []interface{}) {
 	var inOrderTraversalHelper func(*Node)
 	inOrderTraversalHelper = func(currentNode *Node) {
@@ -1,8 +1,10 @@
 package crdt
 
 import (
+	"errors"
 	"testing"
 	"fmt"
+	"reflect"
 )
 
 func repersentationToString(representation []interface{}) (string, error) {
@@ -45,4 +47,459 @@ func TestInsertBackwards(t *testing.T) {
 	if repr != want {
 		t.Errorf("representation <%s> is not the same as want <%s>", repr, want)
 	}
-}
\ No newline at end of file
+}
+
+func TestFormatConvergence(t *testing.T) {
+	var text string = "hello world"
+	var replica1 *TextCRDT = NewTextCRDT("replica1")
+	var replica2 *TextCRDT = NewTextCRDT("replica2")
+	var replica3 *TextCRDT = NewTextCRDT("replica3")
+	for index, char := range text {
+		op, _ := replica1.LocalInsert(int64(index), rune(char))
+		replica2.Apply(op)
+		replica3.Apply(op)
+	}
+
+	// concurrent formats that overlap on "hello" and disagree on bold
+	boldOp, _ := replica1.LocalFormat(0, 5, map[string]interface{}{"bold": true})
+	italicOp, _ := replica2.LocalFormat(0, 11, map[string]interface{}{"bold": false, "italic": true})
+	linkOp, _ := replica3.LocalFormat(6, 11, map[string]interface{}{"link": "https://example.com"})
+
+	// every replica receives the remote operations in a different order
+	replica1.Apply(linkOp)
+	replica1.Apply(italicOp)
+	replica2.Apply(boldOp)
+	replica2.Apply(linkOp)
+	replica3.Apply(italicOp)
+	replica3.Apply(boldOp)
+
+	want := []Span{
+		{Text: "hello ", Attrs: map[string]interface{}{"bold": false, "italic": true}},
+		{Text: "world", Attrs: map[string]interface{}{"bold": false, "italic": true, "link": "https://example.com"}},
+	}
+	for _, replica := range []*TextCRDT{replica1, replica2, replica3} {
+		got := replica.FormattedRepresentation()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s formatted representation %+v is not the same as want %+v", replica.replicaID, got, want)
+		}
+	}
+
+	// applying a format operation twice does not change the result
+	replica1.Apply(italicOp)
+	if got := replica1.FormattedRepresentation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("duplicate format changed representation to %+v", got)
+	}
+}
+
+// a format made after another was applied wins, whichever replica made it
+func TestSequentialFormatWins(t *testing.T) {
+	var replica1 *TextCRDT = NewTextCRDT("a")
+	var replica2 *TextCRDT = NewTextCRDT("b")
+	for index, char := range "hi" {
+		op, _ := replica1.LocalInsert(int64(index), rune(char))
+		replica2.Apply(op)
+	}
+
+	// b bolds, a sees it and unbolds. "a" sorts before "b"
+	boldOp, _ := replica2.LocalFormat(0, 2, map[string]interface{}{"bold": true})
+	replica1.Apply(boldOp)
+	unboldOp, _ := replica1.LocalFormat(0, 2, map[string]interface{}{"bold": nil})
+	replica2.Apply(unboldOp)
+
+	want := []Span{{Text: "hi", Attrs: map[string]interface{}{}}}
+	for _, replica := range []*TextCRDT{replica1, replica2} {
+		if got := replica.FormattedRepresentation(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s formatted representation %+v, want the unbold to win with %+v", replica.replicaID, got, want)
+		}
+	}
+
+	// a replica rebuilt from a snapshot keeps counting after the formats in it
+	restored := NewTextCRDTFromSnapshot(replica2.Snapshot())
+	boldOp, _ = restored.LocalFormat(0, 1, map[string]interface{}{"bold": true})
+	replica1.Apply(boldOp)
+	want = []Span{{Text: "h", Attrs: map[string]interface{}{"bold": true}}, {Text: "i", Attrs: map[string]interface{}{}}}
+	if got := replica1.FormattedRepresentation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("format from a restored replica gives %+v, want %+v", got, want)
+	}
+}
+
+func TestCompactRemovesTombstones(t *testing.T) {
+	var text string = "hello world"
+	var replica1 *TextCRDT = NewTextCRDT("replica1")
+	var replica2 *TextCRDT = NewTextCRDT("replica2")
+	for index, char := range text {
+		op, _ := replica1.LocalInsert(int64(index), rune(char))
+		replica2.Apply(op)
+	}
+	// replica1 deletes " world" from the end, replica2 hasn't seen the last delete yet
+	var lastDelete Operation
+	for index := len(text) - 1; index >= 5; index-- {
+		lastDelete, _ = replica1.LocalDelete(int64(index))
+		if index > 5 {
+			replica2.Apply(lastDelete)
+		}
+	}
+
+	// a clock from before the deletes can't remove anything
+	nodesBefore := replica1.NodeCount()
+	stale := VectorClock{"replica1": int64(len(text))}
+	if removed := replica1.Compact(stale); removed != 0 {
+		t.Errorf("compact with a stale clock removed %d nodes", removed)
+	}
+
+	// tombstones of the deletes everyone has seen go. the space stays until the
+	// clock covers its delete too, and the "w" while the space has a value,
+	// inserting after the space would put the new node under the "w"
+	partial := replica1.VersionClock()
+	partial["replica1"] -= 1
+	if removed := replica2.Compact(partial); removed != 4 {
+		t.Errorf("compact with a partial clock removed %d nodes, want 4", removed)
+	}
+	replica2.Apply(lastDelete)
+
+	// the space right after the "o" stays, inserting after the "o" puts the
+	// new node under it on a replica that didn't compact
+	safe := replica1.VersionClock()
+	for _, replica := range []*TextCRDT{replica1, replica2} {
+		replica.Compact(safe)
+		if replica.NodeCount() != nodesBefore-5 {
+			t.Errorf("%s has %d nodes after compaction, want %d", replica.replicaID, replica.NodeCount(), nodesBefore-5)
+		}
+		repr, err := repersentationToString(replica.Representation())
+		if err != nil {
+			panic(err)
+		}
+		if repr != "hello" {
+			t.Errorf("representation <%s> is not the same as want <hello>", repr)
+		}
+	}
+
+	// inserting after compaction still lands in the right place
+	replica1.LocalInsert(5, '!')
+	repr, _ := repersentationToString(replica1.Representation())
+	if repr != "hello!" {
+		t.Errorf("representation <%s> is not the same as want <hello!>", repr)
+	}
+}
+
+func TestCompactKeepsTombstonesUsedAsOrigin(t *testing.T) {
+	var replica1 *TextCRDT = NewTextCRDT("replica1")
+	var replica2 *TextCRDT = NewTextCRDT("replica2")
+	for index, char := range "ab" {
+		op, _ := replica1.LocalInsert(int64(index), rune(char))
+		replica2.Apply(op)
+	}
+	deleteOp, _ := replica1.LocalDelete(1)
+	replica2.Apply(deleteOp)
+
+	// replica2 saw every operation of replica1, but doesn't compact
+	replica1.Compact(replica1.VersionClock())
+
+	// the "b" is the right origin of an insert after the "a"
+	insertOp, err := replica2.LocalInsert(1, 'c')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replica1.Apply(insertOp); err != nil {
+		t.Fatalf("applying an insert under a tombstone after compaction: %v", err)
+	}
+	repr, _ := repersentationToString(replica1.Representation())
+	if repr != "ac" {
+		t.Errorf("representation <%s> is not the same as want <ac>", repr)
+	}
+}
+
+func TestApplyRecordsOtherReplicas(t *testing.T) {
+	var replica1 *TextCRDT = NewTextCRDT("replica1")
+	var replica2 *TextCRDT = NewTextCRDT("replica2")
+	for index, char := range "hi" {
+		op, _ := replica1.LocalInsert(int64(index), rune(char))
+		replica2.Apply(op)
+	}
+	deleteOp, _ := replica1.LocalDelete(0)
+	replica2.Apply(deleteOp)
+
+	want := VectorClock{"replica1": 3, "replica2": 0}
+	if got := replica2.VersionClock(); !reflect.DeepEqual(got, want) {
+		t.Errorf("version clock after applying replica1's operations is %v, want %v", got, want)
+	}
+}
+
+func TestDeleteSamePositionTwice(t *testing.T) {
+	var replica1 *TextCRDT = NewTextCRDT("replica1")
+	var replica2 *TextCRDT = NewTextCRDT("replica2")
+	for index, char := range "abc" {
+		op, _ := replica1.LocalInsert(int64(index), rune(char))
+		replica2.Apply(op)
+	}
+
+	// both replicas delete "c" before hearing about the other delete
+	delete1, err1 := replica1.LocalDelete(2)
+	delete2, err2 := replica2.LocalDelete(2)
+	if err1 != nil || err2 != nil || IsNoOp(delete1) || IsNoOp(delete2) {
+		t.Fatalf("first delete of index 2 was a no-op: %v, %v", err1, err2)
+	}
+	// the position is past the end now
+	if op, err := replica1.LocalDelete(2); !errors.Is(err, ErrOutOfRange) || !IsNoOp(op) {
+		t.Errorf("second delete of index 2 returned %+v, %v, want NoOp, ErrOutOfRange", op, err)
+	}
+	for _, apply := range []struct {
+		replica *TextCRDT
+		op      Operation
+	}{{replica1, delete2}, {replica2, delete1}} {
+		if changed, err := apply.replica.Apply(apply.op); changed || !errors.Is(err, ErrAlreadyDeleted) {
+			t.Errorf("%s applying the concurrent delete returned %v, %v, want false, ErrAlreadyDeleted", apply.replica.replicaID, changed, err)
+		}
+	}
+	// duplicates are ignored too
+	if changed, _ := replica2.Apply(delete1); changed {
+		t.Errorf("applying a delete twice reported a change")
+	}
+
+	want := []interface{}{'a', 'b'}
+	for _, replica := range []*TextCRDT{replica1, replica2} {
+		if got := replica.Representation(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s has %v, want %v", replica.replicaID, got, want)
+		}
+	}
+	if !reflect.DeepEqual(replica1.Snapshot().Root, replica2.Snapshot().Root) {
+		t.Errorf("replicas disagree on the tombstone of the concurrently deleted character")
+	}
+}
+
+// every byte is a delete made before the replicas hear of each other's:
+// the low bits pick the replica, the next ones the index, which can be past
+// the end, and the top bit delivers the delete twice
+func FuzzConcurrentDeletes(f *testing.F) {
+	f.Add([]byte{0, 1, 2})
+	f.Add([]byte{0x08, 0x09, 0x8a, 0x0b})
+	f.Add([]byte{0x24, 0x25, 0xa6, 0x00, 0x81, 0x02, 0x10})
+	f.Fuzz(func(t *testing.T, deletes []byte) {
+		const text = "abcdefgh"
+		replicas := []*TextCRDT{NewTextCRDT("replica0"), NewTextCRDT("replica1"), NewTextCRDT("replica2")}
+		for index, char := range text {
+			op, _ := replicas[0].LocalInsert(int64(index), rune(char))
+			for _, replica := range replicas[1:] {
+				replica.Apply(op)
+			}
+		}
+
+		var ops []Operation
+		for _, b := range deletes {
+			replica := replicas[int(b&0x03)%len(replicas)]
+			op, err := replica.LocalDelete(int64(b>>2&0x0f) - 2)
+			if err != nil {
+				if !IsNoOp(op) {
+					t.Fatalf("failed delete returned %+v", op)
+				}
+				continue
+			}
+			ops = append(ops, op)
+			if b&0x80 != 0 {
+				ops = append(ops, op)
+			}
+		}
+
+		// each replica hears of the deletes in a different order
+		for i, replica := range replicas {
+			for j := range ops {
+				op := ops[(j+i*len(ops)/len(replicas))%len(ops)]
+				if _, err := replica.Apply(op); err != nil && !errors.Is(err, ErrAlreadyDeleted) {
+					t.Fatalf("%s applying %+v: %v", replica.replicaID, op, err)
+				}
+			}
+		}
+		want := replicas[0].Snapshot().Root
+		for _, replica := range replicas[1:] {
+			if got := replica.Snapshot().Root; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s has %+v, replica0 has %+v", replica.replicaID, got, want)
+			}
+		}
+	})
+}
+
+func TestDeletePastEnd(t *testing.T) {
+	var replica1 *TextCRDT = NewTextCRDT("replica1")
+	var replica2 *TextCRDT = NewTextCRDT("replica2")
+	for _, index := range []int64{0, 5, -1} {
+		if op, err := replica1.LocalDelete(index); !errors.Is(err, ErrOutOfRange) || !IsNoOp(op) {
+			t.Errorf("delete of %d in an empty document returned %+v, %v, want NoOp and ErrOutOfRange", index, op, err)
+		}
+	}
+	for index, char := range "hi" {
+		op, _ := replica1.LocalInsert(int64(index), rune(char))
+		replica2.Apply(op)
+	}
+	versionBefore := replica1.VersionClock()
+	for _, index := range []int64{2, 100, -1} {
+		op, err := replica1.LocalDelete(index)
+		if !errors.Is(err, ErrOutOfRange) || !IsNoOp(op) {
+			t.Errorf("delete of %d returned %+v, %v, want NoOp and ErrOutOfRange", index, op, err)
+		}
+		if changed, _ := replica2.Apply(op); changed {
+			t.Errorf("applying NoOp reported a change")
+		}
+	}
+	if got := replica1.VersionClock(); !reflect.DeepEqual(got, versionBefore) {
+		t.Errorf("no-op deletes moved the version vector to %v, want %v", got, versionBefore)
+	}
+	want := []interface{}{'h', 'i'}
+	for _, replica := range []*TextCRDT{replica1, replica2} {
+		if got := replica.Representation(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s has %v, want %v", replica.replicaID, got, want)
+		}
+	}
+}
+
+func TestCharacterAndWordCount(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		chars int
+		words int
+	}{
+		{"empty", "", 0, 0},
+		{"single word", "hello", 5, 1},
+		{"only spaces", " \t\n", 3, 0},
+		{"punctuation", "hello, world! ...", 17, 3},
+		{"multi-byte", "naïve café 日本語", 14, 3},
+		{"emoji and newlines", "🙂 ok\n\nbye ", 10, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replica := NewTextCRDT("replica1")
+			var index int64
+			for _, char := range test.text {
+				replica.LocalInsert(index, string(char))
+				index++
+			}
+			if got := replica.String(); got != test.text {
+				t.Errorf("String() = %q, want %q", got, test.text)
+			}
+			if got := replica.CharacterCount(); got != test.chars {
+				t.Errorf("CharacterCount() = %d, want %d", got, test.chars)
+			}
+			if got := replica.WordCount(); got != test.words {
+				t.Errorf("WordCount() = %d, want %d", got, test.words)
+			}
+		})
+	}
+
+	// deleted characters don't count
+	replica := NewTextCRDT("replica1")
+	for index, char := range []string{"a", " ", "b"} {
+		replica.LocalInsert(int64(index), char)
+	}
+	replica.LocalDelete(1)
+	if chars, words := replica.CharacterCount(), replica.WordCount(); chars != 2 || words != 1 {
+		t.Errorf("after deleting the space got %d characters and %d words, want 2 and 1", chars, words)
+	}
+}
+
+// a replica rebuilt from its own saved operations keeps numbering after them
+func TestOperationSnapshotReplay(t *testing.T) {
+	var replica1 *TextCRDT = NewTextCRDT("replica1")
+	var saved []OperationSnapshot
+	for index, char := range "hello" {
+		op, _ := replica1.LocalInsert(int64(index), string(char))
+		saved = append(saved, SnapshotOperation(op))
+	}
+	deleteOp, _ := replica1.LocalDelete(0)
+	formatOp, _ := replica1.LocalFormat(0, 2, map[string]interface{}{"bold": true})
+	saved = append(saved, SnapshotOperation(deleteOp), SnapshotOperation(formatOp))
+
+	restored := NewTextCRDT("replica1")
+	for _, snapshot := range saved {
+		op, err := NewOperationFromSnapshot(snapshot)
+		if err != nil {
+			t.Fatalf("restoring %+v: %v", snapshot, err)
+		}
+		restored.Apply(op)
+	}
+	if !reflect.DeepEqual(restored.Snapshot(), replica1.Snapshot()) {
+		t.Errorf("restored replica is %+v, want %+v", restored.Snapshot(), replica1.Snapshot())
+	}
+
+	// new local operations don't reuse the ids of the replayed ones
+	op, _ := restored.LocalInsert(4, "!")
+	replica1.Apply(op)
+	if !reflect.DeepEqual(restored.Snapshot(), replica1.Snapshot()) {
+		t.Errorf("replicas disagree after an insert on the restored replica")
+	}
+}
+
+func TestApplyReportsChange(t *testing.T) {
+	var replica1 *TextCRDT = NewTextCRDT("replica1")
+	var replica2 *TextCRDT = NewTextCRDT("replica2")
+
+	insertOp, err := replica1.LocalInsert(0, 'a')
+	if err != nil {
+		t.Errorf("local insert returned %v", err)
+	}
+	if changed, _ := replica2.Apply(insertOp); !changed {
+		t.Errorf("first apply of an insert reported no change")
+	}
+	if changed, _ := replica2.Apply(insertOp); changed {
+		t.Errorf("second apply of an insert reported a change")
+	}
+	if got := replica2.Representation(); !reflect.DeepEqual(got, []interface{}{'a'}) {
+		t.Errorf("after applying an insert twice replica2 has %v", got)
+	}
+
+	formatOp, _ := replica1.LocalFormat(0, 1, map[string]interface{}{"bold": true})
+	first, _ := replica2.Apply(formatOp)
+	second, _ := replica2.Apply(formatOp)
+	if !first || second {
+		t.Errorf("format applied twice should change the document once")
+	}
+
+	deleteOp, _ := replica1.LocalDelete(0)
+	if changed, err := replica2.Apply(deleteOp); !changed || err != nil {
+		t.Errorf("first apply of a delete returned %v, %v, want true, nil", changed, err)
+	}
+	if changed, err := replica2.Apply(deleteOp); changed || !errors.Is(err, ErrAlreadyDeleted) {
+		t.Errorf("second apply of a delete returned %v, %v, want false, ErrAlreadyDeleted", changed, err)
+	}
+}
+
+func TestFormatOutOfRange(t *testing.T) {
+	replica := NewTextCRDT("replica1")
+	for index, char := range "hi" {
+		replica.LocalInsert(int64(index), rune(char))
+	}
+	versionBefore := replica.VersionClock()
+	for _, span := range [][2]int64{{1, 1}, {1, 0}, {-1, 1}, {0, 3}, {2, 4}} {
+		if op, err := replica.LocalFormat(span[0], span[1], map[string]interface{}{"bold": true}); !errors.Is(err, ErrOutOfRange) || !IsNoOp(op) {
+			t.Errorf("format of [%d, %d) returned %+v, %v, want NoOp and ErrOutOfRange", span[0], span[1], op, err)
+		}
+	}
+	if got := replica.VersionClock(); !reflect.DeepEqual(got, versionBefore) {
+		t.Errorf("no-op formats moved the version vector to %v, want %v", got, versionBefore)
+	}
+	if spans := replica.FormattedRepresentation(); len(spans) != 1 || len(spans[0].Attrs) != 0 {
+		t.Errorf("no-op formats left %+v", spans)
+	}
+}
+
+func TestInsertOutOfRange(t *testing.T) {
+	replica := NewTextCRDT("replica1")
+	for index, char := range "hi" {
+		replica.LocalInsert(int64(index), rune(char))
+	}
+	versionBefore := replica.VersionClock()
+	for _, index := range []int64{3, 100, -1} {
+		if op, err := replica.LocalInsert(index, '!'); !errors.Is(err, ErrOutOfRange) || !IsNoOp(op) {
+			t.Errorf("insert at %d returned %+v, %v, want NoOp and ErrOutOfRange", index, op, err)
+		}
+	}
+	if got := replica.VersionClock(); !reflect.DeepEqual(got, versionBefore) {
+		t.Errorf("no-op inserts moved the version vector to %v, want %v", got, versionBefore)
+	}
+	// the end is still a position
+	if _, err := replica.LocalInsert(2, '!'); err != nil {
+		t.Errorf("insert at the end returned %v", err)
+	}
+	if got := replica.Representation(); !reflect.DeepEqual(got, []interface{}{'h', 'i', '!'}) {
+		t.Errorf("document is %v, want [h i !]", got)
+	}
+}
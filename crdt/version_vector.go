@@ -4,6 +4,15 @@ import (
 	"fmt"
 )
 
+// point in time copy of the counters of a version vector
+type VectorClock map[string]int64
+
+// true if the operation with this id happened at or before the clock
+func (c VectorClock) dominates(id ID) bool {
+	counter, ok := c[id.replicaID]
+	return ok && counter >= id.operationOffset
+}
+
 type VersionVector struct {
 	counters map[string]int64
 	// will need a mutex at some point
@@ -57,4 +66,12 @@ func (v *VersionVector) UpdateOperation(replicaID string, operationOffset int64)
 	}
 	return nil
 
+}
+
+func (v *VersionVector) Clock() VectorClock {
+	clock := make(VectorClock, len(v.counters))
+	for replicaID, counter := range v.counters {
+		clock[replicaID] = counter
+	}
+	return clock
 }
\ No newline at end of file